@@ -0,0 +1,75 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Restricts which hosts may connect. A client whose address is in deniedCIDRs, or not in allowedCIDRs when that is
+ * set, is closed right after accept before any of its commands is read. Unix socket clients are always on the same
+ * machine and are never checked.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+type AccessList struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+// The access list applied to every listener and the WebSocket front-end
+var accessList AccessList
+
+// Parses the configured CIDRs, e.g. 192.168.1.0/24 or fd00::/8
+func parseAccessList(allowed []string, denied []string) (AccessList, error) {
+	var list AccessList
+	var err error
+	if list.allowed, err = parseCIDRs(allowed); err != nil {
+		return AccessList{}, errors.New("allowedCIDRs: " + err.Error())
+	}
+	if list.denied, err = parseCIDRs(denied); err != nil {
+		return AccessList{}, errors.New("deniedCIDRs: " + err.Error())
+	}
+	return list, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Whether a client at ip may connect. The deny list wins, an empty allow list allows every other address
+func (l AccessList) PermitsIP(ip net.IP) bool {
+	for _, network := range l.denied {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(l.allowed) == 0 {
+		return true
+	}
+	for _, network := range l.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a client connecting from addr may connect
+func (l AccessList) Permits(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	return l.PermitsIP(tcp.IP)
+}
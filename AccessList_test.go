@@ -0,0 +1,111 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the allow and deny lists for incoming connections.
+ *
+ */
+
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// The deny list wins over the allow list, an empty allow list allows everything not denied
+func TestAccessListPermits(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		denied  []string
+		ip      string
+		want    bool
+	}{
+		{nil, nil, "203.0.113.7", true},
+		{[]string{"192.168.1.0/24"}, nil, "192.168.1.20", true},
+		{[]string{"192.168.1.0/24"}, nil, "192.168.2.20", false},
+		{[]string{"192.168.1.0/24"}, []string{"192.168.1.20/32"}, "192.168.1.20", false},
+		{nil, []string{"10.0.0.0/8"}, "10.1.2.3", false},
+		{nil, []string{"10.0.0.0/8"}, "127.0.0.1", true},
+		{[]string{"::1/128"}, nil, "::1", true},
+	}
+	for _, test := range tests {
+		list, err := parseAccessList(test.allowed, test.denied)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := list.PermitsIP(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("allowed %v denied %v permits %s: %v, want %v", test.allowed, test.denied, test.ip, got, test.want)
+		}
+	}
+	if _, err := parseAccessList([]string{"192.168.1.0"}, nil); err == nil {
+		t.Fatal("allowedCIDRs entry without a prefix length accepted")
+	}
+}
+
+// A listener handing out the connections queued with Connect
+type fakeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeListener() *fakeListener {
+	return &fakeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// Hands conn to the next Accept
+func (l *fakeListener) Connect(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+	}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *fakeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5077}
+}
+
+// Connections from denied addresses are closed at accept time without handling anything they sent
+func TestAcceptChecksAccessList(t *testing.T) {
+	newTestServer(t)
+	var err error
+	accessList, err = parseAccessList([]string{"192.168.1.0/24"}, []string{"192.168.1.66/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newFakeListener()
+	serveTestListener(t, l, nil)
+
+	clientAt := func(ip string) *fakeConn {
+		conn := newFakeConn()
+		conn.remote = &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+		t.Cleanup(func() { conn.Close() })
+		conn.Send("PING;1")
+		l.Connect(conn)
+		return conn
+	}
+	allowed := clientAt("192.168.1.20")
+	allowed.Expect(t, "PONG;1")
+	for _, ip := range []string{"192.168.1.66", "10.0.0.5"} {
+		denied := clientAt(ip)
+		waitUntil(t, "the connection from "+ip+" to be closed", denied.Closed)
+		if lines := denied.Lines(); len(lines) != 0 {
+			t.Fatalf("denied client at %s was answered %q", ip, lines)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Recovery from a BLE adapter reset (driver hiccup, USB re-enumeration). When writes start failing the server probes
+ * every connected vehicle; if none of them is reachable the adapter is assumed to have reset. A reset that drops the
+ * links is detected as every connected vehicle, more than one, being lost within ADAPTER_RESET_WINDOW. The server then
+ * re-enables the adapter and reconnects the vehicles that were connected, keeping their owners and subscribers, so
+ * notifications resume without clients having to reconnect. Clients are told with ADAPTER;RESET and
+ * ADAPTER;RECOVERED, or ADAPTER;FAILED once the retries are used up.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How close together the connected vehicles have to drop their links for the drops to count as an adapter reset
+const ADAPTER_RESET_WINDOW = time.Second
+
+var recovering int32
+
+// A vehicle to reconnect after an adapter reset, with the clients it had when its link went
+type RecoveredVehicle struct {
+	address string
+	clients ClientsSnapshot
+	lostAt  time.Time
+}
+
+var (
+	lostMu sync.Mutex
+	// the vehicles lost within the last ADAPTER_RESET_WINDOW
+	lostVehicles []RecoveredVehicle
+)
+
+// Captures what reconnecting a vehicle needs before the vehicle is forgotten
+func snapshotVehicle(address string) RecoveredVehicle {
+	vehicle := RecoveredVehicle{address: address, lostAt: time.Now()}
+	if clients, ok := server.VehicleClients.Get(address); ok {
+		vehicle.clients = clients.snapshot()
+	}
+	return vehicle
+}
+
+// Probes every connected vehicle and starts the recovery if none of them can be reached
+func checkAdapter() {
+	addresses := server.DeviceCharacteristics.Keys()
+	if len(addresses) == 0 || atomic.LoadInt32(&recovering) == 1 {
+		return
+	}
+	for _, address := range addresses {
+		if writeToVehicle(address, EncodePing()) == nil {
+			return
+		}
+	}
+	vehicles := make([]RecoveredVehicle, 0, len(addresses))
+	for _, address := range addresses {
+		vehicles = append(vehicles, snapshotVehicle(address))
+	}
+	recoverAdapter(vehicles)
+}
+
+// Records a vehicle that dropped its link and starts the recovery once no connected vehicle is left and more than
+// one was lost within ADAPTER_RESET_WINDOW. A single vehicle can't be told apart from one driving out of range, it
+// stays lost.
+func noteLostVehicle(vehicle RecoveredVehicle) {
+	lostMu.Lock()
+	defer lostMu.Unlock()
+
+	var recent []RecoveredVehicle
+	for _, lost := range lostVehicles {
+		if vehicle.lostAt.Sub(lost.lostAt) <= ADAPTER_RESET_WINDOW {
+			recent = append(recent, lost)
+		}
+	}
+	lostVehicles = append(recent, vehicle)
+	if len(lostVehicles) < 2 || server.ConnectedDevices.Count() > 0 {
+		return
+	}
+	vehicles := lostVehicles
+	lostVehicles = nil
+	go recoverAdapter(vehicles)
+}
+
+// Re-enables the adapter and reconnects the given vehicles with their owners and subscribers, retrying up to
+// AdapterRecoveryRetries times. Vehicles whose owners all went away are not reconnected.
+func recoverAdapter(vehicles []RecoveredVehicle) {
+	if !atomic.CompareAndSwapInt32(&recovering, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&recovering, 0)
+
+	var pending []string
+	for _, vehicle := range vehicles {
+		if restoreVehicleClients(vehicle.address, vehicle.clients) {
+			pending = append(pending, vehicle.address)
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+	displayInfo("BLE adapter reset detected, recovering " + strconv.Itoa(len(pending)) + " vehicles...")
+	broadcast([]byte("ADAPTER;RESET\n"))
+	atomic.StoreInt32(&AdapterEnabled, 0)
+
+	backoff := newBackoff(time.Duration(serverConf.ReconnectBackoffMillis)*time.Millisecond, time.Duration(serverConf.ReconnectMaxBackoffMillis)*time.Millisecond)
+	for attempt := 1; attempt <= serverConf.AdapterRecoveryRetries && len(pending) > 0; attempt++ {
+		time.Sleep(backoff.Next())
+
+		if err := Adapter.Enable(); err != nil {
+			displayInfo("Recovery attempt " + strconv.Itoa(attempt) + ": could not enable BLE stack: " + err.Error())
+			continue
+		}
+		atomic.StoreInt32(&AdapterEnabled, 1)
+
+		var failed []string
+		for _, address := range pending {
+			if err := reconnectVehicle(address); err != nil {
+				displayInfo("Recovery attempt " + strconv.Itoa(attempt) + ": could not reconnect " + address + ": " + err.Error())
+				failed = append(failed, address)
+			}
+		}
+		// the adapter is back, the vehicles still missing get the short delays again
+		if len(failed) < len(pending) {
+			backoff.Reset()
+		}
+		pending = failed
+	}
+
+	if len(pending) > 0 {
+		for _, address := range pending {
+			teardownVehicle(address, nil)
+		}
+		broadcast([]byte("ADAPTER;FAILED\n"))
+		displayInfo("BLE adapter recovery failed, " + strconv.Itoa(len(pending)) + " vehicles dropped.")
+		return
+	}
+	broadcast([]byte("ADAPTER;RECOVERED\n"))
+	displayInfo("BLE adapter recovered.")
+}
+
+// Re-establishes the BLE link to a previously connected vehicle, its owners and subscribers are left untouched.
+// Vehicles that were disconnected or lost in the meantime are not connected again.
+func reconnectVehicle(address string) error {
+	device, ok := server.DiscoveredDevices.Get(address)
+	if !ok {
+		return errors.New("vehicle was never discovered")
+	}
+
+	lock := deviceLock(address)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !server.ConnectedDevices.Has(address) && !server.VehicleClients.Has(address) {
+		return errNotConnected
+	}
+	if old, ok := server.ConnectedDevices.Get(address); ok {
+		old.Disconnect()
+	}
+	server.VehicleStates.Set(address, STATE_CONNECTING)
+	connectedDevice, err := connectVehicle(device)
+	if err != nil {
+		server.VehicleStates.Set(address, STATE_LOST)
+		return err
+	}
+	server.ConnectedDevices.Set(address, connectedDevice)
+	if err := attachVehicle(address, connectedDevice); err != nil {
+		server.VehicleStates.Set(address, STATE_LOST)
+		return err
+	}
+	server.VehicleStates.Set(address, STATE_CONNECTED)
+	broadcastEvent("CONNECTED", address)
+	return nil
+}
@@ -0,0 +1,133 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the recovery from a BLE adapter reset.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// When no connected vehicle can be reached the adapter is enabled again and every vehicle reconnected, with its
+// owners and subscribers kept so notifications resume
+func TestAdapterResetReconnects(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.ReconnectBackoffMillis = 1
+	owner := newTestClient(t, nil)
+	first := connectTestVehicle(t, adapter, owner, TEST_VEHICLE)
+	second := connectTestVehicle(t, adapter, owner, TEST_VEHICLE_2)
+	subscriber := newTestClient(t, nil)
+	subscriber.Send("SUBSCRIBE;" + TEST_VEHICLE_2)
+	subscriber.Expect(t, "SUBSCRIBE;SUCCESS")
+
+	for _, vehicle := range []*fakeVehicle{first, second} {
+		vehicle.writer.OnWrite(failWrites(1, errors.New("adapter reset")))
+	}
+	checkAdapter()
+
+	owner.Expect(t, "ADAPTER;RESET")
+	owner.Expect(t, "ADAPTER;RECOVERED")
+	if enables, _, _, connects := adapter.Calls(); enables != 1 || connects != 4 {
+		t.Fatalf("%d enables and %d connects, want 1 and 4", enables, connects)
+	}
+	if !adapterReady() {
+		t.Fatal("adapter not ready after the recovery")
+	}
+	for _, address := range []string{TEST_VEHICLE, TEST_VEHICLE_2} {
+		expectState(t, address, STATE_CONNECTED)
+	}
+	if clients, _ := server.VehicleClients.Get(TEST_VEHICLE_2); clients.OwnerCount() != 1 {
+		t.Fatalf("%d owners after the recovery", clients.OwnerCount())
+	}
+
+	second.Emit(transitionUpdate(1, 0, 0))
+	notification := TEST_VEHICLE_2 + ";" + encodeHex(transitionUpdate(1, 0, 0))
+	owner.Expect(t, notification)
+	subscriber.Expect(t, notification)
+	owner.Send(TEST_VEHICLE + ";0116")
+	first.ExpectWrite(t, []byte{0x01, 0x16})
+}
+
+// A reset that drops every link fires the disconnect handler for each vehicle, the vehicles are reconnected with the
+// owners and subscribers they had rather than left lost
+func TestAdapterResetDropsLinks(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.ReconnectBackoffMillis = 1
+	owner := newTestClient(t, nil)
+	connectTestVehicle(t, adapter, owner, TEST_VEHICLE)
+	connectTestVehicle(t, adapter, owner, TEST_VEHICLE_2)
+	subscriber := newTestClient(t, nil)
+	subscriber.Send("SUBSCRIBE;" + TEST_VEHICLE_2)
+	subscriber.Expect(t, "SUBSCRIBE;SUCCESS")
+
+	adapter.DropLink(TEST_VEHICLE)
+	adapter.DropLink(TEST_VEHICLE_2)
+
+	owner.Expect(t, "ADAPTER;RESET")
+	owner.Expect(t, "ADAPTER;RECOVERED")
+	if enables, _, _, connects := adapter.Calls(); enables != 1 || connects != 4 {
+		t.Fatalf("%d enables and %d connects, want 1 and 4", enables, connects)
+	}
+	for _, address := range []string{TEST_VEHICLE, TEST_VEHICLE_2} {
+		expectState(t, address, STATE_CONNECTED)
+	}
+	if clients, _ := server.VehicleClients.Get(TEST_VEHICLE_2); clients.OwnerCount() != 1 || clients.SubscriberCount() != 2 {
+		t.Fatalf("%d owners and %d subscribers after the recovery", clients.OwnerCount(), clients.SubscriberCount())
+	}
+
+	vehicle := adapter.Vehicle(TEST_VEHICLE_2)
+	vehicle.Emit(transitionUpdate(1, 0, 0))
+	notification := TEST_VEHICLE_2 + ";" + encodeHex(transitionUpdate(1, 0, 0))
+	owner.Expect(t, notification)
+	subscriber.Expect(t, notification)
+
+	// a single vehicle dropping its link is lost, not a reset
+	adapter.DropLink(TEST_VEHICLE)
+	expectState(t, TEST_VEHICLE, STATE_LOST)
+	owner.Refute(t, "ADAPTER;RESET", 20*time.Millisecond)
+}
+
+// An adapter that stays unusable gives up after adapterRecoveryRetries and drops the vehicles
+func TestAdapterResetFails(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.ReconnectBackoffMillis = 1
+	serverConf.AdapterRecoveryRetries = 2
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	vehicle.writer.OnWrite(failWrites(1, errors.New("adapter reset")))
+	adapter.mu.Lock()
+	adapter.enableErr = errors.New("no adapter")
+	adapter.mu.Unlock()
+	checkAdapter()
+
+	client.Expect(t, "ADAPTER;RESET")
+	client.Expect(t, "ADAPTER;FAILED")
+	if enables, _, _, _ := adapter.Calls(); enables != 2 {
+		t.Fatalf("%d enables, want one per retry", enables)
+	}
+	if adapterReady() || server.ConnectedDevices.Has(TEST_VEHICLE) {
+		t.Fatal("vehicle still connected after the recovery failed")
+	}
+	expectState(t, TEST_VEHICLE, STATE_DISCONNECTED)
+}
+
+// A single unreachable vehicle is not an adapter reset
+func TestAdapterProbeReachesVehicle(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	broken := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	connectTestVehicle(t, adapter, client, TEST_VEHICLE_2)
+
+	broken.writer.OnWrite(failWrites(1, errors.New("out of range")))
+	checkAdapter()
+	client.Refute(t, "ADAPTER;", 0)
+	if _, _, _, connects := adapter.Calls(); connects != 2 {
+		t.Fatalf("%d connects, nothing should have been reconnected", connects)
+	}
+}
@@ -0,0 +1,287 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Encoders for the ANKI Drive vehicle message protocol. Every message starts with a size byte (the length of the
+ * message excluding the size byte itself) followed by the message id, and all multi-byte fields are little-endian.
+ * Message layouts follow the ANKI Drive Programming Guide:
+ *		https://github.com/tenbergen/anki-drive-java/blob/master/Anki%20Drive%20Programming%20Guide.pdf
+ *
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+const (
+	// vehicle message ids sent from the server to the vehicle
+	ANKI_MSG_C2V_PING_REQUEST   = 0x16
+	ANKI_MSG_C2V_SET_LIGHTS     = 0x1d
+	ANKI_MSG_C2V_SET_SPEED      = 0x24
+	ANKI_MSG_C2V_CHANGE_LANE    = 0x25
+	ANKI_MSG_C2V_CANCEL_LANE    = 0x26
+	ANKI_MSG_C2V_SET_OFFSET     = 0x2c
+	ANKI_MSG_C2V_TURN           = 0x32
+	ANKI_MSG_C2V_LIGHTS_PATTERN = 0x33
+	ANKI_MSG_C2V_SDK_MODE       = 0x90
+)
+
+const (
+	// vehicle message ids sent from the vehicle to the server
+	ANKI_MSG_V2C_PING_RESPONSE       = 0x17
+	ANKI_MSG_V2C_BATTERY_LEVEL       = 0x1b
+	ANKI_MSG_V2C_POSITION_UPDATE     = 0x27
+	ANKI_MSG_V2C_TRANSITION_UPDATE   = 0x29
+	ANKI_MSG_V2C_VEHICLE_DELOCALIZED = 0x2b
+	// not in the programming guide, Overdrive firmware reports it when the vehicle bumps into something
+	ANKI_MSG_V2C_COLLISION_DETECTED = 0x4d
+)
+
+const (
+	// SDK mode option letting the client override the vehicle's localization
+	SDK_OPTION_OVERRIDE_LOCALIZATION = 0x01
+)
+
+const (
+	// deceleration used when the server stops a vehicle on its own
+	STOP_ACCELERATION = 12500
+)
+
+const (
+	// turn types of the turn message
+	TURN_LEFT       = 1
+	TURN_RIGHT      = 2
+	TURN_UTURN      = 3
+	TURN_UTURN_JUMP = 4
+
+	// when the vehicle executes the turn
+	TURN_TRIGGER_IMMEDIATE    = 0
+	TURN_TRIGGER_INTERSECTION = 1
+)
+
+const (
+	// lights that can be toggled with the set-lights message
+	LIGHT_HEADLIGHTS  = 0
+	LIGHT_BRAKELIGHTS = 1
+	LIGHT_FRONTLIGHTS = 2
+	LIGHT_ENGINE      = 3
+)
+
+const (
+	// channels of the lights-pattern message
+	LIGHT_CHANNEL_RED    = 0
+	LIGHT_CHANNEL_TAIL   = 1
+	LIGHT_CHANNEL_BLUE   = 2
+	LIGHT_CHANNEL_GREEN  = 3
+	LIGHT_CHANNEL_FRONTL = 4
+	LIGHT_CHANNEL_FRONTR = 5
+)
+
+const (
+	// effects of the lights-pattern message
+	LIGHT_EFFECT_STEADY = 0
+	LIGHT_EFFECT_FADE   = 1
+	LIGHT_EFFECT_THROB  = 2
+	LIGHT_EFFECT_FLASH  = 3
+	LIGHT_EFFECT_RANDOM = 4
+
+	// brightest start or end intensity of a lights pattern
+	LIGHT_MAX_INTENSITY = 14
+)
+
+var (
+	LIGHT_NAMES = map[string]byte{
+		"HEADLIGHTS":  LIGHT_HEADLIGHTS,
+		"BRAKELIGHTS": LIGHT_BRAKELIGHTS,
+		"FRONTLIGHTS": LIGHT_FRONTLIGHTS,
+		"ENGINE":      LIGHT_ENGINE,
+	}
+	TURN_NAMES = map[string]byte{
+		"LEFT":       TURN_LEFT,
+		"RIGHT":      TURN_RIGHT,
+		"UTURN":      TURN_UTURN,
+		"UTURN_JUMP": TURN_UTURN_JUMP,
+	}
+	TURN_TRIGGER_NAMES = map[string]byte{
+		"IMMEDIATE":    TURN_TRIGGER_IMMEDIATE,
+		"INTERSECTION": TURN_TRIGGER_INTERSECTION,
+	}
+	LIGHT_CHANNEL_NAMES = map[string]byte{
+		"RED":    LIGHT_CHANNEL_RED,
+		"TAIL":   LIGHT_CHANNEL_TAIL,
+		"BLUE":   LIGHT_CHANNEL_BLUE,
+		"GREEN":  LIGHT_CHANNEL_GREEN,
+		"FRONTL": LIGHT_CHANNEL_FRONTL,
+		"FRONTR": LIGHT_CHANNEL_FRONTR,
+	}
+	LIGHT_EFFECT_NAMES = map[string]byte{
+		"STEADY": LIGHT_EFFECT_STEADY,
+		"FADE":   LIGHT_EFFECT_FADE,
+		"THROB":  LIGHT_EFFECT_THROB,
+		"FLASH":  LIGHT_EFFECT_FLASH,
+		"RANDOM": LIGHT_EFFECT_RANDOM,
+	}
+)
+
+// Encodes a ping request, the vehicle answers with a ping response
+func EncodePing() []byte {
+	return []byte{0x01, ANKI_MSG_C2V_PING_REQUEST}
+}
+
+// Encodes an SDK mode message, which has to be sent before the vehicle accepts driving commands
+func EncodeSdkMode(on bool, flags byte) []byte {
+	msg := []byte{0x03, ANKI_MSG_C2V_SDK_MODE, 0, flags}
+	if on {
+		msg[2] = 1
+	}
+	return msg
+}
+
+// Encodes a set-lights message turning a single light on or off.
+// The low nibble of the mask marks which lights the message changes, the high nibble holds their new values.
+func EncodeLights(light byte, on bool) []byte {
+	mask := byte(1) << light
+	if on {
+		mask |= byte(1) << (light + 4)
+	}
+	return []byte{0x02, ANKI_MSG_C2V_SET_LIGHTS, mask}
+}
+
+// Encodes a lights-pattern message for a single channel. The message always carries room for three channel
+// configurations; only the first one is used.
+func EncodeLightPattern(channel byte, effect byte, start byte, end byte, cyclesPer10Sec byte) []byte {
+	msg := make([]byte, 18)
+	msg[0] = 17
+	msg[1] = ANKI_MSG_C2V_LIGHTS_PATTERN
+	msg[2] = 1
+	copy(msg[3:], []byte{channel, effect, start, end, cyclesPer10Sec})
+	return msg
+}
+
+// Encodes a turn message, e.g. a U-turn executed immediately or at the next crossing
+func EncodeTurn(turnType byte, trigger byte) []byte {
+	return []byte{0x03, ANKI_MSG_C2V_TURN, turnType, trigger}
+}
+
+// Encodes a set-offset-from-road-center message, telling the vehicle where it currently is relative to the road center.
+// Unlike the change-lane message it carries no speed or acceleration, only the float32 offset in millimeters.
+func EncodeSetOffset(offsetMm float32) []byte {
+	msg := []byte{0x05, ANKI_MSG_C2V_SET_OFFSET, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(msg[2:], math.Float32bits(offsetMm))
+	return msg
+}
+
+// Encodes a change-lane message, moving the vehicle sideways to the given offset from the road center
+func EncodeChangeLane(horizontalSpeedMmPerSec uint16, horizontalAccelMmPerSec2 uint16, offsetMm float32) []byte {
+	msg := make([]byte, 12)
+	msg[0] = 11
+	msg[1] = ANKI_MSG_C2V_CHANGE_LANE
+	binary.LittleEndian.PutUint16(msg[2:], horizontalSpeedMmPerSec)
+	binary.LittleEndian.PutUint16(msg[4:], horizontalAccelMmPerSec2)
+	binary.LittleEndian.PutUint32(msg[6:], math.Float32bits(offsetMm))
+	return msg
+}
+
+// Encodes a cancel-lane-change message, the vehicle stops moving sideways and stays where it is. Vehicles that are
+// not changing lanes ignore it.
+func EncodeCancelLaneChange() []byte {
+	return []byte{0x01, ANKI_MSG_C2V_CANCEL_LANE}
+}
+
+// Encodes a set-speed message. The vehicle does not respect road piece speed limits.
+func EncodeSetSpeed(speedMmPerSec int16, accelMmPerSec2 int16) []byte {
+	msg := []byte{0x06, ANKI_MSG_C2V_SET_SPEED, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(msg[2:], uint16(speedMmPerSec))
+	binary.LittleEndian.PutUint16(msg[4:], uint16(accelMmPerSec2))
+	return msg
+}
+
+// Whether payload consists of complete messages only, i.e. the size byte of each message matches its length and
+// the last message ends exactly at the end of payload. A single message must start with len(payload)-1.
+func ValidFraming(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	for len(payload) > 0 {
+		size := int(payload[0])
+		if size == 0 || size+1 > len(payload) {
+			return false
+		}
+		payload = payload[size+1:]
+	}
+	return true
+}
+
+// Encodes the messages bringing a vehicle back to a known-safe state, in the order they have to be sent: stop,
+// take the current position as the road center, every light off and SDK mode on again
+func EncodeResetSequence() [][]byte {
+	return [][]byte{
+		EncodeSetSpeed(0, STOP_ACCELERATION),
+		EncodeSetOffset(0),
+		EncodeLights(LIGHT_HEADLIGHTS, false),
+		EncodeLights(LIGHT_BRAKELIGHTS, false),
+		EncodeLights(LIGHT_FRONTLIGHTS, false),
+		EncodeLights(LIGHT_ENGINE, false),
+		EncodeSdkMode(true, SDK_OPTION_OVERRIDE_LOCALIZATION),
+	}
+}
+
+// Returns the message id of a vehicle message, or false if the message is too short to carry one
+func MessageId(msg []byte) (byte, bool) {
+	if len(msg) < 2 {
+		return 0, false
+	}
+	return msg[1], true
+}
+
+// Localization position update, sent each time the vehicle reads a location code on the track
+type PositionUpdate struct {
+	LocationId    byte
+	RoadPieceId   byte
+	OffsetMm      float32
+	SpeedMmPerSec uint16
+	ParsingFlags  byte
+}
+
+// Decodes a localization position update, returns false if msg is not one or is truncated
+func ParsePositionUpdate(msg []byte) (PositionUpdate, bool) {
+	if id, ok := MessageId(msg); !ok || id != ANKI_MSG_V2C_POSITION_UPDATE || len(msg) < 11 {
+		return PositionUpdate{}, false
+	}
+	return PositionUpdate{
+		LocationId:    msg[2],
+		RoadPieceId:   msg[3],
+		OffsetMm:      math.Float32frombits(binary.LittleEndian.Uint32(msg[4:])),
+		SpeedMmPerSec: binary.LittleEndian.Uint16(msg[8:]),
+		ParsingFlags:  msg[10],
+	}, true
+}
+
+// Localization transition update, sent each time the vehicle moves from one road piece onto the next
+type TransitionUpdate struct {
+	RoadPieceIdx     byte
+	RoadPieceIdxPrev int8
+	OffsetMm         float32
+}
+
+// Decodes a localization transition update, returns false if msg is not one or is truncated
+func ParseTransition(msg []byte) (TransitionUpdate, bool) {
+	if id, ok := MessageId(msg); !ok || id != ANKI_MSG_V2C_TRANSITION_UPDATE || len(msg) < 8 {
+		return TransitionUpdate{}, false
+	}
+	return TransitionUpdate{
+		RoadPieceIdx:     msg[2],
+		RoadPieceIdxPrev: int8(msg[3]),
+		OffsetMm:         math.Float32frombits(binary.LittleEndian.Uint32(msg[4:])),
+	}, true
+}
+
+// Decodes a battery level response, the battery voltage in mV, returns false if msg is not one or is truncated
+func ParseBatteryLevel(msg []byte) (uint16, bool) {
+	if id, ok := MessageId(msg); !ok || id != ANKI_MSG_V2C_BATTERY_LEVEL || len(msg) < 4 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint16(msg[2:]), true
+}
@@ -0,0 +1,285 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the ANKI message encoders against the byte sequences of the programming guide, and of the commands
+ * built on them.
+ *
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func expectEncoding(t *testing.T, name string, got []byte, want string) {
+	t.Helper()
+	if hex.EncodeToString(got) != want {
+		t.Errorf("%s encoded as %x, want %s", name, got, want)
+	}
+}
+
+func TestEncodeLights(t *testing.T) {
+	tests := []struct {
+		light string
+		on    bool
+		want  string
+	}{
+		{"HEADLIGHTS", true, "021d11"},
+		{"HEADLIGHTS", false, "021d01"},
+		{"BRAKELIGHTS", true, "021d22"},
+		{"FRONTLIGHTS", true, "021d44"},
+		{"ENGINE", true, "021d88"},
+		{"ENGINE", false, "021d08"},
+	}
+	for _, test := range tests {
+		expectEncoding(t, test.light, EncodeLights(LIGHT_NAMES[test.light], test.on), test.want)
+	}
+}
+
+// LIGHTS writes the set-lights message to the vehicle and rejects unknown lights and states without writing
+func TestLightsCommand(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Send("LIGHTS;" + TEST_VEHICLE + ";ENGINE;ON")
+	client.Expect(t, "LIGHTS;SUCCESS")
+	vehicle.ExpectWrite(t, []byte{0x02, 0x1d, 0x88})
+	client.Send("LIGHTS;" + TEST_VEHICLE + ";HEADLIGHTS;OFF")
+	client.Expect(t, "LIGHTS;SUCCESS")
+	vehicle.ExpectWrite(t, []byte{0x02, 0x1d, 0x01})
+
+	for _, frame := range []string{"LIGHTS;" + TEST_VEHICLE + ";HEADLIGHTS;DIM", "LIGHTS;" + TEST_VEHICLE + ";FOGLIGHTS;ON", "LIGHTS;" + TEST_VEHICLE} {
+		client.Send(frame)
+		client.Expect(t, "ERROR;invalid-lights")
+	}
+	if writes := len(vehicle.Writes()); writes != 2 {
+		t.Fatalf("%d writes, the invalid commands must not write", writes)
+	}
+}
+
+// Only the first of the three channel configurations is filled in, the rest of the message is zero
+func TestEncodeLightPattern(t *testing.T) {
+	const unused = "00000000000000000000"
+	tests := []struct {
+		channel string
+		effect  string
+		start   byte
+		end     byte
+		cycles  byte
+		want    string
+	}{
+		{"RED", "STEADY", 14, 14, 0, "113301" + "00000e0e00" + unused},
+		{"BLUE", "THROB", 0, 14, 10, "113301" + "0202000e0a" + unused},
+		{"GREEN", "FLASH", 14, 0, 30, "113301" + "03030e001e" + unused},
+		{"FRONTR", "FADE", 7, 0, 5, "113301" + "0501070005" + unused},
+		{"TAIL", "RANDOM", 0, 14, 255, "113301" + "0104000eff" + unused},
+	}
+	for _, test := range tests {
+		expectEncoding(t, test.channel+" "+test.effect, EncodeLightPattern(LIGHT_CHANNEL_NAMES[test.channel], LIGHT_EFFECT_NAMES[test.effect], test.start, test.end, test.cycles), test.want)
+	}
+}
+
+// LIGHTPATTERN writes the lights-pattern message and rejects unknown channels and effects and intensities over the
+// maximum without writing
+func TestLightPatternCommand(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Send("LIGHTPATTERN;" + TEST_VEHICLE + ";BLUE;THROB;0;14;10")
+	client.Expect(t, "LIGHTPATTERN;SUCCESS")
+	vehicle.ExpectWrite(t, EncodeLightPattern(LIGHT_CHANNEL_BLUE, LIGHT_EFFECT_THROB, 0, 14, 10))
+
+	for _, frame := range []string{
+		"LIGHTPATTERN;" + TEST_VEHICLE + ";PURPLE;THROB;0;14;10",
+		"LIGHTPATTERN;" + TEST_VEHICLE + ";BLUE;STROBE;0;14;10",
+		"LIGHTPATTERN;" + TEST_VEHICLE + ";BLUE;THROB;0;15;10",
+		"LIGHTPATTERN;" + TEST_VEHICLE + ";BLUE;THROB;0;14;256",
+		"LIGHTPATTERN;" + TEST_VEHICLE + ";BLUE;THROB;0;14",
+	} {
+		client.Send(frame)
+		client.Expect(t, "ERROR;invalid-lights")
+	}
+	if writes := len(vehicle.Writes()); writes != 1 {
+		t.Fatalf("%d writes, the invalid patterns must not write", writes)
+	}
+}
+
+func TestEncodeTurn(t *testing.T) {
+	tests := []struct {
+		turn    string
+		trigger string
+		want    string
+	}{
+		{"LEFT", "IMMEDIATE", "03320100"},
+		{"RIGHT", "IMMEDIATE", "03320200"},
+		{"UTURN", "IMMEDIATE", "03320300"},
+		{"UTURN_JUMP", "IMMEDIATE", "03320400"},
+		{"UTURN", "INTERSECTION", "03320301"},
+	}
+	for _, test := range tests {
+		expectEncoding(t, test.turn+" "+test.trigger, EncodeTurn(TURN_NAMES[test.turn], TURN_TRIGGER_NAMES[test.trigger]), test.want)
+	}
+}
+
+// TURN turns immediately unless told otherwise and rejects unknown types and triggers without writing
+func TestTurnCommand(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Send("TURN;" + TEST_VEHICLE + ";UTURN")
+	client.Expect(t, "TURN;SUCCESS")
+	vehicle.ExpectWrite(t, []byte{0x03, 0x32, 0x03, 0x00})
+	client.Send("TURN;" + TEST_VEHICLE + ";RIGHT;INTERSECTION")
+	client.Expect(t, "TURN;SUCCESS")
+	vehicle.ExpectWrite(t, []byte{0x03, 0x32, 0x02, 0x01})
+
+	for _, frame := range []string{"TURN;" + TEST_VEHICLE + ";SIDEWAYS", "TURN;" + TEST_VEHICLE + ";LEFT;LATER;7", "TURN;" + TEST_VEHICLE, "TURN;" + TEST_VEHICLE + ";LEFT;IMMEDIATE;7;8"} {
+		client.Send(frame)
+		client.Expect(t, "ERROR;invalid-turn")
+	}
+	if writes := len(vehicle.Writes()); writes != 2 {
+		t.Fatalf("%d writes, the invalid turns must not write", writes)
+	}
+
+	client.Send("TURN;" + TEST_VEHICLE_2 + ";LEFT")
+	client.Expect(t, "TURN;FAILED;not-connected")
+}
+
+// The offset is a little-endian float32 after the message id
+func TestEncodeSetOffset(t *testing.T) {
+	tests := []struct {
+		offsetMm float32
+		want     string
+	}{
+		{0, "052c00000000"},
+		{1, "052c0000803f"},
+		{68, "052c00008842"},
+		{-23.5, "052c0000bcc1"},
+	}
+	for _, test := range tests {
+		expectEncoding(t, "offset", EncodeSetOffset(test.offsetMm), test.want)
+	}
+}
+
+func TestOffsetCommand(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Send("OFFSET;" + TEST_VEHICLE + ";-23.5")
+	client.Expect(t, "OFFSET;SUCCESS")
+	vehicle.ExpectWrite(t, []byte{0x05, 0x2c, 0x00, 0x00, 0xbc, 0xc1})
+	client.Send("OFFSET;" + TEST_VEHICLE + ";center")
+	client.Expect(t, "ERROR;invalid-offset")
+}
+
+func TestEncodeCancelLaneChange(t *testing.T) {
+	expectEncoding(t, "cancel lane change", EncodeCancelLaneChange(), "0126")
+}
+
+// LANE_CANCEL writes the cancel-lane-change message whether or not a lane change is under way
+func TestLaneCancelCommand(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Send("LANE_CANCEL;" + TEST_VEHICLE)
+	client.Expect(t, "LANE_CANCEL;SUCCESS")
+	client.Send(TEST_VEHICLE + ";" + hex.EncodeToString(EncodeChangeLane(250, 1000, 40)))
+	client.Send("LANE_CANCEL;" + TEST_VEHICLE + ";2")
+	client.Expect(t, "LANE_CANCEL;SUCCESS;2")
+	if got := vehicle.WrittenHex(); len(got) != 3 || got[0] != "0126" || got[1] != hex.EncodeToString(EncodeChangeLane(250, 1000, 40)) || got[2] != "0126" {
+		t.Fatalf("written %q, want the cancel before and after the lane change", got)
+	}
+
+	client.Send("LANE_CANCEL")
+	client.Expect(t, "ERROR;invalid-lane-cancel")
+	client.Send("LANE_CANCEL;" + TEST_VEHICLE_2)
+	client.Expect(t, "LANE_CANCEL;FAILED;not-connected")
+}
+
+// Stop, road center, each light off and SDK mode, in this order
+func TestEncodeResetSequence(t *testing.T) {
+	want := []string{"06240000d43000", "052c00000000", "021d01", "021d02", "021d04", "021d08", "03900101"}
+	got := EncodeResetSequence()
+	if len(got) != len(want) {
+		t.Fatalf("%d reset messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		expectEncoding(t, "reset message "+strconv.Itoa(i), got[i], want[i])
+	}
+}
+
+// RESET writes the whole sequence in order, answers once with the number of messages and ends lane keeping
+func TestResetCommand(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	client.Send("LANEKEEP;" + TEST_VEHICLE + ";-20")
+	client.Expect(t, "LANEKEEP;SUCCESS")
+
+	client.Send("RESET;" + TEST_VEHICLE + ";4")
+	client.Expect(t, "RESET;SUCCESS;7;4")
+	want := []string{"06240000d43000", "052c00000000", "021d01", "021d02", "021d04", "021d08", "03900101"}
+	if got := vehicle.WrittenHex(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("written %q, want %q", got, want)
+	}
+	if server.LaneKeepers.Has(TEST_VEHICLE) {
+		t.Fatal("lane keeping still on after the reset")
+	}
+
+	client.Send("RESET")
+	client.Expect(t, "ERROR;invalid-reset")
+	client.Send("RESET;" + TEST_VEHICLE_2)
+	client.Expect(t, "RESET;FAILED;0;not-connected")
+}
+
+func TestValidFraming(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    bool
+	}{
+		{"0116", true},
+		{"0524c800e803" + "0116", true},
+		{"0216", false},
+		{"0624c800e803", false},
+		{"0524c800e80300", false},
+		{"00", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		payload, _ := hex.DecodeString(test.payload)
+		if got := ValidFraming(payload); got != test.want {
+			t.Errorf("framing of %q valid: %v, want %v", test.payload, got, test.want)
+		}
+	}
+}
+
+// With validateFraming a mis-framed raw write is answered ERROR;bad-framing and not written, without it the payload
+// is written as it is
+func TestValidateFramingWrites(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	serverConf.ValidateFraming = true
+	client.Send(TEST_VEHICLE + ";0216;ACK")
+	client.Expect(t, "ERROR;bad-framing")
+	client.Send(TEST_VEHICLE + ";0116;ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	if got := vehicle.WrittenHex(); len(got) != 1 || got[0] != "0116" {
+		t.Fatalf("written %q, want only the framed ping", got)
+	}
+
+	serverConf.ValidateFraming = false
+	client.Send(TEST_VEHICLE + ";0216;ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	vehicle.ExpectWrite(t, []byte{0x02, 0x16})
+}
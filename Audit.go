@@ -0,0 +1,111 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Audit log of every command the server receives, for reviewing what happened on a shared track. With auditFile set,
+ * each command is appended as <RFC 3339 time>;<client address>;<verb>;<vehicle address>;<message> in the order it
+ * was received. auditRedactPayloads leaves out the message, auditMaxBytes rotates the file to <auditFile>.1.
+ *
+ */
+
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Verbs whose second field is the vehicle they target
+var VEHICLE_VERBS = map[string]bool{
+	"CONNECT":      true,
+	"DISCONNECT":   true,
+	"DETAILS":      true,
+	"VEHICLE":      true,
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"GATT":         true,
+	"REDISCOVER":   true,
+	"READ":         true,
+	"HISTORY":      true,
+	"ALIAS":        true,
+	"QUERY_SPEED":  true,
+	"QUERY_OFFSET": true,
+	"LANEKEEP":     true,
+	"OFFSETLIMIT":  true,
+	"NOTIFY":       true,
+	"PAUSE":        true,
+	"RESUME":       true,
+}
+
+var (
+	auditFile    *os.File
+	auditWritten int64
+	auditMutex   sync.Mutex
+)
+
+// Opens the audit file for appending
+func startAudit(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	auditFile = file
+	auditWritten = info.Size()
+	displayInfo("Auditing commands to " + path)
+	return nil
+}
+
+// Appends a received command to the audit file, if auditing is enabled
+func auditCommand(remoteAddress string, set []string) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if auditFile == nil {
+		return
+	}
+
+	verb := requestVerb(set)
+	var address string
+	switch {
+	case verb == WRITE_VERB:
+		address = normalizeAddress(set[0])
+	case (VEHICLE_VERBS[verb] || QUEUED_VERBS[verb]) && len(set) >= 2:
+		address = normalizeAddress(set[1])
+	}
+	message := strings.Join(set, ";")
+	if serverConf.AuditRedactPayloads {
+		message = ""
+	}
+
+	line := time.Now().Format(time.RFC3339Nano) + ";" + remoteAddress + ";" + verb + ";" + address + ";" + message + "\n"
+	if serverConf.AuditMaxBytes > 0 && auditWritten+int64(len(line)) > serverConf.AuditMaxBytes {
+		rotateAudit()
+	}
+	written, err := auditFile.WriteString(line)
+	auditWritten += int64(written)
+	if err != nil {
+		displayInfo("Could not audit command: " + err.Error())
+	}
+}
+
+// Moves the full audit file to <auditFile>.1 and starts a new one, must be called while holding auditMutex
+func rotateAudit() {
+	path := auditFile.Name()
+	auditFile.Close()
+	if err := os.Rename(path, path+".1"); err != nil {
+		displayInfo("Could not rotate audit file: " + err.Error())
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		displayInfo("Could not reopen audit file, auditing stopped: " + err.Error())
+		auditFile = nil
+		return
+	}
+	auditFile = file
+	auditWritten = 0
+}
@@ -0,0 +1,116 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the audit log.
+ *
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Audits to a file in the test's temporary directory and returns its path
+func startTestAudit(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := startAudit(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		auditMutex.Lock()
+		defer auditMutex.Unlock()
+		auditFile.Close()
+		auditFile = nil
+	})
+	return path
+}
+
+// The audit lines without their time
+func auditLines(t *testing.T, path string) []string {
+	t.Helper()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		if line != "" {
+			lines = append(lines, line[strings.Index(line, ";")+1:])
+		}
+	}
+	return lines
+}
+
+// A raw write is audited as WRITE with the vehicle it went to, RAW;OFF as itself without a vehicle
+func TestAuditWriteAndRawVerbs(t *testing.T) {
+	newTestServer(t)
+	path := startTestAudit(t)
+
+	auditCommand("127.0.0.1:4000", []string{TEST_VEHICLE, "0624c800e80300"})
+	auditCommand("127.0.0.1:4000", []string{"RAW", "OFF"})
+
+	want := []string{
+		"127.0.0.1:4000;WRITE;" + TEST_VEHICLE + ";" + TEST_VEHICLE + ";0624c800e80300",
+		"127.0.0.1:4000;RAW;;RAW;OFF",
+	}
+	got := auditLines(t, path)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("audit lines %q, want %q", got, want)
+	}
+}
+
+// Every command a client sends is audited in the order it was received, with the vehicle it targets
+func TestAuditCommandsInOrder(t *testing.T) {
+	adapter := newTestServer(t)
+	path := startTestAudit(t)
+	client := newTestClient(t, nil)
+	connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	client.Send(TEST_VEHICLE+";0116", "LIGHTS;"+TEST_VEHICLE+";HEADLIGHTS;ON", "PING;4", "DISCONNECT;"+TEST_VEHICLE)
+	client.Expect(t, "DISCONNECT;SUCCESS")
+
+	remote := client.RemoteAddr().String()
+	want := []string{
+		remote + ";SCAN;;SCAN",
+		remote + ";CONNECT;" + TEST_VEHICLE + ";CONNECT;" + TEST_VEHICLE,
+		remote + ";WRITE;" + TEST_VEHICLE + ";" + TEST_VEHICLE + ";0116",
+		remote + ";LIGHTS;" + TEST_VEHICLE + ";LIGHTS;" + TEST_VEHICLE + ";HEADLIGHTS;ON",
+		remote + ";PING;;PING;4",
+		remote + ";DISCONNECT;" + TEST_VEHICLE + ";DISCONNECT;" + TEST_VEHICLE,
+	}
+	if got := auditLines(t, path); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("audit lines %q, want %q", got, want)
+	}
+}
+
+// auditRedactPayloads leaves the messages out, auditMaxBytes moves the full file aside before it grows past the limit
+func TestAuditRedactAndRotate(t *testing.T) {
+	newTestServer(t)
+	serverConf.AuditRedactPayloads = true
+	serverConf.AuditMaxBytes = 200
+	path := startTestAudit(t)
+
+	for i := 0; i < 6; i++ {
+		auditCommand("127.0.0.1:4000", []string{TEST_VEHICLE, "0624c800e80300"})
+	}
+	for _, line := range append(auditLines(t, path+".1"), auditLines(t, path)...) {
+		if line != "127.0.0.1:4000;WRITE;"+TEST_VEHICLE+";" {
+			t.Fatalf("audit line %q still carries the message", line)
+		}
+	}
+	// only one rotated file is kept, neither grows past the limit
+	for _, file := range []string{path, path + ".1"} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() == 0 || info.Size() > serverConf.AuditMaxBytes {
+			t.Fatalf("audit file %s holds %d bytes, the limit is %d", file, info.Size(), serverConf.AuditMaxBytes)
+		}
+	}
+}
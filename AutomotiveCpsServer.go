@@ -15,16 +15,27 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	cmap "github.com/orcaman/concurrent-map/v2"
 	"gopkg.in/yaml.v3"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
-	"regexp"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"tinygo.org/x/bluetooth"
 )
@@ -33,12 +44,40 @@ const (
 	ANSI_RESET = "\u001B[0m"
 	ANSI_RED   = "\u001B[31m"
 	ANSI_GREEN = "\u001B[32m"
+	ANSI_CYAN  = "\u001B[36m"
 )
 
+// The ANKI SDK for Java expects this encoded local name in every SCAN result, DETAILS reports the real one
+const LEGACY_LOCAL_NAME = "10603001202020204472697665"
+
+// How long a timed out scan may take to end after StopScan
+const SCAN_STOP_TIMEOUT = 2 * time.Second
+
+// How long DISCONNECT_ALL waits for the writes in flight to a vehicle before it leaves the vehicle connected
+const URGENT_LOCK_TIMEOUT = 500 * time.Millisecond
+
+// Delay before retrying a temporary accept error, doubled up to the maximum while the errors persist
+const (
+	ACCEPT_RETRY_BASE = 5 * time.Millisecond
+	ACCEPT_RETRY_MAX  = time.Second
+)
+
+// Pause between two vehicles reported to a client, the ANKI SDK for Java misses results that arrive back to back
+var scanResultInterval = 500 * time.Millisecond
+
+// Build version, set with go build -ldflags "-X main.Version=<version>"
+var Version = "dev"
+
 var (
 	server                  Server
-	Adapter                 = bluetooth.DefaultAdapter
-	AdapterEnabled          = false
+	serverConf              ServerConf
+	connectionParams        bluetooth.ConnectionParams
+	onConnectPayloads       [][]byte       // decoded onConnectCommands
+	Adapter                 VehicleAdapter = &BluetoothAdapter{bluetooth.DefaultAdapter}
+	AdapterEnabled          int32          // set to 1 once Adapter.Enable() succeeded, read and written atomically
+	scanMutex               sync.Mutex
+	liveConnections         int32         // clients currently handled by handleRequest, read and written atomically
+	connectSlots            chan struct{} // one entry per vehicle connect in progress, nil if connects are not limited
 	ANKI_STR_SERVICE_UUID   = bluetooth.NewUUID([16]byte{0xBE, 0x15, 0xBE, 0xEF, 0x61, 0x86, 0x40, 0x7E, 0x83, 0x81, 0x0B, 0xD8, 0x9C, 0x4D, 0x8D, 0xF4})
 	ANKI_STR_CHR_READ_UUID  = bluetooth.NewUUID([16]byte{0xBE, 0x15, 0xBE, 0xE0, 0x61, 0x86, 0x40, 0x7E, 0x83, 0x81, 0x0B, 0xD8, 0x9C, 0x4D, 0x8D, 0xF4})
 	ANKI_STR_CHR_WRITE_UUID = bluetooth.NewUUID([16]byte{0xBE, 0x15, 0xBE, 0xE1, 0x61, 0x86, 0x40, 0x7E, 0x83, 0x81, 0x0B, 0xD8, 0x9C, 0x4D, 0x8D, 0xF4})
@@ -46,257 +85,2117 @@ var (
 
 type Server struct {
 	DiscoveredDevices     cmap.ConcurrentMap[string, AnkiVehicle]
-	ConnectedDevices      cmap.ConcurrentMap[string, *bluetooth.Device]
-	DeviceCharacteristics cmap.ConcurrentMap[string, []bluetooth.DeviceCharacteristic]
+	ConnectedDevices      cmap.ConcurrentMap[string, VehicleLink]
+	DeviceCharacteristics cmap.ConcurrentMap[string, VehicleCharacteristics]
+	RateLimiters          cmap.ConcurrentMap[string, *TokenBucket]
+	VehicleStates         cmap.ConcurrentMap[string, VehicleState]
+	VehicleClients        cmap.ConcurrentMap[string, *VehicleClients]
+	DeviceLocks           cmap.ConcurrentMap[string, *sync.RWMutex]
+	Clients               cmap.ConcurrentMap[string, *ClientConn]
+	PingWaiters           cmap.ConcurrentMap[string, chan struct{}]
+	LastActivity          cmap.ConcurrentMap[string, time.Time]
+	CommandQueues         cmap.ConcurrentMap[string, *CommandQueue]
+	LaneKeepers           cmap.ConcurrentMap[string, *LaneKeeper]
+	LastSpeeds            cmap.ConcurrentMap[string, SpeedSample]
+	LastOffsets           cmap.ConcurrentMap[string, float32]
+	CommandHistories      cmap.ConcurrentMap[string, *CommandHistory]
+	Coalescers            cmap.ConcurrentMap[string, *Coalescer]
+	Aliases               cmap.ConcurrentMap[string, string]
+	OffsetLimits          cmap.ConcurrentMap[string, OffsetLimit]
+	NotificationsOff      cmap.ConcurrentMap[string, bool]
+}
+
+// The characteristics of the ANKI service used to talk to a connected vehicle
+type VehicleCharacteristics struct {
+	Writer Characteristic
+	Reader Characteristic
+}
+
+// Lifecycle of a vehicle as seen by the server
+type VehicleState int
+
+const (
+	STATE_DISCOVERED VehicleState = iota
+	STATE_CONNECTING
+	STATE_CONNECTED
+	STATE_DISCONNECTED
+	STATE_LOST
+)
+
+func (s VehicleState) String() string {
+	switch s {
+	case STATE_DISCOVERED:
+		return "DISCOVERED"
+	case STATE_CONNECTING:
+		return "CONNECTING"
+	case STATE_CONNECTED:
+		return "CONNECTED"
+	case STATE_DISCONNECTED:
+		return "DISCONNECTED"
+	case STATE_LOST:
+		return "LOST"
+	}
+	return "UNKNOWN"
 }
 
 type AnkiVehicle struct {
 	Address          string
 	ManufacturerData string
-	LocalName        string
-	Addresser        bluetooth.Addresser
+	// the local name the vehicle actually advertised
+	LocalName string
+	// the advertised manufacturer data records by company id
+	ManufacturerRecords map[uint16][]byte
+	Addresser           bluetooth.Addresser
+	// signal strength of the advertisement in dBm
+	RSSI     int16
+	lastSeen time.Time
 }
 
 type ServerConf struct {
 	Host string `yaml:"host"`
 	Port string `yaml:"port"`
+	// "tcp" (default, dual-stack), "tcp4" or "tcp6" to restrict the address family,
+	// or "unix" to listen on the unix domain socket at SocketPath instead of host and port
+	Network    string `yaml:"network"`
+	SocketPath string `yaml:"socketPath"`
+	// Listen on all of these instead of host and port, each with its own set of permitted commands
+	Listeners []ListenerConf `yaml:"listeners"`
+	// Maximum number of commands written to a single vehicle per second, 0 disables rate limiting
+	MaxCommandsPerSecond int `yaml:"maxCommandsPerSecond"`
+	// What to do with a command over the rate limit: "drop" responds ERROR;rate-limited, "queue" waits briefly
+	RateLimitMode string `yaml:"rateLimitMode"`
+	// How long a queued command may wait for the rate limiter before it is dropped
+	RateLimitQueueMillis int `yaml:"rateLimitQueueMillis"`
+	// Forward at most the latest position update of a vehicle per this many milliseconds, other notifications are
+	// never held back. 0 forwards every position update
+	NotificationCoalesceMillis int `yaml:"notificationCoalesceMillis"`
+	// Number of vehicle notifications buffered per client before the queue policy applies
+	NotificationQueueSize int `yaml:"notificationQueueSize"`
+	// What to do when a client's notification queue is full: "drop-oldest" or "close"
+	NotificationQueuePolicy string `yaml:"notificationQueuePolicy"`
+	// Most vehicles connected at the same time, further CONNECTs wait until one finished. 0 connects all at once
+	MaxConcurrentConnects int `yaml:"maxConcurrentConnects"`
+	// BLE connection parameters passed to Adapter.Connect, 0 leaves the adapter's default in place
+	ConnectionTimeoutMillis     int     `yaml:"connectionTimeoutMillis"`
+	MinConnectionIntervalMillis float64 `yaml:"minConnectionIntervalMillis"`
+	MaxConnectionIntervalMillis float64 `yaml:"maxConnectionIntervalMillis"`
+	// How long a SCAN listens for advertising vehicles
+	ScanTimeoutSeconds int `yaml:"scanTimeoutSeconds"`
+	// Ignore advertisements weaker than this many dBm, e.g. -70. 0 reports every vehicle
+	MinRSSI int16 `yaml:"minRSSI"`
+	// Stop a SCAN early once this many vehicles were found, 0 always scans for scanTimeoutSeconds
+	MaxScanResults int `yaml:"maxScanResults"`
+	// "active" (default) to request the scan response carrying the local name, or "passive" to only listen
+	ScanMode string `yaml:"scanMode"`
+	// Forget discovered vehicles that have not been seen by a scan for this long, 0 keeps them forever
+	DiscoveryTTLSeconds int `yaml:"discoveryTTLSeconds"`
+	// Scan in the background every this many seconds and report vehicles that start or stop advertising to event
+	// subscribers, 0 only scans on SCAN
+	PresenceScanSeconds int `yaml:"presenceScanSeconds"`
+	// Format of scan, status and notification messages sent to clients: "legacy" or "json"
+	WireFormat string `yaml:"wireFormat"`
+	// Case of the hex digits in scan results, DETAILS and forwarded notifications: "lower" or "upper"
+	HexCase string `yaml:"hexCase"`
+	// File the aliases and discovered vehicles are saved to on shutdown and restored from at startup, empty keeps
+	// them in memory only
+	StateFile string `yaml:"stateFile"`
+	// host:port position and transition updates are additionally sent to as UDP datagrams, empty disables it
+	TelemetryUDPAddr string `yaml:"telemetryUDPAddr"`
+	// Directory to record every vehicle notification to, empty disables capturing
+	CaptureDir string `yaml:"captureDir"`
+	// Answer frames that are neither a known verb nor a raw <address>;<hex> write with ERROR;unknown-command instead
+	// of writing them to a vehicle. Off by default, frames are then passed through as they always were
+	StrictCommands bool `yaml:"strictCommands"`
+	// Reject raw writes with ERROR;bad-framing unless the size byte of every ANKI message in them matches its length.
+	// Off by default, since some clients send malformed messages on purpose
+	ValidateFraming bool `yaml:"validateFraming"`
+	// How long a raw command write may take before it is reported as failed, 0 waits forever. The vehicle's next
+	// commands still wait until the write returned
+	CommandTimeoutMillis int `yaml:"commandTimeoutMillis"`
+	// Report the result of every raw command write as <address>;WRITE;OK or <address>;WRITE;FAILED;<reason>,
+	// otherwise only commands sent as <address>;<hex>;ACK are acknowledged
+	WriteWithResponse bool `yaml:"writeWithResponse"`
+	// How long an acknowledged write may take before it is reported as <address>;WRITE;TIMEOUT, 0 waits forever
+	WriteTimeoutMillis int `yaml:"writeTimeoutMillis"`
+	// How many times the server tries to re-enable the adapter and reconnect vehicles after an adapter reset
+	AdapterRecoveryRetries int `yaml:"adapterRecoveryRetries"`
+	// Delay before the first recovery attempt, doubled with jitter after every failed attempt up to the maximum
+	ReconnectBackoffMillis    int `yaml:"reconnectBackoffMillis"`
+	ReconnectMaxBackoffMillis int `yaml:"reconnectMaxBackoffMillis"`
+	// Add a timestamp to forwarded notifications, <address>;<timestamp>;<hex>: "monotonic" for nanoseconds since
+	// server start, "unix" for Unix nanoseconds, empty to keep the legacy <address>;<hex>
+	NotificationTimestamps string `yaml:"notificationTimestamps"`
+	// Enable SDK mode on connect and only report CONNECT;SUCCESS once the vehicle confirmed it
+	ConfirmSdkMode       bool `yaml:"confirmSdkMode"`
+	SdkModeTimeoutMillis int  `yaml:"sdkModeTimeoutMillis"`
+	// Hex ANKI messages written in order to every vehicle right after it connected, before CONNECT;SUCCESS
+	OnConnectCommands []string `yaml:"onConnectCommands"`
+	// Largest single BLE write, longer payloads are split between ANKI messages. 0 disables chunking
+	WriteChunkBytes int `yaml:"writeChunkBytes"`
+	// Retry a failed raw command write this many times, waiting CommandRetryBackoffMillis before the first retry and
+	// doubling the wait after each one. Once the retries are used up the vehicle is reconnected once, unless it was
+	// disconnected or lost in the meantime
+	CommandRetries            int `yaml:"commandRetries"`
+	CommandRetryBackoffMillis int `yaml:"commandRetryBackoffMillis"`
+	// Goroutines handling the frames that are not commands for a vehicle, 0 starts one per frame. Slow commands such
+	// as SCAN and CONNECT are not handled by them but by goroutines of their client
+	DispatchWorkers int `yaml:"dispatchWorkers"`
+	// Most commands held for a paused vehicle, further ones are rejected with ERROR;queue-full until RESUME
+	PausedQueueLimit int `yaml:"pausedQueueLimit"`
+	// Disconnect vehicles that neither received a command nor sent a notification for this long, 0 disables it
+	IdleTimeoutSeconds int `yaml:"idleTimeoutSeconds"`
+	// Also accept clients over WebSocket on host and WSPort
+	WSEnabled bool   `yaml:"wsEnabled"`
+	WSPort    string `yaml:"wsPort"`
+	// File every received command is appended to, empty disables auditing. AuditRedactPayloads leaves out
+	// the message itself, AuditMaxBytes rotates the file to <AuditFile>.1 once it grows larger, 0 never rotates
+	AuditFile           string `yaml:"auditFile"`
+	AuditRedactPayloads bool   `yaml:"auditRedactPayloads"`
+	AuditMaxBytes       int64  `yaml:"auditMaxBytes"`
+	// Only accept clients from these networks, e.g. 192.168.1.0/24. Empty accepts every address not denied
+	AllowedCIDRs []string `yaml:"allowedCIDRs"`
+	// Close connections from these networks right away, even if they are allowed
+	DeniedCIDRs []string `yaml:"deniedCIDRs"`
+	// Close a client that sent no message, PING included, for this long. 0 waits forever. READ_TIMEOUT changes it
+	// per client
+	ReadTimeoutSeconds int `yaml:"readTimeoutSeconds"`
+	// Most clients connected at the same time over every listener and WebSocket, further clients are answered with
+	// ERROR;server-full and closed. 0 accepts any number of clients
+	MaxConnections int `yaml:"maxConnections"`
+	// Seconds between TCP keepalive probes on an idle client connection, a dead client is detected after a few
+	// unanswered probes. 0 disables keepalive
+	KeepAlivePeriodSeconds int `yaml:"keepAlivePeriodSeconds"`
+	// Largest message accepted from a client, counting its newline. Longer ones are rejected with ERROR;frame-too-large
+	// and skipped up to their newline
+	MaxFrameBytes int `yaml:"maxFrameBytes"`
+	// Console output: "debug" adds every message sent to or received from a vehicle, "info" (default) or "error".
+	// LOGLEVEL changes it at runtime
+	LogLevel string `yaml:"logLevel"`
+	// Keep running when the BLE adapter cannot be enabled, SCAN then fails with adapter-not-ready
+	AllowNoAdapter bool `yaml:"allowNoAdapter"`
+	// "ble" to use the host's BLE adapter, "sim" for simulated vehicles that need no hardware
+	Adapter string `yaml:"adapter"`
+	// Stop a vehicle as soon as it reports that it is delocalized
+	StopOnDelocalize bool `yaml:"stopOnDelocalize"`
+}
+
+type ListenerConf struct {
+	Host       string `yaml:"host"`
+	Port       string `yaml:"port"`
+	Network    string `yaml:"network"`
+	SocketPath string `yaml:"socketPath"`
+	// Commands clients of this listener may use, WRITE for <address>;<hex> writes. Empty permits every command,
+	// others are rejected with ERROR;not-permitted
+	AllowedCommands []string `yaml:"allowedCommands"`
 }
 
 func main() {
-	server.DiscoveredDevices = cmap.New[AnkiVehicle]()
-	server.ConnectedDevices = cmap.New[*bluetooth.Device]()
-	server.DeviceCharacteristics = cmap.New[[]bluetooth.DeviceCharacteristic]()
+	configPath := flag.String("config", "serverconf.yml", "path of the server configuration")
+	replay := flag.String("replay", "", "decode a notification capture file instead of running the server")
+	flag.Parse()
+	if *replay != "" {
+		if err := replayCapture(*replay, os.Stdout); err != nil {
+			displayError(err.Error())
+		}
+		return
+	}
 
-	file, err := ioutil.ReadFile("serverconf.yml")
+	server = newServer()
+
+	file, err := ioutil.ReadFile(*configPath)
 	if err != nil {
 		displayError(err.Error())
 	}
 
-	serverConf := ServerConf{}
+	serverConf = defaultServerConf()
 	err = yaml.Unmarshal(file, &serverConf)
 	if err != nil {
 		displayError(err.Error())
 	}
 
-	// Listen for connections on host and port
-	l, err := net.Listen("tcp", serverConf.Host+":"+serverConf.Port)
+	connectionParams, err = buildConnectionParams(serverConf)
+	if err != nil {
+		displayError(err.Error())
+	}
+	onConnectPayloads, err = decodeOnConnectCommands(serverConf.OnConnectCommands)
+	if err != nil {
+		displayError(err.Error())
+	}
+	if serverConf.MaxConcurrentConnects > 0 {
+		connectSlots = make(chan struct{}, serverConf.MaxConcurrentConnects)
+	}
+	accessList, err = parseAccessList(serverConf.AllowedCIDRs, serverConf.DeniedCIDRs)
 	if err != nil {
 		displayError(err.Error())
 	}
+	if serverConf.ScanTimeoutSeconds <= 0 {
+		displayError("scanTimeoutSeconds must be positive")
+	}
+	if serverConf.MaxFrameBytes <= 0 {
+		displayError("maxFrameBytes must be positive")
+	}
+	if !setLogLevel(serverConf.LogLevel) {
+		displayError("logLevel must be debug, info or error")
+	}
+	if serverConf.HexCase != HEX_CASE_LOWER && serverConf.HexCase != HEX_CASE_UPPER {
+		displayError("hexCase must be " + HEX_CASE_LOWER + " or " + HEX_CASE_UPPER)
+	}
+	if serverConf.RateLimitMode != RATE_LIMIT_DROP && serverConf.RateLimitMode != RATE_LIMIT_QUEUE {
+		displayError("rateLimitMode must be " + RATE_LIMIT_DROP + " or " + RATE_LIMIT_QUEUE)
+	}
+	switch serverConf.Adapter {
+	case ADAPTER_BLE:
+	case ADAPTER_SIM:
+		Adapter = newSimAdapter()
+	default:
+		displayError("adapter must be " + ADAPTER_BLE + " or " + ADAPTER_SIM)
+	}
+
+	if err := applyScanMode(serverConf.ScanMode); err != nil {
+		displayError(err.Error())
+	}
+
+	// a vehicle dropping the link on its own (battery, out of range) is reported through the disconnect handler
+	Adapter.SetDisconnectHandler(vehicleLost)
+	for _, line := range startupBanner(*configPath, serverConf) {
+		displayInfo(line)
+	}
+
+	if serverConf.CaptureDir != "" {
+		if err := startCapture(serverConf.CaptureDir); err != nil {
+			displayError(err.Error())
+		}
+	}
+	if serverConf.TelemetryUDPAddr != "" {
+		if err := startTelemetryUDP(serverConf.TelemetryUDPAddr); err != nil {
+			displayError(err.Error())
+		}
+	}
+	if serverConf.AuditFile != "" {
+		if err := startAudit(serverConf.AuditFile); err != nil {
+			displayError(err.Error())
+		}
+	}
+	// a damaged state file only costs the restored state, not the server
+	if serverConf.StateFile != "" {
+		if err := loadState(serverConf.StateFile); err != nil {
+			displayInfo("Ignoring state file " + serverConf.StateFile + ": " + err.Error())
+		}
+	}
+
+	// enable the BLE stack once, nothing but STATUS works without it
+	if err := startAdapter(); err != nil {
+		displayError(err.Error())
+	}
+
+	if serverConf.DiscoveryTTLSeconds > 0 {
+		go sweepDiscoveredDevices(time.Duration(serverConf.DiscoveryTTLSeconds) * time.Second)
+	}
+	if serverConf.PresenceScanSeconds > 0 {
+		go scanPresence(time.Duration(serverConf.PresenceScanSeconds) * time.Second)
+	}
+	if serverConf.IdleTimeoutSeconds > 0 {
+		go sweepIdleVehicles(time.Duration(serverConf.IdleTimeoutSeconds) * time.Second)
+	}
+
+	if serverConf.DispatchWorkers > 0 {
+		startDispatchPool(serverConf.DispatchWorkers)
+	}
+
+	registerMiddleware(permissionMiddleware)
+	registerMiddleware(rateLimitMiddleware)
+
+	// Listen for connections on host and port, or on a unix domain socket, or on every configured listener
+	var listeners []net.Listener
+	for _, listenerConf := range configuredListeners(serverConf) {
+		l, err := listen(listenerConf)
+		if err != nil {
+			displayError(err.Error())
+		}
+		listeners = append(listeners, l)
+
+		// Addr().Network() reports tcp for every address family, show the configured one
+		network := listenerConf.Network
+		if network == "" {
+			network = "tcp"
+		}
+		displayInfo("Starting Server... Listening on " + network + " " + l.Addr().String())
+		go acceptClients(l, permittedCommands(listenerConf.AllowedCommands))
+	}
+
+	// closing the listeners also removes unix socket files
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		displayInfo("Shutting down...")
+		for _, l := range listeners {
+			l.Close()
+		}
+		if serverConf.StateFile != "" {
+			if err := saveState(serverConf.StateFile); err != nil {
+				displayInfo("Could not save state to " + serverConf.StateFile + ": " + err.Error())
+			}
+		}
+		os.Exit(0)
+	}()
+	if serverConf.WSEnabled {
+		go func() {
+			displayError(serveWebSocket(net.JoinHostPort(serverConf.Host, serverConf.WSPort)).Error())
+		}()
+	}
+	// the accept loops and the signal handler run until the server terminates
+	select {}
+}
+
+// A server that knows no vehicles and no clients yet
+func newServer() Server {
+	return Server{
+		DiscoveredDevices:     cmap.New[AnkiVehicle](),
+		ConnectedDevices:      cmap.New[VehicleLink](),
+		DeviceCharacteristics: cmap.New[VehicleCharacteristics](),
+		RateLimiters:          cmap.New[*TokenBucket](),
+		VehicleStates:         cmap.New[VehicleState](),
+		VehicleClients:        cmap.New[*VehicleClients](),
+		DeviceLocks:           cmap.New[*sync.RWMutex](),
+		Clients:               cmap.New[*ClientConn](),
+		PingWaiters:           cmap.New[chan struct{}](),
+		LastActivity:          cmap.New[time.Time](),
+		CommandQueues:         cmap.New[*CommandQueue](),
+		LaneKeepers:           cmap.New[*LaneKeeper](),
+		LastSpeeds:            cmap.New[SpeedSample](),
+		LastOffsets:           cmap.New[float32](),
+		CommandHistories:      cmap.New[*CommandHistory](),
+		Coalescers:            cmap.New[*Coalescer](),
+		Aliases:               cmap.New[string](),
+		OffsetLimits:          cmap.New[OffsetLimit](),
+		NotificationsOff:      cmap.New[bool](),
+	}
+}
+
+// The configuration used for every option serverconf.yml leaves out
+func defaultServerConf() ServerConf {
+	return ServerConf{
+		RateLimitMode:             RATE_LIMIT_DROP,
+		RateLimitQueueMillis:      100,
+		NotificationQueueSize:     256,
+		NotificationQueuePolicy:   QUEUE_DROP_OLDEST,
+		WireFormat:                WIRE_FORMAT_LEGACY,
+		CommandTimeoutMillis:      2000,
+		WriteTimeoutMillis:        2000,
+		AdapterRecoveryRetries:    3,
+		CommandRetryBackoffMillis: 50,
+		PausedQueueLimit:          COMMAND_QUEUE_LIMIT,
+		DispatchWorkers:           32,
+		ReconnectBackoffMillis:    1000,
+		ReconnectMaxBackoffMillis: 30000,
+		SdkModeTimeoutMillis:      2000,
+		WriteChunkBytes:           0,
+		ScanTimeoutSeconds:        5,
+		Adapter:                   ADAPTER_BLE,
+		ScanMode:                  SCAN_MODE_ACTIVE,
+		WSPort:                    "5001",
+		MaxFrameBytes:             1024,
+		HexCase:                   HEX_CASE_LOWER,
+		KeepAlivePeriodSeconds:    30,
+		MaxConcurrentConnects:     2,
+		LogLevel:                  "info",
+	}
+}
 
-	// terminate server on port when disconnected
-	defer func(l net.Listener) {
-		l.Close()
-	}(l)
-	displayInfo("Starting Server... Listening on " + serverConf.Host + ":" + serverConf.Port)
+// Accepts clients on l, allowed restricts the commands they may use. A nil allowed permits every command.
+// A temporary accept error, e.g. running out of file descriptors, is retried with a growing delay; only a failed
+// listener stops the server.
+func acceptClients(l net.Listener, allowed map[string]bool) {
+	atomic.AddInt32(&acceptingListeners, 1)
+	defer atomic.AddInt32(&acceptingListeners, -1)
+	backoff := newBackoff(ACCEPT_RETRY_BASE, ACCEPT_RETRY_MAX)
 	for {
 		// Listen for an incoming connection.
 		conn, err := l.Accept()
-		displayInfo("Connection established.")
-
 		if err != nil {
+			// closed by the shutdown handler
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				delay := backoff.Next()
+				displayInfo("Accept failed: " + err.Error() + ", retrying in " + delay.String())
+				time.Sleep(delay)
+				continue
+			}
 			displayError(err.Error())
 		}
+		backoff.Reset()
+		if !accessList.Permits(conn.RemoteAddr()) {
+			displayInfo("Refusing connection from " + conn.RemoteAddr().String() + ".")
+			conn.Close()
+			continue
+		}
+		displayInfo("Connection established.")
+
+		// unix sockets have no keepalive, their peer is always on the same machine
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			setKeepAlive(tcp, serverConf.KeepAlivePeriodSeconds)
+		}
 		// Handle connections in a new goroutine.
-		go handleRequest(conn)
+		go handleRequest(conn, allowed)
+	}
+}
+
+// Probes an idle client every periodSeconds so a peer that vanished without closing the socket fails the pending
+// read and its vehicles are released, 0 turns keepalive off
+func setKeepAlive(conn *net.TCPConn, periodSeconds int) {
+	if periodSeconds <= 0 {
+		conn.SetKeepAlive(false)
+		return
+	}
+	conn.SetKeepAlive(true)
+	conn.SetKeepAlivePeriod(time.Duration(periodSeconds) * time.Second)
+}
+
+// The listeners to open, the top level host and port unless listeners are configured
+func configuredListeners(conf ServerConf) []ListenerConf {
+	if len(conf.Listeners) > 0 {
+		return conf.Listeners
+	}
+	return []ListenerConf{{Host: conf.Host, Port: conf.Port, Network: conf.Network, SocketPath: conf.SocketPath}}
+}
+
+// Set of the commands a listener permits, nil if it permits every command
+func permittedCommands(commands []string) map[string]bool {
+	if len(commands) == 0 {
+		return nil
+	}
+	allowed := make(map[string]bool)
+	for _, command := range commands {
+		allowed[strings.ToUpper(command)] = true
 	}
+	return allowed
 }
 
-// Handles the incoming requests from the tcp connection
-func handleRequest(conn net.Conn) {
+// Opens the listener described by the configuration
+func listen(conf ListenerConf) (net.Listener, error) {
+	if conf.Network == "unix" {
+		if conf.SocketPath == "" {
+			return nil, errors.New("socketPath must be set when network is unix")
+		}
+		// a socket file left behind by a previous run would make Listen fail
+		if err := os.Remove(conf.SocketPath); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", conf.SocketPath)
+	}
+	switch conf.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("network must be tcp, tcp4, tcp6 or unix")
+	}
+	network := conf.Network
+	if network == "" {
+		network = "tcp"
+	}
+	// JoinHostPort brackets IPv6 hosts
+	return net.Listen(network, net.JoinHostPort(conf.Host, conf.Port))
+}
+
+// Handles the incoming requests from the tcp connection, allowed restricts the commands the client may use
+func handleRequest(conn net.Conn, allowed map[string]bool) {
+	// turn away clients over the limit before they get a writer goroutine or any vehicle
+	defer atomic.AddInt32(&liveConnections, -1)
+	if live := atomic.AddInt32(&liveConnections, 1); serverConf.MaxConnections > 0 && int(live) > serverConf.MaxConnections {
+		displayInfo("Rejecting " + conn.RemoteAddr().String() + ", " + strconv.Itoa(serverConf.MaxConnections) + " clients are connected already.")
+		conn.Write([]byte("ERROR;server-full\n"))
+		conn.Close()
+		return
+	}
+
+	client := newClientConn(conn)
+	client.allowed = allowed
+	countStat(&stats.ConnectionsServed)
+
+	// set while the rest of an oversized frame is arriving
+	oversized := false
+
+	// Frames are split at their newline. The reader holds one byte more than allowed to detect oversized frames, the
+	// slices it returns are reused by the next read, so frames are copied out before they are handed to another
+	// goroutine
+	reader := bufio.NewReaderSize(conn, serverConf.MaxFrameBytes+1)
 
 	// Keep grabbing messages from tcp connection until server termination
 	for {
-		// Read the incoming connection into the buffer.
-		buf := make([]byte, 1024)
-		_, err := conn.Read(buf)
-		// if err, then probably a client disconnect
-		if err != nil {
-			displayInfo("Client disconnect? Disconnecting all devices...")
-			for _, device := range server.ConnectedDevices.Items() {
-				device.Disconnect()
+		// every message slides the deadline, PING keeps an otherwise quiet client connected
+		client.slideDeadline()
+		line, err := reader.ReadSlice('\n')
+		// if err, then probably a client disconnect. A last frame without its newline is still handled
+		if err != nil && err != bufio.ErrBufferFull && (err != io.EOF || len(line) == 0) {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				displayInfo("Client " + conn.RemoteAddr().String() + " silent for " + client.ReadTimeout().String() + ", closing.")
+				conn.Write([]byte("ERROR;read-timeout\n"))
 			}
-			server.ConnectedDevices = cmap.New[*bluetooth.Device]()
-			conn.Close()
+			displayInfo("Client disconnect? Disconnecting devices no other client is using...")
+			for _, address := range releaseClient(client) {
+				teardownVehicle(address, nil)
+			}
+			client.Close()
+			// the client itself no longer receives it, it left the client list on Close
+			broadcastEvent("CLIENT_GONE", conn.RemoteAddr().String())
 			return
 		}
+		// reject an oversized frame instead of handling it truncated, and drop the remainder up to its newline
+		if err == bufio.ErrBufferFull || len(line) > serverConf.MaxFrameBytes {
+			if !oversized {
+				conn.Write([]byte("ERROR;frame-too-large\n"))
+			}
+			oversized = err == bufio.ErrBufferFull
+			continue
+		}
+		if oversized {
+			oversized = false
+			continue
+		}
+		// the next read overwrites line while this frame may still be queued or handled
+		frame := string(line)
+		set := splitFrame(client.Protocol(), frame)
+		auditCommand(conn.RemoteAddr().String(), set)
 
-		// Create a goroutine for incoming msg and listen for the next msg
-		go func(buf []byte) {
-			// parsing msg so the payload can go to the vehicle - payload is at index [1]
-			re, _ := regexp.Compile(";")
-			split := re.Split(string(buf), -1)
-			var set []string
+		// commands for the same vehicle are applied in the order they were received, everything else runs concurrently
+		if address, ok := commandTarget(set); ok {
+			if !commandQueue(address).Enqueue(func() { handleFrame(client, frame, set) }) {
+				conn.Write([]byte("ERROR;queue-full\n"))
+			}
+			continue
+		}
+		switch verb := requestVerb(set); {
+		// an emergency stop must not wait for a worker, nor behind a scan, nor hold up the reader
+		case URGENT_VERBS[verb]:
+			if !client.urgentCommands.Enqueue(func() { handleFrame(client, frame, set) }) {
+				conn.Write([]byte("ERROR;queue-full\n"))
+			}
+		// the protocol version it selects splits the next frame already
+		case verb == "HELLO":
+			handleFrame(client, frame, set)
+		// commands that take seconds only hold up their own client
+		case SLOW_VERBS[verb]:
+			if !client.slowCommands.Enqueue(func() { handleFrame(client, frame, set) }) {
+				conn.Write([]byte("ERROR;queue-full\n"))
+			}
+		default:
+			dispatchJob(func() { handleFrame(client, frame, set) })
+		}
+	}
+}
 
-			for i := range split {
-				set = append(set, strings.Replace(split[i], "\n", "", -1))
+// Handles a single message received from a tcp client. Failed requests have been answered already, the error
+// is only logged. Commands still queued when the client goes away are dropped.
+func handleFrame(client *ClientConn, frame string, set []string) {
+	if client.Context().Err() != nil {
+		return
+	}
+	if err := dispatch(client, client, frame, set); err != nil {
+		displayInfo("Request failed: " + err.Error())
+	}
+}
+
+// Passes the request in frame, split into set, through the middleware chain to handleCommand, which performs it on
+// behalf of client and writes the responses to conn
+func dispatch(client *ClientConn, conn io.Writer, frame string, set []string) error {
+	return commandHandler(&Request{Client: client, Conn: conn, Frame: frame, Set: set, Verb: requestVerb(set)})
+}
+
+// Performs a request that made it through the middleware chain
+func handleCommand(req *Request) error {
+	client, conn, frame, set := req.Client, req.Conn, req.Frame, req.Set
+	address := set[0]
+	var msg string
+
+	if len(set) > 1 {
+		msg = set[1]
+	}
+
+	if serverConf.StrictCommands && !recognizedCommand(set) {
+		conn.Write([]byte("ERROR;unknown-command;" + set[0] + "\n"))
+		return nil
+	}
+
+	// Perform different actions based on the tcp msg received from ANKI SDK
+	switch {
+	// HELLO request, HELLO;<version> selects the protocol version for the following messages
+	case set[0] == "HELLO":
+		requested, err := strconv.Atoi(field(set, 1))
+		if err != nil || requested < PROTOCOL_V1 {
+			conn.Write([]byte("HELLO;FAILED;invalid-version\n"))
+			return nil
+		}
+		version := negotiateProtocol(requested)
+		client.SetProtocol(version)
+		conn.Write([]byte("HELLO;" + strconv.Itoa(version) + "\n"))
+
+	// CAPABILITIES request, the newest protocol version, the supported verbs and the decoded vehicle messages
+	case set[0] == "CAPABILITIES":
+		conn.Write(response(capabilitiesReport(), field(set, 1)))
+
+	// LOGLEVEL request, LOGLEVEL;<DEBUG|INFO|ERROR> changes the console log level, answered with the new level.
+	// Listeners with allowedCommands only permit it if it is listed
+	case set[0] == "LOGLEVEL":
+		if !setLogLevel(field(set, 1)) {
+			conn.Write(response("LOGLEVEL;FAILED;invalid-level", field(set, 2)))
+			return nil
+		}
+		conn.Write(response("LOGLEVEL;"+logLevelName(), field(set, 2)))
+
+	// PING request, answered right away so a client can check the connection and keep its read deadline from expiring
+	case set[0] == "PING":
+		conn.Write(response("PONG", field(set, 1)))
+
+	// READ_TIMEOUT request, READ_TIMEOUT;<seconds> closes this client once it stays silent that long, 0 never does
+	case set[0] == "READ_TIMEOUT":
+		seconds, err := strconv.Atoi(field(set, 1))
+		if err != nil || seconds < 0 {
+			conn.Write(response("READ_TIMEOUT;FAILED;invalid-timeout", field(set, 2)))
+			return nil
+		}
+		client.SetReadTimeout(time.Duration(seconds) * time.Second)
+		conn.Write(response("READ_TIMEOUT;SUCCESS", field(set, 2)))
+
+	// SCAN request from java
+	case set[0] == "SCAN":
+		displayInfo("Scanning...")
+		// call scan function to search for nearby vehicles
+		devices, err := scan(serverConf.MaxScanResults)
+		if err != nil {
+			displayInfo("Scan failed: " + err.Error())
+			conn.Write(encodeMessage(ScanFailedMessage{Type: "scan-failed", Reason: err.Error()}))
+			conn.Write(encodeMessage(ScanCompletedMessage{Type: "scan-completed", ReqId: field(set, 1)}))
+			return nil
+		}
+		mergeDiscoveredDevices(devices)
+		sendDiscoveredDevices(conn, field(set, 1))
+		displayInfo("Scanning Completed.")
+		return nil
+
+	// DISCOVERED request, replays the vehicles found by the last scan without scanning again
+	case set[0] == "DISCOVERED":
+		sendDiscoveredDevices(conn, field(set, 1))
+
+	// DETAILS request, the advertised local name and manufacturer data of a discovered vehicle
+	case set[0] == "DETAILS" && len(set) >= 2:
+		device, ok := server.DiscoveredDevices.Get(normalizeAddress(set[1]))
+		if !ok {
+			conn.Write(response("DETAILS;FAILED;unknown-address", field(set, 2)))
+			return nil
+		}
+		conn.Write(response(vehicleDetails(device), field(set, 2)))
+
+	// VEHICLE request, VEHICLE;<address> reports everything the server tracks about a single vehicle
+	case set[0] == "VEHICLE" && len(set) >= 2:
+		info, ok := vehicleInfo(normalizeAddress(set[1]), field(set, 2))
+		if !ok {
+			conn.Write(response("VEHICLE;FAILED;unknown-address", field(set, 2)))
+			return nil
+		}
+		conn.Write(encodeMessage(info))
+
+	// LIST request, reports the lifecycle state of every vehicle the server knows about
+	case set[0] == "LIST":
+		for address, state := range server.VehicleStates.Items() {
+			conn.Write([]byte("LIST;" + address + ";" + state.String() + "\n"))
+		}
+		conn.Write(response("LIST;COMPLETED", field(set, 1)))
+
+	// LIGHTS request, LIGHTS;<address>;<light>;<ON|OFF> or LIGHTS;<address>;PATTERN;<channel>;<effect>;<start>;<end>;<cycles>
+	case set[0] == "LIGHTS":
+		fields, _ := requestFields(set)
+		set, reqId := splitReqId(set, fields)
+		payload, ok := encodeLightsCommand(set)
+		if !ok {
+			conn.Write(response("ERROR;invalid-lights", reqId))
+			return nil
+		}
+		sendCommand(conn, "LIGHTS", normalizeAddress(set[1]), payload, reqId)
+
+	// LIGHTPATTERN request, LIGHTPATTERN;<address>;<channel>;<effect>;<start>;<end>;<cycles per 10 seconds>
+	case set[0] == "LIGHTPATTERN":
+		set, reqId := splitReqId(set, 7)
+		if len(set) < 2 {
+			conn.Write(response("ERROR;invalid-lights", reqId))
+			return nil
+		}
+		payload, ok := encodeLightPatternCommand(set[2:])
+		if !ok {
+			conn.Write(response("ERROR;invalid-lights", reqId))
+			return nil
+		}
+		sendCommand(conn, "LIGHTPATTERN", normalizeAddress(set[1]), payload, reqId)
+
+	// TURN request, TURN;<address>;<LEFT|RIGHT|UTURN|UTURN_JUMP>[;<IMMEDIATE|INTERSECTION>]
+	case set[0] == "TURN":
+		fields, _ := requestFields(set)
+		set, reqId := splitReqId(set, fields)
+		if len(set) < 3 || len(set) > 4 {
+			conn.Write(response("ERROR;invalid-turn", reqId))
+			return nil
+		}
+		turnType, ok := TURN_NAMES[set[2]]
+		trigger := byte(TURN_TRIGGER_IMMEDIATE)
+		if ok && len(set) == 4 {
+			trigger, ok = TURN_TRIGGER_NAMES[set[3]]
+		}
+		if !ok {
+			conn.Write(response("ERROR;invalid-turn", reqId))
+			return nil
+		}
+		sendCommand(conn, "TURN", normalizeAddress(set[1]), EncodeTurn(turnType, trigger), reqId)
+
+	// LANE_CANCEL request, LANE_CANCEL;<address> aborts a lane change in progress
+	case set[0] == "LANE_CANCEL":
+		set, reqId := splitReqId(set, 2)
+		if len(set) != 2 {
+			conn.Write(response("ERROR;invalid-lane-cancel", reqId))
+			return nil
+		}
+		sendCommand(conn, "LANE_CANCEL", normalizeAddress(set[1]), EncodeCancelLaneChange(), reqId)
+
+	// GATT request, the characteristics discovered for a connected vehicle
+	case set[0] == "GATT" && len(set) >= 2:
+		address := normalizeAddress(set[1])
+		characteristics, ok := server.DeviceCharacteristics.Get(address)
+		if !ok {
+			conn.Write(response("GATT;FAILED;not-connected", field(set, 2)))
+			return nil
+		}
+		// tinygo does not expose the characteristic properties, report how the server uses each one
+		conn.Write([]byte("GATT;" + address + ";" + characteristics.Writer.UUID().String() + ";write-without-response\n"))
+		conn.Write([]byte("GATT;" + address + ";" + characteristics.Reader.UUID().String() + ";notify\n"))
+		conn.Write(response("GATT;COMPLETED", field(set, 2)))
+
+	// REDISCOVER request, looks up the ANKI characteristics of a connected vehicle again without reconnecting it
+	case set[0] == "REDISCOVER" && len(set) >= 2:
+		address := normalizeAddress(set[1])
+		if err := rediscoverVehicle(address); err != nil {
+			conn.Write(response("REDISCOVER;FAILED;"+err.Error(), field(set, 2)))
+			return err
+		}
+		conn.Write(response("REDISCOVER;SUCCESS", field(set, 2)))
+
+	// READ request, a GATT read of the vehicle's read characteristic for values that are not notified
+	case set[0] == "READ" && len(set) >= 2:
+		address := normalizeAddress(set[1])
+		value, err := readFromVehicle(address)
+		if err != nil {
+			conn.Write(response("READ;FAILED;"+err.Error(), field(set, 2)))
+			return err
+		}
+		conn.Write(response(address+";READ;"+encodeHex(value), field(set, 2)))
+
+	// HISTORY request, the last commands written to a connected vehicle, oldest first
+	case set[0] == "HISTORY" && len(set) >= 2:
+		address := normalizeAddress(set[1])
+		if !server.ConnectedDevices.Has(address) {
+			conn.Write(response("HISTORY;FAILED;not-connected", field(set, 2)))
+			return nil
+		}
+		if history, ok := server.CommandHistories.Get(address); ok {
+			for _, entry := range history.Entries() {
+				conn.Write([]byte(historyLine(address, entry) + "\n"))
 			}
+		}
+		conn.Write(response("HISTORY;COMPLETED", field(set, 2)))
+
+	// ALIAS request, ALIAS;<address>;<name> lets every later command name the vehicle instead of giving its address
+	case set[0] == "ALIAS" && len(set) >= 3:
+		address := normalizeAddress(set[1])
+		if !server.DiscoveredDevices.Has(address) {
+			conn.Write(response("ALIAS;FAILED;not-discovered", field(set, 3)))
+			return nil
+		}
+		// names that look like a verb or an address would make messages ambiguous
+		name := strings.TrimSpace(set[2])
+		if name == "" || verbPattern.MatchString(name) || strings.Contains(name, ":") {
+			conn.Write(response("ALIAS;FAILED;invalid-name", field(set, 3)))
+			return nil
+		}
+		server.Aliases.Set(name, address)
+		conn.Write(response("ALIAS;SUCCESS", field(set, 3)))
+		displayInfo(address + " aliased as " + name + ".")
+
+	// QUERY_SPEED request, the speed of the vehicle's latest position update
+	case set[0] == "QUERY_SPEED" && len(set) >= 2:
+		address := normalizeAddress(set[1])
+		if !server.ConnectedDevices.Has(address) {
+			conn.Write(response("ERROR;not-connected;"+address, field(set, 2)))
+			return nil
+		}
+		conn.Write(response(speedReport(address), field(set, 2)))
+
+	// QUERY_OFFSET request, the offset from the road center the vehicle reported last
+	case set[0] == "QUERY_OFFSET" && len(set) >= 2:
+		address := normalizeAddress(set[1])
+		if !server.ConnectedDevices.Has(address) {
+			conn.Write(response("ERROR;not-connected;"+address, field(set, 2)))
+			return nil
+		}
+		conn.Write(response(offsetReport(address), field(set, 2)))
 
-			address := set[0]
-			var msg string
+	// LANEKEEP request, LANEKEEP;<address>;<target offset from road center in mm> or LANEKEEP;<address>;OFF
+	case set[0] == "LANEKEEP":
+		set, reqId := splitReqId(set, 3)
+		if len(set) != 3 {
+			conn.Write(response("ERROR;invalid-offset", reqId))
+			return nil
+		}
+		address := normalizeAddress(set[1])
+		if !server.DeviceCharacteristics.Has(address) {
+			conn.Write(response("LANEKEEP;FAILED;not-connected", reqId))
+			return nil
+		}
+		if set[2] == "OFF" {
+			server.LaneKeepers.Remove(address)
+			conn.Write(response("LANEKEEP;SUCCESS", reqId))
+			return nil
+		}
+		target, err := strconv.ParseFloat(set[2], 32)
+		if err != nil {
+			conn.Write(response("ERROR;invalid-offset", reqId))
+			return nil
+		}
+		server.LaneKeepers.Set(address, &LaneKeeper{TargetMm: float32(target)})
+		conn.Write(response("LANEKEEP;SUCCESS", reqId))
 
-			if len(set) > 1 {
-				msg = set[1]
+	// OFFSETLIMIT request, OFFSETLIMIT;<address>;<min offset>;<max offset> in mm or OFFSETLIMIT;<address>;OFF
+	case set[0] == "OFFSETLIMIT":
+		fields, _ := requestFields(set)
+		set, reqId := splitReqId(set, fields)
+		if len(set) != 3 && len(set) != 4 {
+			conn.Write(response("ERROR;invalid-offset", reqId))
+			return nil
+		}
+		address := normalizeAddress(set[1])
+		if !server.DeviceCharacteristics.Has(address) {
+			conn.Write(response("OFFSETLIMIT;FAILED;not-connected", reqId))
+			return nil
+		}
+		if len(set) == 3 {
+			if set[2] != "OFF" {
+				conn.Write(response("ERROR;invalid-offset", reqId))
+				return nil
 			}
+			server.OffsetLimits.Remove(address)
+			conn.Write(response("OFFSETLIMIT;SUCCESS", reqId))
+			return nil
+		}
+		minMm, minErr := strconv.ParseFloat(set[2], 32)
+		maxMm, maxErr := strconv.ParseFloat(set[3], 32)
+		if minErr != nil || maxErr != nil || minMm > maxMm {
+			conn.Write(response("ERROR;invalid-offset", reqId))
+			return nil
+		}
+		server.OffsetLimits.Set(address, OffsetLimit{MinMm: float32(minMm), MaxMm: float32(maxMm)})
+		conn.Write(response("OFFSETLIMIT;SUCCESS", reqId))
 
-			// Perform different actions based on the tcp msg received from ANKI SDK
-			switch {
-			// SCAN request from java
-			case strings.Contains(string(buf), "SCAN"):
-				displayInfo("Scanning...")
-				// call scan function to search for nearby vehicles
-				server.DiscoveredDevices = scan()
-				for _, device := range server.DiscoveredDevices.Items() {
-					// for each found device, send a tcp msg to java saying found
-					conn.Write([]byte("SCAN;" + device.Address + ";" + device.ManufacturerData + ";" + device.LocalName + "\n"))
-
-					displayInfo("Found device: " + device.Address)
-					time.Sleep(500 * time.Millisecond)
-				}
-				// Stops scanning on java side
-				conn.Write([]byte("SCAN;COMPLETED\n"))
-				fmt.Println(ANSI_GREEN + "Scanning Completed." + ANSI_RESET)
-				return
+	// OFFSET request, OFFSET;<address>;<offset from road center in mm>
+	case set[0] == "OFFSET":
+		set, reqId := splitReqId(set, 3)
+		if len(set) != 3 {
+			conn.Write(response("ERROR;invalid-offset", reqId))
+			return nil
+		}
+		offset, err := strconv.ParseFloat(set[2], 32)
+		if err != nil {
+			conn.Write(response("ERROR;invalid-offset", reqId))
+			return nil
+		}
+		sendCommand(conn, "OFFSET", normalizeAddress(set[1]), EncodeSetOffset(float32(offset)), reqId)
+
+	// BATCH request, several raw ANKI messages written in order with a single acknowledgement
+	case set[0] == "BATCH":
+		set, reqId := splitReqId(set, 3)
+		if len(set) != 3 || set[2] == "" {
+			conn.Write(response("ERROR;invalid-batch", reqId))
+			return nil
+		}
+		var payloads [][]byte
+		for _, encoded := range strings.Split(set[2], ",") {
+			payload, err := hex.DecodeString(encoded)
+			if err != nil || len(payload) == 0 {
+				conn.Write(response("ERROR;invalid-batch", reqId))
+				return nil
+			}
+			payloads = append(payloads, payload)
+		}
+		sendBatch(conn, "BATCH", normalizeAddress(set[1]), payloads, reqId)
 
-			//DISCONNECT request from java
-			case strings.Contains(string(buf), "DISCONNECT"):
+	// RESET request, RESET;<address> brings the vehicle back to a known-safe state and ends lane keeping
+	case set[0] == "RESET":
+		set, reqId := splitReqId(set, 2)
+		if len(set) != 2 {
+			conn.Write(response("ERROR;invalid-reset", reqId))
+			return nil
+		}
+		address := normalizeAddress(set[1])
+		// lane keeping would steer the vehicle away from the new road center again
+		server.LaneKeepers.Remove(address)
+		sendBatch(conn, "RESET", address, EncodeResetSequence(), reqId)
 
-				// disconnect the vehicle with the address in the buffer
-				address := string(bytes.Trim([]byte(set[1]), "\x00"))
-				connectedDevice, ok := server.ConnectedDevices.Get(address)
-				if !ok {
-					displayError("Address: " + address + " could not be found.")
-				}
-				connectedDevice.Disconnect()
-				server.ConnectedDevices.Remove(address)
+	// SUBSCRIBE_EVENTS request, start receiving EVENT frames when any vehicle connects or disconnects
+	case set[0] == "SUBSCRIBE_EVENTS":
+		client.SubscribeEvents(true)
+		conn.Write(response("SUBSCRIBE_EVENTS;SUCCESS", field(set, 1)))
 
-				conn.Write([]byte("DISCONNECT;SUCCESS\n"))
-				displayInfo(address + " Disconnected.")
+	case set[0] == "UNSUBSCRIBE_EVENTS":
+		client.SubscribeEvents(false)
+		conn.Write(response("UNSUBSCRIBE_EVENTS;SUCCESS", field(set, 1)))
 
-			// CONNECT request from java
-			case strings.Contains(set[0], "CONNECT"):
-				// ignore 0x0 fillers
-				payload := bytes.Trim([]byte(set[1]), "\x00")
+	// RAW;ON or RAW;OFF, whether the client receives the <address>;<hex> of every notification alongside decoded frames
+	case set[0] == "RAW":
+		switch field(set, 1) {
+		case "ON":
+			client.ForwardRaw(true)
+		case "OFF":
+			client.ForwardRaw(false)
+		default:
+			conn.Write(response("RAW;FAILED;invalid-mode", field(set, 2)))
+			return nil
+		}
+		conn.Write(response("RAW;SUCCESS", field(set, 2)))
 
-				device, _ := server.DiscoveredDevices.Get(string(payload))
+	// ENCODING request, ENCODING;COMPACT|TEXT selects how position and transition updates are sent to this client
+	case set[0] == "ENCODING":
+		switch field(set, 1) {
+		case ENCODING_COMPACT:
+			// WebSocket clients only receive text messages, which binary frames are not
+			if _, ok := client.Conn.(*WebSocketConn); ok {
+				conn.Write(response("ENCODING;FAILED;unsupported", field(set, 2)))
+				return nil
+			}
+			client.SetCompact(true)
+		case ENCODING_TEXT:
+			client.SetCompact(false)
+		default:
+			conn.Write(response("ENCODING;FAILED;invalid-encoding", field(set, 2)))
+			return nil
+		}
+		conn.Write(response("ENCODING;SUCCESS", field(set, 2)))
 
-				// connect to device
-				connectedDevice, err := Adapter.Connect(device.Addresser, bluetooth.ConnectionParams{})
-				if err != nil {
-					displayError(err.Error())
-				}
+	// NOTIFY request, NOTIFY;<address>;ON|OFF turns the notifications of a connected vehicle on or off for every client
+	case set[0] == "NOTIFY" && len(set) >= 2:
+		address := normalizeAddress(set[1])
+		if !server.ConnectedDevices.Has(address) {
+			conn.Write(response("NOTIFY;FAILED;not-connected", field(set, 3)))
+			return nil
+		}
+		switch field(set, 2) {
+		case "ON":
+			server.NotificationsOff.Remove(address)
+		case "OFF":
+			server.NotificationsOff.Set(address, true)
+		default:
+			conn.Write(response("NOTIFY;FAILED;invalid-mode", field(set, 3)))
+			return nil
+		}
+		conn.Write(response("NOTIFY;SUCCESS", field(set, 3)))
 
-				// add device to concurrent map of devices
-				server.ConnectedDevices.Set(device.Address, connectedDevice)
-				fmt.Println(ANSI_GREEN + "Connected to " + device.Address + ANSI_RESET)
+	// PAUSE request, hold the commands for a vehicle until RESUME
+	case set[0] == "PAUSE" && len(set) >= 2:
+		address := normalizeAddress(set[1])
+		if !server.ConnectedDevices.Has(address) {
+			conn.Write(response("PAUSE;FAILED;not-connected", field(set, 2)))
+			return nil
+		}
+		commandQueue(address).Pause()
+		conn.Write(response("PAUSE;SUCCESS", field(set, 2)))
 
-				services, _ := connectedDevice.DiscoverServices([]bluetooth.UUID{ANKI_STR_SERVICE_UUID})
-				if err != nil {
-					displayInfo(err.Error())
-				}
+	// RESUME request, write the commands held since PAUSE in order
+	case set[0] == "RESUME" && len(set) >= 2:
+		address := normalizeAddress(set[1])
+		if !server.ConnectedDevices.Has(address) {
+			conn.Write(response("RESUME;FAILED;not-connected", field(set, 2)))
+			return nil
+		}
+		pending := commandQueue(address).Resume()
+		conn.Write(response("RESUME;SUCCESS;"+strconv.Itoa(pending), field(set, 2)))
+
+	// SUBSCRIBE request, start receiving notifications of an already connected vehicle
+	case set[0] == "SUBSCRIBE" && len(set) >= 2:
+		address := normalizeAddress(set[1])
+		if !server.ConnectedDevices.Has(address) {
+			conn.Write(response("SUBSCRIBE;FAILED;not-connected", field(set, 2)))
+			return nil
+		}
+		subscribeVehicle(address, client)
+		conn.Write(response("SUBSCRIBE;SUCCESS", field(set, 2)))
+
+	// UNSUBSCRIBE request, stop receiving notifications without dropping the BLE link
+	case set[0] == "UNSUBSCRIBE" && len(set) >= 2:
+		unsubscribeVehicle(normalizeAddress(set[1]), client)
+		conn.Write(response("UNSUBSCRIBE;SUCCESS", field(set, 2)))
+
+	// STATUS request, reports whether the BLE adapter is usable and how many vehicles are connected
+	case set[0] == "STATUS":
+		adapter := "not-ready"
+		if adapterReady() {
+			adapter = "ready"
+		}
+		conn.Write(encodeMessage(StatusMessage{
+			Type:      "status",
+			Adapter:   adapter,
+			Connected: server.ConnectedDevices.Count(),
+			ReqId:     field(set, 1),
+		}))
+
+	// TXPOWER request, TXPOWER reports the adapter's transmit power in dBm and TXPOWER;<dBm> changes it to one of
+	// TX_POWER_LEVELS. The BLE stack can't do either, only the sim adapter supports it. A query with a request id
+	// leaves the power empty, TXPOWER;;<reqId>
+	case set[0] == "TXPOWER":
+		reqId := field(set, 2)
+		if field(set, 1) == "" {
+			power, err := Adapter.TxPower()
+			if err != nil {
+				conn.Write(response("TXPOWER;FAILED;"+err.Error(), reqId))
+				return nil
+			}
+			conn.Write(response("TXPOWER;"+strconv.Itoa(power), reqId))
+			return nil
+		}
+		power, err := strconv.Atoi(set[1])
+		if err != nil || !validTxPower(power) {
+			conn.Write(response("TXPOWER;FAILED;invalid-power", reqId))
+			return nil
+		}
+		if err := Adapter.SetTxPower(power); err != nil {
+			conn.Write(response("TXPOWER;FAILED;"+err.Error(), reqId))
+			return nil
+		}
+		displayInfo("Transmit power set to " + set[1] + " dBm.")
+		conn.Write(response("TXPOWER;SUCCESS", reqId))
+
+	// SELFTEST request, checks the adapter, a scan and the listeners and reports each one
+	case set[0] == "SELFTEST":
+		conn.Write(response(selfTest(), field(set, 1)))
 
-				// Getting the writers and readers services
-				service := services[0]
-				characteristics, _ := service.DiscoverCharacteristics([]bluetooth.UUID{ANKI_STR_CHR_READ_UUID, ANKI_STR_CHR_WRITE_UUID})
-				server.DeviceCharacteristics.Set(device.Address, characteristics)
-
-				readService := characteristics[1]
-
-				// Each time the vehicle sends a msg through bluetooth, the event is triggered
-				readService.EnableNotifications(func(value []byte) {
-					encodedBytes := hex.EncodeToString(value)
-					// Send the vehicle respond back to java
-					conn.Write([]byte(device.Address + ";" + encodedBytes + "\n"))
-					displayInfo("RECEIVED: [" + device.Address + ";" + encodedBytes + "]")
-				})
-
-				// terminate connection request to java
-				conn.Write([]byte("CONNECT;SUCCESS\n"))
-				fmt.Println(ANSI_GREEN + "CONNECT COMPLETED." + ANSI_RESET)
-
-			/* Any other request is assumed to be a command given to the car. Each byte in the buffer represents an action that is
-			outlined in https://github.com/tenbergen/anki-drive-java/blob/master/Anki%20Drive%20Programming%20Guide.pdf
-			*/
-			default:
-				if len(set) == 2 {
-					// Get the writer characteristic
-					characteristics, _ := server.DeviceCharacteristics.Get(address)
-					writeService := characteristics[0]
-					payload, _ := hex.DecodeString(msg)
-
-					// write payload to anki vehicle
-					_, err := writeService.WriteWithoutResponse(payload)
-					if err != nil {
-						displayError(err.Error())
-					}
-
-					displayInfo("SENDING: [" + strings.Replace(string(buf), "\n", "", -1) + "]")
+	// STATS request, uptime and counters since the server started
+	case set[0] == "STATS":
+		conn.Write(encodeMessage(statsMessage(field(set, 1))))
+
+	// SPEED_ALL request, SPEED_ALL;<speed>;<acceleration> sets the same speed on every connected vehicle at once
+	case set[0] == "SPEED_ALL":
+		speed, speedErr := strconv.ParseInt(field(set, 1), 10, 16)
+		accel, accelErr := strconv.ParseInt(field(set, 2), 10, 16)
+		if speedErr != nil || accelErr != nil {
+			conn.Write(response("ERROR;invalid-speed", field(set, 3)))
+			return nil
+		}
+		updated, failures := writeToAll(EncodeSetSpeed(int16(speed), int16(accel)), true)
+		for address, err := range failures {
+			conn.Write([]byte("SPEED_ALL;FAILED;" + address + ";" + err.Error() + "\n"))
+		}
+		conn.Write(response("SPEED_ALL;DONE;"+strconv.Itoa(updated), field(set, 3)))
+
+	// ESTOP request, stops every connected vehicle at once, bypassing the rate limiter
+	case set[0] == "ESTOP":
+		stopped, failures := emergencyStop()
+		for address, err := range failures {
+			conn.Write([]byte("ESTOP;FAILED;" + address + ";" + err.Error() + "\n"))
+		}
+		conn.Write(response("ESTOP;DONE;"+strconv.Itoa(stopped), field(set, 1)))
+		displayInfo("Emergency stop, " + strconv.Itoa(stopped) + " vehicles stopped.")
+
+	// DISCONNECT_ALL request, drops every vehicle regardless of which clients are using it
+	case set[0] == "DISCONNECT_ALL":
+		count := 0
+		for _, address := range server.ConnectedDevices.Keys() {
+			notice := encodeMessage(VehicleEventMessage{Type: "event", Address: address, Event: "DISCONNECTED"})
+			if err := teardownVehicleWithin(address, notice, URGENT_LOCK_TIMEOUT); err == errVehicleBusy {
+				conn.Write([]byte("DISCONNECT_ALL;FAILED;" + address + ";" + err.Error() + "\n"))
+				continue
+			} else if err != nil {
+				displayInfo("Disconnecting " + address + " failed: " + err.Error())
+			}
+			count++
+		}
+		conn.Write(response("DISCONNECT_ALL;DONE;"+strconv.Itoa(count), field(set, 1)))
+		displayInfo(strconv.Itoa(count) + " vehicles disconnected.")
+
+	//DISCONNECT request from java
+	case set[0] == "DISCONNECT":
+		if field(set, 1) == "" {
+			conn.Write(response("ERROR;missing-address", field(set, 2)))
+			return errors.New("DISCONNECT without an address")
+		}
+
+		// disconnect the vehicle with the address in the buffer
+		address := normalizeAddress(set[1])
+		if !server.ConnectedDevices.Has(address) {
+			conn.Write(response("DISCONNECT;FAILED;not-connected", field(set, 2)))
+			return errors.New("address " + address + " could not be found")
+		}
+
+		// only drop the BLE link once no other client is using the vehicle
+		if releaseVehicle(address, client) {
+			teardownVehicle(address, nil)
+			displayInfo(address + " Disconnected.")
+		} else {
+			displayInfo(address + " released, still in use by other clients.")
+		}
+		conn.Write(response("DISCONNECT;SUCCESS", field(set, 2)))
+
+	// CONNECT request from java
+	case set[0] == "CONNECT":
+		if field(set, 1) == "" {
+			conn.Write(response("ERROR;missing-address", field(set, 2)))
+			return errors.New("CONNECT without an address")
+		}
+		// ignore 0x0 fillers
+		payload := normalizeAddress(set[1])
+
+		device, ok := server.DiscoveredDevices.Get(payload)
+		if !ok {
+			conn.Write(response("CONNECT;FAILED;not-discovered", field(set, 2)))
+			return errors.New("address " + payload + " was not discovered")
+		}
+
+		first, already, connecting := acquireVehicle(device.Address, client)
+		// this client connected the vehicle before, don't leak a second link and notification callback
+		if already {
+			conn.Write(response("CONNECT;ALREADY", field(set, 2)))
+			displayInfo(device.Address + " already connected.")
+			return nil
+		}
+		// another client holds the link or is establishing it, share it instead of connecting twice
+		if !first {
+			if err := connecting.Wait(); err != nil {
+				abandonVehicle(device.Address, client)
+				conn.Write(response("CONNECT;FAILED;"+err.Error(), field(set, 2)))
+				return err
+			}
+			conn.Write(response("CONNECT;SUCCESS", field(set, 2)))
+			displayInfo(device.Address + " shared with another client.")
+			return nil
+		}
+
+		err := establishVehicle(device)
+		connecting.Finish(err)
+		if err != nil {
+			abandonVehicle(device.Address, client)
+			countStat(&stats.ConnectFailures)
+			conn.Write(response("CONNECT;FAILED;"+err.Error(), field(set, 2)))
+			return err
+		}
+
+		// terminate connection request to java
+		conn.Write(response("CONNECT;SUCCESS", field(set, 2)))
+		displayInfo("CONNECT COMPLETED.")
+
+	/* Any other request is assumed to be a command given to the car. Each byte in the buffer represents an action that is
+	outlined in https://github.com/tenbergen/anki-drive-java/blob/master/Anki%20Drive%20Programming%20Guide.pdf
+	*/
+	default:
+		// <address>;<hex>;ACK asks for the write result to be reported back
+		if len(set) == 2 || (len(set) == 3 && set[2] == "ACK") {
+			address = normalizeAddress(address)
+			acknowledge := serverConf.WriteWithResponse || field(set, 2) == "ACK"
+
+			if !server.DeviceCharacteristics.Has(address) {
+				// typos and aliases that were never set end up here too, tell them apart from a vehicle not connected yet
+				if !server.DiscoveredDevices.Has(address) && !server.VehicleStates.Has(address) {
+					conn.Write([]byte("ERROR;unknown-target;" + address + "\n"))
+					return nil
 				}
+				conn.Write([]byte("ERROR;not-connected;" + address + "\n"))
+				return nil
+			}
+			payload, err := hex.DecodeString(msg)
+			if serverConf.ValidateFraming && (err != nil || !ValidFraming(payload)) {
+				conn.Write([]byte("ERROR;bad-framing\n"))
+				return nil
+			}
+
+			// write payload to anki vehicle
+			if acknowledge {
+				result, pending := writeWithResponse(address, payload)
+				conn.Write(result)
+				displayDebug("SENDING: [" + strings.Replace(frame, "\n", "", -1) + "]")
+				// the vehicle's next commands wait in its queue until the stack let go of a timed out write, so
+				// they still reach the vehicle after it
+				<-pending
+				return nil
 			}
-		}(buf)
+			pending, err := writeWithRetry(address, payload, time.Duration(serverConf.CommandTimeoutMillis)*time.Millisecond)
+			if err != nil {
+				go checkAdapter()
+				displayInfo("Command to " + address + " failed: " + err.Error())
+				conn.Write([]byte(address + ";COMMAND;FAILED;" + err.Error() + "\n"))
+				<-pending
+				return nil
+			}
+
+			displayDebug("SENDING: [" + strings.Replace(frame, "\n", "", -1) + "]")
+		}
 	}
+	return nil
 }
 
-// function for scanning nearby vehicles returns a map of addresses to vehicles
-func scan() cmap.ConcurrentMap[string, AnkiVehicle] {
+// function for scanning nearby vehicles returns a map of addresses to vehicles, ending early once maxResults were
+// found unless it is 0
+func scan(maxResults int) (cmap.ConcurrentMap[string, AnkiVehicle], error) {
 	devicesFound := cmap.New[AnkiVehicle]()
 
-	channel := make(chan string, 1)
+	// the adapter is enabled once at startup
+	if !adapterReady() {
+		return devicesFound, errors.New("adapter-not-ready")
+	}
+
+	// the BLE stack runs a single scan at a time, concurrent SCAN requests take turns
+	scanMutex.Lock()
+	defer scanMutex.Unlock()
+	countStat(&stats.Scans)
+
+	channel := make(chan error, 1)
+	// closed once maxResults vehicles were found, the scan then ends before its timeout
+	full := make(chan struct{})
+	// set while Adapter.Scan runs, a scan that already ended or failed to start is not stopped
+	started := int32(1)
 	// func that is wrapped, so it can time out in some number of seconds
 	go func() {
-
-		if !AdapterEnabled {
-			must("enable BLE stack", Adapter.Enable())
-			AdapterEnabled = true
-		}
-
-		err := Adapter.Scan(func(adapter *bluetooth.Adapter, device bluetooth.ScanResult) {
-			// only scan for devices that contain "Drive" for anki drive
-			if strings.Contains(device.LocalName(), "Drive") {
-				if !devicesFound.Has(device.Address.String()) {
-					var manufacturerData = ""
-					for _, data := range device.ManufacturerData() {
-						manufacturerData = "beef" + hex.EncodeToString(data)
-					}
-					var localname = "10603001202020204472697665"
-					// ANKI device properties
-					devicesFound.Set(strings.Replace(device.Address.String(), "-", "", -1), AnkiVehicle{
-						Address:          strings.Replace(device.Address.String(), "-", "", -1),
-						ManufacturerData: manufacturerData,
-						LocalName:        localname,
-						Addresser:        device.Address,
-					})
-				}
+		err := Adapter.Scan(func(vehicle AnkiVehicle) {
+			// distant vehicles clutter the results and are often too weak to connect to
+			if serverConf.MinRSSI != 0 && vehicle.RSSI < serverConf.MinRSSI {
+				return
+			}
+			if devicesFound.Has(vehicle.Address) {
+				return
+			}
+			// vehicles reported while the scan is being stopped are left out
+			if maxResults > 0 && devicesFound.Count() >= maxResults {
+				return
+			}
+			vehicle.lastSeen = time.Now()
+			devicesFound.Set(vehicle.Address, vehicle)
+			if devicesFound.Count() == maxResults {
+				close(full)
 			}
 		})
+		atomic.StoreInt32(&started, 0)
+		channel <- err
+	}()
+
+	// timeout scan
+	select {
+	case err := <-channel:
+		// Scan only returns early if it could not be started
 		if err != nil {
-			return
+			return devicesFound, errors.New("start scan: " + err.Error())
+		}
+	case <-full:
+		if err := stopScan(channel, &started); err != nil {
+			return devicesFound, err
 		}
-		//must("start scan", err)
-		//must("enable BLE stack", Adapter.StopScan())
+	case <-time.After(time.Duration(serverConf.ScanTimeoutSeconds) * time.Second):
+		if err := stopScan(channel, &started); err != nil {
+			return devicesFound, err
+		}
+	}
 
-	}()
+	return devicesFound, nil
+}
 
-	// timeout scan
+// Merges the vehicles found by a scan into the known devices, vehicles that stopped advertising are evicted by the
+// discovery sweeper
+func mergeDiscoveredDevices(devices cmap.ConcurrentMap[string, AnkiVehicle]) {
+	for address, device := range devices.Items() {
+		server.DiscoveredDevices.Set(address, device)
+	}
+	for _, address := range server.DiscoveredDevices.Keys() {
+		if !server.ConnectedDevices.Has(address) {
+			// a CONNECT racing with the scan keeps its state
+			server.VehicleStates.Upsert(address, STATE_DISCOVERED, func(exist bool, valueInMap VehicleState, newValue VehicleState) VehicleState {
+				if exist && valueInMap == STATE_CONNECTING {
+					return valueInMap
+				}
+				return newValue
+			})
+		}
+	}
+}
+
+func validTxPower(dBm int) bool {
+	for _, level := range TX_POWER_LEVELS {
+		if dBm == level {
+			return true
+		}
+	}
+	return false
+}
+
+// Stops the running scan and waits for Adapter.Scan to report on done that it returned, so no scan outlives the
+// request and reports vehicles into a finished one
+func stopScan(done chan error, started *int32) error {
+	if atomic.LoadInt32(started) == 0 {
+		if err := <-done; err != nil {
+			return errors.New("start scan: " + err.Error())
+		}
+		return nil
+	}
+	// fails if the scan ended on its own just now, which the wait below sorts out
+	stopErr := Adapter.StopScan()
 	select {
-	case <-channel:
-		channel <- "break"
-		break
-	case <-time.After(5 * time.Second):
-		break
+	case <-done:
+		return nil
+	case <-time.After(SCAN_STOP_TIMEOUT):
+		if stopErr != nil {
+			return errors.New("stop scan: " + stopErr.Error())
+		}
+		return errors.New("stop scan: scan did not end")
+	}
+}
+
+// builds the vehicle message for a LIGHTS request, returns false if the request is malformed
+func encodeLightsCommand(set []string) ([]byte, bool) {
+	if len(set) == 4 {
+		light, ok := LIGHT_NAMES[set[2]]
+		if !ok || (set[3] != "ON" && set[3] != "OFF") {
+			return nil, false
+		}
+		return EncodeLights(light, set[3] == "ON"), true
+	}
+
+	if len(set) == 8 && set[2] == "PATTERN" {
+		return encodeLightPatternCommand(set[3:])
+	}
+
+	return nil, false
+}
+
+// builds a lights-pattern message from <channel>;<effect>;<start>;<end>;<cycles per 10 seconds>,
+// returns false if a field is out of range
+func encodeLightPatternCommand(fields []string) ([]byte, bool) {
+	if len(fields) != 5 {
+		return nil, false
+	}
+	channel, ok := LIGHT_CHANNEL_NAMES[fields[0]]
+	if !ok {
+		return nil, false
+	}
+	effect, ok := LIGHT_EFFECT_NAMES[fields[1]]
+	if !ok {
+		return nil, false
+	}
+	var values []byte
+	for i, field := range fields[2:] {
+		value, err := strconv.ParseUint(field, 10, 8)
+		if err != nil {
+			return nil, false
+		}
+		// start and end are intensities
+		if i < 2 && value > LIGHT_MAX_INTENSITY {
+			return nil, false
+		}
+		values = append(values, byte(value))
+	}
+	return EncodeLightPattern(channel, effect, values[0], values[1], values[2]), true
+}
+
+// Writes an encoded message to a connected vehicle on behalf of a high level command
+// and reports the outcome to the client as <verb>;SUCCESS or <verb>;FAILED;<reason>, followed by the request id
+func sendCommand(conn io.Writer, verb string, address string, payload []byte, reqId string) {
+	err := writeToVehicle(address, payload)
+	if err != nil {
+		if server.DeviceCharacteristics.Has(address) {
+			go checkAdapter()
+		}
+		conn.Write(response(verb+";FAILED;"+err.Error(), reqId))
+		return
+	}
+
+	conn.Write(response(verb+";SUCCESS", reqId))
+	displayDebug("SENDING: [" + address + ";" + hex.EncodeToString(payload) + "]")
+}
+
+// Writes the payloads to a connected vehicle one after another, stopping at the first failure. Reports
+// <verb>;SUCCESS;<count> or <verb>;FAILED;<index>;<reason> with the zero based index of the failed payload,
+// followed by the request id.
+func sendBatch(conn io.Writer, verb string, address string, payloads [][]byte, reqId string) {
+	for i, payload := range payloads {
+		if err := writeToVehicle(address, payload); err != nil {
+			if server.DeviceCharacteristics.Has(address) {
+				go checkAdapter()
+			}
+			conn.Write(response(verb+";FAILED;"+strconv.Itoa(i)+";"+err.Error(), reqId))
+			return
+		}
+		displayDebug("SENDING: [" + address + ";" + hex.EncodeToString(payload) + "]")
+	}
+	conn.Write(response(verb+";SUCCESS;"+strconv.Itoa(len(payloads)), reqId))
+}
+
+// Periodically evicts discovered vehicles not seen within ttl. Connected vehicles are never evicted.
+func sweepDiscoveredDevices(ttl time.Duration) {
+	interval := ttl / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		evictStaleDevices(ttl)
+	}
+}
+
+func evictStaleDevices(ttl time.Duration) {
+	for _, address := range server.DiscoveredDevices.Keys() {
+		evicted := server.DiscoveredDevices.RemoveCb(address, func(key string, device AnkiVehicle, exists bool) bool {
+			return exists && time.Since(device.lastSeen) > ttl && !server.ConnectedDevices.Has(key)
+		})
+		if evicted {
+			server.VehicleStates.RemoveCb(address, func(key string, state VehicleState, exists bool) bool {
+				return exists && state == STATE_DISCOVERED
+			})
+			// an alias of a forgotten vehicle would resolve to an address nothing answers to
+			for name, aliased := range server.Aliases.Items() {
+				if aliased == address {
+					server.Aliases.Remove(name)
+				}
+			}
+			displayInfo(address + " not seen for " + ttl.String() + ", forgotten.")
+		}
+	}
+}
+
+// Formats DETAILS;<address>;<local name>;<local name hex>;<company id>:<data hex>,...
+// The local name is reduced to its printable characters, the hex field carries the exact advertised bytes.
+func vehicleDetails(device AnkiVehicle) string {
+	printableName := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == ';' {
+			return -1
+		}
+		return r
+	}, device.LocalName)
+
+	var records []string
+	for _, companyId := range sortedCompanyIds(device.ManufacturerRecords) {
+		records = append(records, encodeCompanyId(companyId)+":"+encodeHex(device.ManufacturerRecords[companyId]))
+	}
+
+	return "DETAILS;" + device.Address + ";" + strings.TrimSpace(printableName) + ";" +
+		encodeHex([]byte(device.LocalName)) + ";" + strings.Join(records, ",")
+}
+
+// Encodes manufacturer data records the way the SCAN response reports them: for each record, ordered by company id,
+// the company id as 4 hex digits followed by its data. ANKI vehicles advertise a single record of company 0xbeef.
+func encodeManufacturerData(records map[uint16][]byte) string {
+	var encoded strings.Builder
+	for _, companyId := range sortedCompanyIds(records) {
+		encoded.WriteString(encodeCompanyId(companyId))
+		encoded.WriteString(encodeHex(records[companyId]))
+	}
+	return encoded.String()
+}
+
+// The company id as 4 hex digits, most significant byte first
+func encodeCompanyId(companyId uint16) string {
+	return encodeHex([]byte{byte(companyId >> 8), byte(companyId)})
+}
+
+func sortedCompanyIds(records map[uint16][]byte) []uint16 {
+	companyIds := make([]uint16, 0, len(records))
+	for companyId := range records {
+		companyIds = append(companyIds, companyId)
+	}
+	sort.Slice(companyIds, func(i, j int) bool { return companyIds[i] < companyIds[j] })
+	return companyIds
+}
+
+// Sends every discovered vehicle to java the same way a SCAN reports them
+func sendDiscoveredDevices(conn io.Writer, reqId string) {
+	for _, device := range server.DiscoveredDevices.Items() {
+		// for each found device, send a tcp msg to java saying found
+		conn.Write(encodeMessage(ScanResultMessage{
+			Type:             "scan",
+			Address:          device.Address,
+			ManufacturerData: device.ManufacturerData,
+			LocalName:        LEGACY_LOCAL_NAME,
+		}))
+
+		displayInfo("Found device: " + device.Address)
+		time.Sleep(scanResultInterval)
+	}
+	// Stops scanning on java side
+	conn.Write(encodeMessage(ScanCompletedMessage{Type: "scan-completed", ReqId: reqId}))
+}
+
+// Writes an encoded message to the write characteristic of a connected vehicle
+func writeToVehicle(address string, payload []byte) error {
+	lock := deviceLock(address)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	characteristics, ok := server.DeviceCharacteristics.Get(address)
+	if !ok {
+		return errNotConnected
+	}
+	payload = clampOffsets(address, payload)
+	if err := writeChunked(characteristics.Writer, payload); err != nil {
+		return err
+	}
+	touchVehicle(address)
+	recordCommand(address, payload)
+	countStat(&stats.CommandsForwarded)
+	return nil
+}
+
+// Reads the current value of the vehicle's read characteristic
+func readFromVehicle(address string) ([]byte, error) {
+	lock := deviceLock(address)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	characteristics, ok := server.DeviceCharacteristics.Get(address)
+	if !ok {
+		return nil, errNotConnected
+	}
+	// the largest attribute value BLE allows
+	value := make([]byte, 512)
+	n, err := characteristics.Reader.Read(value)
+	if err != nil {
+		return nil, err
+	}
+	touchVehicle(address)
+	return value[:n], nil
+}
+
+// Returned for vehicles the server holds no link to, retrying or reconnecting cannot help those
+var errNotConnected = errors.New("not-connected")
+
+// Writes payload to the vehicle, retrying failed writes up to CommandRetries times with a doubling backoff.
+// If the vehicle is still unreachable after the retries, its BLE link is re-established once before giving up.
+// Each write may take at most timeout, the backoffs and the reconnect don't count against it. A write that timed out
+// may still reach the vehicle, so it is neither retried nor followed by a reconnect: errTimeout is returned right
+// away and pending is closed once the write returned.
+func writeWithRetry(address string, payload []byte, timeout time.Duration) (pending <-chan struct{}, err error) {
+	write := func() error {
+		pending, err = withTimeout(timeout, func() error {
+			return writeToVehicle(address, payload)
+		})
+		return err
+	}
+	if write(); err == nil || err == errNotConnected || err == errTimeout || serverConf.CommandRetries <= 0 {
+		return pending, err
+	}
+
+	backoff := time.Duration(serverConf.CommandRetryBackoffMillis) * time.Millisecond
+	for attempt := 1; attempt <= serverConf.CommandRetries; attempt++ {
+		displayInfo("Write to " + address + " failed (" + err.Error() + "), retry " + strconv.Itoa(attempt) + " of " + strconv.Itoa(serverConf.CommandRetries) + ".")
+		time.Sleep(backoff)
+		backoff *= 2
+		// the vehicle was disconnected or lost while waiting
+		if write(); err == nil || err == errNotConnected || err == errTimeout {
+			return pending, err
+		}
+	}
+
+	// the characteristic is gone, e.g. the vehicle dropped the link, try a fresh connection once
+	displayInfo("Write to " + address + " still failing, reconnecting...")
+	if rerr := reconnectVehicle(address); rerr == errNotConnected {
+		return pending, rerr
+	} else if rerr != nil {
+		return pending, errors.New("reconnect-failed")
+	}
+	write()
+	return pending, err
+}
+
+// Writes payload in chunks of at most WriteChunkBytes, some BLE stacks silently truncate larger writes
+func writeChunked(characteristic Characteristic, payload []byte) error {
+	for _, chunk := range chunkPayload(payload, serverConf.WriteChunkBytes) {
+		if _, err := characteristic.WriteWithoutResponse(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Splits payload into chunks of at most chunkSize bytes. Chunks are cut between the size-prefixed ANKI messages
+// the payload is made of, so a message is only split if it is larger than a chunk on its own.
+func chunkPayload(payload []byte, chunkSize int) [][]byte {
+	if chunkSize <= 0 || len(payload) <= chunkSize {
+		return [][]byte{payload}
+	}
+
+	var chunks [][]byte
+	var current []byte
+	for rest := payload; len(rest) > 0; {
+		// take the next message, or whatever is left if the framing is off
+		n := int(rest[0]) + 1
+		if n > len(rest) {
+			n = len(rest)
+		}
+		msg := rest[:n]
+		rest = rest[n:]
+
+		if len(current) > 0 && len(current)+len(msg) > chunkSize {
+			chunks = append(chunks, current)
+			current = nil
+		}
+		for len(msg) > chunkSize {
+			chunks = append(chunks, msg[:chunkSize])
+			msg = msg[chunkSize:]
+		}
+		current = append(current, msg...)
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// Discovers the characteristics of a freshly connected vehicle, stores them and starts forwarding its notifications
+func attachVehicle(address string, connectedDevice VehicleLink) error {
+	characteristics, err := connectedDevice.DiscoverCharacteristics()
+	if err != nil {
+		return err
+	}
+	server.DeviceCharacteristics.Set(address, characteristics)
+	touchVehicle(address)
+	return enableNotifications(address, characteristics.Reader)
+}
+
+// Forwards the notifications reader receives from the vehicle at address
+func enableNotifications(address string, reader Characteristic) error {
+	// Each time the vehicle sends a msg through bluetooth, the event is triggered
+	return reader.EnableNotifications(func(value []byte) {
+		forwardNotification(address, value, time.Now())
+	})
+}
+
+// Connects a vehicle for its first owner: establishes the link, starts forwarding its notifications, confirms SDK
+// mode if configured and writes the onConnectCommands. A vehicle that fails any of these is disconnected again and
+// the error names the step, e.g. missing-characteristic
+func establishVehicle(device AnkiVehicle) error {
+	// connect to device
+	server.VehicleStates.Set(device.Address, STATE_CONNECTING)
+	connectedDevice, err := connectVehicle(device)
+	if err != nil {
+		server.VehicleStates.Set(device.Address, STATE_DISCONNECTED)
+		return err
+	}
+
+	// add device to concurrent map of devices
+	server.ConnectedDevices.Set(device.Address, connectedDevice)
+	displayInfo("Connected to " + device.Address)
+
+	// Getting the writers and readers services
+	if err := attachVehicle(device.Address, connectedDevice); err != nil {
+		displayInfo("Disconnecting " + device.Address + ": " + err.Error())
+		teardownVehicle(device.Address, nil)
+		return errors.New("missing-characteristic")
+	}
+	if serverConf.ConfirmSdkMode {
+		if err := confirmSdkMode(device.Address, time.Duration(serverConf.SdkModeTimeoutMillis)*time.Millisecond); err != nil {
+			displayInfo("Disconnecting " + device.Address + ", SDK mode not confirmed: " + err.Error())
+			teardownVehicle(device.Address, nil)
+			return errors.New("sdk-mode")
+		}
+	}
+	for i, payload := range onConnectPayloads {
+		if err := writeToVehicle(device.Address, payload); err != nil {
+			displayInfo("Disconnecting " + device.Address + ", on-connect command " + strconv.Itoa(i) + " failed: " + err.Error())
+			teardownVehicle(device.Address, nil)
+			return errors.New("on-connect")
+		}
+		displayDebug("SENDING: [" + device.Address + ";" + hex.EncodeToString(payload) + "]")
+	}
+	server.VehicleStates.Set(device.Address, STATE_CONNECTED)
+	broadcastEvent("CONNECTED", device.Address)
+	return nil
+}
+
+// Establishes the BLE link to a discovered vehicle. At most MaxConcurrentConnects links are being established at the
+// same time, since many BLE stacks fail connects when several run at once; further connects wait for their turn.
+func connectVehicle(device AnkiVehicle) (VehicleLink, error) {
+	if connectSlots != nil {
+		connectSlots <- struct{}{}
+		defer func() { <-connectSlots }()
 	}
+	return Adapter.Connect(device, connectionParams)
+}
+
+// Replaces the stored characteristics of a connected vehicle with freshly discovered ones, e.g. after its GATT cache
+// went stale. A reader that moved is subscribed to again, the stored characteristics are only replaced once that
+// succeeded. Writes wait until the discovery finished.
+func rediscoverVehicle(address string) error {
+	lock := deviceLock(address)
+	lock.Lock()
+	defer lock.Unlock()
+
+	connectedDevice, ok := server.ConnectedDevices.Get(address)
+	if !ok {
+		return errNotConnected
+	}
+	characteristics, err := connectedDevice.DiscoverCharacteristics()
+	if err != nil {
+		return err
+	}
+	// subscribing to the unchanged reader again would forward each notification twice
+	if current, ok := server.DeviceCharacteristics.Get(address); ok && sameCharacteristic(current.Reader, characteristics.Reader) {
+		characteristics.Reader = current.Reader
+	} else if err := enableNotifications(address, characteristics.Reader); err != nil {
+		return err
+	}
+	server.DeviceCharacteristics.Set(address, characteristics)
+	touchVehicle(address)
+	return nil
+}
 
-	return devicesFound
+var errTimeout = errors.New("timeout")
+
+// Runs fn and waits at most timeout for it to return, a timeout of 0 waits forever.
+// fn keeps running in the background after a timeout, done is closed once it returned.
+func withTimeout(timeout time.Duration, fn func() error) (done <-chan struct{}, err error) {
+	returned := make(chan struct{})
+	if timeout <= 0 {
+		err = fn()
+		close(returned)
+		return returned, err
+	}
+	result := make(chan error, 1)
+	go func() {
+		err := fn()
+		close(returned)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return returned, err
+	case <-time.After(timeout):
+		return returned, errTimeout
+	}
 }
 
-func must(action string, err error) {
+// Writes payload and waits for the outcome, returning the address;WRITE;OK or address;WRITE;FAILED;<reason> frame.
+// tinygo has no separate write request, but on BlueZ the write only returns once the stack accepted or
+// rejected it, so its result is the acknowledgement. A write still pending after WriteTimeoutMillis is reported as
+// address;WRITE;TIMEOUT right away, pending is closed once the write returned.
+func writeWithResponse(address string, payload []byte) (result []byte, pending <-chan struct{}) {
+	pending, err := writeWithRetry(address, payload, time.Duration(serverConf.WriteTimeoutMillis)*time.Millisecond)
+	if err == errTimeout {
+		return []byte(address + ";WRITE;TIMEOUT\n"), pending
+	}
 	if err != nil {
-		panic("failed to " + action + ": " + err.Error())
+		return []byte(address + ";WRITE;FAILED;" + err.Error() + "\n"), pending
+	}
+	return []byte(address + ";WRITE;OK\n"), pending
+}
+
+// Writes the stop payload to every connected vehicle in parallel. Returns how many vehicles were stopped
+// and the error for each vehicle that could not be.
+func emergencyStop() (int, map[string]error) {
+	return writeToAll(EncodeSetSpeed(0, STOP_ACCELERATION), false)
+}
+
+// Writes payload to every connected vehicle in parallel, so they all receive it at nearly the same time. Vehicles over
+// their rate limit are skipped unless rateLimited is false. Returns how many vehicles received the payload and the
+// error for each vehicle that did not.
+func writeToAll(payload []byte, rateLimited bool) (int, map[string]error) {
+	failures := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	addresses := server.DeviceCharacteristics.Keys()
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			err := errors.New("rate-limited")
+			if !rateLimited || allowCommand(address) {
+				err = writeToVehicle(address, payload)
+			}
+			if err != nil {
+				mu.Lock()
+				failures[address] = err
+				mu.Unlock()
+			}
+		}(address)
+	}
+	wg.Wait()
+
+	return len(addresses) - len(failures), failures
+}
+
+// Returns the lock guarding a vehicle's characteristics. Writes hold it for reading, teardown for writing,
+// so a command either sees the vehicle fully connected or not at all.
+func deviceLock(address string) *sync.RWMutex {
+	return server.DeviceLocks.Upsert(address, nil, func(exist bool, valueInMap *sync.RWMutex, newValue *sync.RWMutex) *sync.RWMutex {
+		if exist {
+			return valueInMap
+		}
+		return &sync.RWMutex{}
+	})
+}
+
+// Locks lock for writing, giving up after timeout unless it is 0. Unlike a blocked Lock, waiting this way does not
+// hold up the readers arriving meanwhile, e.g. the writes of an ESTOP
+func lockWithin(lock *sync.RWMutex, timeout time.Duration) bool {
+	if timeout <= 0 {
+		lock.Lock()
+		return true
+	}
+	deadline := time.Now().Add(timeout)
+	for !lock.TryLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// Drops the BLE link to a vehicle and forgets everything the server tracked for it.
+// The vehicle is forgotten even if the BLE stack reports an error while disconnecting.
+// Event subscribers are told with EVENT;DISCONNECTED, and a non-nil notice goes to the vehicle's other subscribers,
+// so no client hears of the disconnect twice.
+func teardownVehicle(address string, notice []byte) error {
+	return teardownVehicleWithin(address, notice, 0)
+}
+
+var errVehicleBusy = errors.New("vehicle-busy")
+
+// teardownVehicle waiting at most timeout for the vehicle's in-flight writes, 0 waits forever. A vehicle whose
+// writes are still running after that is left connected and errVehicleBusy returned
+func teardownVehicleWithin(address string, notice []byte, timeout time.Duration) error {
+	// wait for in-flight writes, commands arriving afterwards see the vehicle as not connected
+	lock := deviceLock(address)
+	if !lockWithin(lock, timeout) {
+		return errVehicleBusy
+	}
+	defer lock.Unlock()
+
+	var err error
+	if state, ok := server.VehicleStates.Get(address); ok && state == STATE_CONNECTED {
+		broadcastEvent("DISCONNECTED", address)
+	}
+	if notice != nil {
+		notifySubscribersWithoutEvents(address, notice)
+	}
+	if device, ok := server.ConnectedDevices.Get(address); ok {
+		err = device.Disconnect()
+	}
+	forgetVehicle(address, STATE_DISCONNECTED)
+	return err
+}
+
+// Forgets a vehicle that dropped the link on its own, e.g. with a flat battery or out of range, the same way
+// teardownVehicle does but without disconnecting a link that is gone already
+func vehicleLost(address string) {
+	lock := deviceLock(address)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// vehicles the server disconnected itself were forgotten already
+	if !server.ConnectedDevices.Has(address) {
+		return
+	}
+	// an adapter reset drops every link, the recovery reconnects them with the clients forgotten here
+	vehicle := snapshotVehicle(address)
+	forgetVehicle(address, STATE_LOST)
+	broadcastEvent("DISCONNECTED", address)
+	displayInfo(address + " Lost.")
+	noteLostVehicle(vehicle)
+}
+
+// Removes everything the server tracked for a connected vehicle and leaves it in state. Must be called with the
+// vehicle's lock held for writing
+func forgetVehicle(address string, state VehicleState) {
+	server.ConnectedDevices.Remove(address)
+	server.DeviceCharacteristics.Remove(address)
+	server.RateLimiters.Remove(address)
+	server.VehicleClients.Remove(address)
+	server.LastActivity.Remove(address)
+	server.CommandQueues.Remove(address)
+	server.LaneKeepers.Remove(address)
+	server.LastSpeeds.Remove(address)
+	server.LastOffsets.Remove(address)
+	server.CommandHistories.Remove(address)
+	server.Coalescers.Remove(address)
+	server.OffsetLimits.Remove(address)
+	server.NotificationsOff.Remove(address)
+	server.VehicleStates.Set(address, state)
+}
+
+// Summarizes the version and the resolved configuration, after defaults and validation have been applied
+func startupBanner(configPath string, conf ServerConf) []string {
+	if absolute, err := filepath.Abs(configPath); err == nil {
+		configPath = absolute
+	}
+	var listenOn []string
+	for _, listener := range configuredListeners(conf) {
+		address := net.JoinHostPort(listener.Host, listener.Port)
+		if listener.Network != "" {
+			address = listener.Network + ":" + address
+		}
+		if listener.Network == "unix" {
+			address = "unix:" + listener.SocketPath
+		}
+		if len(listener.AllowedCommands) > 0 {
+			address += " (" + strings.Join(listener.AllowedCommands, ",") + ")"
+		}
+		listenOn = append(listenOn, address)
+	}
+	websocket := "off"
+	if conf.WSEnabled {
+		websocket = net.JoinHostPort(conf.Host, conf.WSPort)
+	}
+	rateLimit := "off"
+	if conf.MaxCommandsPerSecond > 0 {
+		rateLimit = strconv.Itoa(conf.MaxCommandsPerSecond) + "/s (" + conf.RateLimitMode + ")"
+	}
+
+	return []string{
+		"Automotive CPS Bluetooth Server " + Version,
+		"  config:          " + configPath,
+		"  listen:          " + strings.Join(listenOn, ", "),
+		"  adapter:         " + conf.Adapter,
+		"  websocket:       " + websocket,
+		"  scan timeout:    " + strconv.Itoa(conf.ScanTimeoutSeconds) + "s (" + conf.ScanMode + ")",
+		"  wire format:     " + conf.WireFormat,
+		"  rate limit:      " + rateLimit,
+		"  command timeout: " + strconv.Itoa(conf.CommandTimeoutMillis) + "ms",
+		"  capture:         " + orOff(conf.CaptureDir),
+		"  audit:           " + orOff(conf.AuditFile),
+		"  log level:       " + logLevelName(),
+	}
+}
+
+func orOff(value string) string {
+	if value == "" {
+		return "off"
+	}
+	return value
+}
+
+// Validates the configured BLE connection parameters against the ranges allowed by the BLE specification
+// and converts them for Adapter.Connect
+func buildConnectionParams(conf ServerConf) (bluetooth.ConnectionParams, error) {
+	params := bluetooth.ConnectionParams{}
+	minInterval := conf.MinConnectionIntervalMillis
+	maxInterval := conf.MaxConnectionIntervalMillis
+
+	// the BLE connection interval must fall between 7.5ms and 4s
+	for _, interval := range []float64{minInterval, maxInterval} {
+		if interval != 0 && (interval < 7.5 || interval > 4000) {
+			return params, errors.New("connection interval " + strconv.FormatFloat(interval, 'f', -1, 64) + "ms is outside the allowed range of 7.5ms to 4000ms")
+		}
+	}
+	if minInterval != 0 && maxInterval != 0 && minInterval > maxInterval {
+		return params, errors.New("minConnectionIntervalMillis must not be greater than maxConnectionIntervalMillis")
+	}
+	// bluetooth.Duration counts 0.625ms units in a uint16
+	if conf.ConnectionTimeoutMillis < 0 || conf.ConnectionTimeoutMillis > 40959 {
+		return params, errors.New("connectionTimeoutMillis must be between 0 and 40959")
+	}
+
+	params.MinInterval = bluetooth.NewDuration(time.Duration(minInterval * float64(time.Millisecond)))
+	params.MaxInterval = bluetooth.NewDuration(time.Duration(maxInterval * float64(time.Millisecond)))
+	params.ConnectionTimeout = bluetooth.NewDuration(time.Duration(conf.ConnectionTimeoutMillis) * time.Millisecond)
+	return params, nil
+}
+
+// Decodes the hex ANKI messages written to every newly connected vehicle
+func decodeOnConnectCommands(commands []string) ([][]byte, error) {
+	var payloads [][]byte
+	for _, encoded := range commands {
+		payload, err := hex.DecodeString(encoded)
+		if err != nil || len(payload) == 0 {
+			return nil, errors.New("onConnectCommands entry " + strconv.Quote(encoded) + " is not a hex ANKI message")
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, nil
+}
+
+// Returns the field at index i of a parsed message, or an empty string if the message is shorter
+func field(set []string, i int) string {
+	if i < len(set) {
+		return set[i]
+	}
+	return ""
+}
+
+// Splits the optional request id off a request that takes fields fields, requests of any other length are left as
+// they are for the verb to reject
+func splitReqId(set []string, fields int) ([]string, string) {
+	if len(set) == fields+1 {
+		return set[:fields], set[fields]
+	}
+	return set, ""
+}
+
+// Builds a response line, echoing the client's optional request id as a trailing field
+func response(msg string, reqId string) []byte {
+	if reqId != "" {
+		msg += ";" + reqId
+	}
+	return []byte(msg + "\n")
+}
+
+// strips the 0x0 fillers and the '-' separators so addresses match the keys stored by scan()
+func normalizeAddress(address string) string {
+	address = strings.Replace(string(bytes.Trim([]byte(address), "\x00")), "-", "", -1)
+	// a name registered with ALIAS stands for its vehicle's address
+	if aliased, ok := server.Aliases.Get(address); ok {
+		return aliased
+	}
+	return address
+}
+
+// Enables the BLE adapter and records whether it is ready, every request but STATUS needs it
+func enableAdapter() error {
+	if err := Adapter.Enable(); err != nil {
+		atomic.StoreInt32(&AdapterEnabled, 0)
+		return err
+	}
+	atomic.StoreInt32(&AdapterEnabled, 1)
+	return nil
+}
+
+// Enables the adapter at startup. Without one the server only starts if allowNoAdapter is set, otherwise the
+// returned error tells the user what to check.
+func startAdapter() error {
+	err := enableAdapter()
+	if err == nil {
+		return nil
+	}
+	if !serverConf.AllowNoAdapter {
+		return errors.New("No BLE adapter found; check that the adapter is present and powered and that the server may " +
+			"use BlueZ (" + err.Error() + "). Set allowNoAdapter to start without one.")
+	}
+	displayInfo("No BLE adapter found (" + err.Error() + "), continuing without one since allowNoAdapter is set.")
+	return nil
+}
+
+// Configures the adapter to scan actively or passively, before any scan is started
+func applyScanMode(mode string) error {
+	if mode != SCAN_MODE_ACTIVE && mode != SCAN_MODE_PASSIVE {
+		return errors.New("scanMode must be " + SCAN_MODE_ACTIVE + " or " + SCAN_MODE_PASSIVE)
+	}
+	if err := Adapter.SetScanMode(mode); err != nil {
+		return errors.New("scanMode " + mode + ": " + err.Error())
+	}
+	return nil
+}
+
+// Whether the BLE adapter has been enabled and is usable
+func adapterReady() bool {
+	return atomic.LoadInt32(&AdapterEnabled) == 1
+}
+
+func displayDebug(msg string) {
+	if logEnabled(LOG_DEBUG) {
+		fmt.Fprintln(logOutput, ANSI_CYAN+"[DEBUG] "+ANSI_RESET+msg)
 	}
 }
 
 func displayInfo(msg string) {
-	fmt.Println(ANSI_GREEN + "[INFO] " + ANSI_RESET + msg)
+	if logEnabled(LOG_INFO) {
+		fmt.Fprintln(logOutput, ANSI_GREEN+"[INFO] "+ANSI_RESET+msg)
+	}
 }
 
 func displayError(msg string) {
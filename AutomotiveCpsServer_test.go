@@ -0,0 +1,2023 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the request dispatch, every command is handed to dispatch directly and its answers are compared, and of
+ * the request framing, the configuration, the vehicle states and the writes behind the commands.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A client that is not reading from a connection, for requests handed to dispatch directly
+func newDispatchClient(t *testing.T) *ClientConn {
+	t.Helper()
+	client := newClientConn(newFakeConn())
+	t.Cleanup(client.Close)
+	return client
+}
+
+// Dispatches frame for client and returns everything it answered
+func dispatchFrame(client *ClientConn, frame string) ([]string, error) {
+	out := newFakeConn()
+	err := dispatch(client, out, frame+"\n", splitFrame(client.Protocol(), frame+"\n"))
+	return out.Lines(), err
+}
+
+// Every command path through dispatch with a vehicle connected, in an order where each command leaves the vehicle
+// usable for the next one
+func TestDispatchCommands(t *testing.T) {
+	adapter := newTestServer(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	client := newDispatchClient(t)
+
+	tests := []struct {
+		frame string
+		want  []string // prefixes of the response lines, in order
+	}{
+		{"PING", []string{"PONG"}},
+		{"CAPABILITIES", []string{"CAPABILITIES;protocol="}},
+		{"LOGLEVEL;ERROR", []string{"LOGLEVEL;ERROR"}},
+		{"LOGLEVEL;LOUD", []string{"LOGLEVEL;FAILED;invalid-level"}},
+		{"READ_TIMEOUT;0", []string{"READ_TIMEOUT;SUCCESS"}},
+		{"READ_TIMEOUT;-1", []string{"READ_TIMEOUT;FAILED;invalid-timeout"}},
+		{"STATUS", []string{"STATUS;adapter=ready;connected=0"}},
+		{"SCAN", []string{"SCAN;" + TEST_VEHICLE + ";", "SCAN;COMPLETED"}},
+		{"DISCOVERED", []string{"SCAN;" + TEST_VEHICLE + ";", "SCAN;COMPLETED"}},
+		{"DETAILS;" + TEST_VEHICLE, []string{"DETAILS;" + TEST_VEHICLE + ";Drive;"}},
+		{"DETAILS;AA:00:00:00:00:99", []string{"DETAILS;FAILED;unknown-address"}},
+		{"CONNECT;AA:00:00:00:00:99", []string{"CONNECT;FAILED;not-discovered"}},
+		{"CONNECT;" + TEST_VEHICLE, []string{"CONNECT;SUCCESS"}},
+		{"CONNECT;" + TEST_VEHICLE, []string{"CONNECT;ALREADY"}},
+		{"LIST", []string{"LIST;" + TEST_VEHICLE + ";CONNECTED", "LIST;COMPLETED"}},
+		{"VEHICLE;" + TEST_VEHICLE, []string{"VEHICLE;" + TEST_VEHICLE + ";state=CONNECTED"}},
+		{"GATT;" + TEST_VEHICLE, []string{"GATT;" + TEST_VEHICLE + ";", "GATT;" + TEST_VEHICLE + ";", "GATT;COMPLETED"}},
+		{"REDISCOVER;" + TEST_VEHICLE, []string{"REDISCOVER;SUCCESS"}},
+		{"READ;" + TEST_VEHICLE, []string{TEST_VEHICLE + ";READ;"}},
+		{TEST_VEHICLE + ";0624c800e80300", nil},
+		{TEST_VEHICLE + ";0624c800e80300;ACK", []string{TEST_VEHICLE + ";WRITE;OK"}},
+		{"AA:00:00:00:00:99;0624c800e80300", []string{"ERROR;unknown-target;AA:00:00:00:00:99"}},
+		{"LIGHTS;" + TEST_VEHICLE + ";HEADLIGHTS;ON", []string{"LIGHTS;SUCCESS"}},
+		{"LIGHTS;" + TEST_VEHICLE + ";FOGLIGHTS;ON", []string{"ERROR;invalid-lights"}},
+		{"LIGHTPATTERN;" + TEST_VEHICLE + ";RED;FLASH;0;14;10", []string{"LIGHTPATTERN;SUCCESS"}},
+		{"TURN;" + TEST_VEHICLE + ";UTURN", []string{"TURN;SUCCESS"}},
+		{"TURN;" + TEST_VEHICLE + ";SIDEWAYS", []string{"ERROR;invalid-turn"}},
+		{"LANE_CANCEL;" + TEST_VEHICLE, []string{"LANE_CANCEL;SUCCESS"}},
+		{"OFFSET;" + TEST_VEHICLE + ";-20.5", []string{"OFFSET;SUCCESS"}},
+		{"OFFSET;" + TEST_VEHICLE + ";left", []string{"ERROR;invalid-offset"}},
+		{"OFFSETLIMIT;" + TEST_VEHICLE + ";-50;50", []string{"OFFSETLIMIT;SUCCESS"}},
+		{"OFFSETLIMIT;" + TEST_VEHICLE + ";OFF", []string{"OFFSETLIMIT;SUCCESS"}},
+		{"LANEKEEP;" + TEST_VEHICLE + ";10", []string{"LANEKEEP;SUCCESS"}},
+		{"LANEKEEP;" + TEST_VEHICLE + ";OFF", []string{"LANEKEEP;SUCCESS"}},
+		{"BATCH;" + TEST_VEHICLE + ";0624c800e80300,0416", []string{"BATCH;SUCCESS;2"}},
+		{"BATCH;" + TEST_VEHICLE + ";zz", []string{"ERROR;invalid-batch"}},
+		{"HISTORY;" + TEST_VEHICLE, append(repeat("HISTORY;"+TEST_VEHICLE+";", 9), "HISTORY;COMPLETED")},
+		{"QUERY_SPEED;" + TEST_VEHICLE, []string{TEST_VEHICLE + ";SPEED;no-data"}},
+		{"QUERY_OFFSET;" + TEST_VEHICLE, []string{TEST_VEHICLE + ";OFFSET;no-data"}},
+		{"ALIAS;" + TEST_VEHICLE + ";Skull", []string{"ALIAS;SUCCESS"}},
+		{"ALIAS;" + TEST_VEHICLE + ";SKULL", []string{"ALIAS;FAILED;invalid-name"}},
+		{"QUERY_SPEED;Skull", []string{TEST_VEHICLE + ";SPEED;no-data"}},
+		{"SUBSCRIBE_EVENTS", []string{"SUBSCRIBE_EVENTS;SUCCESS"}},
+		{"UNSUBSCRIBE_EVENTS", []string{"UNSUBSCRIBE_EVENTS;SUCCESS"}},
+		{"RAW;OFF", []string{"RAW;SUCCESS"}},
+		{"RAW;ON", []string{"RAW;SUCCESS"}},
+		{"RAW;SOMETIMES", []string{"RAW;FAILED;invalid-mode"}},
+		{"ENCODING;COMPACT", []string{"ENCODING;SUCCESS"}},
+		{"ENCODING;TEXT", []string{"ENCODING;SUCCESS"}},
+		{"ENCODING;MORSE", []string{"ENCODING;FAILED;invalid-encoding"}},
+		{"NOTIFY;" + TEST_VEHICLE + ";OFF", []string{"NOTIFY;SUCCESS"}},
+		{"NOTIFY;" + TEST_VEHICLE + ";ON", []string{"NOTIFY;SUCCESS"}},
+		{"PAUSE;" + TEST_VEHICLE, []string{"PAUSE;SUCCESS"}},
+		{"RESUME;" + TEST_VEHICLE, []string{"RESUME;SUCCESS;0"}},
+		{"UNSUBSCRIBE;" + TEST_VEHICLE, []string{"UNSUBSCRIBE;SUCCESS"}},
+		{"SUBSCRIBE;" + TEST_VEHICLE, []string{"SUBSCRIBE;SUCCESS"}},
+		{"TXPOWER", []string{"TXPOWER;FAILED;unsupported"}},
+		{"SELFTEST", []string{"SELFTEST;adapter=ok;scan=1-found;"}},
+		{"STATS", []string{"STATS;uptime="}},
+		{"SPEED_ALL;300;1000", []string{"SPEED_ALL;DONE;1"}},
+		{"SPEED_ALL;fast", []string{"ERROR;invalid-speed"}},
+		{"ESTOP", []string{"ESTOP;DONE;1"}},
+		{"RESET;" + TEST_VEHICLE, []string{"RESET;SUCCESS;" + strconv.Itoa(len(EncodeResetSequence()))}},
+		{"DISCONNECT;AA:00:00:00:00:99", []string{"DISCONNECT;FAILED;not-connected"}},
+		{"DISCONNECT;" + TEST_VEHICLE, []string{"DISCONNECT;SUCCESS"}},
+		{"LIGHTS;" + TEST_VEHICLE + ";HEADLIGHTS;OFF", []string{"LIGHTS;FAILED;not-connected"}},
+		{TEST_VEHICLE + ";0624c800e80300", []string{"ERROR;not-connected;" + TEST_VEHICLE}},
+		{"CONNECT;" + TEST_VEHICLE, []string{"CONNECT;SUCCESS"}},
+		{"DISCONNECT_ALL", []string{"DISCONNECT_ALL;DONE;1"}},
+		{"HELLO;2", []string{"HELLO;2"}},
+		{"HELLO;zero", []string{"HELLO;FAILED;invalid-version"}},
+	}
+	for _, test := range tests {
+		lines, _ := dispatchFrame(client, test.frame)
+		if len(lines) != len(test.want) {
+			t.Fatalf("%s: got %q, want %d lines starting with %q", test.frame, lines, len(test.want), test.want)
+		}
+		for i, prefix := range test.want {
+			if !strings.HasPrefix(lines[i], prefix) {
+				t.Fatalf("%s: line %d is %q, want it to start with %q", test.frame, i, lines[i], prefix)
+			}
+		}
+	}
+}
+
+func repeat(line string, count int) []string {
+	lines := make([]string, count)
+	for i := range lines {
+		lines[i] = line
+	}
+	return lines
+}
+
+// A bare verb, e.g. CONNECT without an address, is answered instead of crashing the server
+func TestDispatchBareVerbs(t *testing.T) {
+	newTestServer(t)
+	client := newDispatchClient(t)
+
+	for _, verb := range SUPPORTED_VERBS {
+		for _, frame := range []string{verb, verb + ";", verb + ";;"} {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("%q panicked: %v", frame, r)
+					}
+				}()
+				dispatchFrame(client, frame)
+			}()
+		}
+	}
+}
+
+func TestDispatchMissingAddress(t *testing.T) {
+	newTestServer(t)
+	client := newDispatchClient(t)
+
+	for _, frame := range []string{"CONNECT", "CONNECT;", "DISCONNECT", "DISCONNECT;"} {
+		lines, err := dispatchFrame(client, frame)
+		if err == nil {
+			t.Errorf("%q: no error", frame)
+		}
+		if len(lines) != 1 || lines[0] != "ERROR;missing-address" {
+			t.Errorf("%q: got %q, want ERROR;missing-address", frame, lines)
+		}
+	}
+	if lines, _ := dispatchFrame(client, "CONNECT;;7"); len(lines) != 1 || lines[0] != "ERROR;missing-address;7" {
+		t.Errorf("CONNECT with a request id answered %q", lines)
+	}
+}
+
+// Verbs are matched on the first field, a vehicle aliased with a name containing one is written to as usual
+func TestVerbMatchedOnFirstField(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	_, scans, _, _ := adapter.Calls()
+
+	for i, name := range []string{"mySCANcar", "myDISCONNECTcar"} {
+		client.Send("ALIAS;" + TEST_VEHICLE + ";" + name)
+		client.Expect(t, "ALIAS;SUCCESS")
+		client.Send(name + ";0116;ACK")
+		client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+		if writes := vehicle.Writes(); len(writes) != i+1 {
+			t.Fatalf("write to %s not performed, vehicle got %x", name, writes)
+		}
+	}
+	expectState(t, TEST_VEHICLE, STATE_CONNECTED)
+	if _, after, _, _ := adapter.Calls(); after != scans {
+		t.Fatal("a write to an alias containing SCAN started a scan")
+	}
+}
+
+// The vehicle commands and queries echo a trailing request id on success and on failure, and don't take it for an
+// argument
+func TestDispatchRequestIds(t *testing.T) {
+	adapter := newTestServer(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	adapter.txPower, adapter.txPowerSupported = -4, true
+	client := newDispatchClient(t)
+	dispatchFrame(client, "SCAN")
+	dispatchFrame(client, "CONNECT;"+TEST_VEHICLE)
+	vehicle := adapter.Vehicle(TEST_VEHICLE)
+
+	tests := []struct {
+		frame string
+		want  string // the last response line
+	}{
+		{"READ;" + TEST_VEHICLE + ";7", TEST_VEHICLE + ";READ;;7"},
+		{"QUERY_SPEED;" + TEST_VEHICLE + ";7", TEST_VEHICLE + ";SPEED;no-data;7"},
+		{"QUERY_OFFSET;" + TEST_VEHICLE + ";7", TEST_VEHICLE + ";OFFSET;no-data;7"},
+		{"QUERY_SPEED;AA:00:00:00:00:99;7", "ERROR;not-connected;AA:00:00:00:00:99;7"},
+		{"LANEKEEP;" + TEST_VEHICLE + ";10;7", "LANEKEEP;SUCCESS;7"},
+		{"LANEKEEP;" + TEST_VEHICLE + ";OFF;7", "LANEKEEP;SUCCESS;7"},
+		{"LANEKEEP;" + TEST_VEHICLE + ";left;7", "ERROR;invalid-offset;7"},
+		{"LANEKEEP;AA:00:00:00:00:99;10;7", "LANEKEEP;FAILED;not-connected;7"},
+		{"OFFSETLIMIT;" + TEST_VEHICLE + ";-50;50;7", "OFFSETLIMIT;SUCCESS;7"},
+		{"OFFSETLIMIT;" + TEST_VEHICLE + ";OFF;7", "OFFSETLIMIT;SUCCESS;7"},
+		{"OFFSETLIMIT;" + TEST_VEHICLE + ";50;-50;7", "ERROR;invalid-offset;7"},
+		{"OFFSET;" + TEST_VEHICLE + ";-20.5;7", "OFFSET;SUCCESS;7"},
+		{"LIGHTS;" + TEST_VEHICLE + ";HEADLIGHTS;ON;7", "LIGHTS;SUCCESS;7"},
+		{"LIGHTS;" + TEST_VEHICLE + ";PATTERN;RED;FLASH;0;14;10;7", "LIGHTS;SUCCESS;7"},
+		{"LIGHTS;" + TEST_VEHICLE + ";FOGLIGHTS;ON;7", "ERROR;invalid-lights;7"},
+		{"LIGHTPATTERN;" + TEST_VEHICLE + ";RED;FLASH;0;14;10;7", "LIGHTPATTERN;SUCCESS;7"},
+		{"TURN;" + TEST_VEHICLE + ";LEFT;7", "TURN;SUCCESS;7"},
+		{"TURN;" + TEST_VEHICLE + ";LEFT;INTERSECTION;7", "TURN;SUCCESS;7"},
+		{"TURN;" + TEST_VEHICLE + ";SIDEWAYS;7", "ERROR;invalid-turn;7"},
+		{"LANE_CANCEL;" + TEST_VEHICLE + ";7", "LANE_CANCEL;SUCCESS;7"},
+		{"BATCH;" + TEST_VEHICLE + ";0624c800e80300,0116;7", "BATCH;SUCCESS;2;7"},
+		{"BATCH;" + TEST_VEHICLE + ";zz;7", "ERROR;invalid-batch;7"},
+		{"BATCH;AA:00:00:00:00:99;0116;7", "BATCH;FAILED;0;not-connected;7"},
+		{"RESET;" + TEST_VEHICLE + ";7", "RESET;SUCCESS;" + strconv.Itoa(len(EncodeResetSequence())) + ";7"},
+		{"TXPOWER;;7", "TXPOWER;-4;7"},
+		{"TXPOWER;4;7", "TXPOWER;SUCCESS;7"},
+		{"TXPOWER;5;7", "TXPOWER;FAILED;invalid-power;7"},
+		{"TXPOWER", "TXPOWER;4"},
+		{"LIGHTS;AA:00:00:00:00:99;HEADLIGHTS;ON;7", "LIGHTS;FAILED;not-connected;7"},
+		{"SPEED_ALL;fast;0;7", "ERROR;invalid-speed;7"},
+		{"DISCONNECT;;7", "ERROR;missing-address;7"},
+	}
+	for _, test := range tests {
+		lines, _ := dispatchFrame(client, test.frame)
+		if len(lines) == 0 || lines[len(lines)-1] != test.want {
+			t.Errorf("%s: got %q, want %q last", test.frame, lines, test.want)
+		}
+	}
+
+	// the ids were not taken for the optional trigger or the offset bounds
+	if limit, _ := server.OffsetLimits.Get(TEST_VEHICLE); limit != (OffsetLimit{}) {
+		t.Errorf("offset limit %+v left after OFFSETLIMIT;OFF", limit)
+	}
+	writes := vehicle.WrittenHex()
+	for _, want := range []string{encodeHex(EncodeTurn(TURN_LEFT, TURN_TRIGGER_IMMEDIATE)), encodeHex(EncodeTurn(TURN_LEFT, TURN_TRIGGER_INTERSECTION))} {
+		found := false
+		for _, written := range writes {
+			found = found || written == want
+		}
+		if !found {
+			t.Errorf("turn %s was not written, writes %q", want, writes)
+		}
+	}
+}
+
+// DISCONNECT_ALL drops every vehicle and tells each client once per vehicle, with an EVENT frame if it subscribed to
+// events and the vehicle's disconnect notice otherwise
+func TestDisconnectAllNotifiesOnce(t *testing.T) {
+	adapter := newTestServer(t)
+	owner := newTestClient(t, nil)
+	addresses := []string{TEST_VEHICLE, TEST_VEHICLE_2, testVehicleAddress(3)}
+	var vehicles []*fakeVehicle
+	for _, address := range addresses {
+		vehicles = append(vehicles, connectTestVehicle(t, adapter, owner, address))
+	}
+	subscriber := newTestClient(t, nil)
+	watcher := newTestClient(t, nil)
+	watcher.Send("SUBSCRIBE_EVENTS")
+	watcher.Expect(t, "SUBSCRIBE_EVENTS;SUCCESS")
+	owner.Send("SUBSCRIBE_EVENTS")
+	owner.Expect(t, "SUBSCRIBE_EVENTS;SUCCESS")
+	for _, address := range addresses {
+		subscriber.Send("SUBSCRIBE;" + address)
+		subscriber.Expect(t, "SUBSCRIBE;SUCCESS")
+	}
+
+	subscriber.Send("DISCONNECT_ALL")
+	subscriber.Expect(t, "DISCONNECT_ALL;DONE;3")
+	// the vehicles are dropped in no particular order
+	waitUntil(t, "the disconnects", func() bool {
+		return owner.Count("EVENT;DISCONNECTED;") == 3 && watcher.Count("EVENT;DISCONNECTED;") == 3 &&
+			subscriber.Count("AA:") == 3
+	})
+	time.Sleep(50 * time.Millisecond)
+	for _, address := range addresses {
+		if got := subscriber.Count(address + ";DISCONNECTED"); got != 1 {
+			t.Errorf("subscriber got %d disconnect notices for %s, want 1", got, address)
+		}
+		if got := subscriber.Count("EVENT;"); got != 0 {
+			t.Errorf("subscriber without events got %d EVENT frames", got)
+		}
+		for name, client := range map[string]*fakeConn{"owner": owner, "watcher": watcher} {
+			if got := client.Count("EVENT;DISCONNECTED;" + address); got != 1 {
+				t.Errorf("%s got %d EVENT;DISCONNECTED for %s, want 1", name, got, address)
+			}
+			if got := client.Count(address + ";DISCONNECTED"); got != 0 {
+				t.Errorf("%s got the disconnect notice for %s besides the EVENT", name, address)
+			}
+		}
+		if server.ConnectedDevices.Has(address) || server.VehicleClients.Has(address) || server.DeviceCharacteristics.Has(address) {
+			t.Errorf("%s is still tracked after DISCONNECT_ALL", address)
+		}
+		if state, _ := server.VehicleStates.Get(address); state != STATE_DISCONNECTED {
+			t.Errorf("%s is %v after DISCONNECT_ALL", address, state)
+		}
+	}
+	for i, vehicle := range vehicles {
+		if got := vehicle.Disconnects(); got != 1 {
+			t.Errorf("%s disconnected %d times", addresses[i], got)
+		}
+	}
+}
+
+// Frames are split at their newline, however the client's writes cut them, and the limit counts the newline
+func TestFrameSplitting(t *testing.T) {
+	newTestServer(t)
+	serverConf.MaxFrameBytes = 16
+	client := newTestClient(t, nil)
+
+	client.SendBytes([]byte("PING;1\nPING;2\nPI"))
+	client.SendBytes([]byte("NG;3\n"))
+	waitUntil(t, "three PONGs", func() bool { return client.Count("PONG;") == 3 })
+	for _, id := range []string{"1", "2", "3"} {
+		if client.Count("PONG;"+id) != 1 {
+			t.Errorf("no PONG;%s in %q", id, client.Lines())
+		}
+	}
+
+	// PING; and a request id of 10 characters with the newline make 16 bytes
+	client.Send("PING;0123456789")
+	client.Expect(t, "PONG;0123456789")
+}
+
+// Frames arriving back to back, cut anywhere by the client's writes, each reach their handler intact while the reader
+// already reuses its buffer for the next ones
+func TestBackToBackFrames(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	// within COMMAND_QUEUE_LIMIT, the writes are queued faster than they drain
+	const frames = 200
+	var stream []byte
+	var want []string
+	for i := 0; i < frames; i++ {
+		payload := encodeHex(EncodeSetSpeed(int16(i), 1000))
+		stream = append(stream, "PING;"+strconv.Itoa(i)+"\n"+TEST_VEHICLE+";"+payload+"\n"...)
+		want = append(want, payload)
+	}
+	for len(stream) > 0 {
+		// uneven writes, so frames are cut at every position sooner or later
+		n := 1 + len(stream)%97
+		if n > len(stream) {
+			n = len(stream)
+		}
+		client.SendBytes(stream[:n])
+		stream = stream[n:]
+	}
+
+	waitUntil(t, "every PONG", func() bool { return client.Count("PONG;") == frames })
+	pongs := make(map[string]int)
+	for _, line := range client.Lines() {
+		if strings.HasPrefix(line, "PONG;") {
+			pongs[line]++
+		}
+	}
+	for i := 0; i < frames; i++ {
+		if pongs["PONG;"+strconv.Itoa(i)] != 1 {
+			t.Fatalf("PONG;%d answered %d times", i, pongs["PONG;"+strconv.Itoa(i)])
+		}
+	}
+	waitUntil(t, "every write", func() bool { return len(vehicle.Writes()) == frames })
+	for i, write := range vehicle.WrittenHex() {
+		if write != want[i] {
+			t.Fatalf("write %d is %s, want %s", i, write, want[i])
+		}
+	}
+	if client.Count("ERROR;") != 0 {
+		t.Fatalf("errors for intact frames, %q", client.Lines())
+	}
+}
+
+// A frame over the limit is answered with a single ERROR;frame-too-large and skipped up to its newline
+func TestFrameTooLarge(t *testing.T) {
+	newTestServer(t)
+	serverConf.MaxFrameBytes = 16
+	client := newTestClient(t, nil)
+
+	client.Send("PING;0123456789a")
+	client.Expect(t, "ERROR;frame-too-large")
+	client.Send("PING;1")
+	client.Expect(t, "PONG;1")
+
+	// longer than the reader's buffer and cut into several writes
+	client.SendBytes([]byte("PING;" + strings.Repeat("x", 40)))
+	client.SendBytes([]byte(strings.Repeat("y", 40) + "\nPING;2\n"))
+	client.Expect(t, "PONG;2")
+	if got := client.Count("ERROR;frame-too-large"); got != 2 {
+		t.Errorf("%d frame-too-large errors for two oversized frames", got)
+	}
+	if got := client.Count("PONG;"); got != 2 {
+		t.Errorf("%d PONGs, the oversized frames must not be handled: %q", got, client.Lines())
+	}
+}
+
+func expectState(t *testing.T, address string, want VehicleState) {
+	t.Helper()
+	waitUntil(t, address+" "+want.String(), func() bool {
+		state, ok := server.VehicleStates.Get(address)
+		return ok && state == want
+	})
+}
+
+// A vehicle goes from DISCOVERED through CONNECTING and CONNECTED to DISCONNECTED, or LOST if it drops the link
+func TestVehicleStateTransitions(t *testing.T) {
+	adapter := newTestServer(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	client := newTestClient(t, nil)
+
+	client.Send("SCAN")
+	client.Expect(t, "SCAN;COMPLETED")
+	expectState(t, TEST_VEHICLE, STATE_DISCOVERED)
+
+	connecting := make(chan struct{})
+	adapter.onConnect = func(address string) { <-connecting }
+	client.Send("CONNECT;" + TEST_VEHICLE)
+	expectState(t, TEST_VEHICLE, STATE_CONNECTING)
+	close(connecting)
+	client.Expect(t, "CONNECT;SUCCESS")
+	expectState(t, TEST_VEHICLE, STATE_CONNECTED)
+	client.Send("LIST")
+	client.Expect(t, "LIST;"+TEST_VEHICLE+";CONNECTED")
+
+	client.Send("DISCONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "DISCONNECT;SUCCESS")
+	expectState(t, TEST_VEHICLE, STATE_DISCONNECTED)
+
+	client.Send("CONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "CONNECT;SUCCESS")
+	client.Send("SUBSCRIBE_EVENTS")
+	client.Expect(t, "SUBSCRIBE_EVENTS;SUCCESS")
+	adapter.DropLink(TEST_VEHICLE)
+	expectState(t, TEST_VEHICLE, STATE_LOST)
+	client.Expect(t, "EVENT;DISCONNECTED;"+TEST_VEHICLE)
+	client.Send("LIST")
+	client.Expect(t, "LIST;"+TEST_VEHICLE+";LOST")
+
+	adapter.FailConnect(TEST_VEHICLE, errors.New("le-connection-abort-by-local"))
+	client.Send("CONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "CONNECT;FAILED;le-connection-abort-by-local")
+	expectState(t, TEST_VEHICLE, STATE_DISCONNECTED)
+}
+
+// A vehicle that dropped the link is forgotten as thoroughly as one disconnected on purpose, but not disconnected
+func TestLostVehicleForgotten(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.MaxCommandsPerSecond = 10
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	client.Send("LANEKEEP;" + TEST_VEHICLE + ";10")
+	client.Expect(t, "LANEKEEP;SUCCESS")
+	client.Send("OFFSETLIMIT;" + TEST_VEHICLE + ";-10;10")
+	client.Expect(t, "OFFSETLIMIT;SUCCESS")
+	client.Send(TEST_VEHICLE + ";0116;ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	vehicle.Emit(positionUpdate(1, 2, 3, 400))
+	client.Expect(t, TEST_VEHICLE+";")
+
+	adapter.DropLink(TEST_VEHICLE)
+	expectState(t, TEST_VEHICLE, STATE_LOST)
+	for name, has := range map[string]bool{
+		"ConnectedDevices":      server.ConnectedDevices.Has(TEST_VEHICLE),
+		"DeviceCharacteristics": server.DeviceCharacteristics.Has(TEST_VEHICLE),
+		"RateLimiters":          server.RateLimiters.Has(TEST_VEHICLE),
+		"VehicleClients":        server.VehicleClients.Has(TEST_VEHICLE),
+		"LastActivity":          server.LastActivity.Has(TEST_VEHICLE),
+		"LaneKeepers":           server.LaneKeepers.Has(TEST_VEHICLE),
+		"LastSpeeds":            server.LastSpeeds.Has(TEST_VEHICLE),
+		"LastOffsets":           server.LastOffsets.Has(TEST_VEHICLE),
+		"CommandHistories":      server.CommandHistories.Has(TEST_VEHICLE),
+		"OffsetLimits":          server.OffsetLimits.Has(TEST_VEHICLE),
+	} {
+		if has {
+			t.Errorf("%s still has the lost vehicle", name)
+		}
+	}
+	if got := vehicle.Disconnects(); got != 0 {
+		t.Errorf("%d disconnects of a link that is gone", got)
+	}
+	// reported by the stack again while the server tears the vehicle down itself, nothing happens twice
+	adapter.DropLink(TEST_VEHICLE)
+	if state, _ := server.VehicleStates.Get(TEST_VEHICLE); state != STATE_LOST {
+		t.Errorf("state %v after a second drop", state)
+	}
+}
+
+// A write that fails a few times is retried until it goes through, without touching the link
+func TestWriteWithRetryRecovers(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.CommandRetries = 3
+	serverConf.CommandRetryBackoffMillis = 1
+	vehicle := connectTestVehicle(t, adapter, newTestClient(t, nil), TEST_VEHICLE)
+
+	vehicle.writer.OnWrite(failWrites(2, errors.New("write failed")))
+	if _, err := writeWithRetry(TEST_VEHICLE, EncodePing(), 0); err != nil {
+		t.Fatalf("write failed after retries: %v", err)
+	}
+	if got := vehicle.writer.Attempts(); got != 3 {
+		t.Errorf("%d write attempts, want 3", got)
+	}
+	if _, _, _, connects := adapter.Calls(); connects != 1 {
+		t.Errorf("%d connects, want no reconnect", connects)
+	}
+}
+
+// Once the retries are used up the link is re-established once and the write tried on it
+func TestWriteWithRetryReconnects(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.CommandRetries = 2
+	serverConf.CommandRetryBackoffMillis = 1
+	vehicle := connectTestVehicle(t, adapter, newTestClient(t, nil), TEST_VEHICLE)
+
+	vehicle.writer.OnWrite(failWrites(3, errors.New("write failed")))
+	if _, err := writeWithRetry(TEST_VEHICLE, EncodePing(), 0); err != nil {
+		t.Fatalf("write failed after reconnecting: %v", err)
+	}
+	if _, _, _, connects := adapter.Calls(); connects != 2 {
+		t.Errorf("%d connects, want one reconnect", connects)
+	}
+	if state, _ := server.VehicleStates.Get(TEST_VEHICLE); state != STATE_CONNECTED {
+		t.Errorf("state after reconnecting %v", state)
+	}
+
+	vehicle.writer.OnWrite(failWrites(10, errors.New("write failed")))
+	adapter.FailConnect(TEST_VEHICLE, errors.New("le-connection-abort-by-local"))
+	if _, err := writeWithRetry(TEST_VEHICLE, EncodePing(), 0); err == nil || err.Error() != "reconnect-failed" {
+		t.Errorf("write to an unreachable vehicle returned %v, want reconnect-failed", err)
+	}
+}
+
+// The timeout covers each write on its own, not the backoffs nor the reconnect. A write that timed out is neither
+// retried nor followed by a reconnect
+func TestWriteWithRetryTimeout(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.CommandRetries = 2
+	serverConf.CommandRetryBackoffMillis = 30
+	vehicle := connectTestVehicle(t, adapter, newTestClient(t, nil), TEST_VEHICLE)
+
+	adapter.onConnect = func(string) { time.Sleep(50 * time.Millisecond) }
+	vehicle.writer.OnWrite(failWrites(3, errors.New("write failed")))
+	if _, err := writeWithRetry(TEST_VEHICLE, EncodePing(), 40*time.Millisecond); err != nil {
+		t.Fatalf("write with slow retries and reconnect failed: %v", err)
+	}
+
+	release := make(chan struct{})
+	vehicle.writer.OnWrite(func(p []byte) error {
+		<-release
+		return errors.New("write failed")
+	})
+	attempts := vehicle.writer.Attempts()
+	_, _, _, connects := adapter.Calls()
+	pending, err := writeWithRetry(TEST_VEHICLE, EncodePing(), 20*time.Millisecond)
+	if err != errTimeout {
+		t.Fatalf("hung write returned %v, want a timeout", err)
+	}
+	select {
+	case <-pending:
+		t.Fatal("pending closed before the hung write returned")
+	default:
+	}
+	close(release)
+	<-pending
+	if _, _, _, after := adapter.Calls(); vehicle.writer.Attempts() != attempts+1 || after != connects {
+		t.Fatal("timed out write retried or followed by a reconnect")
+	}
+}
+
+// Vehicles that are not connected, or stop being connected while the write is retried, are never reconnected
+func TestWriteWithRetryNotConnected(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.CommandRetries = 3
+	serverConf.CommandRetryBackoffMillis = 20
+	client := newTestClient(t, nil)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	client.Send("SCAN")
+	client.Expect(t, "SCAN;COMPLETED")
+
+	if _, err := writeWithRetry(TEST_VEHICLE, EncodePing(), 0); err != errNotConnected {
+		t.Fatalf("write to a discovered vehicle returned %v, want not-connected", err)
+	}
+	if _, _, _, connects := adapter.Calls(); connects != 0 {
+		t.Fatalf("%d connects to a vehicle nobody connected", connects)
+	}
+
+	client.Send("CONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "CONNECT;SUCCESS")
+	vehicle := adapter.Vehicle(TEST_VEHICLE)
+	var dropped int32
+	vehicle.writer.OnWrite(func(p []byte) error {
+		// the link drops under the first write, the handler runs once the write let go of the vehicle
+		if atomic.AddInt32(&dropped, 1) == 1 {
+			go adapter.DropLink(TEST_VEHICLE)
+		}
+		return errors.New("write failed")
+	})
+	if _, err := writeWithRetry(TEST_VEHICLE, EncodePing(), 0); err != errNotConnected {
+		t.Errorf("write to a lost vehicle returned %v, want not-connected", err)
+	}
+	if err := reconnectVehicle(TEST_VEHICLE); err != errNotConnected {
+		t.Errorf("reconnect of a lost vehicle returned %v, want not-connected", err)
+	}
+	if _, _, _, connects := adapter.Calls(); connects != 1 {
+		t.Errorf("%d connects, want no reconnect", connects)
+	}
+	if state, _ := server.VehicleStates.Get(TEST_VEHICLE); state != STATE_LOST {
+		t.Errorf("state %v, want LOST", state)
+	}
+}
+
+// The configured intervals and timeout are converted to 0.625ms units, values BLE does not allow are refused
+func TestBuildConnectionParams(t *testing.T) {
+	conf := defaultServerConf()
+	conf.MinConnectionIntervalMillis = 7.5
+	conf.MaxConnectionIntervalMillis = 30
+	conf.ConnectionTimeoutMillis = 4000
+	params, err := buildConnectionParams(conf)
+	if err != nil {
+		t.Fatalf("valid parameters refused: %v", err)
+	}
+	if params.MinInterval != 12 || params.MaxInterval != 48 || params.ConnectionTimeout != 6400 {
+		t.Fatalf("params %+v, want intervals 12 and 48 and timeout 6400", params)
+	}
+
+	for name, change := range map[string]func(conf *ServerConf){
+		"interval below 7.5ms":   func(conf *ServerConf) { conf.MinConnectionIntervalMillis = 5 },
+		"interval above 4s":      func(conf *ServerConf) { conf.MaxConnectionIntervalMillis = 4500 },
+		"min above max":          func(conf *ServerConf) { conf.MinConnectionIntervalMillis, conf.MaxConnectionIntervalMillis = 50, 20 },
+		"negative timeout":       func(conf *ServerConf) { conf.ConnectionTimeoutMillis = -1 },
+		"timeout beyond uint16s": func(conf *ServerConf) { conf.ConnectionTimeoutMillis = 41000 },
+	} {
+		conf := defaultServerConf()
+		change(&conf)
+		if _, err := buildConnectionParams(conf); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
+
+// CONNECT hands the configured connection parameters to the adapter
+func TestConnectPassesConnectionParams(t *testing.T) {
+	adapter := newTestServer(t)
+	conf := defaultServerConf()
+	conf.MinConnectionIntervalMillis = 15
+	conf.MaxConnectionIntervalMillis = 30
+	conf.ConnectionTimeoutMillis = 2000
+	var err error
+	if connectionParams, err = buildConnectionParams(conf); err != nil {
+		t.Fatal(err)
+	}
+	connectTestVehicle(t, adapter, newTestClient(t, nil), TEST_VEHICLE)
+
+	adapter.mu.Lock()
+	defer adapter.mu.Unlock()
+	if len(adapter.connectParams) != 1 || adapter.connectParams[0] != connectionParams {
+		t.Fatalf("Connect got %+v, want %+v", adapter.connectParams, connectionParams)
+	}
+}
+
+// STATUS tells a usable adapter from one that is not, e.g. while it is being recovered, and scans wait for it
+func TestStatusReadiness(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newDispatchClient(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+
+	if lines, _ := dispatchFrame(client, "STATUS;7"); len(lines) != 1 || lines[0] != "STATUS;adapter=ready;connected=0;7" {
+		t.Fatalf("ready adapter reported as %q", lines)
+	}
+	dispatchFrame(client, "SCAN")
+	dispatchFrame(client, "CONNECT;"+TEST_VEHICLE)
+	if lines, _ := dispatchFrame(client, "STATUS"); len(lines) != 1 || lines[0] != "STATUS;adapter=ready;connected=1" {
+		t.Fatalf("status with a vehicle connected %q", lines)
+	}
+
+	atomic.StoreInt32(&AdapterEnabled, 0)
+	if lines, _ := dispatchFrame(client, "STATUS"); len(lines) != 1 || lines[0] != "STATUS;adapter=not-ready;connected=1" {
+		t.Fatalf("not ready adapter reported as %q", lines)
+	}
+	lines, _ := dispatchFrame(client, "SCAN")
+	if len(lines) != 2 || lines[0] != "SCAN;FAILED;adapter-not-ready" || lines[1] != "SCAN;COMPLETED" {
+		t.Fatalf("scan without an adapter answered %q", lines)
+	}
+	if _, scans, _, _ := adapter.Calls(); scans != 1 {
+		t.Fatalf("%d scans, the adapter must not scan while not ready", scans)
+	}
+}
+
+// An adapter that can't be enabled leaves SCAN failing with a reason instead of crashing the server
+func TestScanEnableFailure(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newDispatchClient(t)
+	adapter.enableErr = errors.New("no adapter")
+	if err := enableAdapter(); err == nil || adapterReady() {
+		t.Fatal("adapter ready although Enable failed")
+	}
+
+	lines, _ := dispatchFrame(client, "SCAN")
+	if len(lines) != 2 || lines[0] != "SCAN;FAILED;adapter-not-ready" || lines[1] != "SCAN;COMPLETED" {
+		t.Fatalf("scan without an adapter answered %q", lines)
+	}
+	if _, scans, _, _ := adapter.Calls(); scans != 0 {
+		t.Fatalf("%d scans on an adapter that failed to enable", scans)
+	}
+
+	adapter.enableErr = nil
+	if err := enableAdapter(); err != nil || !adapterReady() {
+		t.Fatalf("adapter not ready after Enable succeeded: %v", err)
+	}
+}
+
+// A scan the adapter refuses to start is reported and completed, and the next scan runs as usual
+func TestScanStartFailure(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newDispatchClient(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	adapter.scanErr = errors.New("busy")
+
+	lines, _ := dispatchFrame(client, "SCAN;3")
+	if len(lines) != 2 || lines[0] != "SCAN;FAILED;start scan: busy" || lines[1] != "SCAN;COMPLETED;3" {
+		t.Fatalf("failed scan answered %q", lines)
+	}
+	if server.DiscoveredDevices.Count() != 0 {
+		t.Fatal("failed scan discovered vehicles")
+	}
+
+	adapter.mu.Lock()
+	adapter.scanErr = nil
+	adapter.mu.Unlock()
+	lines, _ = dispatchFrame(client, "SCAN")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "SCAN;"+TEST_VEHICLE) || lines[1] != "SCAN;COMPLETED" {
+		t.Fatalf("scan after a failed one answered %q", lines)
+	}
+}
+
+// The adapter is enabled once at startup, scans neither enable it again nor stop a scan that already ended
+func TestScanEnablesOnce(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newDispatchClient(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	if err := enableAdapter(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		dispatchFrame(client, "SCAN")
+	}
+	if enables, scans, stopScans, _ := adapter.Calls(); enables != 1 || scans != 3 || stopScans != 0 {
+		t.Fatalf("%d enables, %d scans and %d stops, want 1, 3 and 0", enables, scans, stopScans)
+	}
+}
+
+// DISCOVERED replays every vehicle of the last scans without scanning again
+func TestDiscoveredReplaysDevices(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newDispatchClient(t)
+	want := map[string]bool{}
+	for n := 1; n <= 3; n++ {
+		address := testVehicleAddress(n)
+		server.DiscoveredDevices.Set(address, AnkiVehicle{Address: address, ManufacturerData: "beef0001" + strconv.Itoa(n), lastSeen: time.Now()})
+		want["SCAN;"+address+";beef0001"+strconv.Itoa(n)+";"+LEGACY_LOCAL_NAME] = true
+	}
+
+	lines, _ := dispatchFrame(client, "DISCOVERED;5")
+	if len(lines) != 4 || lines[3] != "SCAN;COMPLETED;5" {
+		t.Fatalf("DISCOVERED answered %q", lines)
+	}
+	for _, line := range lines[:3] {
+		if !want[line] {
+			t.Errorf("unexpected vehicle %q", line)
+		}
+		delete(want, line)
+	}
+	if _, scans, _, _ := adapter.Calls(); scans != 0 {
+		t.Fatalf("DISCOVERED started %d scans", scans)
+	}
+
+	server.DiscoveredDevices.Clear()
+	if lines, _ := dispatchFrame(client, "DISCOVERED"); len(lines) != 1 || lines[0] != "SCAN;COMPLETED" {
+		t.Fatalf("DISCOVERED without vehicles answered %q", lines)
+	}
+}
+
+// The sweep forgets vehicles not seen within the ttl, unless they are connected
+func TestEvictStaleDevices(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	connected := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	stale := testVehicleAddress(3)
+	fresh := testVehicleAddress(4)
+	old := time.Now().Add(-time.Hour)
+	server.DiscoveredDevices.Set(stale, AnkiVehicle{Address: stale, lastSeen: old})
+	server.VehicleStates.Set(stale, STATE_DISCOVERED)
+	server.DiscoveredDevices.Set(fresh, AnkiVehicle{Address: fresh, lastSeen: time.Now()})
+	server.VehicleStates.Set(fresh, STATE_DISCOVERED)
+	device, _ := server.DiscoveredDevices.Get(TEST_VEHICLE)
+	device.lastSeen = old
+	server.DiscoveredDevices.Set(TEST_VEHICLE, device)
+	server.Aliases.Set("stale", stale)
+	server.Aliases.Set("fresh", fresh)
+
+	evictStaleDevices(time.Minute)
+	if server.DiscoveredDevices.Has(stale) || server.VehicleStates.Has(stale) || server.Aliases.Has("stale") {
+		t.Error("stale vehicle still known")
+	}
+	if !server.DiscoveredDevices.Has(fresh) || !server.Aliases.Has("fresh") {
+		t.Error("vehicle seen within the ttl was forgotten")
+	}
+	if !server.DiscoveredDevices.Has(TEST_VEHICLE) || connected.Disconnects() != 0 {
+		t.Error("connected vehicle was forgotten")
+	}
+	expectState(t, TEST_VEHICLE, STATE_CONNECTED)
+}
+
+// A raw command with ACK, or any raw command with writeWithResponse, reports the outcome of its write, other raw
+// commands are written without an answer
+func TestWriteWithResponse(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Send(TEST_VEHICLE + ";0116")
+	vehicle.ExpectWrite(t, []byte{0x01, 0x16})
+	client.Refute(t, TEST_VEHICLE+";WRITE;", 20*time.Millisecond)
+
+	client.Send(TEST_VEHICLE + ";0117;ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	vehicle.ExpectWrite(t, []byte{0x01, 0x17})
+
+	vehicle.writer.OnWrite(failWrites(1, errors.New("rejected")))
+	client.Send(TEST_VEHICLE + ";0117;ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;FAILED;rejected")
+
+	serverConf.WriteWithResponse = true
+	client.Send(TEST_VEHICLE + ";0116")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	if writes := len(vehicle.Writes()); writes != 3 {
+		t.Fatalf("%d writes went through, want 3", writes)
+	}
+}
+
+// CONNECT works whatever order discovery returns the characteristics in, and fails cleanly without one of them
+func TestConnectCharacteristics(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	adapter.Advertise(TEST_VEHICLE_2, -50)
+	client.Send("SCAN")
+	client.Expect(t, "SCAN;COMPLETED")
+
+	reversed := adapter.Vehicle(TEST_VEHICLE)
+	reversed.characteristics = []Characteristic{reversed.reader, reversed.writer}
+	client.Send("CONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "CONNECT;SUCCESS")
+	client.Send(TEST_VEHICLE + ";0116")
+	reversed.ExpectWrite(t, []byte{0x01, 0x16})
+	reversed.Emit(transitionUpdate(1, 0, 0))
+	client.Expect(t, TEST_VEHICLE+";"+encodeHex(transitionUpdate(1, 0, 0)))
+
+	missing := adapter.Vehicle(TEST_VEHICLE_2)
+	missing.characteristics = []Characteristic{missing.reader}
+	client.Send("CONNECT;" + TEST_VEHICLE_2)
+	client.Expect(t, "CONNECT;FAILED;missing-characteristic")
+	if missing.Disconnects() != 1 {
+		t.Errorf("%d disconnects of the vehicle missing a characteristic", missing.Disconnects())
+	}
+	if server.ConnectedDevices.Has(TEST_VEHICLE_2) || server.DeviceCharacteristics.Has(TEST_VEHICLE_2) || server.VehicleClients.Has(TEST_VEHICLE_2) {
+		t.Error("vehicle missing a characteristic is still tracked")
+	}
+	expectState(t, TEST_VEHICLE_2, STATE_DISCONNECTED)
+	client.Send(TEST_VEHICLE_2 + ";0116")
+	client.Expect(t, "ERROR;not-connected;"+TEST_VEHICLE_2)
+}
+
+// Raw commands that can't be delivered are answered: vehicles not connected with ERROR;not-connected, failed and
+// hung writes with COMMAND;FAILED
+func TestCommandFailures(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.CommandTimeoutMillis = 50
+	client := newTestClient(t, nil)
+	adapter.Advertise(TEST_VEHICLE_2, -50)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Send(TEST_VEHICLE_2 + ";0116")
+	client.Expect(t, "ERROR;not-connected;"+TEST_VEHICLE_2)
+
+	vehicle.writer.OnWrite(failWrites(1, errors.New("rejected")))
+	client.Send(TEST_VEHICLE + ";0116")
+	client.Expect(t, TEST_VEHICLE+";COMMAND;FAILED;rejected")
+	// the failure has the adapter probed, which reaches the vehicle
+	waitUntil(t, "the adapter probe", func() bool { return vehicle.writer.Attempts() == 2 })
+
+	release := make(chan struct{})
+	var calls int32
+	vehicle.writer.OnWrite(func(p []byte) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+		}
+		return nil
+	})
+	client.Send(TEST_VEHICLE + ";0117")
+	client.Expect(t, TEST_VEHICLE+";COMMAND;FAILED;timeout")
+	close(release)
+	vehicle.ExpectWrite(t, []byte{0x01, 0x17})
+
+	// waits for the writes still holding the vehicle
+	client.Send("DISCONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "DISCONNECT;SUCCESS")
+}
+
+// Commands racing a DISCONNECT for the same vehicle either reach it while it is connected or are rejected as not
+// connected, none of them writes to the link once it is being torn down
+func TestCommandsRacingDisconnect(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	var lateWrites int32
+	vehicle.writer.OnWrite(func(p []byte) error {
+		if vehicle.Disconnects() != 0 {
+			atomic.AddInt32(&lateWrites, 1)
+		}
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*50)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := writeWithRetry(TEST_VEHICLE, EncodePing(), 0); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	client.Send("DISCONNECT;" + TEST_VEHICLE)
+	wg.Wait()
+	client.Expect(t, "DISCONNECT;SUCCESS")
+	close(errs)
+
+	for err := range errs {
+		if err != errNotConnected {
+			t.Fatalf("command racing the disconnect failed with %v", err)
+		}
+	}
+	if late := atomic.LoadInt32(&lateWrites); late != 0 {
+		t.Fatalf("%d writes after the link was torn down", late)
+	}
+	// once disconnected every command is rejected the same way
+	for i := 0; i < 3; i++ {
+		if _, err := writeWithRetry(TEST_VEHICLE, EncodePing(), 0); err != errNotConnected {
+			t.Fatalf("command after the disconnect returned %v", err)
+		}
+	}
+	client.Send(TEST_VEHICLE + ";0116")
+	client.Expect(t, "ERROR;not-connected;"+TEST_VEHICLE)
+}
+
+// With network unix the server listens on the socket file, replacing one left behind, and removes it on close
+func TestUnixSocketPing(t *testing.T) {
+	newTestServer(t)
+	path := filepath.Join(t.TempDir(), "server.sock")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := listen(ListenerConf{Network: "unix", SocketPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTestListener(t, l, nil)
+
+	client := dialTestClient(t, "unix", path)
+	if got := client.Exchange(t, "PING;3"); got != "PONG;3" {
+		t.Fatalf("PING over the unix socket answered %q", got)
+	}
+	l.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file left behind: %v", err)
+	}
+
+	if _, err := listen(ListenerConf{Network: "unix"}); err == nil {
+		t.Fatal("unix listener without a socketPath")
+	}
+}
+
+// ESTOP stops every connected vehicle, a vehicle that can't be reached is reported without failing the others
+func TestEmergencyStop(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	var vehicles []*fakeVehicle
+	for n := 1; n <= 3; n++ {
+		vehicles = append(vehicles, connectTestVehicle(t, adapter, client, testVehicleAddress(n)))
+	}
+	stop := EncodeSetSpeed(0, STOP_ACCELERATION)
+
+	client.Send("ESTOP;9")
+	client.Expect(t, "ESTOP;DONE;3;9")
+	for _, vehicle := range vehicles {
+		vehicle.ExpectWrite(t, stop)
+	}
+
+	unreachable := testVehicleAddress(2)
+	vehicles[1].writer.OnWrite(failWrites(1, errors.New("link lost")))
+	client.Send("ESTOP")
+	client.Expect(t, "ESTOP;FAILED;"+unreachable+";link lost")
+	client.Expect(t, "ESTOP;DONE;2")
+	for n, vehicle := range vehicles {
+		want := 2
+		if n == 1 {
+			want = 1
+		}
+		if got := len(vehicle.Writes()); got != want {
+			t.Errorf("vehicle %d received %d stops, want %d", n+1, got, want)
+		}
+	}
+}
+
+// A client connecting a vehicle it connected already keeps its single link
+func TestDuplicateConnect(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Send("CONNECT;"+TEST_VEHICLE, "CONNECT;"+TEST_VEHICLE+";4")
+	client.Expect(t, "CONNECT;ALREADY")
+	client.Expect(t, "CONNECT;ALREADY;4")
+	if _, _, _, connects := adapter.Calls(); connects != 1 {
+		t.Fatalf("%d BLE connects for one vehicle", connects)
+	}
+	if clients, _ := server.VehicleClients.Get(TEST_VEHICLE); clients.OwnerCount() != 1 {
+		t.Fatalf("%d owners, the repeated CONNECT must not count twice", clients.OwnerCount())
+	}
+	// one DISCONNECT lets go of the vehicle
+	client.Send("DISCONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "DISCONNECT;SUCCESS")
+	if vehicle.Disconnects() != 1 {
+		t.Fatalf("%d BLE disconnects", vehicle.Disconnects())
+	}
+}
+
+// Payloads over the chunk size are cut between messages, a message larger than a chunk on its own is cut too
+func TestChunkPayload(t *testing.T) {
+	speed := EncodeSetSpeed(200, 1000)
+	var fourSpeeds []byte
+	for i := 0; i < 4; i++ {
+		fourSpeeds = append(fourSpeeds, speed...)
+	}
+	large := append([]byte{24}, make([]byte, 24)...)
+	tests := []struct {
+		name    string
+		payload []byte
+		size    int
+		want    []int
+	}{
+		{"small", speed, 20, []int{7}},
+		{"four messages", fourSpeeds, 20, []int{14, 14}},
+		{"one large message", large, 20, []int{20, 5}},
+		{"message after a large one", append(append([]byte(nil), large...), speed...), 20, []int{20, 12}},
+		{"chunking off", fourSpeeds, 0, []int{28}},
+	}
+	for _, test := range tests {
+		chunks := chunkPayload(test.payload, test.size)
+		var sizes []int
+		var joined []byte
+		for _, chunk := range chunks {
+			sizes = append(sizes, len(chunk))
+			joined = append(joined, chunk...)
+		}
+		if len(sizes) != len(test.want) || string(joined) != string(test.payload) {
+			t.Errorf("%s: chunks of %v, want %v", test.name, sizes, test.want)
+			continue
+		}
+		for i := range sizes {
+			if sizes[i] != test.want[i] {
+				t.Errorf("%s: chunks of %v, want %v", test.name, sizes, test.want)
+				break
+			}
+		}
+	}
+}
+
+// A raw command longer than writeChunkBytes reaches the vehicle in several writes, chunking is off by default
+func TestChunkedWrites(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	payload := strings.Repeat("0624c800e80300", 4)
+
+	client.Send(TEST_VEHICLE + ";" + payload + ";ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	if writes := vehicle.Writes(); len(writes) != 1 || len(writes[0]) != 28 {
+		t.Fatalf("written as %x by default, want a single write", writes)
+	}
+
+	serverConf.WriteChunkBytes = 20
+	client.Send(TEST_VEHICLE + ";" + payload + ";ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	writes := vehicle.Writes()[1:]
+	if len(writes) != 2 || len(writes[0]) != 14 || len(writes[1]) != 14 {
+		t.Fatalf("written as %x, want two chunks of two messages", writes)
+	}
+}
+
+// The banner shows the configuration as the server runs it, the options serverconf.yml sets over the defaults
+func TestStartupBanner(t *testing.T) {
+	newTestServer(t)
+	conf := defaultServerConf()
+	yamlConf := "host: 127.0.0.1\nport: \"5999\"\nscanTimeoutSeconds: 7\nwireFormat: json\nmaxCommandsPerSecond: 10\n" +
+		"wsEnabled: true\nwsPort: \"5002\"\n"
+	if err := yaml.Unmarshal([]byte(yamlConf), &conf); err != nil {
+		t.Fatal(err)
+	}
+	setLogLevel("info")
+
+	banner := startupBanner("serverconf.yml", conf)
+	absolute, _ := filepath.Abs("serverconf.yml")
+	want := map[string]string{
+		"Automotive CPS Bluetooth Server": "Automotive CPS Bluetooth Server " + Version,
+		"  config:":                       "  config:          " + absolute,
+		"  listen:":                       "  listen:          127.0.0.1:5999",
+		"  websocket:":                    "  websocket:       127.0.0.1:5002",
+		"  scan timeout:":                 "  scan timeout:    7s (" + SCAN_MODE_ACTIVE + ")",
+		"  wire format:":                  "  wire format:     json",
+		"  rate limit:":                   "  rate limit:      10/s (" + RATE_LIMIT_DROP + ")",
+		"  command timeout:":              "  command timeout: 2000ms",
+		"  capture:":                      "  capture:         off",
+		"  log level:":                    "  log level:       INFO",
+	}
+	for _, line := range banner {
+		for prefix, wantLine := range want {
+			if strings.HasPrefix(line, prefix) {
+				if line != wantLine {
+					t.Errorf("banner line %q, want %q", line, wantLine)
+				}
+				delete(want, prefix)
+			}
+		}
+	}
+	for _, missing := range want {
+		t.Errorf("banner without %q", missing)
+	}
+}
+
+// DETAILS reports the local name and manufacturer data the vehicle advertised, not the placeholder SCAN sends
+func TestDetailsAdvertisedName(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newDispatchClient(t)
+	name := "\x02Drive;Skull "
+	adapter.advertised = []AnkiVehicle{{
+		Address:             TEST_VEHICLE,
+		LocalName:           name,
+		ManufacturerRecords: map[uint16][]byte{0xbeef: {0x00, 0x01}, 0x004c: {0xff}},
+		ManufacturerData:    "004cffbeef0001",
+	}}
+	dispatchFrame(client, "SCAN")
+	if device, _ := server.DiscoveredDevices.Get(TEST_VEHICLE); device.LocalName != name {
+		t.Fatalf("scan stored the name %q, want the advertised %q", device.LocalName, name)
+	}
+
+	lines, _ := dispatchFrame(client, "DETAILS;"+TEST_VEHICLE+";2")
+	want := "DETAILS;" + TEST_VEHICLE + ";DriveSkull;" + encodeHex([]byte(name)) + ";004c:ff,beef:0001;2"
+	if len(lines) != 1 || lines[0] != want {
+		t.Fatalf("DETAILS answered %q, want %q", lines, want)
+	}
+	if lines, _ := dispatchFrame(client, "DETAILS;"+TEST_VEHICLE_2); len(lines) != 1 || lines[0] != "DETAILS;FAILED;unknown-address" {
+		t.Fatalf("DETAILS of an unknown vehicle answered %q", lines)
+	}
+}
+
+// BATCH writes its messages in the order given and answers once, a failed write ends the batch and names the message
+func TestBatchOrder(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	batch := [][]byte{EncodeSetSpeed(300, 1000), EncodeSetOffset(20), EncodeLights(LIGHT_HEADLIGHTS, true), EncodePing()}
+	var encoded []string
+	for _, payload := range batch {
+		encoded = append(encoded, encodeHex(payload))
+	}
+
+	client.Send("BATCH;" + TEST_VEHICLE + ";" + strings.Join(encoded, ",") + ";6")
+	client.Expect(t, "BATCH;SUCCESS;4;6")
+	writes := vehicle.Writes()
+	if len(writes) != len(batch) {
+		t.Fatalf("%d writes for a batch of %d", len(writes), len(batch))
+	}
+	for i := range batch {
+		if string(writes[i]) != string(batch[i]) {
+			t.Fatalf("write %d is %x, want %x", i, writes[i], batch[i])
+		}
+	}
+	if client.Count("BATCH;") != 1 {
+		t.Fatalf("%d answers to one batch", client.Count("BATCH;"))
+	}
+
+	for _, frame := range []string{"BATCH;" + TEST_VEHICLE, "BATCH;" + TEST_VEHICLE + ";0116,zz", "BATCH;" + TEST_VEHICLE + ";0116,,0116"} {
+		client.Send(frame)
+		client.Expect(t, "ERROR;invalid-batch")
+	}
+
+	var calls int32
+	vehicle.writer.OnWrite(func(p []byte) error {
+		if atomic.AddInt32(&calls, 1) == 2 {
+			return errors.New("rejected")
+		}
+		return nil
+	})
+	client.Send("BATCH;" + TEST_VEHICLE + ";" + strings.Join(encoded, ","))
+	client.Expect(t, "BATCH;FAILED;1;rejected")
+	// the failure has the adapter probed
+	waitUntil(t, "the adapter probe", func() bool { return atomic.LoadInt32(&calls) == 3 })
+	client.Send("DISCONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "DISCONNECT;SUCCESS")
+	if writes := len(vehicle.Writes()); writes != len(batch)+2 {
+		t.Fatalf("%d writes, the failed batch must stop at its failed message", writes)
+	}
+}
+
+// Scans merging into the known vehicles while other clients list and replay them, clean under the race detector
+func TestConcurrentScanAndList(t *testing.T) {
+	adapter := newTestServer(t)
+	for n := 1; n <= 5; n++ {
+		adapter.Advertise(testVehicleAddress(n), -50)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			client := newDispatchClient(t)
+			for j := 0; j < 5; j++ {
+				if lines, _ := dispatchFrame(client, "SCAN"); lines[len(lines)-1] != "SCAN;COMPLETED" {
+					t.Errorf("scan answered %q", lines)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			client := newDispatchClient(t)
+			for j := 0; j < 20; j++ {
+				dispatchFrame(client, "LIST")
+				dispatchFrame(client, "DISCOVERED")
+				dispatchFrame(client, "DETAILS;"+testVehicleAddress(1))
+			}
+		}()
+	}
+	wg.Wait()
+	if count := server.DiscoveredDevices.Count(); count != 5 {
+		t.Fatalf("%d vehicles known after the scans, want 5", count)
+	}
+}
+
+// With network tcp6 the server listens on IPv6 and clients connect over it, skipped where there is no IPv6 loopback
+func TestListenTcp6(t *testing.T) {
+	newTestServer(t)
+	l, err := listen(ListenerConf{Host: "::1", Port: "0", Network: "tcp6"})
+	if err != nil {
+		t.Skip("no IPv6 loopback: " + err.Error())
+	}
+	serveTestListener(t, l, nil)
+	if !strings.HasPrefix(l.Addr().String(), "[::1]:") {
+		t.Fatalf("listening on %v", l.Addr())
+	}
+	client := dialTestClient(t, "tcp6", l.Addr().String())
+	if got := client.Exchange(t, "PING"); got != "PONG" {
+		t.Fatalf("PING over IPv6 answered %q", got)
+	}
+
+	if _, err := listen(ListenerConf{Host: "127.0.0.1", Port: "0", Network: "udp"}); err == nil {
+		t.Fatal("listening on an unsupported network")
+	}
+}
+
+// GATT lists the characteristics discovered for a vehicle by UUID, followed by the COMPLETED sentinel
+func TestGattCharacteristics(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newDispatchClient(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	vehicle := adapter.Vehicle(TEST_VEHICLE)
+	vehicle.characteristics = []Characteristic{vehicle.reader, vehicle.writer}
+	dispatchFrame(client, "SCAN")
+	dispatchFrame(client, "CONNECT;"+TEST_VEHICLE)
+
+	lines, _ := dispatchFrame(client, "GATT;"+TEST_VEHICLE+";8")
+	want := []string{
+		"GATT;" + TEST_VEHICLE + ";" + ANKI_STR_CHR_WRITE_UUID.String() + ";write-without-response",
+		"GATT;" + TEST_VEHICLE + ";" + ANKI_STR_CHR_READ_UUID.String() + ";notify",
+		"GATT;COMPLETED;8",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("GATT answered %q, want %q", lines, want)
+	}
+	if lines, _ := dispatchFrame(client, "GATT;"+TEST_VEHICLE_2); len(lines) != 1 || lines[0] != "GATT;FAILED;not-connected" {
+		t.Fatalf("GATT of a vehicle not connected answered %q", lines)
+	}
+}
+
+// Each configured listener permits its own commands, a client is held to the set of the listener it connected to
+func TestListenersWithPermissions(t *testing.T) {
+	adapter := newTestServer(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	serverConf.Listeners = []ListenerConf{
+		{Host: "127.0.0.1", Port: "0"},
+		{Host: "127.0.0.1", Port: "0", AllowedCommands: []string{"ping", "STATUS"}},
+	}
+	var addresses []string
+	for _, listenerConf := range configuredListeners(serverConf) {
+		l, err := listen(listenerConf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serveTestListener(t, l, permittedCommands(listenerConf.AllowedCommands))
+		addresses = append(addresses, l.Addr().String())
+	}
+	control := dialTestClient(t, "tcp", addresses[0])
+	telemetry := dialTestClient(t, "tcp", addresses[1])
+
+	control.Send(t, "SCAN")
+	control.Expect(t, "SCAN;COMPLETED")
+	if got := control.Exchange(t, "CONNECT;"+TEST_VEHICLE); got != "CONNECT;SUCCESS" {
+		t.Fatalf("CONNECT on the control listener answered %q", got)
+	}
+
+	if got := telemetry.Exchange(t, "PING;1"); got != "PONG;1" {
+		t.Fatalf("PING on the restricted listener answered %q", got)
+	}
+	if got := telemetry.Exchange(t, "STATUS"); !strings.HasPrefix(got, "STATUS;") {
+		t.Fatalf("STATUS on the restricted listener answered %q", got)
+	}
+	for _, frame := range []string{"SCAN", "DISCONNECT;" + TEST_VEHICLE, TEST_VEHICLE + ";0116", "ESTOP"} {
+		if got := telemetry.Exchange(t, frame); got != "ERROR;not-permitted" {
+			t.Fatalf("%q on the restricted listener answered %q", frame, got)
+		}
+	}
+	if !server.ConnectedDevices.Has(TEST_VEHICLE) || len(adapter.Vehicle(TEST_VEHICLE).Writes()) != 0 {
+		t.Fatal("a command the listener does not permit reached the vehicle")
+	}
+}
+
+// The configured scanMode is set on the adapter, an unknown mode is refused without touching it
+func TestApplyScanMode(t *testing.T) {
+	adapter := newTestServer(t)
+	if err := applyScanMode(SCAN_MODE_PASSIVE); err != nil {
+		t.Fatal(err)
+	}
+	if mode := adapter.ScanMode(); mode != SCAN_MODE_PASSIVE {
+		t.Fatalf("adapter scans %s, want %s", mode, SCAN_MODE_PASSIVE)
+	}
+	if err := applyScanMode("aggressive"); err == nil || adapter.ScanMode() != SCAN_MODE_PASSIVE {
+		t.Fatalf("unknown scan mode applied: %v", err)
+	}
+
+	// the BLE stack can only scan actively
+	if err := (&BluetoothAdapter{}).SetScanMode(SCAN_MODE_PASSIVE); err == nil {
+		t.Fatal("BLE adapter accepted passive scanning")
+	}
+}
+
+// A passive scan of the simulated vehicles gets no scan response, so no local name
+func TestSimAdapterPassiveScan(t *testing.T) {
+	for _, mode := range []string{SCAN_MODE_ACTIVE, SCAN_MODE_PASSIVE} {
+		t.Run(mode, func(t *testing.T) {
+			sim := newSimAdapter()
+			sim.SetScanMode(mode)
+			found := make(chan AnkiVehicle, len(sim.vehicles))
+			done := make(chan error)
+			go func() { done <- sim.Scan(func(vehicle AnkiVehicle) { found <- vehicle }) }()
+			vehicle := <-found
+			if err := sim.StopScan(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if want := map[string]string{SCAN_MODE_ACTIVE: SIM_LOCAL_NAME, SCAN_MODE_PASSIVE: ""}[mode]; vehicle.LocalName != want {
+				t.Fatalf("%s scan found local name %q, want %q", mode, vehicle.LocalName, want)
+			}
+		})
+	}
+}
+
+// Without an adapter the server refuses to start with an actionable message, unless allowNoAdapter is set
+func TestStartWithoutAdapter(t *testing.T) {
+	adapter := newTestServer(t)
+	adapter.enableErr = errors.New("no default adapter present")
+
+	err := startAdapter()
+	if err == nil {
+		t.Fatal("started without an adapter")
+	}
+	for _, hint := range []string{"No BLE adapter found", "no default adapter present", "allowNoAdapter"} {
+		if !strings.Contains(err.Error(), hint) {
+			t.Errorf("startup error %q does not mention %q", err, hint)
+		}
+	}
+
+	serverConf.AllowNoAdapter = true
+	if err := startAdapter(); err != nil {
+		t.Fatalf("allowNoAdapter set and startup failed: %v", err)
+	}
+	if adapterReady() {
+		t.Fatal("adapter reported ready without one")
+	}
+	// the server then runs, but refuses to scan as long as there is no adapter
+	client := newTestClient(t, nil)
+	client.Send("SCAN")
+	client.Expect(t, "SCAN;FAILED;adapter-not-ready")
+}
+
+// A client that vanished without closing its socket is let go once the keepalive probe fails its pending read, and
+// the vehicles only it owned are disconnected
+func TestHalfOpenClientReleased(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Vanish(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ETIMEDOUT)})
+	waitUntil(t, "the vehicle to be released", func() bool { return vehicle.Disconnects() == 1 })
+	if server.ConnectedDevices.Has(TEST_VEHICLE) || server.VehicleClients.Has(TEST_VEHICLE) {
+		t.Fatal("vehicle of the vanished client still tracked")
+	}
+	waitUntil(t, "the client to be let go", func() bool { return atomic.LoadInt32(&liveConnections) == 0 })
+}
+
+// The client over maxConnections is answered ERROR;server-full and closed, a client leaving makes room again
+func TestMaxConnections(t *testing.T) {
+	newTestServer(t)
+	serverConf.MaxConnections = 3
+	l, err := listen(ListenerConf{Host: "127.0.0.1", Port: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTestListener(t, l, nil)
+
+	var clients []*socketClient
+	for i := 0; i < serverConf.MaxConnections; i++ {
+		client := dialTestClient(t, "tcp", l.Addr().String())
+		if got := client.Exchange(t, "PING"); got != "PONG" {
+			t.Fatalf("client %d of %d answered %q", i+1, serverConf.MaxConnections, got)
+		}
+		clients = append(clients, client)
+	}
+	rejected := dialTestClient(t, "tcp", l.Addr().String())
+	if got := rejected.ReadLine(t); got != "ERROR;server-full" {
+		t.Fatalf("client over the limit answered %q", got)
+	}
+	rejected.conn.SetReadDeadline(time.Now().Add(TEST_TIMEOUT))
+	if _, err := rejected.reader.ReadByte(); err != io.EOF {
+		t.Fatalf("rejected client still connected: %v", err)
+	}
+
+	clients[0].conn.Close()
+	waitUntil(t, "the client to leave", func() bool {
+		return atomic.LoadInt32(&liveConnections) == int32(serverConf.MaxConnections-1)
+	})
+	if got := dialTestClient(t, "tcp", l.Addr().String()).Exchange(t, "PING"); got != "PONG" {
+		t.Fatalf("client taking the free place answered %q", got)
+	}
+}
+
+// An accept error that goes away on its own, like running out of file descriptors
+type temporaryAcceptError struct{}
+
+func (temporaryAcceptError) Error() string   { return "accept: too many open files" }
+func (temporaryAcceptError) Timeout() bool   { return false }
+func (temporaryAcceptError) Temporary() bool { return true }
+
+// A listener whose first accepts fail with a temporary error
+type flakyListener struct {
+	net.Listener
+	failures int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.failures, -1) >= 0 {
+		return nil, temporaryAcceptError{}
+	}
+	return l.Listener.Accept()
+}
+
+// Temporary accept errors are retried, the clients connecting afterwards are served
+func TestAcceptRetriesTemporaryErrors(t *testing.T) {
+	newTestServer(t)
+	l, err := listen(ListenerConf{Host: "127.0.0.1", Port: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flaky := &flakyListener{Listener: l, failures: 3}
+	serveTestListener(t, flaky, nil)
+
+	client := dialTestClient(t, "tcp", l.Addr().String())
+	if got := client.Exchange(t, "PING"); got != "PONG" {
+		t.Fatalf("PING after the accept errors answered %q", got)
+	}
+	if failures := atomic.LoadInt32(&flaky.failures); failures >= 0 {
+		t.Fatalf("served before the accept errors were retried, %d left", failures+1)
+	}
+	second := dialTestClient(t, "tcp", l.Addr().String())
+	if got := second.Exchange(t, "PING"); got != "PONG" {
+		t.Fatalf("PING of the next client answered %q", got)
+	}
+}
+
+// The configured onConnectCommands are written in order before CONNECT;SUCCESS, a failing one fails the connect
+func TestOnConnectCommands(t *testing.T) {
+	adapter := newTestServer(t)
+	var err error
+	onConnectPayloads, err = decodeOnConnectCommands([]string{"03900101", "052c00000000", "0624c800e803"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	if got := strings.Join(vehicle.WrittenHex(), ","); got != "03900101,052c00000000,0624c800e803" {
+		t.Fatalf("on connect wrote %s", got)
+	}
+
+	failing := adapter.Vehicle(TEST_VEHICLE_2)
+	failing.writer.onWrite = func(p []byte) error {
+		if p[1] == ANKI_MSG_C2V_SET_OFFSET {
+			return errors.New("write failed")
+		}
+		return nil
+	}
+	adapter.Advertise(TEST_VEHICLE_2, -50)
+	client.Send("SCAN")
+	client.Expect(t, "SCAN;COMPLETED")
+	client.Send("CONNECT;" + TEST_VEHICLE_2)
+	client.Expect(t, "CONNECT;FAILED;on-connect")
+	if failing.Disconnects() != 1 || server.ConnectedDevices.Has(TEST_VEHICLE_2) {
+		t.Fatal("vehicle kept connected after an on-connect command failed")
+	}
+	if writes := len(failing.Writes()); writes != 1 {
+		t.Fatalf("%d on-connect commands written, the ones after the failed one must not be", writes)
+	}
+
+	if _, err := decodeOnConnectCommands([]string{"0116", "sdk"}); err == nil {
+		t.Fatal("onConnectCommands entry that is not hex accepted")
+	}
+}
+
+// REDISCOVER replaces the stored characteristics of a connected vehicle and subscribes to a reader that moved
+func TestRediscoverVehicle(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	// a reader at the same handle keeps its subscription
+	writer := &fakeCharacteristic{uuid: ANKI_STR_CHR_WRITE_UUID}
+	unchanged := &fakeCharacteristic{uuid: ANKI_STR_CHR_READ_UUID, handle: vehicle.reader.handle}
+	vehicle.mu.Lock()
+	vehicle.characteristics = []Characteristic{unchanged, writer}
+	vehicle.mu.Unlock()
+	client.Send("REDISCOVER;" + TEST_VEHICLE)
+	client.Expect(t, "REDISCOVER;SUCCESS")
+	if stored, _ := server.DeviceCharacteristics.Get(TEST_VEHICLE); stored.Writer != writer || stored.Reader != vehicle.reader {
+		t.Fatal("stored characteristics not replaced, or the subscribed reader replaced")
+	}
+	unchanged.mu.Lock()
+	subscribed := unchanged.callback != nil
+	unchanged.mu.Unlock()
+	if subscribed {
+		t.Fatal("unchanged reader subscribed to again")
+	}
+
+	// a reader that fails to subscribe leaves the stored characteristics as they are
+	failing := &fakeCharacteristic{uuid: ANKI_STR_CHR_READ_UUID, handle: 0x0e, notifyErr: errors.New("notify failed")}
+	vehicle.mu.Lock()
+	vehicle.characteristics = []Characteristic{failing, &fakeCharacteristic{uuid: ANKI_STR_CHR_WRITE_UUID}}
+	vehicle.mu.Unlock()
+	client.Send("REDISCOVER;" + TEST_VEHICLE)
+	client.Expect(t, "REDISCOVER;FAILED;notify failed")
+	if stored, _ := server.DeviceCharacteristics.Get(TEST_VEHICLE); stored.Writer != writer || stored.Reader != vehicle.reader {
+		t.Fatal("stored characteristics replaced by a failed rediscovery")
+	}
+
+	reader := &fakeCharacteristic{uuid: ANKI_STR_CHR_READ_UUID, handle: 0x0e}
+	vehicle.mu.Lock()
+	vehicle.characteristics = []Characteristic{reader, writer}
+	vehicle.mu.Unlock()
+	client.Send("REDISCOVER;" + TEST_VEHICLE)
+	client.Expect(t, "REDISCOVER;SUCCESS")
+	if stored, _ := server.DeviceCharacteristics.Get(TEST_VEHICLE); stored.Writer != writer || stored.Reader != reader {
+		t.Fatal("stored characteristics not replaced")
+	}
+
+	client.Send(TEST_VEHICLE + ";0116;ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	if len(writer.Writes()) != 1 || len(vehicle.writer.Writes()) != 0 {
+		t.Fatal("write did not go to the rediscovered writer")
+	}
+	reader.mu.Lock()
+	callback := reader.callback
+	reader.mu.Unlock()
+	if callback == nil {
+		t.Fatal("notifications of the rediscovered reader not enabled")
+	}
+	callback(transitionUpdate(1, 0, 0))
+	client.Expect(t, TEST_VEHICLE+";"+encodeHex(transitionUpdate(1, 0, 0)))
+
+	vehicle.mu.Lock()
+	vehicle.discoverErr = errors.New("discovery failed")
+	vehicle.mu.Unlock()
+	client.Send("REDISCOVER;" + TEST_VEHICLE)
+	client.Expect(t, "REDISCOVER;FAILED;")
+	client.Send("REDISCOVER;" + TEST_VEHICLE_2)
+	client.Expect(t, "REDISCOVER;FAILED;"+errNotConnected.Error())
+}
+
+// READ answers the value of the vehicle's read characteristic in hex, a failed read with READ;FAILED
+func TestReadCharacteristic(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	vehicle.reader.mu.Lock()
+	vehicle.reader.value = []byte{0x03, 0x1b, 0x10, 0x0e}
+	vehicle.reader.mu.Unlock()
+	client.Send("READ;" + TEST_VEHICLE)
+	if got := client.Expect(t, TEST_VEHICLE+";READ;"); got != TEST_VEHICLE+";READ;031b100e" {
+		t.Fatalf("read answered %q", got)
+	}
+
+	vehicle.reader.mu.Lock()
+	vehicle.reader.readErr = errors.New("read failed")
+	vehicle.reader.mu.Unlock()
+	client.Send("READ;" + TEST_VEHICLE + ";3")
+	client.Expect(t, "READ;FAILED;read failed;3")
+	client.Send("READ;" + TEST_VEHICLE_2)
+	client.Expect(t, "READ;FAILED;"+errNotConnected.Error())
+}
+
+// A scan that runs into scanTimeoutSeconds stops the adapter's scan and waits for it, leaving no goroutine behind
+func TestScanTimeoutStopsScan(t *testing.T) {
+	adapter := newTestServer(t)
+	adapter.holdScan = true
+	adapter.Advertise(TEST_VEHICLE, -50)
+	base := runtime.NumGoroutine()
+
+	start := time.Now()
+	found, err := scan(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < time.Duration(serverConf.ScanTimeoutSeconds)*time.Second {
+		t.Fatalf("scan returned after %v, before its timeout", took)
+	}
+	if !found.Has(TEST_VEHICLE) {
+		t.Fatal("vehicle found before the timeout left out")
+	}
+	if _, scans, stopScans, _ := adapter.Calls(); scans != 1 || stopScans != 1 {
+		t.Fatalf("%d scans stopped %d times, want the timed out scan stopped once", scans, stopScans)
+	}
+	adapter.mu.Lock()
+	scanning := adapter.stopScan != nil
+	adapter.mu.Unlock()
+	if scanning {
+		t.Fatal("adapter still scanning after the timeout")
+	}
+	waitUntil(t, "the scan goroutine to end", func() bool { return runtime.NumGoroutine() <= base })
+}
+
+// SPEED_ALL writes the same speed to every connected vehicle in parallel and reports the ones that failed
+func TestSpeedAll(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	addresses := []string{TEST_VEHICLE, TEST_VEHICLE_2, "AA:00:00:00:00:03"}
+	var vehicles []*fakeVehicle
+	for _, address := range addresses {
+		vehicles = append(vehicles, connectTestVehicle(t, adapter, client, address))
+	}
+
+	// every write waits for the others to start, so writes made one after another time out
+	var arrived sync.WaitGroup
+	arrived.Add(len(vehicles))
+	allArrived := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(allArrived)
+	}()
+	for i, vehicle := range vehicles {
+		failing := i == len(vehicles)-1
+		vehicle.writer.OnWrite(func(p []byte) error {
+			arrived.Done()
+			select {
+			case <-allArrived:
+			case <-time.After(TEST_TIMEOUT):
+				return errors.New("written one after another")
+			}
+			if failing {
+				return errors.New("write failed")
+			}
+			return nil
+		})
+	}
+
+	client.Send("SPEED_ALL;500;1000;4")
+	client.Expect(t, "SPEED_ALL;FAILED;"+addresses[2]+";write failed")
+	client.Expect(t, "SPEED_ALL;DONE;2;4")
+	for _, vehicle := range vehicles[:2] {
+		if writes := vehicle.Writes(); len(writes) != 1 || string(writes[0]) != string(EncodeSetSpeed(500, 1000)) {
+			t.Fatalf("%s received %x", vehicle.address, writes)
+		}
+	}
+}
+
+// A command naming a vehicle by its alias targets the aliased address, raw writes included
+func TestAliasTargetsVehicle(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	skull := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	groundShock := connectTestVehicle(t, adapter, client, TEST_VEHICLE_2)
+
+	client.Send("ALIAS;"+TEST_VEHICLE+";Skull", "ALIAS;"+TEST_VEHICLE_2+";Ground Shock")
+	client.Expect(t, "ALIAS;SUCCESS")
+	client.Expect(t, "ALIAS;SUCCESS")
+	client.Send("Skull;0116;ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	client.Send("LIGHTS;Ground Shock;ENGINE;ON")
+	client.Expect(t, "LIGHTS;SUCCESS")
+	groundShock.ExpectWrite(t, EncodeLights(LIGHT_ENGINE, true))
+	if len(skull.Writes()) != 1 || len(groundShock.Writes()) != 1 {
+		t.Fatalf("%d and %d writes, each alias must only reach its own vehicle", len(skull.Writes()), len(groundShock.Writes()))
+	}
+
+	// an alias can be moved to another vehicle, but only to one that was discovered
+	client.Send("ALIAS;" + TEST_VEHICLE_2 + ";Skull")
+	client.Expect(t, "ALIAS;SUCCESS")
+	if address := normalizeAddress("Skull"); address != TEST_VEHICLE_2 {
+		t.Fatalf("moved alias resolves to %s", address)
+	}
+	client.Send("ALIAS;AA:00:00:00:00:09;Nuke")
+	client.Expect(t, "ALIAS;FAILED;not-discovered")
+	client.Send("ALIAS;" + TEST_VEHICLE + ";aa:00")
+	client.Expect(t, "ALIAS;FAILED;invalid-name")
+}
+
+// A write hanging past writeTimeoutMillis is answered address;WRITE;TIMEOUT right away, the vehicle's next commands
+// wait until the hung write returned
+func TestWriteTimeout(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.WriteTimeoutMillis = 50
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	release := make(chan struct{})
+	vehicle.writer.OnWrite(func(p []byte) error {
+		if p[1] == ANKI_MSG_C2V_PING_REQUEST {
+			<-release
+		}
+		return nil
+	})
+	client.Send(TEST_VEHICLE + ";0116;ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;TIMEOUT")
+	client.Send(TEST_VEHICLE + ";0624c800e803;ACK")
+	client.Refute(t, TEST_VEHICLE+";WRITE;", 100*time.Millisecond)
+	if got := vehicle.WrittenHex(); len(got) != 0 {
+		t.Fatalf("written %q while the ping hangs", got)
+	}
+
+	// the hung write completes once the stack lets go of it, the next command follows it
+	close(release)
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	if got := vehicle.WrittenHex(); len(got) != 2 || got[0] != "0116" || got[1] != "0624c800e803" {
+		t.Fatalf("written %q, want the ping before the speed", got)
+	}
+	client.Send("DISCONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "DISCONNECT;SUCCESS")
+}
+
+// With minRSSI set a scan only reports the vehicles advertising at or above it, 0 reports every vehicle
+func TestScanMinRSSI(t *testing.T) {
+	adapter := newTestServer(t)
+	addresses := []string{TEST_VEHICLE, TEST_VEHICLE_2, "AA:00:00:00:00:03"}
+	for i, rssi := range []int16{-40, -70, -90} {
+		adapter.Advertise(addresses[i], rssi)
+	}
+	for _, test := range []struct {
+		minRSSI int16
+		want    []string
+	}{
+		{-70, addresses[:2]},
+		{0, addresses},
+	} {
+		serverConf.MinRSSI = test.minRSSI
+		found, err := scan(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := found.Keys(); len(keys) != len(test.want) {
+			t.Fatalf("minRSSI %d found %q, want %q", test.minRSSI, keys, test.want)
+		}
+		for _, address := range test.want {
+			if !found.Has(address) {
+				t.Fatalf("minRSSI %d left out %s", test.minRSSI, address)
+			}
+		}
+	}
+
+	serverConf.MinRSSI = -70
+	client := newTestClient(t, nil)
+	client.Send("SCAN")
+	client.Expect(t, "SCAN;COMPLETED")
+	if scanned := client.Count("SCAN;AA:"); scanned != 2 {
+		t.Fatalf("SCAN reported %d vehicles, want the 2 above minRSSI", scanned)
+	}
+}
+
+// With maxScanResults set a scan stops the adapter once it found that many vehicles instead of running into its timeout
+func TestMaxScanResults(t *testing.T) {
+	adapter := newTestServer(t)
+	adapter.holdScan = true
+	serverConf.MaxScanResults = 3
+	for i := 1; i <= 5; i++ {
+		adapter.Advertise("AA:00:00:00:00:0"+strconv.Itoa(i), -50)
+	}
+	client := newTestClient(t, nil)
+
+	start := time.Now()
+	client.Send("SCAN;1")
+	client.Expect(t, "SCAN;COMPLETED;1")
+	if took := time.Since(start); took >= time.Duration(serverConf.ScanTimeoutSeconds)*time.Second {
+		t.Fatalf("scan took %v, it ran into its timeout", took)
+	}
+	if scanned := client.Count("SCAN;AA:"); scanned != serverConf.MaxScanResults {
+		t.Fatalf("%d vehicles reported, want %d", scanned, serverConf.MaxScanResults)
+	}
+	if _, _, stopScans, _ := adapter.Calls(); stopScans != 1 {
+		t.Fatalf("adapter scan stopped %d times", stopScans)
+	}
+}
+
+// With readTimeoutSeconds set an idle client is closed with ERROR;read-timeout and its vehicles released, a client
+// that keeps pinging stays connected, and READ_TIMEOUT;0 exempts a client
+func TestReadTimeout(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.ReadTimeoutSeconds = 1
+	idle := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, idle, TEST_VEHICLE)
+	pinging := newTestClient(t, nil)
+	exempt := newTestClient(t, nil)
+	exempt.Send("READ_TIMEOUT;0;1")
+	exempt.Expect(t, "READ_TIMEOUT;SUCCESS;1")
+
+	timeout := time.Duration(serverConf.ReadTimeoutSeconds) * time.Second
+	for start := time.Now(); time.Since(start) < timeout*3/2; time.Sleep(timeout / 4) {
+		pinging.Send("PING")
+		pinging.Expect(t, "PONG")
+	}
+	idle.Expect(t, "ERROR;read-timeout")
+	waitUntil(t, "the idle client to be closed", idle.Closed)
+	waitUntil(t, "the idle client's vehicle to be released", func() bool { return vehicle.Disconnects() == 1 })
+	if pinging.Closed() || exempt.Closed() {
+		t.Fatal("client closed although it pinged or turned the timeout off")
+	}
+	exempt.Send("PING")
+	exempt.Expect(t, "PONG")
+}
+
+// Concurrent CONNECTs take turns on maxConcurrentConnects slots, and each one still reports its own result
+func TestConnectConcurrencyLimit(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.MaxConcurrentConnects = 2
+	connectSlots = make(chan struct{}, serverConf.MaxConcurrentConnects)
+	var inFlight, most int32
+	adapter.onConnect = func(address string) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			seen := atomic.LoadInt32(&most)
+			if n <= seen || atomic.CompareAndSwapInt32(&most, seen, n) {
+				break
+			}
+		}
+		time.Sleep(30 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+	}
+	const vehicles = 5
+	for i := 1; i <= vehicles; i++ {
+		adapter.Advertise("AA:00:00:00:00:0"+strconv.Itoa(i), -50)
+	}
+	scanner := newTestClient(t, nil)
+	scanner.Send("SCAN")
+	scanner.Expect(t, "SCAN;COMPLETED")
+
+	var clients []*fakeConn
+	for i := 1; i <= vehicles; i++ {
+		client := newTestClient(t, nil)
+		client.Send("CONNECT;AA:00:00:00:00:0" + strconv.Itoa(i) + ";" + strconv.Itoa(i))
+		clients = append(clients, client)
+	}
+	for i, client := range clients {
+		client.Expect(t, "CONNECT;SUCCESS;"+strconv.Itoa(i+1))
+	}
+	if n := atomic.LoadInt32(&most); n != int32(serverConf.MaxConcurrentConnects) {
+		t.Fatalf("at most %d connects ran at once, want %d", n, serverConf.MaxConcurrentConnects)
+	}
+}
+
+// Raw writes to an address that is nowhere to be found or to an alias never set are answered
+// ERROR;unknown-target;<address> after alias resolution, a known vehicle not connected with ERROR;not-connected
+func TestUnknownTarget(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	adapter.Advertise(TEST_VEHICLE_2, -50)
+	client.Send("SCAN")
+	client.Expect(t, "SCAN;COMPLETED")
+	client.Send("ALIAS;"+TEST_VEHICLE+";Skull", "ALIAS;"+TEST_VEHICLE_2+";Ground Shock")
+	client.Expect(t, "ALIAS;SUCCESS")
+	client.Expect(t, "ALIAS;SUCCESS")
+
+	tests := []struct {
+		frame string
+		want  string
+	}{
+		{"AA:00:00:00:00:99;0116", "ERROR;unknown-target;AA:00:00:00:00:99"},
+		{"AA:00:00:00:00:99;0116;ACK", "ERROR;unknown-target;AA:00:00:00:00:99"},
+		{"aa:00:00:00:00:01;0116", "ERROR;unknown-target;aa:00:00:00:00:01"},
+		{"Skul;0116", "ERROR;unknown-target;Skul"},
+		{"Nuke;0116;ACK", "ERROR;unknown-target;Nuke"},
+		{"Ground Shock;0116", "ERROR;not-connected;" + TEST_VEHICLE_2},
+		{TEST_VEHICLE_2 + ";0116;ACK", "ERROR;not-connected;" + TEST_VEHICLE_2},
+	}
+	for _, test := range tests {
+		client.Send(test.frame)
+		if got := client.Expect(t, "ERROR;"); got != test.want {
+			t.Errorf("%q answered %q, want %q", test.frame, got, test.want)
+		}
+	}
+
+	// the handler survived all of them and the connected vehicle got none of the writes
+	client.Send("Skull;0116;ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	if writes := len(vehicle.Writes()); writes != 1 {
+		t.Fatalf("%d writes, only the one to the connected vehicle must reach it", writes)
+	}
+}
+
+// TXPOWER passes an allowed level on to the adapter and reports the adapter's power, an adapter without the
+// capability is answered TXPOWER;FAILED;unsupported for both
+func TestTxPower(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+
+	client.Send("TXPOWER;4;1")
+	client.Expect(t, "TXPOWER;FAILED;unsupported;1")
+	client.Send("TXPOWER")
+	client.Expect(t, "TXPOWER;FAILED;unsupported")
+
+	adapter.mu.Lock()
+	adapter.txPower, adapter.txPowerSupported = 0, true
+	adapter.mu.Unlock()
+	for _, level := range TX_POWER_LEVELS {
+		client.Send("TXPOWER;" + strconv.Itoa(level))
+		client.Expect(t, "TXPOWER;SUCCESS")
+		if power, _ := adapter.TxPower(); power != level {
+			t.Fatalf("adapter power %d after TXPOWER;%d", power, level)
+		}
+		client.Send("TXPOWER")
+		client.Expect(t, "TXPOWER;"+strconv.Itoa(level))
+	}
+	for _, frame := range []string{"TXPOWER;5", "TXPOWER;loud", "TXPOWER;-41"} {
+		client.Send(frame)
+		client.Expect(t, "TXPOWER;FAILED;invalid-power")
+	}
+	if power, _ := adapter.TxPower(); power != TX_POWER_LEVELS[len(TX_POWER_LEVELS)-1] {
+		t.Fatalf("adapter power %d changed by an invalid level", power)
+	}
+
+	// the BLE stack has no transmit power control
+	if _, err := (&BluetoothAdapter{}).TxPower(); err == nil || err.Error() != "unsupported" {
+		t.Fatalf("BLE adapter power query %v", err)
+	}
+}
+
+// A scan that ended before it was stopped is not stopped again
+func TestStopScanWhenEnded(t *testing.T) {
+	adapter := newTestServer(t)
+	done := make(chan error, 1)
+	done <- nil
+	started := int32(0)
+	if err := stopScan(done, &started); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, stopScans, _ := adapter.Calls(); stopScans != 0 {
+		t.Fatalf("%d stops of an ended scan", stopScans)
+	}
+
+	done <- errors.New("adapter busy")
+	if err := stopScan(done, &started); err == nil || err.Error() != "start scan: adapter busy" {
+		t.Fatalf("ended scan reported %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Exponential backoff with jitter for retried operations such as BLE reconnects. The delay doubles with every attempt
+ * up to a maximum, and only its upper half is fixed so retries for many vehicles don't line up and hammer the adapter
+ * together.
+ *
+ */
+
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// The cap of a Backoff without a positive Max, so the doubling delay can't overflow
+const BACKOFF_DEFAULT_MAX = 5 * time.Minute
+
+type Backoff struct {
+	Base time.Duration
+	// BACKOFF_DEFAULT_MAX if not positive
+	Max     time.Duration
+	attempt int
+	random  *rand.Rand
+}
+
+func newBackoff(base time.Duration, max time.Duration) *Backoff {
+	return &Backoff{Base: base, Max: max, random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Returns the delay before the next attempt, somewhere between half and all of Base * 2^attempt, capped at Max
+func (b *Backoff) Next() time.Duration {
+	max := b.Max
+	if max <= 0 {
+		max = BACKOFF_DEFAULT_MAX
+	}
+	delay := b.Base
+	for i := 0; i < b.attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	b.attempt++
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(b.random.Int63n(int64(half)+1))
+}
+
+// Starts over at Base, called once an attempt succeeded
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,50 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the exponential backoff.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Every delay lies in the upper half of Base * 2^attempt, capped at Max
+func TestBackoffGrowsWithinJitter(t *testing.T) {
+	backoff := newBackoff(100*time.Millisecond, time.Second)
+	for attempt, full := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		full *= time.Millisecond
+		if delay := backoff.Next(); delay < full/2 || delay > full {
+			t.Errorf("attempt %d: delay %v outside %v to %v", attempt, delay, full/2, full)
+		}
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	backoff := newBackoff(100*time.Millisecond, time.Second)
+	for i := 0; i < 5; i++ {
+		backoff.Next()
+	}
+	backoff.Reset()
+	if delay := backoff.Next(); delay < 50*time.Millisecond || delay > 100*time.Millisecond {
+		t.Errorf("delay after Reset %v, want Base again", delay)
+	}
+}
+
+// Without a positive Max the delay stops at BACKOFF_DEFAULT_MAX instead of doubling until it overflows
+func TestBackoffWithoutMax(t *testing.T) {
+	for _, max := range []time.Duration{0, -time.Second} {
+		backoff := newBackoff(time.Second, max)
+		for attempt := 0; attempt < 100; attempt++ {
+			if delay := backoff.Next(); delay < 0 || delay > BACKOFF_DEFAULT_MAX {
+				t.Fatalf("max %v, attempt %d: delay %v", max, attempt, delay)
+			}
+		}
+		if delay := backoff.Next(); delay < BACKOFF_DEFAULT_MAX/2 {
+			t.Errorf("max %v: delay %v after 100 attempts, want it capped at %v", max, delay, BACKOFF_DEFAULT_MAX)
+		}
+	}
+}
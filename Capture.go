@@ -0,0 +1,107 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Recording of the raw BLE notification stream for offline debugging. With captureDir set, every notification is
+ * appended to a per-session file as <unix nanos>;<address>;<hex>. Running the server with -replay <file> feeds a
+ * recording through the message decoders without any BLE hardware.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	captureFile  *os.File
+	captureMutex sync.Mutex
+)
+
+// Creates the capture file for this session inside dir
+func startCapture(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "capture-"+time.Now().Format("20060102-150405")+".log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	captureFile = file
+	displayInfo("Capturing notifications to " + file.Name())
+	return nil
+}
+
+// Appends a notification to the capture file, if capturing is enabled
+func captureNotification(address string, value []byte, receivedAt time.Time) {
+	captureMutex.Lock()
+	defer captureMutex.Unlock()
+	if captureFile == nil {
+		return
+	}
+	line := strconv.FormatInt(receivedAt.UnixNano(), 10) + ";" + address + ";" + hex.EncodeToString(value) + "\n"
+	if _, err := captureFile.WriteString(line); err != nil {
+		displayInfo("Could not capture notification: " + err.Error())
+	}
+}
+
+// A single recorded notification
+type CapturedNotification struct {
+	Timestamp time.Time
+	Address   string
+	Value     []byte
+}
+
+// Parses one line of a capture file
+func parseCaptureLine(line string) (CapturedNotification, error) {
+	fields := strings.Split(line, ";")
+	if len(fields) != 3 {
+		return CapturedNotification{}, errors.New("expected <timestamp>;<address>;<hex>")
+	}
+	nanos, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return CapturedNotification{}, err
+	}
+	value, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return CapturedNotification{}, err
+	}
+	return CapturedNotification{Timestamp: time.Unix(0, nanos), Address: fields[1], Value: value}, nil
+}
+
+// Feeds every notification of a capture file through the decoders and prints the result to out
+func replayCapture(path string, out io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		notification, err := parseCaptureLine(scanner.Text())
+		if err != nil {
+			displayInfo("Skipping line " + strconv.Itoa(lineNumber) + ": " + err.Error())
+			continue
+		}
+		decoded, ok := describeNotification(notification.Value)
+		if !ok {
+			decoded = hex.EncodeToString(notification.Value)
+		}
+		fmt.Fprintln(out, notification.Timestamp.Format(time.RFC3339Nano)+" "+notification.Address+";"+decoded)
+	}
+	return scanner.Err()
+}
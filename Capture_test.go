@@ -0,0 +1,87 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the notification capture and its replay.
+ *
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Notifications captured while the server runs replay through the decoders as they were received
+func TestCaptureReplayRoundTrip(t *testing.T) {
+	adapter := newTestServer(t)
+	dir := t.TempDir()
+	if err := startCapture(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		captureMutex.Lock()
+		defer captureMutex.Unlock()
+		captureFile.Close()
+		captureFile = nil
+	})
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	vehicle.Emit(positionUpdate(3, 17, -23.5, 300))
+	vehicle.Emit(transitionUpdate(18, 17, 0))
+	vehicle.Emit([]byte{0x01, 0xff})
+	client.Expect(t, TEST_VEHICLE+";01ff")
+
+	files, _ := filepath.Glob(filepath.Join(dir, "capture-*.log"))
+	if len(files) != 1 {
+		t.Fatalf("capture files %q, want one", files)
+	}
+	var replayed strings.Builder
+	if err := replayCapture(files[0], &replayed); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		TEST_VEHICLE + ";POS;3;17;-23.5;300",
+		TEST_VEHICLE + ";TRANSITION;18;17;0",
+		TEST_VEHICLE + ";01ff",
+	}
+	lines := strings.Split(strings.TrimSuffix(replayed.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("replayed %q, want %q", lines, want)
+	}
+	for i, line := range lines {
+		// each line is <RFC 3339 timestamp> <address>;<decoded>
+		stamp, decoded, _ := strings.Cut(line, " ")
+		if _, err := time.Parse(time.RFC3339Nano, stamp); err != nil || decoded != want[i] {
+			t.Errorf("replayed %q, want %q", line, want[i])
+		}
+	}
+}
+
+// Lines that are not notifications are skipped, the rest of the capture still replays
+func TestReplaySkipsDamagedLines(t *testing.T) {
+	newTestServer(t)
+	path := filepath.Join(t.TempDir(), "capture.log")
+	capture := "1700000000000000000;" + TEST_VEHICLE + ";0117\n" +
+		"garbage\n" +
+		"1700000000000000001;" + TEST_VEHICLE + ";zz\n" +
+		"\n" +
+		"1700000000000000002;" + TEST_VEHICLE_2 + ";0117\n"
+	if err := os.WriteFile(path, []byte(capture), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var replayed strings.Builder
+	if err := replayCapture(path, &replayed); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(replayed.String(), "\n"); got != 2 {
+		t.Fatalf("replayed %q, want the two valid lines", replayed.String())
+	}
+	if err := replayCapture(filepath.Join(t.TempDir(), "missing.log"), &replayed); err == nil {
+		t.Fatal("replaying a missing file succeeded")
+	}
+}
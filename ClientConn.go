@@ -0,0 +1,240 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Wraps a tcp client connection with a bounded outbound queue for vehicle notifications. The BLE notification
+ * callback only enqueues frames and a dedicated writer goroutine drains the queue to the socket, so a slow or
+ * stalled client can never block the BLE stack. Every goroutine working for the client watches its context, which is
+ * cancelled when the client goes away, so none of them outlives the connection.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	QUEUE_DROP_OLDEST = "drop-oldest"
+	QUEUE_CLOSE       = "close"
+)
+
+var nextClientId uint64
+
+type ClientConn struct {
+	Id       string
+	Conn     net.Conn
+	outbound chan []byte
+	ctx      context.Context
+	cancel   context.CancelFunc
+	once     sync.Once
+	dropped  uint64
+	// set to 1 while the client wants EVENT frames, read and written atomically
+	events int32
+	// set to 1 after RAW;OFF, when the client only wants decoded notifications, read and written atomically
+	rawOff int32
+	// set to 1 after ENCODING;COMPACT, read and written atomically
+	compact int32
+	// protocol version selected with HELLO, 0 until then, read and written atomically
+	protocol int32
+	// how long the client may stay silent before it is closed, 0 waits forever, read and written atomically
+	readTimeout int64
+	// commands the client's listener permits, nil permits every command
+	allowed map[string]bool
+	// the client's SLOW_VERBS commands waiting or running
+	slowCommands *CommandQueue
+	// the client's URGENT_VERBS commands, handled one after the other
+	urgentCommands *CommandQueue
+}
+
+// Wraps conn, registers it in server.Clients and starts its writer goroutine
+func newClientConn(conn net.Conn) *ClientConn {
+	size := serverConf.NotificationQueueSize
+	if size <= 0 {
+		size = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &ClientConn{
+		Id:       strconv.FormatUint(atomic.AddUint64(&nextClientId, 1), 10),
+		Conn:     conn,
+		outbound: make(chan []byte, size),
+		ctx:      ctx,
+		cancel:   cancel,
+
+		slowCommands:   &CommandQueue{workers: SLOW_COMMANDS_PER_CLIENT},
+		urgentCommands: &CommandQueue{},
+	}
+	client.SetReadTimeout(time.Duration(serverConf.ReadTimeoutSeconds) * time.Second)
+	server.Clients.Set(client.Id, client)
+	go client.writeLoop()
+	return client
+}
+
+func (c *ClientConn) writeLoop() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case frame := <-c.outbound:
+			if _, err := c.Conn.Write(frame); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// Queues a frame for the client without blocking. When the queue is full the configured policy either drops the
+// oldest queued frame or closes the connection.
+func (c *ClientConn) Notify(frame []byte) {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case c.outbound <- frame:
+			return
+		default:
+		}
+
+		if serverConf.NotificationQueuePolicy == QUEUE_CLOSE {
+			displayInfo("Notification queue full for " + c.Conn.RemoteAddr().String() + ", closing connection.")
+			c.Close()
+			return
+		}
+
+		select {
+		case <-c.outbound:
+			dropped := atomic.AddUint64(&c.dropped, 1)
+			displayInfo("Notification queue full for " + c.Conn.RemoteAddr().String() + ", dropped " + strconv.FormatUint(dropped, 10) + " notifications so far.")
+		default:
+		}
+	}
+}
+
+// Cancelled once the client disconnected or was closed
+func (c *ClientConn) Context() context.Context {
+	return c.ctx
+}
+
+// Writes a response to the client, or fails with net.ErrClosed once it went away, so a command finishing after the
+// disconnect does not write to the closed socket
+func (c *ClientConn) Write(p []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(p)
+}
+
+// The protocol version the client's messages are parsed with, version 1 until it sent HELLO
+func (c *ClientConn) Protocol() int {
+	if version := atomic.LoadInt32(&c.protocol); version != 0 {
+		return int(version)
+	}
+	return PROTOCOL_V1
+}
+
+func (c *ClientConn) SetProtocol(version int) {
+	atomic.StoreInt32(&c.protocol, int32(version))
+}
+
+// How long the client may go without sending a message, PING included, before it is closed. 0 waits forever
+func (c *ClientConn) ReadTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.readTimeout))
+}
+
+// Changes the read timeout, including the deadline of a read already waiting
+func (c *ClientConn) SetReadTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&c.readTimeout, int64(timeout))
+	c.slideDeadline()
+}
+
+// Moves the read deadline to a full read timeout from now
+func (c *ClientConn) slideDeadline() {
+	if timeout := c.ReadTimeout(); timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// Whether the client's listener permits the command verb
+func (c *ClientConn) Permits(verb string) bool {
+	return c.allowed == nil || c.allowed[verb]
+}
+
+// Number of notifications dropped because the client could not keep up
+func (c *ClientConn) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// Stops the writer goroutine and closes the underlying connection, safe to call more than once
+func (c *ClientConn) Close() {
+	c.once.Do(func() {
+		server.Clients.Remove(c.Id)
+		c.cancel()
+		c.Conn.Close()
+	})
+}
+
+// Queues a frame for every connected client
+func broadcast(frame []byte) {
+	for _, client := range server.Clients.Items() {
+		client.Notify(frame)
+	}
+}
+
+// Starts or stops delivering EVENT frames to the client
+func (c *ClientConn) SubscribeEvents(on bool) {
+	var value int32
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&c.events, value)
+}
+
+// Starts or stops forwarding the raw hex of every vehicle notification to the client
+func (c *ClientConn) ForwardRaw(on bool) {
+	var value int32
+	if !on {
+		value = 1
+	}
+	atomic.StoreInt32(&c.rawOff, value)
+}
+
+// Selects the compact binary encoding of position and transition updates, or the text encoding
+func (c *ClientConn) SetCompact(on bool) {
+	var value int32
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&c.compact, value)
+}
+
+// Whether the client sent SUBSCRIBE_EVENTS
+func (c *ClientConn) WantsEvents() bool {
+	return atomic.LoadInt32(&c.events) == 1
+}
+
+func (c *ClientConn) Compact() bool {
+	return atomic.LoadInt32(&c.compact) == 1
+}
+
+// Whether the client receives the raw hex of vehicle notifications, the default
+func (c *ClientConn) WantsRaw() bool {
+	return atomic.LoadInt32(&c.rawOff) == 0
+}
+
+// Queues EVENT;<event>;<address> for every client that sent SUBSCRIBE_EVENTS. Legacy SDK clients never see them.
+func broadcastEvent(event string, address string) {
+	frame := []byte("EVENT;" + event + ";" + address + "\n")
+	for _, client := range server.Clients.Items() {
+		if client.WantsEvents() {
+			client.Notify(frame)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the per-client notification queue, its policies for clients that can't keep up, of the events broadcast
+ * to the clients and of the teardown of a client that left.
+ *
+ */
+
+package main
+
+import (
+	"net"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The BLE notification callback returns right away for a client that stopped reading, however many notifications
+// arrive, and the client gets the newest ones once it reads again
+func TestNotifyDoesNotBlockOnSlowClient(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.NotificationQueueSize = 4
+	owner := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, owner, TEST_VEHICLE)
+
+	conn := newFakeConn()
+	slow := newClientConn(conn)
+	t.Cleanup(slow.Close)
+	subscribeVehicle(TEST_VEHICLE, slow)
+	conn.Stall()
+
+	const notifications = 100
+	for i := 0; i < notifications; i++ {
+		start := time.Now()
+		vehicle.Emit(positionUpdate(byte(i), 1, 0, 300))
+		if took := time.Since(start); took > 100*time.Millisecond {
+			t.Fatalf("notification %d blocked the callback for %v", i, took)
+		}
+	}
+	// the writer goroutine holds one frame besides the queue
+	if dropped := int(slow.Dropped()); dropped < notifications-serverConf.NotificationQueueSize-1 {
+		t.Fatalf("%d notifications dropped, the queue holds %d", dropped, serverConf.NotificationQueueSize)
+	}
+
+	conn.Unstall()
+	last := TEST_VEHICLE + ";" + encodeHex(positionUpdate(notifications-1, 1, 0, 300))
+	if got := conn.Expect(t, last); got != last {
+		t.Fatalf("newest notification %q", got)
+	}
+	if got := conn.Count(TEST_VEHICLE + ";"); got > serverConf.NotificationQueueSize+1 {
+		t.Fatalf("%d notifications delivered, more than the queue holds", got)
+	}
+	// the stalled client did not hold up the other subscriber
+	owner.Expect(t, last)
+}
+
+// With notificationQueuePolicy close a client whose queue overflows is disconnected instead
+func TestNotifyClosesSlowClient(t *testing.T) {
+	newTestServer(t)
+	serverConf.NotificationQueueSize = 4
+	serverConf.NotificationQueuePolicy = QUEUE_CLOSE
+	conn := newFakeConn()
+	client := newClientConn(conn)
+	t.Cleanup(client.Close)
+	conn.Stall()
+
+	for i := 0; i < 10; i++ {
+		client.Notify([]byte("frame;" + strconv.Itoa(i) + "\n"))
+	}
+	if !conn.Closed() || client.Context().Err() == nil {
+		t.Fatal("client with a full queue was not closed")
+	}
+	if server.Clients.Has(client.Id) {
+		t.Fatal("closed client is still listed")
+	}
+	// notifications for a closed client are dropped without blocking
+	client.Notify([]byte("frame;late\n"))
+}
+
+// A client that subscribed to events learns of the vehicles another client connects and disconnects, clients that
+// did not subscribe are not sent any
+func TestEventsReachOtherClients(t *testing.T) {
+	adapter := newTestServer(t)
+	watcher := newTestClient(t, nil)
+	legacy := newTestClient(t, nil)
+	watcher.Send("SUBSCRIBE_EVENTS;2")
+	watcher.Expect(t, "SUBSCRIBE_EVENTS;SUCCESS;2")
+
+	driver := newTestClient(t, nil)
+	connectTestVehicle(t, adapter, driver, TEST_VEHICLE)
+	watcher.Expect(t, "EVENT;CONNECTED;"+TEST_VEHICLE)
+	driver.Send("DISCONNECT;" + TEST_VEHICLE)
+	driver.Expect(t, "DISCONNECT;SUCCESS")
+	watcher.Expect(t, "EVENT;DISCONNECTED;"+TEST_VEHICLE)
+	legacy.Refute(t, "EVENT;", 20*time.Millisecond)
+	driver.Refute(t, "EVENT;", 0)
+
+	watcher.Send("UNSUBSCRIBE_EVENTS")
+	watcher.Expect(t, "UNSUBSCRIBE_EVENTS;SUCCESS")
+	driver.Send("CONNECT;" + TEST_VEHICLE)
+	driver.Expect(t, "CONNECT;SUCCESS")
+	watcher.Refute(t, "EVENT;", 20*time.Millisecond)
+}
+
+// A client that connects a vehicle, subscribes and leaves takes every goroutine started for it along
+func TestClientLeavesNoGoroutines(t *testing.T) {
+	adapter := newTestServer(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	base := runtime.NumGoroutine()
+
+	for i := 0; i < 5; i++ {
+		client := newFakeConn()
+		done := make(chan struct{})
+		go func() {
+			handleRequest(client, nil)
+			close(done)
+		}()
+		client.Send("SCAN")
+		client.Expect(t, "SCAN;COMPLETED")
+		client.Send("CONNECT;" + TEST_VEHICLE)
+		client.Expect(t, "CONNECT;SUCCESS")
+		client.Send("SUBSCRIBE_EVENTS;2", TEST_VEHICLE+";0116;ACK")
+		client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+		adapter.Vehicle(TEST_VEHICLE).Emit(positionUpdate(1, 17, 0, 300))
+		client.Expect(t, TEST_VEHICLE+";")
+
+		client.Close()
+		<-done
+		waitUntil(t, "the vehicle to be released", func() bool { return !server.ConnectedDevices.Has(TEST_VEHICLE) })
+	}
+	waitUntil(t, "the clients' goroutines to end", func() bool { return runtime.NumGoroutine() <= base })
+}
+
+// A client that left, whether it closed the connection or vanished, is reported EVENT;CLIENT_GONE;<remote address>
+// to the other clients, and the vehicles only it owned are released
+func TestClientGoneEvent(t *testing.T) {
+	for _, drop := range []string{"close", "vanish"} {
+		t.Run(drop, func(t *testing.T) {
+			adapter := newTestServer(t)
+			watcher := newTestClient(t, nil)
+			shared := connectTestVehicle(t, adapter, watcher, TEST_VEHICLE_2)
+			watcher.Send("SUBSCRIBE_EVENTS;2")
+			watcher.Expect(t, "SUBSCRIBE_EVENTS;SUCCESS;2")
+
+			driver := newTestClient(t, nil)
+			owned := connectTestVehicle(t, adapter, driver, TEST_VEHICLE)
+			driver.Send("CONNECT;" + TEST_VEHICLE_2)
+			driver.Expect(t, "CONNECT;SUCCESS")
+			if drop == "close" {
+				driver.Close()
+			} else {
+				driver.Vanish(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ETIMEDOUT})
+			}
+
+			watcher.Expect(t, "EVENT;CLIENT_GONE;"+driver.RemoteAddr().String())
+			waitUntil(t, "the vehicle only the driver owned to be released", func() bool { return owned.Disconnects() == 1 })
+			if shared.Disconnects() != 0 || !server.ConnectedDevices.Has(TEST_VEHICLE_2) {
+				t.Fatal("the vehicle the watcher still owns was released")
+			}
+			if clients, _ := server.VehicleClients.Get(TEST_VEHICLE_2); clients.OwnerCount() != 1 {
+				t.Fatalf("%d owners left, the driver's ownership was kept", clients.OwnerCount())
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Optional coalescing of position updates, enabled with notificationCoalesceMillis. A vehicle reports its position
+ * many times a second; with coalescing only the latest position update within each interval is forwarded to the
+ * clients, while every other notification still passes through at once. The server itself keeps using every update.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type Coalescer struct {
+	mu        sync.Mutex
+	latest    NotificationFrames
+	lastSent  time.Time
+	scheduled bool
+}
+
+// Forwards the frames of a position update right away if none was forwarded within interval, otherwise holds on to
+// them until the interval is over, replacing any update held before
+func coalescePosition(address string, frames NotificationFrames, interval time.Duration) {
+	c := server.Coalescers.Upsert(address, nil, func(exist bool, valueInMap *Coalescer, newValue *Coalescer) *Coalescer {
+		if exist {
+			return valueInMap
+		}
+		return &Coalescer{}
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.scheduled {
+		c.latest = frames
+		return
+	}
+	wait := interval - time.Since(c.lastSent)
+	if wait <= 0 {
+		c.lastSent = time.Now()
+		notifyRawSubscribers(address, frames)
+		return
+	}
+	c.latest = frames
+	c.scheduled = true
+	time.AfterFunc(wait, func() {
+		c.mu.Lock()
+		latest := c.latest
+		c.latest = NotificationFrames{}
+		c.scheduled = false
+		c.lastSent = time.Now()
+		c.mu.Unlock()
+		notifyRawSubscribers(address, latest)
+	})
+}
@@ -0,0 +1,53 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the coalescing of position updates.
+ *
+ */
+
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// A burst of position updates within notificationCoalesceMillis is forwarded as its first and its latest update,
+// the other notifications pass through at once
+func TestCoalescePositionUpdates(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.NotificationCoalesceMillis = 100
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	positions := TEST_VEHICLE + ";" + encodeHex(positionUpdate(0, 17, 0, 300))[:4]
+
+	const burst = 20
+	collision := []byte{0x01, ANKI_MSG_V2C_COLLISION_DETECTED}
+	for i := 0; i < burst; i++ {
+		vehicle.Emit(positionUpdate(byte(i), 17, 0, uint16(300+i)))
+		if i == burst/2 {
+			vehicle.Emit(collision)
+		}
+	}
+	client.Expect(t, TEST_VEHICLE+";"+encodeHex(positionUpdate(0, 17, 0, 300)))
+	client.Expect(t, TEST_VEHICLE+";"+encodeHex(collision))
+	client.Expect(t, TEST_VEHICLE+";COLLISION")
+	client.Expect(t, TEST_VEHICLE+";"+encodeHex(positionUpdate(burst-1, 17, 0, 300+burst-1)))
+	if forwarded := client.Count(positions); forwarded != 2 {
+		t.Fatalf("%d of %d position updates forwarded, want the first and the latest", forwarded, burst)
+	}
+
+	// the server still keeps track of every update
+	client.Send("QUERY_SPEED;" + TEST_VEHICLE)
+	client.Expect(t, TEST_VEHICLE+";SPEED;"+strconv.Itoa(300+burst-1)+";")
+
+	// an update after a quiet interval is forwarded right away
+	time.Sleep(time.Duration(serverConf.NotificationCoalesceMillis) * time.Millisecond)
+	start := time.Now()
+	vehicle.Emit(positionUpdate(burst, 17, 0, 300))
+	client.Expect(t, TEST_VEHICLE+";"+encodeHex(positionUpdate(burst, 17, 0, 300)))
+	if took := time.Since(start); took >= time.Duration(serverConf.NotificationCoalesceMillis)*time.Millisecond {
+		t.Fatalf("update after a quiet interval held back for %v", took)
+	}
+}
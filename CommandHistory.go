@@ -0,0 +1,89 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * The last commands written to each connected vehicle, kept in a fixed-size ring so HISTORY can show what the
+ * server sent a misbehaving vehicle. The history is dropped with the vehicle's BLE link.
+ *
+ */
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Commands remembered per vehicle, older ones are overwritten
+const COMMAND_HISTORY_SIZE = 32
+
+var ANKI_C2V_NAMES = map[byte]string{
+	ANKI_MSG_C2V_PING_REQUEST:   "PING",
+	ANKI_MSG_C2V_SET_LIGHTS:     "SET_LIGHTS",
+	ANKI_MSG_C2V_SET_SPEED:      "SET_SPEED",
+	ANKI_MSG_C2V_CHANGE_LANE:    "CHANGE_LANE",
+	ANKI_MSG_C2V_CANCEL_LANE:    "CANCEL_LANE_CHANGE",
+	ANKI_MSG_C2V_SET_OFFSET:     "SET_OFFSET",
+	ANKI_MSG_C2V_TURN:           "TURN",
+	ANKI_MSG_C2V_LIGHTS_PATTERN: "LIGHTS_PATTERN",
+	ANKI_MSG_C2V_SDK_MODE:       "SDK_MODE",
+}
+
+type HistoryEntry struct {
+	SentAt  time.Time
+	Payload []byte
+}
+
+type CommandHistory struct {
+	mu      sync.Mutex
+	entries [COMMAND_HISTORY_SIZE]HistoryEntry
+	next    int
+	count   int
+}
+
+// Remembers a payload written to the vehicle, overwriting the oldest entry once the ring is full
+func (h *CommandHistory) Add(payload []byte, sentAt time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries[h.next] = HistoryEntry{SentAt: sentAt, Payload: append([]byte(nil), payload...)}
+	h.next = (h.next + 1) % COMMAND_HISTORY_SIZE
+	if h.count < COMMAND_HISTORY_SIZE {
+		h.count++
+	}
+}
+
+// The remembered commands, oldest first
+func (h *CommandHistory) Entries() []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := make([]HistoryEntry, 0, h.count)
+	for i := 0; i < h.count; i++ {
+		entries = append(entries, h.entries[(h.next-h.count+i+COMMAND_HISTORY_SIZE)%COMMAND_HISTORY_SIZE])
+	}
+	return entries
+}
+
+// Records a payload written to a connected vehicle
+func recordCommand(address string, payload []byte) {
+	history := server.CommandHistories.Upsert(address, nil, func(exist bool, valueInMap *CommandHistory, newValue *CommandHistory) *CommandHistory {
+		if exist {
+			return valueInMap
+		}
+		return &CommandHistory{}
+	})
+	history.Add(payload, time.Now())
+}
+
+// Formats HISTORY;<address>;<time>;<message name>;<hex> for a remembered command. The name is the one of the first
+// ANKI message in the payload.
+func historyLine(address string, entry HistoryEntry) string {
+	name := "UNKNOWN"
+	if id, ok := MessageId(entry.Payload); ok {
+		if known, ok := ANKI_C2V_NAMES[id]; ok {
+			name = known
+		} else {
+			name = "0x" + strconv.FormatUint(uint64(id), 16)
+		}
+	}
+	return "HISTORY;" + address + ";" + entry.SentAt.Format(time.RFC3339Nano) + ";" + name + ";" + encodeHex(entry.Payload)
+}
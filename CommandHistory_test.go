@@ -0,0 +1,73 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the per-vehicle command history.
+ *
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// A full ring keeps the newest COMMAND_HISTORY_SIZE commands, oldest first
+func TestCommandHistoryRing(t *testing.T) {
+	var history CommandHistory
+	start := time.Now()
+	for i := 0; i < COMMAND_HISTORY_SIZE+8; i++ {
+		history.Add([]byte{0x01, byte(i)}, start.Add(time.Duration(i)*time.Millisecond))
+	}
+	entries := history.Entries()
+	if len(entries) != COMMAND_HISTORY_SIZE {
+		t.Fatalf("%d entries kept, the ring holds %d", len(entries), COMMAND_HISTORY_SIZE)
+	}
+	for i, entry := range entries {
+		if want := byte(i + 8); entry.Payload[1] != want {
+			t.Fatalf("entry %d is command %d, want %d", i, entry.Payload[1], want)
+		}
+	}
+}
+
+// HISTORY lists the commands written to the vehicle in order, followed by COMPLETED, and is dropped with the link
+func TestHistoryCommand(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Send("HISTORY;" + TEST_VEHICLE)
+	client.Expect(t, "HISTORY;COMPLETED")
+
+	client.Send(TEST_VEHICLE+";0624c800e803", "LIGHTS;"+TEST_VEHICLE+";ENGINE;ON", TEST_VEHICLE+";02ff01;ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	client.Send("HISTORY;" + TEST_VEHICLE + ";9")
+	var got []string
+	for {
+		line := client.Expect(t, "HISTORY;")
+		if line == "HISTORY;COMPLETED;9" {
+			break
+		}
+		fields := strings.Split(line, ";")
+		if len(fields) != 5 || fields[1] != TEST_VEHICLE {
+			t.Fatalf("history line %q", line)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, fields[2]); err != nil {
+			t.Fatalf("history line %q: %v", line, err)
+		}
+		got = append(got, fields[3]+";"+fields[4])
+	}
+	want := []string{"SET_SPEED;0624c800e803", "SET_LIGHTS;021d88", "0xff;02ff01"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("history %q, want %q", got, want)
+	}
+
+	client.Send("DISCONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "DISCONNECT;SUCCESS")
+	if server.CommandHistories.Has(TEST_VEHICLE) {
+		t.Fatal("history kept after the link dropped")
+	}
+	client.Send("HISTORY;" + TEST_VEHICLE)
+	client.Expect(t, "HISTORY;FAILED;not-connected")
+}
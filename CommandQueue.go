@@ -0,0 +1,150 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Keeps the commands sent to a vehicle in order. Every incoming message is otherwise handled in its own goroutine,
+ * so a SET_SPEED followed by a CHANGE_LANE could reach the vehicle the other way around. Commands for a connected
+ * vehicle are queued instead and drained one after another by a single worker, while different vehicles still
+ * proceed concurrently. PAUSE;<address> holds a vehicle's queue, RESUME;<address> writes what was queued meanwhile.
+ *
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"regexp"
+	"sync"
+)
+
+// Most commands a vehicle may have waiting before new ones are rejected
+const COMMAND_QUEUE_LIMIT = 256
+
+// Verbs whose second field is the vehicle they command
+var QUEUED_VERBS = map[string]bool{
+	"LIGHTS":       true,
+	"LIGHTPATTERN": true,
+	"TURN":         true,
+	"OFFSET":       true,
+	"LANE_CANCEL":  true,
+	"BATCH":        true,
+	"RESET":        true,
+}
+
+var verbPattern = regexp.MustCompile("^[A-Z_]+$")
+
+// The verb raw <address>;<hex> writes are permitted and audited by. It is not RAW, which is the RAW;ON|OFF command
+const WRITE_VERB = "WRITE"
+
+type CommandQueue struct {
+	mu      sync.Mutex
+	pending []func()
+	// worker goroutines draining the queue
+	running int
+	// most workers draining the queue at once, 0 for a single one, which keeps the commands in order
+	workers int
+	// set by PAUSE, commands then wait until RESUME
+	paused bool
+}
+
+// Queues command behind the ones already waiting, returns false if the queue is full.
+// Worker goroutines are only running while commands are waiting and the queue is not paused.
+func (q *CommandQueue) Enqueue(command func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limit := COMMAND_QUEUE_LIMIT
+	if q.paused {
+		limit = serverConf.PausedQueueLimit
+	}
+	if len(q.pending) >= limit {
+		return false
+	}
+	q.pending = append(q.pending, command)
+	if q.running < q.maxWorkers() && !q.paused {
+		q.running++
+		go q.drain()
+	}
+	return true
+}
+
+func (q *CommandQueue) maxWorkers() int {
+	if q.workers > 0 {
+		return q.workers
+	}
+	return 1
+}
+
+func (q *CommandQueue) drain() {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 || q.paused {
+			q.running--
+			q.mu.Unlock()
+			return
+		}
+		command := q.pending[0]
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+
+		command()
+	}
+}
+
+// Holds the commands queued from now on until Resume, a command being written is still completed
+func (q *CommandQueue) Pause() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = true
+}
+
+// Writes the commands queued while paused in the order they were received, returns how many are waiting
+func (q *CommandQueue) Resume() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = false
+	for q.running < q.maxWorkers() && q.running < len(q.pending) {
+		q.running++
+		go q.drain()
+	}
+	return len(q.pending)
+}
+
+func commandQueue(address string) *CommandQueue {
+	return server.CommandQueues.Upsert(address, nil, func(exist bool, valueInMap *CommandQueue, newValue *CommandQueue) *CommandQueue {
+		if exist {
+			return valueInMap
+		}
+		return &CommandQueue{}
+	})
+}
+
+// The verb of a parsed message, WRITE_VERB for <address>;<hex> writes
+func requestVerb(set []string) string {
+	if verbPattern.MatchString(set[0]) {
+		return set[0]
+	}
+	return WRITE_VERB
+}
+
+// Returns the connected vehicle a parsed message commands, or false if the message is no vehicle command
+func commandTarget(set []string) (string, bool) {
+	address, ok := commandVehicle(set)
+	return address, ok && server.ConnectedDevices.Has(address)
+}
+
+// The vehicle a parsed message commands, false for messages that don't command a vehicle
+func commandVehicle(set []string) (string, bool) {
+	var address string
+	switch {
+	case QUEUED_VERBS[set[0]] && len(set) >= 2:
+		address = set[1]
+	// a raw <address>;<hex>[;ACK] write
+	case !verbPattern.MatchString(set[0]) && (len(set) == 2 || (len(set) == 3 && set[2] == "ACK")):
+		if _, err := hex.DecodeString(set[1]); err != nil {
+			return "", false
+		}
+		address = set[0]
+	default:
+		return "", false
+	}
+	return normalizeAddress(address), true
+}
@@ -0,0 +1,136 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the per-vehicle command queue.
+ *
+ */
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Commands reach each vehicle in the order they were received, however long the writes take, while the vehicles
+// are commanded concurrently
+func TestCommandsInOrder(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicles := []*fakeVehicle{
+		connectTestVehicle(t, adapter, client, TEST_VEHICLE),
+		connectTestVehicle(t, adapter, client, TEST_VEHICLE_2),
+	}
+	for _, vehicle := range vehicles {
+		// uneven writes would let commands overtake each other if they were written concurrently
+		var mu sync.Mutex
+		var writes int
+		vehicle.writer.OnWrite(func(p []byte) error {
+			mu.Lock()
+			writes++
+			delay := time.Duration(writes%3) * time.Millisecond
+			mu.Unlock()
+			time.Sleep(delay)
+			return nil
+		})
+	}
+
+	const commands = 60
+	for i := 0; i < commands; i++ {
+		for _, vehicle := range vehicles {
+			client.Send(vehicle.address + ";" + encodeHex(EncodeSetSpeed(int16(i), 1000)))
+		}
+	}
+	for _, vehicle := range vehicles {
+		waitUntil(t, "the commands to "+vehicle.address, func() bool { return len(vehicle.Writes()) == commands })
+		for i, write := range vehicle.Writes() {
+			if string(write) != string(EncodeSetSpeed(int16(i), 1000)) {
+				t.Fatalf("write %d to %s is %x, the commands were reordered", i, vehicle.address, write)
+			}
+		}
+	}
+}
+
+// A write that timed out still holds up the vehicle's next commands, they are written after it in the order they
+// were received
+func TestCommandsInOrderAfterTimeout(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.CommandTimeoutMillis = 30
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	slow := EncodeSetSpeed(300, 1000)
+	release := make(chan struct{})
+	vehicle.writer.OnWrite(func(p []byte) error {
+		if string(p) == string(slow) {
+			<-release
+		}
+		return nil
+	})
+	client.Send(TEST_VEHICLE + ";" + encodeHex(slow))
+	client.Expect(t, TEST_VEHICLE+";COMMAND;FAILED;"+errTimeout.Error())
+	client.Send("LIGHTS;"+TEST_VEHICLE+";HEADLIGHTS;ON;1", TEST_VEHICLE+";"+encodeHex(EncodeSetSpeed(0, 1000)))
+	client.Refute(t, "LIGHTS;", 60*time.Millisecond)
+	close(release)
+	client.Expect(t, "LIGHTS;SUCCESS;1")
+
+	want := []string{encodeHex(slow), encodeHex(EncodeLights(LIGHT_NAMES["HEADLIGHTS"], true)), encodeHex(EncodeSetSpeed(0, 1000))}
+	// the failed command has the adapter probed with a ping, which does not go through the queue
+	var got []string
+	waitUntil(t, "the commands after the timed out write", func() bool {
+		got = nil
+		for _, write := range vehicle.WrittenHex() {
+			if write != encodeHex(EncodePing()) {
+				got = append(got, write)
+			}
+		}
+		return len(got) == len(want)
+	})
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("written %q, want %q", got, want)
+	}
+}
+
+// Commands sent while a vehicle is paused are held, up to pausedQueueLimit, and written in order on RESUME
+func TestPauseAndResume(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.PausedQueueLimit = 12
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Send("PAUSE;" + TEST_VEHICLE + ";1")
+	client.Expect(t, "PAUSE;SUCCESS;1")
+	var want []string
+	for i := 0; i < 11; i++ {
+		client.Send(TEST_VEHICLE + ";" + encodeHex(EncodeSetSpeed(int16(i*10), 1000)))
+		want = append(want, encodeHex(EncodeSetSpeed(int16(i*10), 1000)))
+	}
+	client.Send("LIGHTS;" + TEST_VEHICLE + ";ENGINE;ON")
+	want = append(want, encodeHex(EncodeLights(LIGHT_ENGINE, true)))
+	client.Send(TEST_VEHICLE + ";0116")
+	client.Expect(t, "ERROR;queue-full")
+	time.Sleep(20 * time.Millisecond)
+	if writes := len(vehicle.Writes()); writes != 0 {
+		t.Fatalf("%d writes while paused", writes)
+	}
+
+	client.Send("RESUME;" + TEST_VEHICLE + ";2")
+	client.Expect(t, "RESUME;SUCCESS;12;2")
+	client.Expect(t, "LIGHTS;SUCCESS")
+	waitUntil(t, "the held commands", func() bool { return len(vehicle.Writes()) == len(want) })
+	for i, write := range vehicle.WrittenHex() {
+		if write != want[i] {
+			t.Fatalf("write %d is %s, want %s, the held commands were reordered", i, write, want[i])
+		}
+	}
+
+	// once resumed commands are written right away again
+	client.Send(TEST_VEHICLE + ";0116;ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	client.Send("PAUSE;" + TEST_VEHICLE_2)
+	client.Expect(t, "PAUSE;FAILED;not-connected")
+	client.Send("RESUME;" + TEST_VEHICLE_2)
+	client.Expect(t, "RESUME;FAILED;not-connected")
+}
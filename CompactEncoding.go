@@ -0,0 +1,80 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Compact binary encoding of position and transition updates for clients that stream many vehicles, selected per
+ * client with ENCODING;COMPACT. Every other message keeps its text form. A compact frame is
+ *		0xff | length n (1) | telemetry datagram (n)
+ * with the datagram laid out as described in TelemetryUDP.go. 0xff never occurs in the ASCII text frames, so a
+ * client tells both apart by the first byte.
+ *
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+const (
+	COMPACT_FRAME_MARKER = 0xff
+
+	ENCODING_TEXT    = "TEXT"
+	ENCODING_COMPACT = "COMPACT"
+)
+
+// Wraps a telemetry datagram into a compact frame, nil if there is no datagram
+func compactFrame(datagram []byte) []byte {
+	if datagram == nil {
+		return nil
+	}
+	return append([]byte{COMPACT_FRAME_MARKER, byte(len(datagram))}, datagram...)
+}
+
+// A position or transition update decoded from a compact frame, exactly one of Position and Transition is set
+type TelemetryRecord struct {
+	Address    string
+	ReceivedAt time.Time
+	Position   *PositionUpdate
+	Transition *TransitionUpdate
+}
+
+// Decodes a compact frame, returns false if frame is not a complete one of a known layout version
+func DecodeCompactFrame(frame []byte) (TelemetryRecord, bool) {
+	if len(frame) < 2 || frame[0] != COMPACT_FRAME_MARKER || int(frame[1])+2 != len(frame) {
+		return TelemetryRecord{}, false
+	}
+	datagram := frame[2:]
+	if len(datagram) < 11 || datagram[0] != TELEMETRY_UDP_VERSION {
+		return TelemetryRecord{}, false
+	}
+	addressEnd := 11 + int(datagram[10])
+	if addressEnd > len(datagram) {
+		return TelemetryRecord{}, false
+	}
+	record := TelemetryRecord{
+		Address:    string(datagram[11:addressEnd]),
+		ReceivedAt: time.Unix(0, int64(binary.LittleEndian.Uint64(datagram[2:]))),
+	}
+
+	fields := datagram[addressEnd:]
+	switch {
+	case datagram[1] == ANKI_MSG_V2C_POSITION_UPDATE && len(fields) == 8:
+		record.Position = &PositionUpdate{
+			LocationId:    fields[0],
+			RoadPieceId:   fields[1],
+			OffsetMm:      math.Float32frombits(binary.LittleEndian.Uint32(fields[2:])),
+			SpeedMmPerSec: binary.LittleEndian.Uint16(fields[6:]),
+		}
+	case datagram[1] == ANKI_MSG_V2C_TRANSITION_UPDATE && len(fields) == 6:
+		record.Transition = &TransitionUpdate{
+			RoadPieceIdx:     fields[0],
+			RoadPieceIdxPrev: int8(fields[1]),
+			OffsetMm:         math.Float32frombits(binary.LittleEndian.Uint32(fields[2:])),
+		}
+	default:
+		return TelemetryRecord{}, false
+	}
+	return record, true
+}
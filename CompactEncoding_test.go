@@ -0,0 +1,99 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the compact encoding of position and transition updates.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Waits for the client's next compact frame written after the first from bytes and returns it
+func expectCompactFrame(t *testing.T, client *fakeConn, from int) []byte {
+	t.Helper()
+	var frame []byte
+	waitUntil(t, "a compact frame", func() bool {
+		written := client.Written()
+		start := bytes.IndexByte(written[from:], COMPACT_FRAME_MARKER)
+		if start < 0 || from+start+2 > len(written) {
+			return false
+		}
+		end := from + start + 2 + int(written[from+start+1])
+		if end > len(written) {
+			return false
+		}
+		frame = written[from+start : end]
+		return true
+	})
+	return frame
+}
+
+// A compact frame decodes to the values its datagram was encoded from, truncated and unknown frames are refused
+func TestDecodeCompactFrame(t *testing.T) {
+	receivedAt := time.Unix(1700000000, 123456789)
+	frame := compactFrame(telemetryDatagram(TEST_VEHICLE, positionUpdate(33, 17, -23.5, 450), receivedAt))
+	record, ok := DecodeCompactFrame(frame)
+	want := PositionUpdate{LocationId: 33, RoadPieceId: 17, OffsetMm: -23.5, SpeedMmPerSec: 450}
+	if !ok || record.Address != TEST_VEHICLE || !record.ReceivedAt.Equal(receivedAt) || record.Position == nil || *record.Position != want {
+		t.Fatalf("decoded %+v, want %+v of %s", record, want, TEST_VEHICLE)
+	}
+
+	if compactFrame(telemetryDatagram(TEST_VEHICLE, []byte{0x01, 0x17}, receivedAt)) != nil {
+		t.Fatal("compact frame for a ping response")
+	}
+	for _, bad := range [][]byte{frame[:len(frame)-1], frame[1:], {COMPACT_FRAME_MARKER, 0}, nil} {
+		if _, ok := DecodeCompactFrame(bad); ok {
+			t.Errorf("decoded the bad frame %x", bad)
+		}
+	}
+}
+
+// A client that selected ENCODING;COMPACT decodes the same position and transition a text client parses from its
+// hex, and gets the other messages in their text form still
+func TestCompactEncodingRoundTrip(t *testing.T) {
+	adapter := newTestServer(t)
+	compact := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, compact, TEST_VEHICLE)
+	text := newTestClient(t, nil)
+	text.Send("SUBSCRIBE;" + TEST_VEHICLE)
+	text.Expect(t, "SUBSCRIBE;SUCCESS")
+	compact.Send("ENCODING;COMPACT;1")
+	compact.Expect(t, "ENCODING;SUCCESS;1")
+
+	from := len(compact.Written())
+	vehicle.Emit(positionUpdate(33, 17, -23.5, 450))
+	raw, _ := hex.DecodeString(strings.TrimPrefix(text.Expect(t, TEST_VEHICLE+";"), TEST_VEHICLE+";"))
+	position, _ := ParsePositionUpdate(raw)
+	frame := expectCompactFrame(t, compact, from)
+	if record, ok := DecodeCompactFrame(frame); !ok || record.Address != TEST_VEHICLE || record.Position == nil || *record.Position != position {
+		t.Fatalf("compact position %+v, the text form parses to %+v", record, position)
+	}
+
+	from = len(compact.Written())
+	vehicle.Emit(transitionUpdate(4, -1, 12.5))
+	raw, _ = hex.DecodeString(strings.TrimPrefix(text.Expect(t, TEST_VEHICLE+";"), TEST_VEHICLE+";"))
+	transition, _ := ParseTransition(raw)
+	frame = expectCompactFrame(t, compact, from)
+	if record, ok := DecodeCompactFrame(frame); !ok || record.Transition == nil || *record.Transition != transition {
+		t.Fatalf("compact transition %+v, the text form parses to %+v", record, transition)
+	}
+
+	// compact frames end in no newline, so the text frames after them are looked for in the bytes
+	vehicle.Emit([]byte{0x01, 0x17})
+	waitUntil(t, "the ping response in its text form", func() bool {
+		return bytes.Contains(compact.Written(), []byte(TEST_VEHICLE+";0117\n"))
+	})
+	compact.Send("ENCODING;TEXT")
+	waitUntil(t, "the text encoding", func() bool { return bytes.HasSuffix(compact.Written(), []byte("ENCODING;SUCCESS\n")) })
+	vehicle.Emit(positionUpdate(34, 17, -23.5, 450))
+	compact.Expect(t, TEST_VEHICLE+";"+encodeHex(positionUpdate(34, 17, -23.5, 450)))
+	compact.Send("ENCODING;ZIP")
+	compact.Expect(t, "ENCODING;FAILED;invalid-encoding")
+}
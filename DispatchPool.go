@@ -0,0 +1,59 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Bounded pool of goroutines handling the frames that are not queued for a vehicle. Without it every frame got a
+ * goroutine of its own, so a client flooding the server could create any number of them. A client whose frames find
+ * every worker busy is no longer read from until one is free, which slows a flooding client down by itself.
+ * dispatchWorkers sets the pool size, 0 goes back to a goroutine per frame.
+ *
+ * Commands that may take seconds, like SCAN waiting for its turn on the adapter, never run on the pool, or a single
+ * client could occupy every worker with them. They wait in a queue of their own client, drained by at most
+ * SLOW_COMMANDS_PER_CLIENT goroutines. ESTOP and DISCONNECT_ALL must not wait behind anything, they have a queue and
+ * goroutine of their own per client, so the reader goes on reading while they run.
+ *
+ */
+
+package main
+
+// Verbs that may block for seconds on the BLE stack and are queued per client instead of handled on the pool
+var SLOW_VERBS = map[string]bool{
+	"SCAN":       true,
+	"DISCOVERED": true,
+	"CONNECT":    true,
+	"DISCONNECT": true,
+	"REDISCOVER": true,
+	"READ":       true,
+	"SELFTEST":   true,
+}
+
+// Verbs handled on the client's urgent queue, ahead of every command still waiting
+var URGENT_VERBS = map[string]bool{
+	"ESTOP":          true,
+	"DISCONNECT_ALL": true,
+}
+
+// Most slow commands of a single client running at the same time, further ones wait for one of them to finish
+const SLOW_COMMANDS_PER_CLIENT = 4
+
+// Frames waiting for a worker, nil while the pool is disabled
+var dispatchJobs chan func()
+
+func startDispatchPool(workers int) {
+	dispatchJobs = make(chan func())
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range dispatchJobs {
+				job()
+			}
+		}()
+	}
+}
+
+// Runs job on a pool worker, blocking until one takes it
+func dispatchJob(job func()) {
+	if dispatchJobs == nil {
+		go job()
+		return
+	}
+	dispatchJobs <- job
+}
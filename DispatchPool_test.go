@@ -0,0 +1,188 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the dispatch pool and of the slow and urgent commands kept off it.
+ *
+ */
+
+package main
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Makes every request take a while, so frames arriving faster than that pile up somewhere
+func slowRequests(delay time.Duration) {
+	registerMiddleware(func(next Handler) Handler {
+		return func(req *Request) error {
+			time.Sleep(delay)
+			return next(req)
+		}
+	})
+}
+
+func stopDispatchPool(t *testing.T) {
+	t.Cleanup(func() {
+		close(dispatchJobs)
+		dispatchJobs = nil
+	})
+}
+
+// A client flooding the server with frames is handled by the pool's workers, not a goroutine per frame
+func TestDispatchPoolBoundsGoroutines(t *testing.T) {
+	newTestServer(t)
+	const workers, frames = 8, 400
+	startDispatchPool(workers)
+	stopDispatchPool(t)
+	slowRequests(time.Millisecond)
+	base := runtime.NumGoroutine()
+
+	client := newTestClient(t, nil)
+	var most int
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if n := runtime.NumGoroutine(); n > most {
+				most = n
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for i := 0; i < frames; i++ {
+		client.Send("PING;" + strconv.Itoa(i))
+	}
+	waitUntil(t, "every PONG", func() bool { return client.Count("PONG;") == frames })
+	close(done)
+	wg.Wait()
+
+	// the client's reader and writer, the sampler and the workers, plus a few the runtime starts
+	if limit := base + workers + 10; most > limit {
+		t.Fatalf("%d goroutines while flooding, want at most %d", most, limit)
+	}
+}
+
+// SCANs queue up behind each other on the adapter, they must not keep other clients waiting nor their own ESTOP
+func TestSlowCommandsDoNotStarvePool(t *testing.T) {
+	adapter := newTestServer(t)
+	startDispatchPool(2)
+	stopDispatchPool(t)
+	adapter.holdScan = true
+	scanner := newTestClient(t, nil)
+	other := newTestClient(t, nil)
+
+	const scans = 6
+	for i := 0; i < scans; i++ {
+		scanner.Send("SCAN;" + strconv.Itoa(i))
+	}
+	waitUntil(t, "the first scan", func() bool {
+		_, started, _, _ := adapter.Calls()
+		return started > 0
+	})
+
+	start := time.Now()
+	other.Send("PING;1")
+	other.Expect(t, "PONG;1")
+	scanner.Send("ESTOP;2")
+	scanner.Expect(t, "ESTOP;DONE;0;2")
+	scanner.Send("PING;3")
+	scanner.Expect(t, "PONG;3")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("answers took %v while scans were waiting", elapsed)
+	}
+	if completed := scanner.Count("SCAN;COMPLETED"); completed > 0 {
+		t.Fatalf("%d scans completed already, the answers did not overtake them", completed)
+	}
+
+	// every scan still completes once the adapter lets them
+	adapter.ReleaseScans()
+	waitUntil(t, "every scan", func() bool { return scanner.Count("SCAN;COMPLETED") == scans })
+}
+
+// A client's slow commands run on a bounded number of its own goroutines
+func TestSlowCommandsPerClientLimit(t *testing.T) {
+	adapter := newTestServer(t)
+	connectSlots = nil
+	const connects = 10
+	for i := 0; i < connects; i++ {
+		server.DiscoveredDevices.Set(testVehicleAddress(i), AnkiVehicle{Address: testVehicleAddress(i)})
+	}
+	release := make(chan struct{})
+	var mu sync.Mutex
+	running, most := 0, 0
+	adapter.onConnect = func(address string) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}
+	client := newTestClient(t, nil)
+
+	for i := 0; i < connects; i++ {
+		client.Send("CONNECT;" + testVehicleAddress(i))
+	}
+	waitUntil(t, "the first connects", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return running == SLOW_COMMANDS_PER_CLIENT
+	})
+	// give further connects the chance to start, which they must not
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	waitUntil(t, "every CONNECT answered", func() bool { return client.Count("CONNECT;SUCCESS") == connects })
+	mu.Lock()
+	defer mu.Unlock()
+	if most != SLOW_COMMANDS_PER_CLIENT {
+		t.Fatalf("%d connects ran at once, want %d", most, SLOW_COMMANDS_PER_CLIENT)
+	}
+}
+
+// An urgent command waiting for a busy vehicle does not hold up the client's reader, and DISCONNECT_ALL gives up on
+// the vehicle once its write is still running after URGENT_LOCK_TIMEOUT
+func TestUrgentCommandsDoNotBlockReader(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	release := make(chan struct{})
+	vehicle.writer.OnWrite(func(p []byte) error {
+		<-release
+		return nil
+	})
+	client.Send(TEST_VEHICLE + ";0116")
+	waitUntil(t, "the write to hang", func() bool { return vehicle.writer.Attempts() > 0 })
+
+	start := time.Now()
+	client.Send("DISCONNECT_ALL;1", "PING;2")
+	client.Expect(t, "PONG;2")
+	if client.Count("DISCONNECT_ALL;") > 0 {
+		t.Fatal("DISCONNECT_ALL answered before the PING read after it")
+	}
+	client.Expect(t, "DISCONNECT_ALL;FAILED;"+TEST_VEHICLE+";"+errVehicleBusy.Error())
+	client.Expect(t, "DISCONNECT_ALL;DONE;0;1")
+	if elapsed := time.Since(start); elapsed < URGENT_LOCK_TIMEOUT || elapsed > URGENT_LOCK_TIMEOUT+500*time.Millisecond {
+		t.Fatalf("DISCONNECT_ALL gave up after %v, want %v", elapsed, URGENT_LOCK_TIMEOUT)
+	}
+	expectState(t, TEST_VEHICLE, STATE_CONNECTED)
+
+	close(release)
+	client.Send("DISCONNECT_ALL;3")
+	client.Expect(t, "DISCONNECT_ALL;DONE;1;3")
+}
@@ -0,0 +1,126 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * End-to-end tests of the tcp protocol against fake and simulated vehicles, from the scan to the vehicle's
+ * notifications.
+ *
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The flow of the ANKI SDK for Java: scan, connect, drive and receive the vehicle's position updates
+func TestScanConnectCommandNotification(t *testing.T) {
+	adapter := newTestServer(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	client := newTestClient(t, nil)
+
+	client.Send("SCAN")
+	if got, want := client.Expect(t, "SCAN;"), "SCAN;"+TEST_VEHICLE+";beef00011234;"+LEGACY_LOCAL_NAME; got != want {
+		t.Fatalf("scan result %q, want %q", got, want)
+	}
+	client.Expect(t, "SCAN;COMPLETED")
+
+	client.Send("CONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "CONNECT;SUCCESS")
+	vehicle := adapter.Vehicle(TEST_VEHICLE)
+
+	client.Send(TEST_VEHICLE + ";0624c800e80300")
+	vehicle.ExpectWrite(t, EncodeSetSpeed(200, 1000))
+
+	vehicle.Emit(positionUpdate(17, 33, -23.5, 200))
+	if got, want := client.Expect(t, TEST_VEHICLE+";"), TEST_VEHICLE+";"+encodeHex(positionUpdate(17, 33, -23.5, 200)); got != want {
+		t.Fatalf("notification %q, want %q", got, want)
+	}
+	if got := speedReport(TEST_VEHICLE); !strings.HasPrefix(got, TEST_VEHICLE+";SPEED;200;") {
+		t.Fatalf("speed after the position update %q", got)
+	}
+
+	client.Send("DISCONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "DISCONNECT;SUCCESS")
+	if got := vehicle.Disconnects(); got != 1 {
+		t.Fatalf("%d BLE disconnects, want 1", got)
+	}
+}
+
+// A second client shares the vehicle the first one connected, both see its notifications and the high level
+// commands of either reach it
+func TestSharedVehicleCommandsAndNotifications(t *testing.T) {
+	adapter := newTestServer(t)
+	owner := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, owner, TEST_VEHICLE)
+
+	watcher := newTestClient(t, nil)
+	watcher.Send("SUBSCRIBE;" + TEST_VEHICLE + ";7")
+	watcher.Expect(t, "SUBSCRIBE;SUCCESS;7")
+
+	watcher.Send("LIGHTS;" + TEST_VEHICLE + ";HEADLIGHTS;ON")
+	watcher.Expect(t, "LIGHTS;SUCCESS")
+	vehicle.ExpectWrite(t, EncodeLights(LIGHT_HEADLIGHTS, true))
+
+	vehicle.Emit(transitionUpdate(4, 3, 12))
+	notification := TEST_VEHICLE + ";" + encodeHex(transitionUpdate(4, 3, 12))
+	for _, client := range []*fakeConn{owner, watcher} {
+		if got := client.Expect(t, TEST_VEHICLE+";"); got != notification {
+			t.Fatalf("notification %q, want %q", got, notification)
+		}
+	}
+
+	// the link stays up until its last owner lets go, the subscriber does not keep it
+	watcher.Send("UNSUBSCRIBE;" + TEST_VEHICLE)
+	watcher.Expect(t, "UNSUBSCRIBE;SUCCESS")
+	owner.Send("DISCONNECT;" + TEST_VEHICLE)
+	owner.Expect(t, "DISCONNECT;SUCCESS")
+	if state, _ := server.VehicleStates.Get(TEST_VEHICLE); state != STATE_DISCONNECTED {
+		t.Fatalf("state after DISCONNECT %v", state)
+	}
+}
+
+// The server with adapter: sim is driven over a real tcp connection the way the ANKI SDK for Java drives it, the
+// simulated vehicle reports its position at the speed it was given
+func TestSimAdapterOverTcp(t *testing.T) {
+	newTestServer(t)
+	Adapter = newSimAdapter()
+	Adapter.SetDisconnectHandler(vehicleLost)
+	serverConf.MaxScanResults = 2
+	l, err := listen(ListenerConf{Host: "127.0.0.1", Port: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTestListener(t, l, nil)
+	client := dialTestClient(t, "tcp", l.Addr().String())
+
+	client.Send(t, "SCAN")
+	var found []string
+	for line := client.ReadLine(t); line != "SCAN;COMPLETED"; line = client.ReadLine(t) {
+		found = append(found, line)
+	}
+	if len(found) != 2 {
+		t.Fatalf("scan found %q, want the two simulated vehicles", found)
+	}
+	address := strings.Split(found[0], ";")[1]
+	client.Send(t, "CONNECT;"+address)
+	client.Expect(t, "CONNECT;SUCCESS")
+	client.Send(t, address+";"+hex.EncodeToString(EncodeSetSpeed(300, 1000)))
+
+	notification := client.Expect(t, address+";0a27")
+	payload, _ := hex.DecodeString(strings.Split(notification, ";")[1])
+	if position, ok := ParsePositionUpdate(payload); !ok || position.SpeedMmPerSec != 300 {
+		t.Fatalf("position update %q does not report the speed that was set", notification)
+	}
+
+	client.Send(t, address+";"+hex.EncodeToString(EncodeSetSpeed(0, 1000))+";ACK")
+	client.Expect(t, address+";WRITE;OK")
+	// lets a position update already on its way arrive, the ping then orders it before the disconnect
+	time.Sleep(2 * SIM_POSITION_INTERVAL)
+	client.Send(t, address+";0116;ACK")
+	client.Expect(t, address+";WRITE;OK")
+	client.Send(t, "DISCONNECT;"+address)
+	client.Expect(t, "DISCONNECT;SUCCESS")
+}
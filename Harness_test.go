@@ -0,0 +1,835 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Test doubles for driving the server without a BLE adapter or a network. fakeConn is a scripted client connection
+ * that records everything the server writes to it, fakeAdapter hands out programmable vehicles whose writes are
+ * recorded and whose notifications the test emits. newTestServer resets the server's global state for every test.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"tinygo.org/x/bluetooth"
+)
+
+// How long a test waits for the server to do something before it fails
+const TEST_TIMEOUT = 2 * time.Second
+
+// Addresses of the vehicles most tests use
+const (
+	TEST_VEHICLE   = "AA:00:00:00:00:01"
+	TEST_VEHICLE_2 = "AA:00:00:00:00:02"
+)
+
+var testClientPort int32
+
+// Resets the server to the defaults with fakeAdapter as its adapter, as main would start it with an empty
+// serverconf.yml, and quiets the console
+func newTestServer(t *testing.T) *fakeAdapter {
+	t.Helper()
+	adapter := newFakeAdapter()
+	server = newServer()
+	serverConf = defaultServerConf()
+	serverConf.ScanTimeoutSeconds = 1
+	Adapter = adapter
+	atomic.StoreInt32(&AdapterEnabled, 1)
+	connectionParams = bluetooth.ConnectionParams{}
+	onConnectPayloads = nil
+	lostVehicles = nil
+	connectSlots = make(chan struct{}, serverConf.MaxConcurrentConnects)
+	accessList = AccessList{}
+	stats = Stats{}
+	scanResultInterval = 0
+	dispatchJobs = nil
+	middlewares = nil
+	commandHandler = handleCommand
+	registerMiddleware(permissionMiddleware)
+	registerMiddleware(rateLimitMiddleware)
+	Adapter.SetDisconnectHandler(vehicleLost)
+	setLogLevel("error")
+	return adapter
+}
+
+// Connects a scripted client to the server, allowed restricts its commands like a listener's allowedCommands.
+// The client is closed and its handler waited for when the test ends.
+func newTestClient(t *testing.T, allowed map[string]bool) *fakeConn {
+	t.Helper()
+	conn := newFakeConn()
+	done := make(chan struct{})
+	go func() {
+		handleRequest(conn, allowed)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		select {
+		case <-done:
+		case <-time.After(TEST_TIMEOUT):
+			t.Errorf("handler of %v still running after the client closed", conn.RemoteAddr())
+		}
+	})
+	return conn
+}
+
+// Serves l like main does until the test ends, then waits until every client was let go. Clients have to be dialed
+// after the last listener was started, their cleanup then closes them before
+func serveTestListener(t *testing.T, l net.Listener, allowed map[string]bool) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		acceptClients(l, allowed)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+		waitUntil(t, "the listener's clients to be let go", func() bool { return atomic.LoadInt32(&liveConnections) == 0 })
+	})
+}
+
+// A client connected to a real listener, closed when the test ends
+type socketClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestClient(t *testing.T, network string, address string) *socketClient {
+	t.Helper()
+	conn, err := net.DialTimeout(network, address, TEST_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &socketClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Sends frame and returns the next line the server answers, without its newline
+func (c *socketClient) Exchange(t *testing.T, frame string) string {
+	t.Helper()
+	c.Send(t, frame)
+	return c.ReadLine(t)
+}
+
+func (c *socketClient) Send(t *testing.T, frame string) {
+	t.Helper()
+	if _, err := c.conn.Write([]byte(frame + "\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reads lines until one starts with prefix and returns it
+func (c *socketClient) Expect(t *testing.T, prefix string) string {
+	t.Helper()
+	for {
+		if line := c.ReadLine(t); strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+}
+
+func (c *socketClient) ReadLine(t *testing.T) string {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(TEST_TIMEOUT))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading from %v: %v", c.conn.RemoteAddr(), err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+// Scans as client and connects it to the advertised vehicle at address
+func connectTestVehicle(t *testing.T, adapter *fakeAdapter, client *fakeConn, address string) *fakeVehicle {
+	t.Helper()
+	adapter.Advertise(address, -50)
+	client.Send("SCAN")
+	client.Expect(t, "SCAN;COMPLETED")
+	client.Send("CONNECT;" + address)
+	client.Expect(t, "CONNECT;SUCCESS")
+	return adapter.Vehicle(address)
+}
+
+// Polls condition until it holds, failing the test after TEST_TIMEOUT
+func waitUntil(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(TEST_TIMEOUT)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// A localization position update as a vehicle sends it
+func positionUpdate(location byte, piece byte, offsetMm float32, speed uint16) []byte {
+	msg := []byte{10, ANKI_MSG_V2C_POSITION_UPDATE, location, piece, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(msg[4:], math.Float32bits(offsetMm))
+	binary.LittleEndian.PutUint16(msg[8:], speed)
+	return msg
+}
+
+// A localization transition update as a vehicle sends it
+func transitionUpdate(piece byte, previous int8, offsetMm float32) []byte {
+	msg := []byte{7, ANKI_MSG_V2C_TRANSITION_UPDATE, piece, byte(previous), 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(msg[4:], math.Float32bits(offsetMm))
+	return msg
+}
+
+// A client connection whose incoming frames are scripted with Send and whose outgoing ones are recorded
+type fakeConn struct {
+	incoming chan []byte
+	closed   chan struct{}
+	once     sync.Once
+	remote   net.Addr
+
+	mu       sync.Mutex
+	pending  []byte
+	written  []byte
+	next     int // lines already returned by Expect
+	deadline time.Time
+	// writes wait while it is set, like a client that stopped reading
+	stall chan struct{}
+	// returned by reads once set, like the error of a keepalive probe the peer never answered
+	readErr error
+}
+
+func newFakeConn() *fakeConn {
+	port := atomic.AddInt32(&testClientPort, 1)
+	return &fakeConn{
+		incoming: make(chan []byte, 64),
+		closed:   make(chan struct{}),
+		remote:   &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000 + int(port)},
+	}
+}
+
+// Queues frames for the server to read, a newline is added to frames without one
+func (c *fakeConn) Send(frames ...string) {
+	for _, frame := range frames {
+		if !strings.HasSuffix(frame, "\n") {
+			frame += "\n"
+		}
+		c.SendBytes([]byte(frame))
+	}
+}
+
+// Queues data for the server to read as it is, a single Read returns at most one SendBytes
+func (c *fakeConn) SendBytes(data []byte) {
+	select {
+	case c.incoming <- data:
+	case <-c.closed:
+	}
+}
+
+// Everything the server wrote, split into lines
+func (c *fakeConn) Lines() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lines()
+}
+
+// Everything the server wrote as it is, for binary frames that are no lines
+func (c *fakeConn) Written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.written...)
+}
+
+func (c *fakeConn) lines() []string {
+	text := string(c.written)
+	if !strings.HasSuffix(text, "\n") {
+		// a line still being written is not complete yet
+		if i := strings.LastIndex(text, "\n"); i >= 0 {
+			text = text[:i+1]
+		} else {
+			text = ""
+		}
+	}
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Waits for the next line starting with prefix, skipping the lines before it, and returns it
+func (c *fakeConn) Expect(t *testing.T, prefix string) string {
+	t.Helper()
+	deadline := time.Now().Add(TEST_TIMEOUT)
+	for {
+		c.mu.Lock()
+		lines := c.lines()
+		for i := c.next; i < len(lines); i++ {
+			if strings.HasPrefix(lines[i], prefix) {
+				c.next = i + 1
+				c.mu.Unlock()
+				return lines[i]
+			}
+		}
+		c.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("%v: no line starting with %q, got %q", c.remote, prefix, lines)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Fails if a line starting with prefix arrives within wait, lines already returned by Expect don't count
+func (c *fakeConn) Refute(t *testing.T, prefix string, wait time.Duration) {
+	t.Helper()
+	time.Sleep(wait)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lines := c.lines()
+	for i := c.next; i < len(lines); i++ {
+		if strings.HasPrefix(lines[i], prefix) {
+			t.Fatalf("%v: unexpected line %q", c.remote, lines[i])
+		}
+	}
+}
+
+// Number of lines starting with prefix written so far
+func (c *fakeConn) Count(prefix string) int {
+	count := 0
+	for _, line := range c.Lines() {
+		if strings.HasPrefix(line, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func (c *fakeConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		c.mu.Unlock()
+		return n, nil
+	}
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		deadline, readErr := c.deadline, c.readErr
+		c.mu.Unlock()
+		if readErr != nil {
+			return 0, readErr
+		}
+		// the deadline may move while the read waits, look at it again every few milliseconds
+		wait := 5 * time.Millisecond
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			if remaining < wait {
+				wait = remaining
+			}
+		}
+		select {
+		case data := <-c.incoming:
+			c.mu.Lock()
+			n := copy(p, data)
+			c.pending = append(c.pending, data[n:]...)
+			c.mu.Unlock()
+			return n, nil
+		case <-c.closed:
+			return 0, io.EOF
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	stall := c.stall
+	c.mu.Unlock()
+	if stall != nil {
+		select {
+		case <-stall:
+		case <-c.closed:
+		}
+	}
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written = append(c.written, p...)
+	return len(p), nil
+}
+
+// Holds up every write until Unstall, as if the client stopped reading and its socket buffer filled up
+func (c *fakeConn) Stall() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stall = make(chan struct{})
+}
+
+func (c *fakeConn) Unstall() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stall != nil {
+		close(c.stall)
+		c.stall = nil
+	}
+}
+
+// Makes the pending read fail with err without closing the connection, as if the peer vanished
+func (c *fakeConn) Vanish(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readErr = err
+}
+
+// Ends the connection, the server's next read sees EOF
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+// Whether the server closed the connection, or the test did
+func (c *fakeConn) Closed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *fakeConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5077}
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *fakeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *fakeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// A VehicleAdapter with programmable scans and connects whose vehicles record what they are sent
+type fakeAdapter struct {
+	mu sync.Mutex
+	// returned by Enable and Scan
+	enableErr error
+	scanErr   error
+	// reported by every scan
+	advertised []AnkiVehicle
+	// keep scanning until StopScan like a real adapter, otherwise a scan ends once it reported every vehicle
+	holdScan bool
+	stopScan chan struct{}
+	scanMode string
+	// returned by Connect for a vehicle, and called by Connect before it returns, e.g. to hold it up
+	connectErrs map[string]error
+	onConnect   func(address string)
+	// the dBm TxPower reports, unsupported unless txPowerSupported
+	txPower          int
+	txPowerSupported bool
+	vehicles         map[string]*fakeVehicle
+	disconnected     func(address string)
+
+	enables       int
+	scans         int
+	stopScans     int
+	connects      int
+	connectParams []bluetooth.ConnectionParams
+}
+
+func newFakeAdapter() *fakeAdapter {
+	return &fakeAdapter{
+		connectErrs: make(map[string]error),
+		vehicles:    make(map[string]*fakeVehicle),
+		scanMode:    SCAN_MODE_ACTIVE,
+	}
+}
+
+// Makes the following scans report a vehicle at address with the given signal strength
+func (a *fakeAdapter) Advertise(address string, rssi int16) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.advertised {
+		if a.advertised[i].Address == address {
+			a.advertised[i].RSSI = rssi
+			return
+		}
+	}
+	// encoded when it is advertised like the BLE adapter does, in the hexCase then configured
+	records := map[uint16][]byte{0xbeef: {0x00, 0x01, 0x12, 0x34}}
+	a.advertised = append(a.advertised, AnkiVehicle{
+		Address:             address,
+		ManufacturerData:    encodeManufacturerData(records),
+		LocalName:           "Drive",
+		ManufacturerRecords: records,
+		RSSI:                rssi,
+	})
+}
+
+// Stops reporting the vehicle at address in scans
+func (a *fakeAdapter) Unadvertise(address string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.advertised {
+		if a.advertised[i].Address == address {
+			a.advertised = append(a.advertised[:i], a.advertised[i+1:]...)
+			return
+		}
+	}
+}
+
+// Makes the following connects to address fail with err, nil lets them succeed again
+func (a *fakeAdapter) FailConnect(address string, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.connectErrs[address] = err
+}
+
+// The vehicle Connect hands out for address, created on first use so a test can program it before it connects
+func (a *fakeAdapter) Vehicle(address string) *fakeVehicle {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.vehicle(address)
+}
+
+func (a *fakeAdapter) vehicle(address string) *fakeVehicle {
+	vehicle, ok := a.vehicles[address]
+	if !ok {
+		vehicle = &fakeVehicle{
+			address: address,
+			writer:  &fakeCharacteristic{uuid: ANKI_STR_CHR_WRITE_UUID},
+			reader:  &fakeCharacteristic{uuid: ANKI_STR_CHR_READ_UUID},
+		}
+		a.vehicles[address] = vehicle
+	}
+	return vehicle
+}
+
+// Reports that the vehicle at address dropped the link on its own, as the BLE stack would
+func (a *fakeAdapter) DropLink(address string) {
+	a.mu.Lock()
+	handler := a.disconnected
+	a.mu.Unlock()
+	if handler != nil {
+		handler(address)
+	}
+}
+
+// Number of Enable, Scan, StopScan and Connect calls so far
+func (a *fakeAdapter) Calls() (enables int, scans int, stopScans int, connects int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.enables, a.scans, a.stopScans, a.connects
+}
+
+func (a *fakeAdapter) Enable() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.enables++
+	return a.enableErr
+}
+
+func (a *fakeAdapter) Scan(found func(AnkiVehicle)) error {
+	a.mu.Lock()
+	a.scans++
+	if a.scanErr != nil {
+		a.mu.Unlock()
+		return a.scanErr
+	}
+	advertised := append([]AnkiVehicle(nil), a.advertised...)
+	stop := make(chan struct{})
+	a.stopScan = stop
+	hold := a.holdScan
+	a.mu.Unlock()
+
+	for _, vehicle := range advertised {
+		found(vehicle)
+	}
+	if hold {
+		<-stop
+	}
+	return nil
+}
+
+func (a *fakeAdapter) StopScan() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stopScans++
+	if a.stopScan == nil {
+		return errors.New("not scanning")
+	}
+	close(a.stopScan)
+	a.stopScan = nil
+	return nil
+}
+
+// Ends the scan in progress and lets the following ones end as soon as they reported every vehicle
+func (a *fakeAdapter) ReleaseScans() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.holdScan = false
+	if a.stopScan != nil {
+		close(a.stopScan)
+		a.stopScan = nil
+	}
+}
+
+func (a *fakeAdapter) SetScanMode(mode string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.scanMode = mode
+	return nil
+}
+
+// The scan mode last set on the adapter
+func (a *fakeAdapter) ScanMode() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.scanMode
+}
+
+func (a *fakeAdapter) TxPower() (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.txPowerSupported {
+		return 0, errors.New("unsupported")
+	}
+	return a.txPower, nil
+}
+
+func (a *fakeAdapter) SetTxPower(dBm int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.txPowerSupported {
+		return errors.New("unsupported")
+	}
+	a.txPower = dBm
+	return nil
+}
+
+func (a *fakeAdapter) Connect(vehicle AnkiVehicle, params bluetooth.ConnectionParams) (VehicleLink, error) {
+	a.mu.Lock()
+	a.connects++
+	a.connectParams = append(a.connectParams, params)
+	err := a.connectErrs[vehicle.Address]
+	onConnect := a.onConnect
+	link := a.vehicle(vehicle.Address)
+	a.mu.Unlock()
+
+	if onConnect != nil {
+		onConnect(vehicle.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func (a *fakeAdapter) SetDisconnectHandler(handler func(address string)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.disconnected = handler
+}
+
+// The link to a fake vehicle, its characteristics record writes and emit notifications on demand
+type fakeVehicle struct {
+	address string
+	writer  *fakeCharacteristic
+	reader  *fakeCharacteristic
+
+	mu          sync.Mutex
+	discoverErr error
+	// what discovery returns in this order if set, by default the writer and the reader
+	characteristics []Characteristic
+	discovers       int
+	disconnects     int
+}
+
+func (v *fakeVehicle) DiscoverCharacteristics() (VehicleCharacteristics, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.discovers++
+	if v.discoverErr != nil {
+		return VehicleCharacteristics{}, v.discoverErr
+	}
+	if v.characteristics != nil {
+		return matchCharacteristics(v.characteristics)
+	}
+	return VehicleCharacteristics{Writer: v.writer, Reader: v.reader}, nil
+}
+
+func (v *fakeVehicle) Disconnect() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.disconnects++
+	return nil
+}
+
+func (v *fakeVehicle) Disconnects() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.disconnects
+}
+
+// Sends a notification from the vehicle as the BLE stack would, a no-op until the server subscribed to them
+func (v *fakeVehicle) Emit(value []byte) {
+	v.reader.mu.Lock()
+	callback := v.reader.callback
+	v.reader.mu.Unlock()
+	if callback != nil {
+		callback(value)
+	}
+}
+
+// Everything written to the vehicle so far
+func (v *fakeVehicle) Writes() [][]byte {
+	return v.writer.Writes()
+}
+
+// The hex of every write to the vehicle so far, in order
+func (v *fakeVehicle) WrittenHex() []string {
+	var written []string
+	for _, write := range v.Writes() {
+		written = append(written, encodeHex(write))
+	}
+	return written
+}
+
+// Waits until the vehicle received a write of payload
+func (v *fakeVehicle) ExpectWrite(t *testing.T, payload []byte) {
+	t.Helper()
+	waitUntil(t, "write of "+encodeHex(payload)+" to "+v.address, func() bool {
+		for _, write := range v.Writes() {
+			if string(write) == string(payload) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+type fakeCharacteristic struct {
+	uuid   bluetooth.UUID
+	handle uint16
+
+	mu sync.Mutex
+	// decides the outcome of every write before it is recorded, nil lets every write succeed
+	onWrite  func(p []byte) error
+	writes   [][]byte
+	attempts int
+	callback func([]byte)
+	// fails EnableNotifications
+	notifyErr error
+	value     []byte
+	readErr   error
+}
+
+func (c *fakeCharacteristic) UUID() bluetooth.UUID {
+	return c.uuid
+}
+
+func (c *fakeCharacteristic) Handle() uint16 {
+	return c.handle
+}
+
+func (c *fakeCharacteristic) WriteWithoutResponse(p []byte) (int, error) {
+	c.mu.Lock()
+	c.attempts++
+	onWrite := c.onWrite
+	c.mu.Unlock()
+	if onWrite != nil {
+		if err := onWrite(p); err != nil {
+			return 0, err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes = append(c.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (c *fakeCharacteristic) EnableNotifications(callback func(buf []byte)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.notifyErr != nil {
+		return c.notifyErr
+	}
+	c.callback = callback
+	return nil
+}
+
+func (c *fakeCharacteristic) Read(data []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	return copy(data, c.value), nil
+}
+
+// Replaces the outcome of the following writes, see onWrite
+func (c *fakeCharacteristic) OnWrite(onWrite func(p []byte) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onWrite = onWrite
+}
+
+func (c *fakeCharacteristic) Writes() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]byte(nil), c.writes...)
+}
+
+// Number of writes tried, failed ones included
+func (c *fakeCharacteristic) Attempts() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.attempts
+}
+
+// Fails the next count writes with err, later ones succeed
+func failWrites(count int, err error) func(p []byte) error {
+	var failed int32
+	return func(p []byte) error {
+		if atomic.AddInt32(&failed, 1) <= int32(count) {
+			return err
+		}
+		return nil
+	}
+}
+
+// The address of the n-th vehicle of a test that needs many
+func testVehicleAddress(n int) string {
+	suffix := strconv.FormatInt(int64(n), 16)
+	for len(suffix) < 4 {
+		suffix = "0" + suffix
+	}
+	return "AA:00:00:00:" + strings.ToUpper(suffix[:2]) + ":" + strings.ToUpper(suffix[2:])
+}
@@ -0,0 +1,43 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Disconnects vehicles that sit connected but unused. A vehicle is active while commands are written to it or it
+ * sends notifications, so a car reporting position updates as it drives is never considered idle.
+ *
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// Records that a command was written to or a notification received from the vehicle
+func touchVehicle(address string) {
+	server.LastActivity.Set(address, time.Now())
+}
+
+func sweepIdleVehicles(timeout time.Duration) {
+	interval := timeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		disconnectIdleVehicles(timeout, time.Now())
+	}
+}
+
+// Tears down every connected vehicle without activity for longer than timeout before now
+func disconnectIdleVehicles(timeout time.Duration, now time.Time) {
+	for _, address := range server.ConnectedDevices.Keys() {
+		lastActivity, ok := server.LastActivity.Get(address)
+		if !ok || now.Sub(lastActivity) <= timeout {
+			continue
+		}
+		notice := encodeMessage(VehicleEventMessage{Type: "event", Address: address, Event: "DISCONNECTED", Reason: "IDLE"})
+		if err := teardownVehicle(address, notice); err != nil {
+			displayInfo("Could not disconnect idle vehicle " + address + ": " + err.Error())
+		}
+		displayInfo(address + " idle for " + timeout.String() + ", disconnected.")
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the idle vehicle sweep.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Only vehicles without activity for longer than the timeout are disconnected, and their subscribers are told why
+func TestDisconnectIdleVehicles(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	idle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	busy := connectTestVehicle(t, adapter, client, TEST_VEHICLE_2)
+
+	now := time.Now()
+	server.LastActivity.Set(TEST_VEHICLE, now.Add(-2*time.Minute))
+	server.LastActivity.Set(TEST_VEHICLE_2, now.Add(-30*time.Second))
+	disconnectIdleVehicles(time.Minute, now)
+
+	client.Expect(t, TEST_VEHICLE+";IDLE;DISCONNECTED")
+	if idle.Disconnects() != 1 || server.ConnectedDevices.Has(TEST_VEHICLE) {
+		t.Errorf("idle vehicle still connected")
+	}
+	if busy.Disconnects() != 0 || !server.ConnectedDevices.Has(TEST_VEHICLE_2) {
+		t.Errorf("vehicle active within the timeout was disconnected")
+	}
+	if state, _ := server.VehicleStates.Get(TEST_VEHICLE); state != STATE_DISCONNECTED {
+		t.Errorf("idle vehicle is %v", state)
+	}
+}
+
+// With wireFormat json the idle notice is a json event like the other vehicle events
+func TestIdleNoticeJson(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	serverConf.WireFormat = WIRE_FORMAT_JSON
+
+	now := time.Now()
+	server.LastActivity.Set(TEST_VEHICLE, now.Add(-2*time.Minute))
+	disconnectIdleVehicles(time.Minute, now)
+
+	var event VehicleEventMessage
+	if err := json.Unmarshal([]byte(client.Expect(t, "{")), &event); err != nil {
+		t.Fatalf("idle notice is not json: %v", err)
+	}
+	want := VehicleEventMessage{Type: "event", Address: TEST_VEHICLE, Event: "DISCONNECTED", Reason: "IDLE"}
+	if event != want {
+		t.Fatalf("idle notice %+v, want %+v", event, want)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Lane-keeping assist. After LANEKEEP;<address>;<target offset> the server watches the vehicle's position updates
+ * and sends a change-lane message back toward the target whenever the reported offset drifts too far from it,
+ * until LANEKEEP;<address>;OFF.
+ *
+ */
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// drift from the target offset that is tolerated before correcting
+	LANEKEEP_TOLERANCE_MM = 5
+	// a correction takes a while to show up in the position updates, don't pile up change-lane messages
+	LANEKEEP_CORRECTION_INTERVAL = 500 * time.Millisecond
+	LANEKEEP_HORIZONTAL_SPEED    = 300
+	LANEKEEP_HORIZONTAL_ACCEL    = 2500
+)
+
+type LaneKeeper struct {
+	TargetMm       float32
+	mu             sync.Mutex
+	lastCorrection time.Time
+}
+
+// Called for every position update, corrects the vehicle if it drifted from the target offset
+func keepLane(address string, offsetMm float32) {
+	keeper, ok := server.LaneKeepers.Get(address)
+	if !ok || math.Abs(float64(offsetMm-keeper.TargetMm)) <= LANEKEEP_TOLERANCE_MM {
+		return
+	}
+
+	keeper.mu.Lock()
+	if time.Since(keeper.lastCorrection) < LANEKEEP_CORRECTION_INTERVAL {
+		keeper.mu.Unlock()
+		return
+	}
+	keeper.lastCorrection = time.Now()
+	keeper.mu.Unlock()
+
+	// don't hold up the BLE callback with the write
+	go func() {
+		displayInfo("Lane keeping: " + address + " at " + strconv.FormatFloat(float64(offsetMm), 'f', 1, 32) + "mm, steering back to " +
+			strconv.FormatFloat(float64(keeper.TargetMm), 'f', 1, 32) + "mm")
+		if err := writeToVehicle(address, EncodeChangeLane(LANEKEEP_HORIZONTAL_SPEED, LANEKEEP_HORIZONTAL_ACCEL, keeper.TargetMm)); err != nil {
+			displayInfo("Lane keeping correction for " + address + " failed: " + err.Error())
+		}
+	}()
+}
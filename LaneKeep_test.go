@@ -0,0 +1,59 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the lane-keeping assist.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A vehicle drifting from the target offset is steered back toward it, drift within the tolerance and vehicles
+// without lane keeping are left alone
+func TestLaneKeepCorrectsDrift(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	correction := EncodeChangeLane(LANEKEEP_HORIZONTAL_SPEED, LANEKEEP_HORIZONTAL_ACCEL, -20)
+
+	vehicle.Emit(positionUpdate(1, 17, 30, 400))
+	client.Send("LANEKEEP;" + TEST_VEHICLE + ";-20;3")
+	client.Expect(t, "LANEKEEP;SUCCESS;3")
+	vehicle.Emit(positionUpdate(2, 17, -22, 400))
+	time.Sleep(20 * time.Millisecond)
+	if writes := len(vehicle.Writes()); writes != 0 {
+		t.Fatalf("%d corrections before the vehicle drifted", writes)
+	}
+
+	vehicle.Emit(positionUpdate(3, 17, -5, 400))
+	vehicle.ExpectWrite(t, correction)
+	// the correction needs time to show, a drift right after it is not corrected again
+	vehicle.Emit(positionUpdate(4, 17, -6, 400))
+	time.Sleep(20 * time.Millisecond)
+	if writes := len(vehicle.Writes()); writes != 1 {
+		t.Fatalf("%d corrections, want 1 within the correction interval", writes)
+	}
+	keeper, _ := server.LaneKeepers.Get(TEST_VEHICLE)
+	keeper.mu.Lock()
+	keeper.lastCorrection = time.Now().Add(-LANEKEEP_CORRECTION_INTERVAL)
+	keeper.mu.Unlock()
+	vehicle.Emit(positionUpdate(5, 17, -40, 400))
+	waitUntil(t, "a second correction", func() bool { return len(vehicle.Writes()) == 2 })
+
+	client.Send("LANEKEEP;" + TEST_VEHICLE + ";OFF")
+	client.Expect(t, "LANEKEEP;SUCCESS")
+	vehicle.Emit(positionUpdate(6, 17, 50, 400))
+	time.Sleep(20 * time.Millisecond)
+	if writes := len(vehicle.Writes()); writes != 2 {
+		t.Fatalf("%d corrections after lane keeping was turned off", writes)
+	}
+
+	client.Send("LANEKEEP;" + TEST_VEHICLE + ";center")
+	client.Expect(t, "ERROR;invalid-offset")
+	client.Send("LANEKEEP;" + TEST_VEHICLE_2 + ";0")
+	client.Expect(t, "LANEKEEP;FAILED;not-connected")
+}
@@ -0,0 +1,60 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Log levels of the console output. DEBUG adds a line for every message sent to or received from a vehicle, INFO
+ * leaves those out and ERROR only reports fatal errors. logLevel sets the level at startup, LOGLEVEL;<level> changes
+ * it while the server runs.
+ *
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	LOG_DEBUG int32 = iota
+	LOG_INFO
+	LOG_ERROR
+)
+
+var LOG_LEVEL_NAMES = map[string]int32{
+	"DEBUG": LOG_DEBUG,
+	"INFO":  LOG_INFO,
+	"ERROR": LOG_ERROR,
+}
+
+// The current log level, read and written atomically since every goroutine logs
+var logLevel = LOG_INFO
+
+// Where the DEBUG and INFO lines are printed
+var logOutput io.Writer = os.Stdout
+
+// Changes the log level to the named one, case insensitive. Returns false for an unknown level
+func setLogLevel(name string) bool {
+	level, ok := LOG_LEVEL_NAMES[strings.ToUpper(name)]
+	if !ok {
+		return false
+	}
+	atomic.StoreInt32(&logLevel, level)
+	return true
+}
+
+func logLevelName() string {
+	level := atomic.LoadInt32(&logLevel)
+	for name, value := range LOG_LEVEL_NAMES {
+		if value == level {
+			return name
+		}
+	}
+	return "UNKNOWN"
+}
+
+// Whether messages of level are printed at the current log level
+func logEnabled(level int32) bool {
+	return level >= atomic.LoadInt32(&logLevel)
+}
@@ -0,0 +1,103 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the log levels and of changing them at runtime.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Collects the log lines printed by every goroutine of the server
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) Contains(text string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Contains(b.buf.String(), text)
+}
+
+// Prints the server's log lines into a buffer until the test ends, set up before the server so it is restored last
+func captureLog(t *testing.T) *logBuffer {
+	captured := &logBuffer{}
+	logOutput = captured
+	t.Cleanup(func() { logOutput = os.Stdout })
+	return captured
+}
+
+// LOGLEVEL;DEBUG prints every message sent to a vehicle from the next command on, LOGLEVEL;INFO leaves them out again
+func TestLogLevelCommand(t *testing.T) {
+	captured := captureLog(t)
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Send("LOGLEVEL;debug;1")
+	client.Expect(t, "LOGLEVEL;DEBUG;1")
+	// commands of a client are handled in order, after the PONG the write before it has been logged
+	client.Send(TEST_VEHICLE+";0116", "PING;2")
+	client.Expect(t, "PONG;2")
+	if !captured.Contains("[DEBUG] " + ANSI_RESET + "SENDING: [" + TEST_VEHICLE + ";0116]") {
+		t.Fatal("write not logged at DEBUG")
+	}
+
+	client.Send("LOGLEVEL;INFO;3")
+	client.Expect(t, "LOGLEVEL;INFO;3")
+	client.Send(TEST_VEHICLE+";0117", "PING;4")
+	client.Expect(t, "PONG;4")
+	if captured.Contains("SENDING: [" + TEST_VEHICLE + ";0117]") {
+		t.Fatal("write logged at INFO")
+	}
+
+	client.Send("LOGLEVEL;LOUD")
+	client.Expect(t, "LOGLEVEL;FAILED;invalid-level")
+	if logLevelName() != "INFO" {
+		t.Fatalf("log level %s after an invalid level", logLevelName())
+	}
+	// a listener with allowedCommands has to list it
+	restricted := newTestClient(t, permittedCommands([]string{"PING"}))
+	restricted.Send("LOGLEVEL;DEBUG")
+	restricted.Expect(t, "ERROR;not-permitted")
+	if logLevelName() != "INFO" {
+		t.Fatalf("log level %s changed by a client not permitted to", logLevelName())
+	}
+}
+
+// The progress of SCAN and CONNECT is logged at INFO and left out at ERROR
+func TestCommandProgressLogging(t *testing.T) {
+	captured := captureLog(t)
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+
+	setLogLevel("ERROR")
+	connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	if captured.Contains("Connected to") || captured.Contains("CONNECT COMPLETED.") {
+		t.Fatal("CONNECT logged at ERROR")
+	}
+
+	setLogLevel("INFO")
+	connectTestVehicle(t, adapter, client, TEST_VEHICLE_2)
+	if !captured.Contains("[INFO] "+ANSI_RESET+"Connected to "+TEST_VEHICLE_2) || !captured.Contains("CONNECT COMPLETED.") {
+		t.Fatal("CONNECT not logged at INFO")
+	}
+	dispatchFrame(newDispatchClient(t), "SCAN")
+	if !captured.Contains("[INFO] " + ANSI_RESET + "Scanning Completed.") {
+		t.Fatal("SCAN not logged at INFO")
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * The chain every parsed request passes through before the command handler. A middleware wraps the next handler
+ * and may act before or after it, or answer the request itself and stop it there, e.g. to reject a command the
+ * client may not use. Middlewares are registered at startup and run in the order they were registered.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// A request of a client, split into its fields
+type Request struct {
+	Client *ClientConn
+	Conn   io.Writer
+	Frame  string
+	Set    []string
+	// the command verb, WRITE_VERB for <address>;<hex> writes
+	Verb string
+}
+
+type Handler func(req *Request) error
+
+type Middleware func(next Handler) Handler
+
+var (
+	middlewares []Middleware
+	// handleCommand wrapped in every registered middleware, built once the middlewares are registered
+	commandHandler Handler = handleCommand
+)
+
+// Appends m to the chain, must be called before the server accepts clients
+func registerMiddleware(m Middleware) {
+	middlewares = append(middlewares, m)
+	commandHandler = buildChain(handleCommand)
+}
+
+// Wraps handler so a request passes through the registered middlewares first to last before reaching it
+func buildChain(handler Handler) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Rejects commands the client's listener does not permit with ERROR;not-permitted
+func permissionMiddleware(next Handler) Handler {
+	return func(req *Request) error {
+		if !req.Client.Permits(req.Verb) {
+			req.Conn.Write(response("ERROR;not-permitted", requestId(req.Set)))
+			return errors.New(req.Verb + " is not permitted on this listener")
+		}
+		return next(req)
+	}
+}
+
+// Rejects commands for a vehicle over its rate limit with ERROR;rate-limited
+func rateLimitMiddleware(next Handler) Handler {
+	return func(req *Request) error {
+		if address, ok := commandVehicle(req.Set); ok && !allowCommand(address) {
+			req.Conn.Write(response("ERROR;rate-limited", requestId(req.Set)))
+			return nil
+		}
+		return next(req)
+	}
+}
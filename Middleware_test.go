@@ -0,0 +1,120 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the middleware chain every request passes through.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// WRITE permits raw writes and RAW the RAW;ON|OFF command, neither one permits the other
+func TestPermittedWriteAndRaw(t *testing.T) {
+	adapter := newTestServer(t)
+	owner := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, owner, TEST_VEHICLE)
+
+	writer := newTestClient(t, permittedCommands([]string{"write"}))
+	writer.Send(TEST_VEHICLE + ";0116;ACK")
+	writer.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	vehicle.ExpectWrite(t, EncodePing())
+	writer.Send("RAW;OFF")
+	writer.Expect(t, "ERROR;not-permitted")
+
+	toggler := newTestClient(t, permittedCommands([]string{"RAW"}))
+	toggler.Send("RAW;OFF")
+	toggler.Expect(t, "RAW;SUCCESS")
+	toggler.Send(TEST_VEHICLE + ";0116;ACK")
+	toggler.Expect(t, "ERROR;not-permitted")
+}
+
+// A middleware that records when a request passes it on the way in and on the way out
+func recordingMiddleware(name string, trace *[]string) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) error {
+			*trace = append(*trace, name+">"+req.Verb)
+			err := next(req)
+			*trace = append(*trace, name+"<"+req.Verb)
+			return err
+		}
+	}
+}
+
+// Middlewares run in the order they were registered and unwind in reverse, one answering a request stops it there
+func TestMiddlewareOrderAndShortCircuit(t *testing.T) {
+	adapter := newTestServer(t)
+	middlewares = nil
+	var trace []string
+	registerMiddleware(recordingMiddleware("first", &trace))
+	registerMiddleware(func(next Handler) Handler {
+		return func(req *Request) error {
+			if req.Verb == "SCAN" {
+				req.Conn.Write([]byte("ERROR;no-scanning\n"))
+				return errors.New("scanning is off")
+			}
+			return next(req)
+		}
+	})
+	registerMiddleware(recordingMiddleware("last", &trace))
+	client := newDispatchClient(t)
+
+	lines, err := dispatchFrame(client, "PING;1")
+	if err != nil || strings.Join(lines, ",") != "PONG;1" {
+		t.Fatalf("PING answered %q, %v", lines, err)
+	}
+	if got := strings.Join(trace, ","); got != "first>PING,last>PING,last<PING,first<PING" {
+		t.Fatalf("middlewares ran as %s", got)
+	}
+
+	trace = nil
+	lines, err = dispatchFrame(client, "SCAN")
+	if err == nil || strings.Join(lines, ",") != "ERROR;no-scanning" {
+		t.Fatalf("SCAN answered %q, %v", lines, err)
+	}
+	if got := strings.Join(trace, ","); got != "first>SCAN,first<SCAN" {
+		t.Fatalf("middlewares ran as %s, the chain must stop at the rejecting one", got)
+	}
+	if _, scans, _, _ := adapter.Calls(); scans != 0 {
+		t.Fatal("rejected SCAN reached the handler")
+	}
+}
+
+// The permission check comes before the rate limit, a command the client may not use never takes a token
+func TestPermissionBeforeRateLimit(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.MaxCommandsPerSecond = 1
+	owner := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, owner, TEST_VEHICLE)
+
+	reader := newTestClient(t, permittedCommands([]string{"PING"}))
+	for i := 0; i < 3; i++ {
+		reader.Send(TEST_VEHICLE + ";0116")
+		reader.Expect(t, "ERROR;not-permitted")
+	}
+	owner.Send(TEST_VEHICLE + ";0116;ACK")
+	owner.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	vehicle.ExpectWrite(t, EncodePing())
+}
+
+// A rejected request is answered with its request id
+func TestRejectionRequestIds(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.MaxCommandsPerSecond = 1
+	owner := newTestClient(t, nil)
+	connectTestVehicle(t, adapter, owner, TEST_VEHICLE)
+
+	reader := newTestClient(t, permittedCommands([]string{"PING"}))
+	reader.Send("SCAN;7")
+	reader.Expect(t, "ERROR;not-permitted;7")
+	reader.Send("TURN;" + TEST_VEHICLE + ";LEFT;8")
+	reader.Expect(t, "ERROR;not-permitted;8")
+
+	owner.Send("LIGHTS;"+TEST_VEHICLE+";HEADLIGHTS;ON;1", "LIGHTS;"+TEST_VEHICLE+";HEADLIGHTS;OFF;2")
+	owner.Expect(t, "LIGHTS;SUCCESS;1")
+	owner.Expect(t, "ERROR;rate-limited;2")
+}
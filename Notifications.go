@@ -0,0 +1,186 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Forwarding of vehicle notifications to the subscribed tcp clients. Every notification is forwarded as raw hex;
+ * messages the server understands are additionally reported as a readable frame.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	TIMESTAMP_MONOTONIC = "monotonic"
+	TIMESTAMP_UNIX      = "unix"
+)
+
+// Monotonic reference for notification timestamps
+var startTime = time.Now()
+
+// Called by the BLE stack for each message a vehicle sends, must return quickly.
+// receivedAt is taken as early as possible in the BLE callback.
+func forwardNotification(address string, value []byte, receivedAt time.Time) {
+	captureNotification(address, value, receivedAt)
+	touchVehicle(address)
+	countStat(&stats.Notifications)
+	encodedBytes := encodeHex(value)
+	displayDebug("RECEIVED: [" + address + ";" + encodedBytes + "]")
+
+	// tinygo cannot unsubscribe from a characteristic, so NOTIFY;<address>;OFF only stops the delivery to clients
+	// here. The server keeps tracking the vehicle and answering its pings
+	if !server.NotificationsOff.Has(address) {
+		deliverNotification(address, value, encodedBytes, receivedAt)
+	}
+
+	msgId, ok := MessageId(value)
+	if !ok {
+		return
+	}
+
+	switch msgId {
+	case ANKI_MSG_V2C_POSITION_UPDATE:
+		if position, ok := ParsePositionUpdate(value); ok {
+			recordPosition(address, position, receivedAt)
+			keepLane(address, position.OffsetMm)
+		}
+
+	case ANKI_MSG_V2C_TRANSITION_UPDATE:
+		if transition, ok := ParseTransition(value); ok {
+			recordTransition(address, transition)
+		}
+
+	// answers the ping the server sends after enabling SDK mode
+	case ANKI_MSG_V2C_PING_RESPONSE:
+		answerPing(address)
+
+	// the vehicle lost track of where it is on the track, e.g. it flew off or hit an unreadable segment
+	case ANKI_MSG_V2C_VEHICLE_DELOCALIZED:
+		displayInfo(address + " Delocalized.")
+		if serverConf.StopOnDelocalize {
+			// don't hold up the BLE callback with the write
+			go func() {
+				if err := writeToVehicle(address, EncodeSetSpeed(0, STOP_ACCELERATION)); err != nil {
+					displayInfo("Could not stop delocalized vehicle " + address + ": " + err.Error())
+				}
+			}()
+		}
+
+	// the vehicle hit another vehicle or an obstacle
+	case ANKI_MSG_V2C_COLLISION_DETECTED:
+		displayInfo(address + " Collision.")
+	}
+}
+
+// Sends a notification to the subscribed clients and the telemetry listeners, delocalizations and collisions are
+// also reported as an event
+func deliverNotification(address string, value []byte, encodedBytes string, receivedAt time.Time) {
+	// Queue the vehicle respond for every subscribed client, never block the BLE stack on a slow client
+	frame := encodeMessage(NotificationMessage{
+		Type:      "notification",
+		Address:   address,
+		Timestamp: notificationTimestamp(receivedAt),
+		Payload:   encodedBytes,
+	})
+	// position and transition updates also have a compact form for clients that selected ENCODING;COMPACT
+	datagram := telemetryDatagram(address, value, receivedAt)
+	frames := NotificationFrames{Raw: frame, Compact: compactFrame(datagram), Decoded: decodedFrame(address, value)}
+	msgId, ok := MessageId(value)
+	if ok && msgId == ANKI_MSG_V2C_POSITION_UPDATE && serverConf.NotificationCoalesceMillis > 0 {
+		coalescePosition(address, frames, time.Duration(serverConf.NotificationCoalesceMillis)*time.Millisecond)
+	} else {
+		notifyRawSubscribers(address, frames)
+	}
+	if datagram != nil {
+		sendTelemetry(datagram)
+	}
+
+	switch {
+	case ok && msgId == ANKI_MSG_V2C_VEHICLE_DELOCALIZED:
+		notifySubscribers(address, encodeMessage(VehicleEventMessage{Type: "event", Address: address, Event: "DELOCALIZED"}))
+	case ok && msgId == ANKI_MSG_V2C_COLLISION_DETECTED:
+		notifySubscribers(address, encodeMessage(VehicleEventMessage{Type: "event", Address: address, Event: "COLLISION"}))
+	}
+}
+
+// Wakes up the confirmSdkMode waiting for the vehicle's ping response, if any
+func answerPing(address string) {
+	if waiter, ok := server.PingWaiters.Pop(address); ok {
+		close(waiter)
+	}
+}
+
+// The decoded position, transition or battery frame for the clients that turned the raw hex off, nil for other
+// messages. Delocalizations and collisions are reported to every subscriber already
+func decodedFrame(address string, value []byte) []byte {
+	if msgId, ok := MessageId(value); !ok || msgId == ANKI_MSG_V2C_VEHICLE_DELOCALIZED || msgId == ANKI_MSG_V2C_COLLISION_DETECTED {
+		return nil
+	}
+	description, ok := describeNotification(value)
+	if !ok {
+		return nil
+	}
+	return encodeMessage(DecodedNotificationMessage{Type: "decoded", Address: address, Message: description})
+}
+
+// Describes a vehicle message the server knows how to decode, e.g. "POS;<location>;<piece>;<offset>;<speed>"
+func describeNotification(value []byte) (string, bool) {
+	if position, ok := ParsePositionUpdate(value); ok {
+		return "POS;" + strconv.Itoa(int(position.LocationId)) + ";" + strconv.Itoa(int(position.RoadPieceId)) + ";" +
+			strconv.FormatFloat(float64(position.OffsetMm), 'f', -1, 32) + ";" + strconv.Itoa(int(position.SpeedMmPerSec)), true
+	}
+	if transition, ok := ParseTransition(value); ok {
+		return "TRANSITION;" + strconv.Itoa(int(transition.RoadPieceIdx)) + ";" + strconv.Itoa(int(transition.RoadPieceIdxPrev)) + ";" +
+			strconv.FormatFloat(float64(transition.OffsetMm), 'f', -1, 32), true
+	}
+	if millivolts, ok := ParseBatteryLevel(value); ok {
+		return "BATTERY;" + strconv.Itoa(int(millivolts)), true
+	}
+	if msgId, ok := MessageId(value); ok && msgId == ANKI_MSG_V2C_VEHICLE_DELOCALIZED {
+		return "DELOCALIZED", true
+	}
+	if msgId, ok := MessageId(value); ok && msgId == ANKI_MSG_V2C_COLLISION_DETECTED {
+		return "COLLISION", true
+	}
+	return "", false
+}
+
+// Formats the configured notification timestamp, nanoseconds since server start or Unix nanoseconds.
+// Empty if timestamps are disabled.
+func notificationTimestamp(receivedAt time.Time) string {
+	switch serverConf.NotificationTimestamps {
+	case TIMESTAMP_MONOTONIC:
+		// Sub uses the monotonic clock, so timestamps never go backwards
+		return strconv.FormatInt(receivedAt.Sub(startTime).Nanoseconds(), 10)
+	case TIMESTAMP_UNIX:
+		return strconv.FormatInt(receivedAt.UnixNano(), 10)
+	}
+	return ""
+}
+
+// Enables SDK mode and waits for the vehicle to confirm it. Vehicles do not acknowledge the SDK mode message
+// itself, but they handle messages in order, so the response to a ping sent right after it confirms that the
+// SDK mode message was processed.
+func confirmSdkMode(address string, timeout time.Duration) error {
+	waiter := make(chan struct{})
+	server.PingWaiters.Set(address, waiter)
+	defer server.PingWaiters.Remove(address)
+
+	if err := writeToVehicle(address, EncodeSdkMode(true, SDK_OPTION_OVERRIDE_LOCALIZATION)); err != nil {
+		return err
+	}
+	if err := writeToVehicle(address, EncodePing()); err != nil {
+		return err
+	}
+
+	select {
+	case <-waiter:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("no acknowledgement within " + timeout.String())
+	}
+}
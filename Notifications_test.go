@@ -0,0 +1,239 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of how vehicle notifications reach the subscribed clients.
+ *
+ */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The raw-on subscriber receives the hex of each notification, the raw-off one the decoded frame instead
+func TestRawOnAndOffSubscribers(t *testing.T) {
+	adapter := newTestServer(t)
+	raw := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, raw, TEST_VEHICLE)
+	decoded := newTestClient(t, nil)
+	decoded.Send("SUBSCRIBE;" + TEST_VEHICLE)
+	decoded.Expect(t, "SUBSCRIBE;SUCCESS")
+	decoded.Send("RAW;OFF")
+	decoded.Expect(t, "RAW;SUCCESS")
+
+	battery := []byte{3, ANKI_MSG_V2C_BATTERY_LEVEL, 0x6c, 0x0f}
+	notifications := []struct {
+		value   []byte
+		decoded string
+	}{
+		{positionUpdate(17, 33, -23.5, 300), TEST_VEHICLE + ";POS;17;33;-23.5;300"},
+		{transitionUpdate(4, -1, 12), TEST_VEHICLE + ";TRANSITION;4;-1;12"},
+		{battery, TEST_VEHICLE + ";BATTERY;3948"},
+		{[]byte{1, ANKI_MSG_V2C_VEHICLE_DELOCALIZED}, TEST_VEHICLE + ";DELOCALIZED"},
+	}
+	for _, notification := range notifications {
+		vehicle.Emit(notification.value)
+		if got, want := raw.Expect(t, TEST_VEHICLE+";"), TEST_VEHICLE+";"+encodeHex(notification.value); got != want {
+			t.Fatalf("raw subscriber got %q, want %q", got, want)
+		}
+		if got := decoded.Expect(t, TEST_VEHICLE+";"); got != notification.decoded {
+			t.Fatalf("raw-off subscriber got %q, want %q", got, notification.decoded)
+		}
+	}
+	// the delocalization reaches the raw subscriber decoded as well
+	raw.Expect(t, TEST_VEHICLE+";DELOCALIZED")
+
+	// a message the server does not decode only reaches raw subscribers
+	vehicle.Emit([]byte{1, 0x77})
+	raw.Expect(t, TEST_VEHICLE+";0177")
+	decoded.Refute(t, TEST_VEHICLE+";", 50*time.Millisecond)
+
+	if got := raw.Count(TEST_VEHICLE + ";POS"); got != 0 {
+		t.Fatalf("raw subscriber received %d decoded position frames", got)
+	}
+	decoded.Send("RAW;ON")
+	decoded.Expect(t, "RAW;SUCCESS")
+	vehicle.Emit(battery)
+	decoded.Expect(t, TEST_VEHICLE+";"+encodeHex(battery))
+}
+
+func TestDecodedFrameJson(t *testing.T) {
+	newTestServer(t)
+	serverConf.WireFormat = WIRE_FORMAT_JSON
+	got := string(decodedFrame(TEST_VEHICLE, positionUpdate(1, 2, 0, 100)))
+	want := `{"type":"decoded","address":"` + TEST_VEHICLE + `","message":"POS;1;2;0;100"}` + "\n"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// A delocalized vehicle is reported to its subscribers as <address>;DELOCALIZED next to the raw hex
+func TestDelocalizedNotification(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	vehicle.Emit([]byte{0x01, ANKI_MSG_V2C_VEHICLE_DELOCALIZED})
+	client.Expect(t, TEST_VEHICLE+";012b")
+	if got := client.Expect(t, TEST_VEHICLE+";DELOCALIZED"); got != TEST_VEHICLE+";DELOCALIZED" {
+		t.Fatalf("delocalized frame %q", got)
+	}
+	// the vehicle keeps driving unless stopOnDelocalize is set
+	client.Refute(t, TEST_VEHICLE+";", 20*time.Millisecond)
+	if writes := len(vehicle.Writes()); writes != 0 {
+		t.Fatalf("%d writes to a delocalized vehicle without stopOnDelocalize", writes)
+	}
+}
+
+// With stopOnDelocalize the server stops a vehicle that lost track of the road on its own
+func TestStopOnDelocalize(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.StopOnDelocalize = true
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	vehicle.Emit([]byte{0x01, ANKI_MSG_V2C_VEHICLE_DELOCALIZED})
+	client.Expect(t, TEST_VEHICLE+";DELOCALIZED")
+	vehicle.ExpectWrite(t, EncodeSetSpeed(0, STOP_ACCELERATION))
+}
+
+// A collision is reported to its subscribers as <address>;COLLISION next to the raw hex, whatever the message carries
+func TestCollisionNotification(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	for _, collision := range [][]byte{{0x01, ANKI_MSG_V2C_COLLISION_DETECTED}, {0x03, ANKI_MSG_V2C_COLLISION_DETECTED, 0x01, 0x00}} {
+		vehicle.Emit(collision)
+		client.Expect(t, TEST_VEHICLE+";"+encodeHex(collision))
+		if got := client.Expect(t, TEST_VEHICLE+";COLLISION"); got != TEST_VEHICLE+";COLLISION" {
+			t.Fatalf("collision frame %q", got)
+		}
+	}
+	if description, ok := describeNotification([]byte{0x01, ANKI_MSG_V2C_COLLISION_DETECTED}); !ok || description != "COLLISION" {
+		t.Fatalf("collision described as %q", description)
+	}
+
+	serverConf.WireFormat = WIRE_FORMAT_JSON
+	vehicle.Emit([]byte{0x01, ANKI_MSG_V2C_COLLISION_DETECTED})
+	want := `{"type":"event","address":"` + TEST_VEHICLE + `","event":"COLLISION"}`
+	if got := client.Expect(t, `{"type":"event"`); got != want {
+		t.Fatalf("json collision event %q, want %q", got, want)
+	}
+}
+
+// NOTIFY;<address>;OFF stops forwarding the vehicle's notifications and ON resumes it. The BLE callback stays
+// registered, tinygo cannot unsubscribe, the server still tracks the vehicle, and reconnecting turns them on again
+func TestNotifyOnOff(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	vehicle.reader.mu.Lock()
+	registered := vehicle.reader.callback != nil
+	vehicle.reader.mu.Unlock()
+	if !registered {
+		t.Fatal("notifications not enabled on connect")
+	}
+
+	client.Send("NOTIFY;" + TEST_VEHICLE + ";OFF;1")
+	client.Expect(t, "NOTIFY;SUCCESS;1")
+	server.LastActivity.Remove(TEST_VEHICLE)
+	vehicle.Emit(positionUpdate(1, 17, 0, 300))
+	if !server.LastActivity.Has(TEST_VEHICLE) {
+		t.Fatal("notification while notifications are off did not count as vehicle activity")
+	}
+	client.Refute(t, TEST_VEHICLE+";", 20*time.Millisecond)
+	client.Send("QUERY_SPEED;" + TEST_VEHICLE)
+	if got := client.Expect(t, TEST_VEHICLE+";SPEED;"); !strings.HasPrefix(got, TEST_VEHICLE+";SPEED;300;") {
+		t.Fatalf("speed %q while notifications are off, want the update's 300", got)
+	}
+
+	client.Send("NOTIFY;" + TEST_VEHICLE + ";ON")
+	client.Expect(t, "NOTIFY;SUCCESS")
+	vehicle.Emit(positionUpdate(2, 17, 0, 300))
+	client.Expect(t, TEST_VEHICLE+";"+encodeHex(positionUpdate(2, 17, 0, 300)))
+
+	client.Send("NOTIFY;" + TEST_VEHICLE + ";OFF")
+	client.Expect(t, "NOTIFY;SUCCESS")
+	client.Send("DISCONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "DISCONNECT;SUCCESS")
+	client.Send("CONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "CONNECT;SUCCESS")
+	vehicle.Emit(positionUpdate(3, 17, 0, 300))
+	client.Expect(t, TEST_VEHICLE+";"+encodeHex(positionUpdate(3, 17, 0, 300)))
+
+	client.Send("NOTIFY;" + TEST_VEHICLE + ";MAYBE")
+	client.Expect(t, "NOTIFY;FAILED;invalid-mode")
+	client.Send("NOTIFY;" + TEST_VEHICLE_2 + ";ON")
+	client.Expect(t, "NOTIFY;FAILED;not-connected")
+}
+
+// With notificationTimestamps set every forwarded notification carries when it was received, never going backwards
+func TestNotificationTimestamps(t *testing.T) {
+	for _, mode := range []string{TIMESTAMP_MONOTONIC, TIMESTAMP_UNIX} {
+		t.Run(mode, func(t *testing.T) {
+			adapter := newTestServer(t)
+			serverConf.NotificationTimestamps = mode
+			client := newTestClient(t, nil)
+			vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+			const burst = 50
+			for i := 0; i < burst; i++ {
+				vehicle.Emit(positionUpdate(byte(i), 1, 0, 300))
+			}
+			var previous int64
+			for i := 0; i < burst; i++ {
+				fields := strings.Split(client.Expect(t, TEST_VEHICLE+";"), ";")
+				if len(fields) != 3 || fields[2] != encodeHex(positionUpdate(byte(i), 1, 0, 300)) {
+					t.Fatalf("notification %d is %q, want <address>;<timestamp>;<hex>", i, fields)
+				}
+				stamp, err := strconv.ParseInt(fields[1], 10, 64)
+				if err != nil || stamp < previous {
+					t.Fatalf("timestamp %q after %d", fields[1], previous)
+				}
+				previous = stamp
+			}
+			if mode == TIMESTAMP_UNIX && time.Since(time.Unix(0, previous)) > time.Minute {
+				t.Fatalf("unix timestamp %d is not the time of the notification", previous)
+			}
+		})
+	}
+}
+
+// With confirmSdkMode CONNECT only succeeds once the vehicle answered the ping sent after the SDK mode message
+func TestConfirmSdkMode(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.ConfirmSdkMode = true
+	serverConf.SdkModeTimeoutMillis = 100
+	client := newTestClient(t, nil)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	adapter.Advertise(TEST_VEHICLE_2, -50)
+	client.Send("SCAN")
+	client.Expect(t, "SCAN;COMPLETED")
+
+	answering := adapter.Vehicle(TEST_VEHICLE)
+	answering.writer.OnWrite(func(p []byte) error {
+		if string(p) == string(EncodePing()) {
+			go answering.Emit([]byte{0x01, ANKI_MSG_V2C_PING_RESPONSE})
+		}
+		return nil
+	})
+	client.Send("CONNECT;" + TEST_VEHICLE)
+	client.Expect(t, "CONNECT;SUCCESS")
+	answering.ExpectWrite(t, EncodeSdkMode(true, SDK_OPTION_OVERRIDE_LOCALIZATION))
+
+	silent := adapter.Vehicle(TEST_VEHICLE_2)
+	client.Send("CONNECT;" + TEST_VEHICLE_2)
+	client.Expect(t, "CONNECT;FAILED;sdk-mode")
+	silent.ExpectWrite(t, EncodePing())
+	if silent.Disconnects() != 1 || server.ConnectedDevices.Has(TEST_VEHICLE_2) {
+		t.Fatal("vehicle that did not confirm SDK mode is still connected")
+	}
+	if server.PingWaiters.Has(TEST_VEHICLE_2) {
+		t.Fatal("ping waiter left behind")
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Server enforced offset limits. After OFFSETLIMIT;<address>;<min>;<max> every change-lane and set-offset message
+ * written to the vehicle, whether raw, batched or sent by the server itself, has its offset clamped into the range,
+ * so a narrow track cannot be left by steering. OFFSETLIMIT;<address>;OFF lifts the limit.
+ *
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Allowed offsets from the road center in mm
+type OffsetLimit struct {
+	MinMm float32
+	MaxMm float32
+}
+
+func (l OffsetLimit) clamp(offsetMm float32) float32 {
+	// a NaN offset compares false against both bounds
+	if offsetMm < l.MinMm || offsetMm != offsetMm {
+		return l.MinMm
+	}
+	if offsetMm > l.MaxMm {
+		return l.MaxMm
+	}
+	return offsetMm
+}
+
+// Returns payload with the offset of every change-lane and set-offset message clamped into the vehicle's limit.
+// payload itself is never modified, it may be shared with the caller.
+func clampOffsets(address string, payload []byte) []byte {
+	limit, ok := server.OffsetLimits.Get(address)
+	if !ok {
+		return payload
+	}
+
+	clamped := append([]byte(nil), payload...)
+	for p := clamped; len(p) > 0 && int(p[0])+1 <= len(p); p = p[p[0]+1:] {
+		msg := p[:p[0]+1]
+		var field []byte
+		switch id, _ := MessageId(msg); {
+		case id == ANKI_MSG_C2V_CHANGE_LANE && len(msg) >= 10:
+			field = msg[6:10]
+		case id == ANKI_MSG_C2V_SET_OFFSET && len(msg) >= 6:
+			field = msg[2:6]
+		default:
+			continue
+		}
+		offsetMm := math.Float32frombits(binary.LittleEndian.Uint32(field))
+		binary.LittleEndian.PutUint32(field, math.Float32bits(limit.clamp(offsetMm)))
+	}
+	return clamped
+}
@@ -0,0 +1,51 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the per-vehicle offset limit.
+ *
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Change-lane and set-offset targets outside the vehicle's limit are written clamped into it, until the limit is
+// cleared
+func TestOffsetLimitClampsLaneChanges(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Send("OFFSETLIMIT;" + TEST_VEHICLE + ";-20;20")
+	client.Expect(t, "OFFSETLIMIT;SUCCESS")
+	client.Send(TEST_VEHICLE + ";" + hex.EncodeToString(EncodeChangeLane(250, 1000, 60)) + ";ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	vehicle.ExpectWrite(t, EncodeChangeLane(250, 1000, 20))
+
+	// every message of a batched payload is clamped and the others are left alone, written in chunks
+	before := len(vehicle.Writes())
+	batched := append(append(EncodeSetOffset(-68), EncodeSetSpeed(300, 1000)...), EncodeChangeLane(250, 1000, 10)...)
+	client.Send(TEST_VEHICLE + ";" + hex.EncodeToString(batched) + ";ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	want := append(append(EncodeSetOffset(-20), EncodeSetSpeed(300, 1000)...), EncodeChangeLane(250, 1000, 10)...)
+	if got := strings.Join(vehicle.WrittenHex()[before:], ""); got != hex.EncodeToString(want) {
+		t.Fatalf("batched payload written as %s, want %x", got, want)
+	}
+
+	client.Send("OFFSETLIMIT;" + TEST_VEHICLE + ";OFF")
+	client.Expect(t, "OFFSETLIMIT;SUCCESS")
+	client.Send(TEST_VEHICLE + ";" + hex.EncodeToString(EncodeChangeLane(250, 1000, 60)) + ";ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	vehicle.ExpectWrite(t, EncodeChangeLane(250, 1000, 60))
+
+	for _, frame := range []string{"OFFSETLIMIT;" + TEST_VEHICLE + ";20;-20", "OFFSETLIMIT;" + TEST_VEHICLE + ";-20;wide", "OFFSETLIMIT;" + TEST_VEHICLE + ";ON"} {
+		client.Send(frame)
+		client.Expect(t, "ERROR;invalid-offset")
+	}
+	client.Send("OFFSETLIMIT;" + TEST_VEHICLE_2 + ";-20;20")
+	client.Expect(t, "OFFSETLIMIT;FAILED;not-connected")
+}
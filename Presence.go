@@ -0,0 +1,61 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Background presence scanning, enabled with presenceScanSeconds. The server scans every interval without connecting,
+ * refreshes the discovered vehicles and tells event subscribers EVENT;PRESENT;<address> when a vehicle starts
+ * advertising and EVENT;ABSENT;<address> once it was missing from PRESENCE_MISSED_SCANS scans in a row. Presence scans
+ * take turns with SCAN requests on the scan mutex, and connected vehicles, which stop advertising, count as present.
+ *
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// Scans in a row a vehicle must be missing from before it is reported absent, a single scan misses weak vehicles
+const PRESENCE_MISSED_SCANS = 2
+
+func scanPresence(interval time.Duration) {
+	// vehicles reported present and how many scans in a row missed them, only touched by this goroutine
+	missed := make(map[string]int)
+	for range time.Tick(interval) {
+		presenceScan(missed)
+	}
+}
+
+// Runs one presence scan, refreshing the discovered vehicles and reporting the changes in presence
+func presenceScan(missed map[string]int) {
+	// the presence of every vehicle matters here, so maxScanResults does not apply
+	devices, err := scan(0)
+	if err != nil {
+		displayDebug("Presence scan failed: " + err.Error())
+		return
+	}
+	mergeDiscoveredDevices(devices)
+	updatePresence(missed, devices.Keys())
+}
+
+// Reports the vehicles in found that were not present before and the present ones missed too often
+func updatePresence(missed map[string]int, found []string) {
+	seen := make(map[string]bool, len(found))
+	for _, address := range found {
+		seen[address] = true
+		if _, present := missed[address]; !present {
+			broadcastEvent("PRESENT", address)
+		}
+		missed[address] = 0
+	}
+	for address := range missed {
+		if seen[address] || server.ConnectedDevices.Has(address) {
+			missed[address] = 0
+			continue
+		}
+		missed[address]++
+		if missed[address] >= PRESENCE_MISSED_SCANS {
+			delete(missed, address)
+			broadcastEvent("ABSENT", address)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the background presence scan.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Vehicles that start advertising are reported present once, and absent after missing from PRESENCE_MISSED_SCANS
+// scans in a row. A connected vehicle, which stops advertising, stays present
+func TestPresenceTransitions(t *testing.T) {
+	adapter := newTestServer(t)
+	watcher := newTestClient(t, nil)
+	watcher.Send("SUBSCRIBE_EVENTS;2")
+	watcher.Expect(t, "SUBSCRIBE_EVENTS;SUCCESS;2")
+	missed := make(map[string]int)
+
+	adapter.Advertise(TEST_VEHICLE, -50)
+	adapter.Advertise(TEST_VEHICLE_2, -60)
+	presenceScan(missed)
+	watcher.Expect(t, "EVENT;PRESENT;")
+	watcher.Expect(t, "EVENT;PRESENT;")
+	if !server.DiscoveredDevices.Has(TEST_VEHICLE) || !server.DiscoveredDevices.Has(TEST_VEHICLE_2) {
+		t.Fatal("presence scan did not refresh the discovered vehicles")
+	}
+	presenceScan(missed)
+	watcher.Refute(t, "EVENT;", 20*time.Millisecond)
+
+	adapter.Unadvertise(TEST_VEHICLE_2)
+	presenceScan(missed)
+	watcher.Refute(t, "EVENT;ABSENT;", 20*time.Millisecond)
+	presenceScan(missed)
+	watcher.Expect(t, "EVENT;ABSENT;"+TEST_VEHICLE_2)
+	adapter.Advertise(TEST_VEHICLE_2, -60)
+	presenceScan(missed)
+	watcher.Expect(t, "EVENT;PRESENT;"+TEST_VEHICLE_2)
+
+	driver := newTestClient(t, nil)
+	driver.Send("CONNECT;" + TEST_VEHICLE)
+	driver.Expect(t, "CONNECT;SUCCESS")
+	watcher.Expect(t, "EVENT;CONNECTED;"+TEST_VEHICLE)
+	adapter.Unadvertise(TEST_VEHICLE)
+	for i := 0; i < PRESENCE_MISSED_SCANS+1; i++ {
+		presenceScan(missed)
+	}
+	watcher.Refute(t, "EVENT;ABSENT;", 20*time.Millisecond)
+	if _, _, _, connects := adapter.Calls(); connects != 1 {
+		t.Fatalf("%d connects, presence scans must not connect", connects)
+	}
+}
+
+// Presence scans and SCAN requests take turns on the adapter, both complete
+func TestPresenceScanWithScanRequests(t *testing.T) {
+	adapter := newTestServer(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	client := newTestClient(t, nil)
+	missed := make(map[string]int)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			presenceScan(missed)
+		}
+		close(done)
+	}()
+	for i := 0; i < 5; i++ {
+		client.Send("SCAN")
+		client.Expect(t, "SCAN;COMPLETED")
+	}
+	select {
+	case <-done:
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatal("presence scans did not complete")
+	}
+	if _, scans, _, _ := adapter.Calls(); scans != 10 {
+		t.Fatalf("%d scans, want 10", scans)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Protocol versions a client can select with HELLO;<version>. Version 1, used until a client sends HELLO, splits
+ * every message at each ';'. Version 2 lets a field contain the delimiter: a backslash takes the character after it
+ * literally, so "\;" is a ';' within a field and "\\" a backslash. CAPABILITIES reports the newest version together with
+ * the command verbs and the vehicle messages the server decodes, so clients can feature-detect. With strictCommands
+ * anything else is answered with ERROR;unknown-command;<verb> instead of being taken for a raw vehicle write.
+ *
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+const (
+	PROTOCOL_V1 = 1
+	PROTOCOL_V2 = 2
+
+	PROTOCOL_LATEST = PROTOCOL_V2
+)
+
+var (
+	// every verb handleCommand understands, raw writes sent as <address>;<hex> aside
+	SUPPORTED_VERBS = []string{
+		"ALIAS", "BATCH", "CAPABILITIES", "CONNECT", "DETAILS", "DISCONNECT", "DISCONNECT_ALL", "DISCOVERED",
+		"ENCODING", "ESTOP", "GATT", "HELLO", "HISTORY", "LANEKEEP", "LANE_CANCEL", "LIGHTPATTERN", "LIGHTS",
+		"LIST", "LOGLEVEL", "NOTIFY", "OFFSET", "OFFSETLIMIT", "PAUSE", "PING", "QUERY_OFFSET", "QUERY_SPEED",
+		"RAW", "READ", "READ_TIMEOUT", "REDISCOVER", "RESET", "RESUME", "SCAN", "SELFTEST", "SPEED_ALL", "STATS",
+		"STATUS", "SUBSCRIBE", "SUBSCRIBE_EVENTS", "TURN", "TXPOWER", "UNSUBSCRIBE", "UNSUBSCRIBE_EVENTS",
+		"VEHICLE",
+	}
+	// the number of fields of every verb that takes a request id, the request id is the field after them
+	REQUEST_FIELDS = map[string]int{
+		"ALIAS": 3, "BATCH": 3, "CAPABILITIES": 1, "CONNECT": 2, "DETAILS": 2, "DISCONNECT": 2, "DISCONNECT_ALL": 1,
+		"DISCOVERED": 1, "ENCODING": 2, "ESTOP": 1, "GATT": 2, "HISTORY": 2, "LANEKEEP": 3, "LANE_CANCEL": 2,
+		"LIGHTPATTERN": 7, "LIGHTS": 4, "LIST": 1, "LOGLEVEL": 2, "NOTIFY": 3, "OFFSET": 3, "OFFSETLIMIT": 4,
+		"PAUSE": 2, "PING": 1, "QUERY_OFFSET": 2, "QUERY_SPEED": 2, "RAW": 2, "READ": 2, "READ_TIMEOUT": 2,
+		"REDISCOVER": 2, "RESET": 2, "RESUME": 2, "SCAN": 1, "SELFTEST": 1, "SPEED_ALL": 3, "STATS": 1, "STATUS": 1,
+		"SUBSCRIBE": 2, "SUBSCRIBE_EVENTS": 1, "TURN": 4, "TXPOWER": 2, "UNSUBSCRIBE": 2, "UNSUBSCRIBE_EVENTS": 1,
+		"VEHICLE": 2,
+	}
+	// vehicle messages the server decodes instead of only forwarding their hex
+	DECODED_MESSAGES = []string{"POSITION", "TRANSITION", "BATTERY", "PING", "DELOCALIZED", "COLLISION"}
+)
+
+// CAPABILITIES;protocol=<newest version>;verbs=<verb>,...;decoders=<message>,...
+func capabilitiesReport() string {
+	return "CAPABILITIES;protocol=" + strconv.Itoa(PROTOCOL_LATEST) + ";verbs=" + strings.Join(SUPPORTED_VERBS, ",") +
+		";decoders=" + strings.Join(DECODED_MESSAGES, ",")
+}
+
+// Whether set is a supported verb or a well-formed raw <address>;<hex>[;ACK] write. Used with strictCommands, so a
+// mistyped verb is rejected instead of written to a vehicle
+func recognizedCommand(set []string) bool {
+	for _, verb := range SUPPORTED_VERBS {
+		if set[0] == verb {
+			return true
+		}
+	}
+	// aliases never look like a verb, so a verb-like first field is a mistyped one
+	if verbPattern.MatchString(set[0]) {
+		return false
+	}
+	if len(set) != 2 && !(len(set) == 3 && set[2] == "ACK") {
+		return false
+	}
+	_, err := hex.DecodeString(set[1])
+	return err == nil
+}
+
+// The number of fields of the request in set before its optional request id, false for requests without one
+func requestFields(set []string) (int, bool) {
+	fields, ok := REQUEST_FIELDS[set[0]]
+	switch set[0] {
+	case "LIGHTS":
+		if field(set, 2) == "PATTERN" {
+			fields = 8
+		}
+	// the trigger is optional as well, a fourth field that is not one is the request id
+	case "TURN":
+		if _, isTrigger := TURN_TRIGGER_NAMES[field(set, 3)]; len(set) == 4 && !isTrigger {
+			fields = 3
+		}
+	case "OFFSETLIMIT":
+		if field(set, 2) == "OFF" {
+			fields = 3
+		}
+	}
+	return fields, ok
+}
+
+// The request id set ends with, so a request rejected before it reaches its verb is still answered with it
+func requestId(set []string) string {
+	fields, ok := requestFields(set)
+	if !ok {
+		return ""
+	}
+	return field(set, fields)
+}
+
+// Splits a message into its fields as the protocol version of its client does, without newlines and 0x0 fillers
+func splitFrame(protocol int, frame string) []string {
+	if protocol == PROTOCOL_V2 {
+		return splitEscapedFields(frame)
+	}
+	var set []string
+	for _, field := range strings.Split(frame, ";") {
+		set = append(set, strings.Trim(strings.Replace(field, "\n", "", -1), "\x00"))
+	}
+	return set
+}
+
+// Splits a version 2 message into its fields, resolving escapes and dropping newlines and 0x0 fillers
+func splitEscapedFields(frame string) []string {
+	var set []string
+	var current strings.Builder
+	escaped := false
+	for _, r := range frame {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ';':
+			set = append(set, strings.Trim(current.String(), "\x00"))
+			current.Reset()
+		case r == '\n':
+		default:
+			current.WriteRune(r)
+		}
+	}
+	return append(set, strings.Trim(current.String(), "\x00"))
+}
+
+// The version used with a client asking for requested, the newest one the server knows if the client is ahead
+func negotiateProtocol(requested int) int {
+	if requested > PROTOCOL_LATEST {
+		return PROTOCOL_LATEST
+	}
+	return requested
+}
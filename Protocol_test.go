@@ -0,0 +1,160 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the protocol version handshake, of the capabilities report, of the version 2 escaping and of the
+ * strictCommands check.
+ *
+ */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A backslash takes the next character literally, so fields can contain the delimiter and the backslash itself
+func TestSplitEscapedFields(t *testing.T) {
+	tests := []struct {
+		frame string
+		want  []string
+	}{
+		{"PING;1\n", []string{"PING", "1"}},
+		{`ALIAS;AA:00:00:00:00:01;red\;car` + "\n", []string{"ALIAS", "AA:00:00:00:00:01", "red;car"}},
+		{`a\;b\\;c`, []string{`a;b\`, "c"}},
+		{"a;;b\x00", []string{"a", "", "b"}},
+	}
+	for _, test := range tests {
+		if got := splitEscapedFields(test.frame); strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%q split into %q, want %q", test.frame, got, test.want)
+		}
+	}
+}
+
+// HELLO selects the version for the client that sent it, capped at the newest one, and refuses versions that are no
+// number or below 1
+func TestHelloHandshake(t *testing.T) {
+	newTestServer(t)
+	client := newTestClient(t, nil)
+	for _, frame := range []string{"HELLO", "HELLO;0", "HELLO;two"} {
+		client.Send(frame)
+		client.Expect(t, "HELLO;FAILED;invalid-version")
+	}
+	client.Send("HELLO;9")
+	client.Expect(t, "HELLO;"+strconv.Itoa(PROTOCOL_LATEST))
+	client.Send("HELLO;1")
+	client.Expect(t, "HELLO;1")
+	client.Send("HELLO;2")
+	client.Expect(t, "HELLO;2")
+
+	// other clients keep version 1 until they send HELLO themselves
+	other := newTestClient(t, nil)
+	other.Send("PING;1")
+	other.Expect(t, "PONG;1")
+}
+
+// CAPABILITIES reports the newest version and lists the verbs and decoders added since the first release
+func TestCapabilities(t *testing.T) {
+	newTestServer(t)
+	client := newTestClient(t, nil)
+	client.Send("CAPABILITIES;7")
+	fields := strings.Split(client.Expect(t, "CAPABILITIES;"), ";")
+	if len(fields) != 5 || fields[1] != "protocol="+strconv.Itoa(PROTOCOL_LATEST) || fields[4] != "7" {
+		t.Fatalf("capabilities %q", fields)
+	}
+	verbs := strings.TrimPrefix(fields[2], "verbs=")
+	decoders := strings.TrimPrefix(fields[3], "decoders=")
+	listed := map[string]bool{}
+	for _, name := range append(strings.Split(verbs, ","), strings.Split(decoders, ",")...) {
+		listed[name] = true
+	}
+	for _, name := range []string{"CAPABILITIES", "HELLO", "LIGHTPATTERN", "TURN", "LANE_CANCEL", "OFFSETLIMIT", "RESET",
+		"PAUSE", "RESUME", "TXPOWER", "SELFTEST", "LOGLEVEL", "ENCODING", "VEHICLE", "QUERY_OFFSET", "COLLISION"} {
+		if !listed[name] {
+			t.Errorf("%s missing from the capabilities", name)
+		}
+	}
+}
+
+// Under version 2 an escaped delimiter stays within its field, version 1 splits at it
+func TestEscapedDelimiter(t *testing.T) {
+	adapter := newTestServer(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	v2 := newTestClient(t, nil)
+	v2.Send("SCAN")
+	v2.Expect(t, "SCAN;COMPLETED")
+	v2.Send("HELLO;2")
+	v2.Expect(t, "HELLO;2")
+
+	v2.Send(`ALIAS;` + TEST_VEHICLE + `;red\;car;1`)
+	v2.Expect(t, "ALIAS;SUCCESS;1")
+	if address, ok := server.Aliases.Get("red;car"); !ok || address != TEST_VEHICLE {
+		t.Fatalf("alias with an escaped delimiter not set, %q", address)
+	}
+	v2.Send(`CONNECT;red\;car`)
+	v2.Expect(t, "CONNECT;SUCCESS")
+
+	v1 := newTestClient(t, nil)
+	v1.Send(`ALIAS;` + TEST_VEHICLE + `;blue\;car`)
+	v1.Expect(t, "ALIAS;SUCCESS;car")
+	if _, ok := server.Aliases.Get(`blue\`); !ok {
+		t.Fatal("version 1 did not split at the escaped delimiter")
+	}
+}
+
+// Frames of a version 2 client are routed and audited with its split, from the frame right after its HELLO on
+func TestEscapedDelimiterRouting(t *testing.T) {
+	adapter := newTestServer(t)
+	path := startTestAudit(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	server.Aliases.Set("red;car", TEST_VEHICLE)
+
+	client.Send("HELLO;2", `red\;car;0116;ACK`)
+	client.Expect(t, "HELLO;2")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	vehicle.ExpectWrite(t, EncodePing())
+
+	lines := auditLines(t, path)
+	remote := client.RemoteAddr().String()
+	want := []string{remote + ";HELLO;;HELLO;2", remote + ";WRITE;" + TEST_VEHICLE + ";red;car;0116;ACK"}
+	if len(lines) < 2 || strings.Join(lines[len(lines)-2:], "\n") != strings.Join(want, "\n") {
+		t.Fatalf("audit lines %q, want %q last", lines, want)
+	}
+}
+
+// A mistyped command passes through as a raw write by default, and is answered ERROR;unknown-command with
+// strictCommands, which still lets well-formed raw writes through
+func TestStrictCommands(t *testing.T) {
+	tests := []struct {
+		strict bool
+		want   []string
+	}{
+		{false, []string{"ERROR;unknown-target;CONECT", "ERROR;unknown-target;SPEDD", TEST_VEHICLE + ";WRITE;OK"}},
+		{true, []string{"ERROR;unknown-command;CONECT", "ERROR;unknown-command;SPEDD", "ERROR;unknown-command;" + TEST_VEHICLE}},
+	}
+	for _, test := range tests {
+		t.Run("strict="+strconv.FormatBool(test.strict), func(t *testing.T) {
+			adapter := newTestServer(t)
+			client := newTestClient(t, nil)
+			vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+			serverConf.StrictCommands = test.strict
+
+			for i, frame := range []string{"CONECT;" + TEST_VEHICLE, "SPEDD;0624c800e80300;ACK", TEST_VEHICLE + ";PING;ACK"} {
+				client.Send(frame)
+				client.Expect(t, test.want[i])
+			}
+			client.Send(TEST_VEHICLE + ";0116;ACK")
+			client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+			want := 1
+			if !test.strict {
+				// the write with the mistyped hex reached the vehicle, with nothing left to write of its payload
+				want = 2
+			}
+			if writes := vehicle.Writes(); len(writes) != want || len(writes[0]) != 0 && !test.strict {
+				t.Fatalf("written %q, want %d writes", vehicle.WrittenHex(), want)
+			}
+		})
+	}
+}
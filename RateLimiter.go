@@ -0,0 +1,102 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Token bucket rate limiter used to cap how fast commands are written to a single ANKI Drive vehicle.
+ * BLE can only absorb a limited number of writes per second; flooding a vehicle causes dropped commands and
+ * link resets.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	RATE_LIMIT_DROP  = "drop"
+	RATE_LIMIT_QUEUE = "queue"
+)
+
+// A token bucket that refills at rate tokens per second and holds at most capacity tokens
+type TokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(commandsPerSecond int) *TokenBucket {
+	return &TokenBucket{
+		rate:     float64(commandsPerSecond),
+		capacity: float64(commandsPerSecond),
+		tokens:   float64(commandsPerSecond),
+		last:     time.Now(),
+	}
+}
+
+// refills the bucket based on the time elapsed since the last call, must be called while holding mu
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+}
+
+// Takes a token if one is available, otherwise returns false without blocking
+func (b *TokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+	return false
+}
+
+// Takes a token, waiting up to maxWait for one to become available. Returns false if the wait would exceed maxWait
+func (b *TokenBucket) Wait(maxWait time.Duration) bool {
+	b.mu.Lock()
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		b.mu.Unlock()
+		return true
+	}
+
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxWait {
+		b.mu.Unlock()
+		return false
+	}
+	// reserve the token now so concurrent waiters queue up behind this one
+	b.tokens--
+	b.mu.Unlock()
+
+	time.Sleep(wait)
+	return true
+}
+
+// Returns true if a command to address may be written now according to the configured rate limit
+func allowCommand(address string) bool {
+	if serverConf.MaxCommandsPerSecond <= 0 {
+		return true
+	}
+
+	limiter := server.RateLimiters.Upsert(address, nil, func(exist bool, valueInMap *TokenBucket, newValue *TokenBucket) *TokenBucket {
+		if exist {
+			return valueInMap
+		}
+		return newTokenBucket(serverConf.MaxCommandsPerSecond)
+	})
+
+	if serverConf.RateLimitMode == RATE_LIMIT_QUEUE {
+		return limiter.Wait(time.Duration(serverConf.RateLimitQueueMillis) * time.Millisecond)
+	}
+	return limiter.Allow()
+}
@@ -0,0 +1,108 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the per-vehicle command rate limit.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A full bucket allows a burst of its capacity, then refills at its rate
+func TestTokenBucketBurst(t *testing.T) {
+	bucket := newTokenBucket(5)
+	for i := 0; i < 5; i++ {
+		if !bucket.Allow() {
+			t.Fatalf("command %d of the burst was refused", i+1)
+		}
+	}
+	if bucket.Allow() {
+		t.Fatal("command over the burst was allowed")
+	}
+
+	// as if 400ms passed, two tokens at 5 per second
+	bucket.mu.Lock()
+	bucket.last = bucket.last.Add(-400 * time.Millisecond)
+	bucket.mu.Unlock()
+	allowed := 0
+	for bucket.Allow() {
+		allowed++
+	}
+	if allowed != 2 {
+		t.Fatalf("%d commands allowed after 400ms, want 2", allowed)
+	}
+}
+
+// Wait gives up at once if the next token is further away than maxWait, and otherwise waits for it
+func TestTokenBucketWait(t *testing.T) {
+	bucket := newTokenBucket(10)
+	for bucket.Allow() {
+	}
+	if bucket.Wait(10 * time.Millisecond) {
+		t.Fatal("waited longer than allowed")
+	}
+	start := time.Now()
+	if !bucket.Wait(time.Second) {
+		t.Fatal("no token within a second at 10 per second")
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("token granted after %v, the bucket was empty", waited)
+	}
+}
+
+// In drop mode a burst over the limit is written up to the limit and the rest answered with ERROR;rate-limited
+func TestRateLimitDropsBurst(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.MaxCommandsPerSecond = 5
+	client := newDispatchClient(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	dispatchFrame(client, "SCAN")
+	dispatchFrame(client, "CONNECT;"+TEST_VEHICLE)
+	vehicle := adapter.Vehicle(TEST_VEHICLE)
+
+	limited := 0
+	for i := 0; i < 10; i++ {
+		lines, _ := dispatchFrame(client, TEST_VEHICLE+";0116")
+		if len(lines) == 1 && lines[0] == "ERROR;rate-limited" {
+			limited++
+		}
+	}
+	if written := len(vehicle.Writes()); written != 5 || limited != 5 {
+		t.Fatalf("%d written and %d rate limited, want 5 each", written, limited)
+	}
+	// other vehicles have their own limit
+	if !allowCommand(TEST_VEHICLE_2) {
+		t.Fatal("a vehicle without commands was rate limited")
+	}
+}
+
+// In queue mode commands over the limit wait for a token instead of being dropped
+func TestRateLimitQueuesBurst(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.MaxCommandsPerSecond = 20
+	serverConf.RateLimitMode = RATE_LIMIT_QUEUE
+	serverConf.RateLimitQueueMillis = 1000
+	client := newDispatchClient(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	dispatchFrame(client, "SCAN")
+	dispatchFrame(client, "CONNECT;"+TEST_VEHICLE)
+	vehicle := adapter.Vehicle(TEST_VEHICLE)
+
+	start := time.Now()
+	for i := 0; i < 25; i++ {
+		if lines, _ := dispatchFrame(client, TEST_VEHICLE+";0116"); len(lines) != 0 {
+			t.Fatalf("command %d answered %q", i+1, lines)
+		}
+	}
+	if written := len(vehicle.Writes()); written != 25 {
+		t.Fatalf("%d of 25 commands written", written)
+	}
+	// five commands over the burst at 20 per second take 250ms
+	if took := time.Since(start); took < 200*time.Millisecond {
+		t.Fatalf("25 commands took %v, the limit was not enforced", took)
+	}
+}
@@ -0,0 +1,39 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * One-shot diagnostics for troubleshooting in the field. SELFTEST reports, in one line,
+ *		SELFTEST;adapter=<ok|not-ready>;scan=<n>-found|failed|skipped;listener=<ok|n-of-m>
+ * The scan is the one a presence scan runs: it takes its turn on the scan mutex, leaves connected vehicles alone and
+ * does not change the discovered vehicles.
+ *
+ */
+
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// Listeners whose accept loop is running
+var acceptingListeners int32
+
+func selfTest() string {
+	adapter, scanResult := "not-ready", "skipped"
+	if adapterReady() {
+		adapter = "ok"
+		if devices, err := scan(0); err != nil {
+			displayInfo("Self-test scan failed: " + err.Error())
+			scanResult = "failed"
+		} else {
+			scanResult = strconv.Itoa(devices.Count()) + "-found"
+		}
+	}
+
+	listener := "ok"
+	accepting, configured := int(atomic.LoadInt32(&acceptingListeners)), len(configuredListeners(serverConf))
+	if accepting != configured {
+		listener = strconv.Itoa(accepting) + "-of-" + strconv.Itoa(configured)
+	}
+	return "SELFTEST;adapter=" + adapter + ";scan=" + scanResult + ";listener=" + listener
+}
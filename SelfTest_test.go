@@ -0,0 +1,56 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the diagnostic self-test.
+ *
+ */
+
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// With the sim adapter SELFTEST finds both simulated vehicles, also while one of them is connected, and reports the
+// listeners that are not accepting
+func TestSelfTest(t *testing.T) {
+	newTestServer(t)
+	Adapter = newSimAdapter()
+	Adapter.SetDisconnectHandler(vehicleLost)
+	l, err := listen(ListenerConf{Host: "127.0.0.1", Port: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConf.Listeners = []ListenerConf{{Host: "127.0.0.1", Port: "0"}}
+	serveTestListener(t, l, nil)
+	waitUntil(t, "the listener to accept", func() bool { return atomic.LoadInt32(&acceptingListeners) == 1 })
+	client := dialTestClient(t, "tcp", l.Addr().String())
+
+	if got := client.Exchange(t, "SELFTEST"); got != "SELFTEST;adapter=ok;scan=2-found;listener=ok" {
+		t.Fatalf("self-test %q", got)
+	}
+
+	client.Send(t, "SCAN")
+	line := client.Expect(t, "SCAN;")
+	address := strings.Split(line, ";")[1]
+	client.Expect(t, "SCAN;COMPLETED")
+	client.Send(t, "CONNECT;"+address)
+	client.Expect(t, "CONNECT;SUCCESS")
+	serverConf.Listeners = append(serverConf.Listeners, ListenerConf{Network: "unix", SocketPath: "/tmp/unused.sock"})
+	if got := client.Exchange(t, "SELFTEST"); got != "SELFTEST;adapter=ok;scan=2-found;listener=1-of-2" {
+		t.Fatalf("self-test with a vehicle connected and a listener down %q", got)
+	}
+	if !server.ConnectedDevices.Has(address) {
+		t.Fatal("the self-test scan disturbed the connected vehicle")
+	}
+
+	atomic.StoreInt32(&AdapterEnabled, 0)
+	if got := client.Exchange(t, "SELFTEST"); got != "SELFTEST;adapter=not-ready;scan=skipped;listener=1-of-2" {
+		t.Fatalf("self-test without an adapter %q", got)
+	}
+	atomic.StoreInt32(&AdapterEnabled, 1)
+	client.Send(t, "DISCONNECT;"+address)
+	client.Expect(t, "DISCONNECT;SUCCESS")
+}
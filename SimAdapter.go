@@ -0,0 +1,260 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * A simulated BLE adapter, selected with adapter: sim. It advertises a couple of fake vehicles, accepts connects and
+ * answers pings, and while a vehicle has a speed set it reports position updates as if it drove around a loop.
+ * Lets the whole tcp protocol be exercised on machines without ANKI vehicles or a BLE adapter.
+ *
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+	"tinygo.org/x/bluetooth"
+)
+
+const SIM_POSITION_INTERVAL = 250 * time.Millisecond
+
+var (
+	// advertised local name of a real vehicle: state, version and "    Drive"
+	SIM_LOCAL_NAME = string([]byte{0x10, 0x60, 0x30, 0x01}) + "    Drive"
+	// road pieces of the simulated loop
+	SIM_TRACK = []byte{33, 18, 39, 17, 40, 20, 34}
+)
+
+type SimAdapter struct {
+	vehicles []AnkiVehicle
+	mu       sync.Mutex
+	scanStop chan struct{}
+	passive  bool
+	txPower  int
+}
+
+func newSimAdapter() *SimAdapter {
+	sim := &SimAdapter{}
+	// the second vehicle is further away, so minRSSI can be tried out
+	for i, rssi := range []int16{-50, -80} {
+		records := map[uint16][]byte{0xbeef: {byte(0x08 + i)}}
+		sim.vehicles = append(sim.vehicles, AnkiVehicle{
+			Address:             "5A:00:00:00:00:0" + strconv.Itoa(i+1),
+			ManufacturerData:    encodeManufacturerData(records),
+			LocalName:           SIM_LOCAL_NAME,
+			ManufacturerRecords: records,
+			RSSI:                rssi,
+		})
+	}
+	return sim
+}
+
+func (s *SimAdapter) Enable() error {
+	return nil
+}
+
+func (s *SimAdapter) Scan(found func(AnkiVehicle)) error {
+	s.mu.Lock()
+	if s.scanStop != nil {
+		s.mu.Unlock()
+		return errors.New("already scanning")
+	}
+	stop := make(chan struct{})
+	s.scanStop = stop
+	passive := s.passive
+	s.mu.Unlock()
+
+	for _, vehicle := range s.vehicles {
+		// the local name is only sent in the scan response, which passive scans don't request
+		if passive {
+			vehicle.LocalName = ""
+		}
+		found(vehicle)
+	}
+	<-stop
+	return nil
+}
+
+func (s *SimAdapter) StopScan() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scanStop == nil {
+		return errors.New("not scanning")
+	}
+	close(s.scanStop)
+	s.scanStop = nil
+	return nil
+}
+
+func (s *SimAdapter) SetScanMode(mode string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.passive = mode == SCAN_MODE_PASSIVE
+	return nil
+}
+
+func (s *SimAdapter) TxPower() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.txPower, nil
+}
+
+// The simulated vehicles are always in reach, the power is only remembered
+func (s *SimAdapter) SetTxPower(dBm int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.txPower = dBm
+	return nil
+}
+
+func (s *SimAdapter) Connect(vehicle AnkiVehicle, params bluetooth.ConnectionParams) (VehicleLink, error) {
+	for _, simulated := range s.vehicles {
+		if simulated.Address == vehicle.Address {
+			return &simVehicle{done: make(chan struct{})}, nil
+		}
+	}
+	return nil, errors.New("no simulated vehicle " + vehicle.Address)
+}
+
+// Simulated vehicles never drop the link on their own
+func (s *SimAdapter) SetDisconnectHandler(handler func(address string)) {
+}
+
+type simVehicle struct {
+	mu       sync.Mutex
+	speed    uint16
+	offsetMm float32
+	notify   func([]byte)
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (v *simVehicle) DiscoverCharacteristics() (VehicleCharacteristics, error) {
+	return VehicleCharacteristics{
+		Writer: simCharacteristic{v, ANKI_STR_CHR_WRITE_UUID},
+		Reader: simCharacteristic{v, ANKI_STR_CHR_READ_UUID},
+	}, nil
+}
+
+func (v *simVehicle) Disconnect() error {
+	v.once.Do(func() {
+		close(v.done)
+	})
+	return nil
+}
+
+// Sends a notification if the server subscribed to them
+func (v *simVehicle) send(msg []byte) {
+	v.mu.Lock()
+	notify := v.notify
+	v.mu.Unlock()
+	if notify != nil {
+		notify(msg)
+	}
+}
+
+// Applies the messages of a single write, which always ends between two messages
+func (v *simVehicle) receive(p []byte) {
+	for len(p) > 0 && int(p[0])+1 <= len(p) {
+		msg := p[:p[0]+1]
+		p = p[p[0]+1:]
+
+		id, ok := MessageId(msg)
+		if !ok {
+			continue
+		}
+		switch {
+		case id == ANKI_MSG_C2V_PING_REQUEST:
+			v.send([]byte{0x01, ANKI_MSG_V2C_PING_RESPONSE})
+		case id == ANKI_MSG_C2V_SET_SPEED && len(msg) >= 4:
+			speed := int16(binary.LittleEndian.Uint16(msg[2:]))
+			if speed < 0 {
+				speed = 0
+			}
+			v.mu.Lock()
+			v.speed = uint16(speed)
+			v.mu.Unlock()
+		case id == ANKI_MSG_C2V_SET_OFFSET && len(msg) >= 6:
+			v.mu.Lock()
+			v.offsetMm = math.Float32frombits(binary.LittleEndian.Uint32(msg[2:]))
+			v.mu.Unlock()
+		// simulated vehicles reach the new lane at once
+		case id == ANKI_MSG_C2V_CHANGE_LANE && len(msg) >= 10:
+			v.mu.Lock()
+			v.offsetMm = math.Float32frombits(binary.LittleEndian.Uint32(msg[6:]))
+			v.mu.Unlock()
+		}
+	}
+}
+
+// Reports a position update every SIM_POSITION_INTERVAL while the vehicle has a speed set
+func (v *simVehicle) drive() {
+	ticker := time.NewTicker(SIM_POSITION_INTERVAL)
+	defer ticker.Stop()
+	var location, piece int
+	for {
+		select {
+		case <-v.done:
+			return
+		case <-ticker.C:
+		}
+
+		v.mu.Lock()
+		speed, offsetMm := v.speed, v.offsetMm
+		v.mu.Unlock()
+		if speed == 0 {
+			continue
+		}
+
+		msg := make([]byte, 11)
+		msg[0] = 10
+		msg[1] = ANKI_MSG_V2C_POSITION_UPDATE
+		msg[2] = byte(location)
+		msg[3] = SIM_TRACK[piece]
+		binary.LittleEndian.PutUint32(msg[4:], math.Float32bits(offsetMm))
+		binary.LittleEndian.PutUint16(msg[8:], speed)
+		v.send(msg)
+
+		location++
+		if location%4 == 0 {
+			piece = (piece + 1) % len(SIM_TRACK)
+		}
+	}
+}
+
+type simCharacteristic struct {
+	vehicle *simVehicle
+	uuid    bluetooth.UUID
+}
+
+func (c simCharacteristic) UUID() bluetooth.UUID {
+	return c.uuid
+}
+
+func (c simCharacteristic) WriteWithoutResponse(p []byte) (int, error) {
+	select {
+	case <-c.vehicle.done:
+		return 0, errors.New("disconnected")
+	default:
+	}
+	c.vehicle.receive(p)
+	return len(p), nil
+}
+
+func (c simCharacteristic) EnableNotifications(callback func(buf []byte)) error {
+	c.vehicle.mu.Lock()
+	started := c.vehicle.notify != nil
+	c.vehicle.notify = callback
+	c.vehicle.mu.Unlock()
+	if !started {
+		go c.vehicle.drive()
+	}
+	return nil
+}
+
+func (c simCharacteristic) Read(data []byte) (int, error) {
+	return 0, nil
+}
@@ -0,0 +1,102 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Optional persistence of aliases and discovered vehicles, enabled with stateFile. The state is written when the
+ * server shuts down and read back at startup, so a restarted server resolves known vehicles and aliases without
+ * scanning first. A restored vehicle still has to be seen by a SCAN before it can be connected over BLE.
+ *
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+)
+
+type PersistedState struct {
+	Aliases  map[string]string  `yaml:"aliases"`
+	Vehicles []PersistedVehicle `yaml:"vehicles"`
+}
+
+type PersistedVehicle struct {
+	Address   string `yaml:"address"`
+	LocalName string `yaml:"localName"`
+	// hex data by company id
+	ManufacturerRecords map[uint16]string `yaml:"manufacturerRecords"`
+	LastSeen            time.Time         `yaml:"lastSeen"`
+}
+
+// Writes the aliases and discovered vehicles to path, replacing the previous state only once the new one is complete
+func saveState(path string) error {
+	state := PersistedState{Aliases: server.Aliases.Items()}
+	for _, vehicle := range server.DiscoveredDevices.Items() {
+		records := make(map[uint16]string)
+		for companyId, data := range vehicle.ManufacturerRecords {
+			records[companyId] = hex.EncodeToString(data)
+		}
+		state.Vehicles = append(state.Vehicles, PersistedVehicle{
+			Address:             vehicle.Address,
+			LocalName:           vehicle.LocalName,
+			ManufacturerRecords: records,
+			LastSeen:            vehicle.lastSeen,
+		})
+	}
+
+	encoded, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", encoded, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Restores the aliases and discovered vehicles saved in path. A missing file is no error, the server then simply
+// starts without any.
+func loadState(path string) error {
+	encoded, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state PersistedState
+	if err := yaml.Unmarshal(encoded, &state); err != nil {
+		return err
+	}
+
+	for _, vehicle := range state.Vehicles {
+		if vehicle.Address == "" {
+			continue
+		}
+		records := make(map[uint16][]byte)
+		for companyId, encodedData := range vehicle.ManufacturerRecords {
+			data, err := hex.DecodeString(encodedData)
+			if err != nil {
+				return errors.New("vehicle " + vehicle.Address + ": " + err.Error())
+			}
+			records[companyId] = data
+		}
+		server.DiscoveredDevices.Set(vehicle.Address, AnkiVehicle{
+			Address:             vehicle.Address,
+			ManufacturerData:    encodeManufacturerData(records),
+			LocalName:           vehicle.LocalName,
+			ManufacturerRecords: records,
+			lastSeen:            vehicle.LastSeen,
+		})
+		server.VehicleStates.Set(vehicle.Address, STATE_DISCOVERED)
+	}
+	for name, address := range state.Aliases {
+		server.Aliases.Set(name, address)
+	}
+	displayInfo("Restored " + strconv.Itoa(len(state.Vehicles)) + " vehicles and " + strconv.Itoa(len(state.Aliases)) + " aliases from " + path)
+	return nil
+}
@@ -0,0 +1,78 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the state file persisting aliases and discovered vehicles across restarts.
+ *
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The aliases and vehicles saved by one server are restored by the next one
+func TestStateRoundTrip(t *testing.T) {
+	newTestServer(t)
+	path := filepath.Join(t.TempDir(), "state.yml")
+	lastSeen := time.Now().Add(-time.Minute)
+	records := map[uint16][]byte{0xbeef: {0x00, 0x01, 0x12, 0x34}}
+	server.DiscoveredDevices.Set(TEST_VEHICLE, AnkiVehicle{
+		Address:             TEST_VEHICLE,
+		ManufacturerData:    encodeManufacturerData(records),
+		LocalName:           "Drive",
+		ManufacturerRecords: records,
+		lastSeen:            lastSeen,
+	})
+	server.Aliases.Set("Skull", TEST_VEHICLE)
+	if err := saveState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted server
+	server = newServer()
+	if err := loadState(path); err != nil {
+		t.Fatal(err)
+	}
+	if address := normalizeAddress("Skull"); address != TEST_VEHICLE {
+		t.Fatalf("alias resolves to %q after the restart", address)
+	}
+	vehicle, ok := server.DiscoveredDevices.Get(TEST_VEHICLE)
+	if !ok {
+		t.Fatal("discovered vehicle not restored")
+	}
+	if vehicle.LocalName != "Drive" || vehicle.ManufacturerData != "beef00011234" || string(vehicle.ManufacturerRecords[0xbeef]) != string(records[0xbeef]) || !vehicle.lastSeen.Equal(lastSeen) {
+		t.Fatalf("restored vehicle %+v", vehicle)
+	}
+	if state, _ := server.VehicleStates.Get(TEST_VEHICLE); state != STATE_DISCOVERED {
+		t.Fatalf("restored vehicle is %v", state)
+	}
+}
+
+// A missing state file starts the server empty, a damaged one is reported
+func TestLoadMissingOrCorruptState(t *testing.T) {
+	newTestServer(t)
+	dir := t.TempDir()
+	if err := loadState(filepath.Join(dir, "missing.yml")); err != nil {
+		t.Fatalf("missing state file: %v", err)
+	}
+
+	for name, content := range map[string]string{
+		"truncated.yml": "aliases: {Skull: ",
+		"badhex.yml":    "vehicles:\n  - address: " + TEST_VEHICLE + "\n    manufacturerRecords: {48879: zz}\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadState(path); err == nil {
+			t.Errorf("%s loaded without an error", name)
+		}
+	}
+	if server.Aliases.Count() != 0 || server.DiscoveredDevices.Count() != 0 {
+		t.Fatal("damaged state files restored something")
+	}
+}
@@ -0,0 +1,44 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Counters of what the server did since it started, reported by the STATS command for operational dashboards.
+ *
+ */
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Every counter only grows and is updated atomically
+type Stats struct {
+	ConnectionsServed uint64
+	CommandsForwarded uint64
+	Notifications     uint64
+	Scans             uint64
+	ConnectFailures   uint64
+}
+
+var stats Stats
+
+// Counts one more event on counter, e.g. countStat(&stats.Scans)
+func countStat(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+// A consistent enough snapshot of the counters, uptime and the clients connected right now
+func statsMessage(reqId string) StatsMessage {
+	return StatsMessage{
+		Type:               "stats",
+		UptimeSeconds:      int64(time.Since(startTime) / time.Second),
+		ConnectionsServed:  atomic.LoadUint64(&stats.ConnectionsServed),
+		CurrentConnections: server.Clients.Count(),
+		CommandsForwarded:  atomic.LoadUint64(&stats.CommandsForwarded),
+		Notifications:      atomic.LoadUint64(&stats.Notifications),
+		Scans:              atomic.LoadUint64(&stats.Scans),
+		ConnectFailures:    atomic.LoadUint64(&stats.ConnectFailures),
+		ReqId:              reqId,
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the counters reported by STATS.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// The counters reflect the clients, scans, connects, commands and notifications the server handled
+func TestStatsCounters(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	adapter.connectErrs[TEST_VEHICLE_2] = errors.New("connection refused")
+	adapter.Advertise(TEST_VEHICLE_2, -50)
+	client.Send("SCAN")
+	client.Expect(t, "SCAN;COMPLETED")
+	client.Send("CONNECT;" + TEST_VEHICLE_2)
+	client.Expect(t, "CONNECT;FAILED")
+
+	client.Send(TEST_VEHICLE+";0116", TEST_VEHICLE+";0116;ACK")
+	client.Expect(t, TEST_VEHICLE+";WRITE;OK")
+	vehicle.Emit(positionUpdate(1, 17, 0, 300))
+	vehicle.Emit(transitionUpdate(18, 17, 0))
+	client.Expect(t, TEST_VEHICLE+";"+encodeHex(transitionUpdate(18, 17, 0)))
+
+	client.Send("STATS;7")
+	report := client.Expect(t, "STATS;")
+	fields := strings.Split(report, ";")
+	if fields[len(fields)-1] != "7" {
+		t.Fatalf("stats report %q does not end with the request id", report)
+	}
+	counters := make(map[string]string)
+	for _, field := range fields[1 : len(fields)-1] {
+		name, value, _ := strings.Cut(field, "=")
+		counters[name] = value
+	}
+	want := map[string]string{
+		"uptime":          counters["uptime"],
+		"conns":           "2",
+		"current":         "2",
+		"commands":        "2",
+		"notifications":   "2",
+		"scans":           "2",
+		"connectFailures": "1",
+	}
+	if counters["uptime"] == "" || len(counters) != len(want) {
+		t.Fatalf("stats report %q, want the counters %v", report, want)
+	}
+	for name, value := range want {
+		if counters[name] != value {
+			t.Errorf("%s=%s, want %s", name, counters[name], value)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tracks which tcp clients share each connected vehicle. Owners are the clients that sent CONNECT for a vehicle and
+ * keep its BLE link alive; the link is only torn down once the last owner disconnects it or goes away. Subscribers
+ * are the clients that receive the vehicle's notifications.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+)
+
+type VehicleClients struct {
+	mu          sync.Mutex
+	owners      map[*ClientConn]bool
+	subscribers map[*ClientConn]bool
+	// the connect of the first owner, nil for vehicles connected otherwise
+	connecting *PendingConnect
+}
+
+// The connect a vehicle's first owner is establishing, the owners arriving meanwhile answer with its outcome
+type PendingConnect struct {
+	done chan struct{}
+	err  error
+}
+
+// Waits until the connect finished and returns its error, a nil connect has succeeded
+func (p *PendingConnect) Wait() error {
+	if p == nil {
+		return nil
+	}
+	<-p.done
+	return p.err
+}
+
+// Reports the outcome of the connect to the owners waiting for it
+func (p *PendingConnect) Finish(err error) {
+	p.err = err
+	close(p.done)
+}
+
+func newVehicleClients() *VehicleClients {
+	return &VehicleClients{
+		owners:      make(map[*ClientConn]bool),
+		subscribers: make(map[*ClientConn]bool),
+	}
+}
+
+// Number of clients holding the vehicle's BLE link
+func (v *VehicleClients) OwnerCount() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.owners)
+}
+
+// Number of clients receiving the vehicle's notifications
+func (v *VehicleClients) SubscriberCount() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.subscribers)
+}
+
+func (v *VehicleClients) snapshotSubscribers() []*ClientConn {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	clients := make([]*ClientConn, 0, len(v.subscribers))
+	for client := range v.subscribers {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// The owners and subscribers of a vehicle, kept while its BLE link is re-established
+type ClientsSnapshot struct {
+	owners      []*ClientConn
+	subscribers []*ClientConn
+}
+
+func (v *VehicleClients) snapshot() ClientsSnapshot {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var snapshot ClientsSnapshot
+	for client := range v.owners {
+		snapshot.owners = append(snapshot.owners, client)
+	}
+	for client := range v.subscribers {
+		snapshot.subscribers = append(snapshot.subscribers, client)
+	}
+	return snapshot
+}
+
+// Registers the clients of a snapshot with the vehicle again, besides any it has now, skipping the clients that went
+// away in the meantime. Returns false if no owner is left, the vehicle's clients are forgotten then.
+func restoreVehicleClients(address string, snapshot ClientsSnapshot) bool {
+	clients := vehicleClients(address)
+	clients.mu.Lock()
+	for _, client := range snapshot.owners {
+		if server.Clients.Has(client.Id) {
+			clients.owners[client] = true
+		}
+	}
+	for _, client := range snapshot.subscribers {
+		if server.Clients.Has(client.Id) {
+			clients.subscribers[client] = true
+		}
+	}
+	owned := len(clients.owners) > 0
+	clients.mu.Unlock()
+
+	if !owned {
+		server.VehicleClients.RemoveCb(address, func(key string, clients *VehicleClients, exists bool) bool {
+			return exists && clients.OwnerCount() == 0
+		})
+	}
+	return owned
+}
+
+func vehicleClients(address string) *VehicleClients {
+	return server.VehicleClients.Upsert(address, nil, func(exist bool, valueInMap *VehicleClients, newValue *VehicleClients) *VehicleClients {
+		if exist {
+			return valueInMap
+		}
+		return newVehicleClients()
+	})
+}
+
+// Registers client as an owner and subscriber of the vehicle. Returns first if client is the first owner,
+// meaning the BLE link still has to be established and connecting finished once it is, and already if client owned
+// the vehicle before. Other owners wait for connecting before they use the link.
+func acquireVehicle(address string, client *ClientConn) (first bool, already bool, connecting *PendingConnect) {
+	clients := vehicleClients(address)
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	if clients.owners[client] {
+		return false, true, nil
+	}
+	first = len(clients.owners) == 0
+	if first {
+		clients.connecting = &PendingConnect{done: make(chan struct{})}
+	}
+	clients.owners[client] = true
+	clients.subscribers[client] = true
+	return first, false, clients.connecting
+}
+
+// Removes client as an owner and subscriber of the vehicle. Returns true if no owners remain,
+// meaning the BLE link should be torn down.
+func releaseVehicle(address string, client *ClientConn) bool {
+	clients, ok := server.VehicleClients.Get(address)
+	if !ok {
+		return true
+	}
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	delete(clients.owners, client)
+	delete(clients.subscribers, client)
+	return len(clients.owners) == 0
+}
+
+// Releases a vehicle the connect of client failed for, the vehicle's clients are forgotten once no owner is left
+func abandonVehicle(address string, client *ClientConn) {
+	releaseVehicle(address, client)
+	server.VehicleClients.RemoveCb(address, func(key string, clients *VehicleClients, exists bool) bool {
+		return exists && clients.OwnerCount() == 0
+	})
+}
+
+// Removes client from every vehicle it owns or subscribes to. Returns the addresses of the vehicles that
+// no longer have an owner.
+func releaseClient(client *ClientConn) []string {
+	var orphaned []string
+	for address, clients := range server.VehicleClients.Items() {
+		clients.mu.Lock()
+		_, owned := clients.owners[client]
+		delete(clients.owners, client)
+		delete(clients.subscribers, client)
+		if owned && len(clients.owners) == 0 {
+			orphaned = append(orphaned, address)
+		}
+		clients.mu.Unlock()
+	}
+	return orphaned
+}
+
+// Starts delivering the vehicle's notifications to client without taking ownership of the BLE link
+func subscribeVehicle(address string, client *ClientConn) {
+	clients := vehicleClients(address)
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	clients.subscribers[client] = true
+}
+
+// Stops delivering the vehicle's notifications to client, ownership of the BLE link is unaffected
+func unsubscribeVehicle(address string, client *ClientConn) {
+	clients, ok := server.VehicleClients.Get(address)
+	if !ok {
+		return
+	}
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	delete(clients.subscribers, client)
+}
+
+// Fans a vehicle notification out to every subscribed client
+func notifySubscribers(address string, frame []byte) {
+	clients, ok := server.VehicleClients.Get(address)
+	if !ok {
+		return
+	}
+	for _, client := range clients.snapshotSubscribers() {
+		client.Notify(frame)
+	}
+}
+
+// Fans frame out to the vehicle's subscribers that did not send SUBSCRIBE_EVENTS, the others hear of the same thing
+// through an EVENT frame
+func notifySubscribersWithoutEvents(address string, frame []byte) {
+	clients, ok := server.VehicleClients.Get(address)
+	if !ok {
+		return
+	}
+	for _, client := range clients.snapshotSubscribers() {
+		if !client.WantsEvents() {
+			client.Notify(frame)
+		}
+	}
+}
+
+// The forms of a single vehicle notification a subscriber may receive, Compact and Decoded are nil for messages
+// that have none
+type NotificationFrames struct {
+	// <address>;<hex>
+	Raw []byte
+	// the ENCODING;COMPACT form of a position or transition update
+	Compact []byte
+	// e.g. <address>;POS;<location>;<piece>;<offset>;<speed>, for clients that sent RAW;OFF
+	Decoded []byte
+}
+
+// Fans the raw hex of a vehicle notification out to the subscribed clients that did not turn it off with RAW;OFF,
+// and the decoded frame to those that did. Clients that selected ENCODING;COMPACT receive the compact frame instead
+// of the raw hex, if there is one.
+func notifyRawSubscribers(address string, frames NotificationFrames) {
+	clients, ok := server.VehicleClients.Get(address)
+	if !ok {
+		return
+	}
+	for _, client := range clients.snapshotSubscribers() {
+		switch {
+		case !client.WantsRaw():
+			if frames.Decoded != nil {
+				client.Notify(frames.Decoded)
+			}
+		case frames.Compact != nil && client.Compact():
+			client.Notify(frames.Compact)
+		default:
+			client.Notify(frames.Raw)
+		}
+	}
+}
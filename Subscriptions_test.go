@@ -0,0 +1,126 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the vehicles shared between clients, their owners and subscribers.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Two clients connecting the same vehicle share one BLE link, which stays up until the last of them lets go
+func TestSharedVehicleReferenceCounting(t *testing.T) {
+	adapter := newTestServer(t)
+	first := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, first, TEST_VEHICLE)
+	second := newTestClient(t, nil)
+	second.Send("CONNECT;" + TEST_VEHICLE)
+	second.Expect(t, "CONNECT;SUCCESS")
+	if _, _, _, connects := adapter.Calls(); connects != 1 {
+		t.Fatalf("%d BLE connects for a shared vehicle", connects)
+	}
+	clients, _ := server.VehicleClients.Get(TEST_VEHICLE)
+	if owners := clients.OwnerCount(); owners != 2 {
+		t.Fatalf("%d owners, want 2", owners)
+	}
+
+	vehicle.Emit(transitionUpdate(1, 0, 0))
+	notification := TEST_VEHICLE + ";" + encodeHex(transitionUpdate(1, 0, 0))
+	first.Expect(t, notification)
+	second.Expect(t, notification)
+
+	first.Send("DISCONNECT;" + TEST_VEHICLE)
+	first.Expect(t, "DISCONNECT;SUCCESS")
+	if vehicle.Disconnects() != 0 || !server.ConnectedDevices.Has(TEST_VEHICLE) {
+		t.Fatal("link dropped while another client still owns the vehicle")
+	}
+	vehicle.Emit(transitionUpdate(2, 1, 0))
+	second.Expect(t, TEST_VEHICLE+";"+encodeHex(transitionUpdate(2, 1, 0)))
+	first.Refute(t, TEST_VEHICLE+";", 20*time.Millisecond)
+
+	// the last owner going away drops the link as well as disconnecting it would
+	second.Close()
+	waitUntil(t, "the link to drop", func() bool { return vehicle.Disconnects() == 1 })
+	if server.ConnectedDevices.Has(TEST_VEHICLE) || server.VehicleClients.Has(TEST_VEHICLE) {
+		t.Fatal("vehicle still tracked after its last owner left")
+	}
+}
+
+// A subscribed client receives the vehicle's notifications until it unsubscribes, other clients never do
+func TestSubscribeAndUnsubscribe(t *testing.T) {
+	adapter := newTestServer(t)
+	owner := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, owner, TEST_VEHICLE)
+	subscriber := newTestClient(t, nil)
+	bystander := newTestClient(t, nil)
+
+	subscriber.Send("SUBSCRIBE;" + TEST_VEHICLE)
+	subscriber.Expect(t, "SUBSCRIBE;SUCCESS")
+	vehicle.Emit(transitionUpdate(1, 0, 0))
+	subscriber.Expect(t, TEST_VEHICLE+";"+encodeHex(transitionUpdate(1, 0, 0)))
+	bystander.Refute(t, TEST_VEHICLE+";", 20*time.Millisecond)
+
+	subscriber.Send("UNSUBSCRIBE;" + TEST_VEHICLE)
+	subscriber.Expect(t, "UNSUBSCRIBE;SUCCESS")
+	vehicle.Emit(transitionUpdate(2, 1, 0))
+	owner.Expect(t, TEST_VEHICLE+";"+encodeHex(transitionUpdate(2, 1, 0)))
+	subscriber.Refute(t, TEST_VEHICLE+";", 20*time.Millisecond)
+
+	// subscribing takes no ownership, and needs a connected vehicle
+	if clients, _ := server.VehicleClients.Get(TEST_VEHICLE); clients.OwnerCount() != 1 {
+		t.Fatalf("%d owners, subscribers must not own the vehicle", clients.OwnerCount())
+	}
+	subscriber.Send("SUBSCRIBE;" + TEST_VEHICLE_2)
+	subscriber.Expect(t, "SUBSCRIBE;FAILED;not-connected")
+}
+
+// A client connecting a vehicle whose connect another client started answers with that connect's outcome, and a
+// failed connect releases only the ownership of the clients it failed for
+func TestSharedConnectWaitsForOutcome(t *testing.T) {
+	adapter := newTestServer(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+	first := newTestClient(t, nil)
+	second := newTestClient(t, nil)
+	first.Send("SCAN")
+	first.Expect(t, "SCAN;COMPLETED")
+
+	owners := func() int {
+		clients, ok := server.VehicleClients.Get(TEST_VEHICLE)
+		if !ok {
+			return 0
+		}
+		return clients.OwnerCount()
+	}
+	connectBoth := func() {
+		release := make(chan struct{})
+		adapter.onConnect = func(string) { <-release }
+		first.Send("CONNECT;" + TEST_VEHICLE)
+		expectState(t, TEST_VEHICLE, STATE_CONNECTING)
+		second.Send("CONNECT;" + TEST_VEHICLE)
+		waitUntil(t, "the second client to own the vehicle", func() bool { return owners() == 2 })
+		second.Refute(t, "CONNECT;", 20*time.Millisecond)
+		close(release)
+	}
+
+	adapter.FailConnect(TEST_VEHICLE, errors.New("le-connection-abort-by-local"))
+	connectBoth()
+	first.Expect(t, "CONNECT;FAILED;le-connection-abort-by-local")
+	second.Expect(t, "CONNECT;FAILED;le-connection-abort-by-local")
+	waitUntil(t, "the failed vehicle to be forgotten", func() bool { return !server.VehicleClients.Has(TEST_VEHICLE) })
+
+	adapter.FailConnect(TEST_VEHICLE, nil)
+	connectBoth()
+	first.Expect(t, "CONNECT;SUCCESS")
+	second.Expect(t, "CONNECT;SUCCESS")
+	if _, _, _, connects := adapter.Calls(); connects != 2 {
+		t.Fatalf("%d BLE connects, want one per CONNECT of the first client", connects)
+	}
+	if owners() != 2 {
+		t.Fatalf("%d owners, want 2", owners())
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Latest telemetry of each connected vehicle, taken from its position and transition updates, so clients can query
+ * it without decoding every notification themselves.
+ *
+ */
+
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+type SpeedSample struct {
+	SpeedMmPerSec uint16
+	ReceivedAt    time.Time
+}
+
+// Remembers the speed and offset the vehicle reported in a position update
+func recordPosition(address string, position PositionUpdate, receivedAt time.Time) {
+	server.LastSpeeds.Set(address, SpeedSample{SpeedMmPerSec: position.SpeedMmPerSec, ReceivedAt: receivedAt})
+	server.LastOffsets.Set(address, position.OffsetMm)
+}
+
+// Remembers the offset the vehicle reported when it moved onto the next road piece
+func recordTransition(address string, transition TransitionUpdate) {
+	server.LastOffsets.Set(address, transition.OffsetMm)
+}
+
+// Everything the server tracks about a vehicle, false if it never saw the vehicle
+func vehicleInfo(address string, reqId string) (VehicleInfoMessage, bool) {
+	state, known := server.VehicleStates.Get(address)
+	device, discovered := server.DiscoveredDevices.Get(address)
+	if !known && !discovered {
+		return VehicleInfoMessage{}, false
+	}
+	if !known {
+		state = STATE_DISCOVERED
+	}
+
+	info := VehicleInfoMessage{
+		Type:    "vehicle",
+		Address: address,
+		State:   state.String(),
+		// a connected vehicle only counts as having notifications on while the server is subscribed to them
+		Notifications: server.DeviceCharacteristics.Has(address) && !server.NotificationsOff.Has(address),
+		ReqId:         reqId,
+	}
+	for name, aliased := range server.Aliases.Items() {
+		if aliased == address {
+			info.Alias = name
+			break
+		}
+	}
+	if discovered && !device.lastSeen.IsZero() {
+		info.LastSeen = device.lastSeen.UTC().Format(time.RFC3339)
+	}
+	if sample, ok := server.LastSpeeds.Get(address); ok {
+		info.SpeedMmPerSec = &sample.SpeedMmPerSec
+	}
+	if offset, ok := server.LastOffsets.Get(address); ok {
+		info.OffsetMm = &offset
+	}
+	if clients, ok := server.VehicleClients.Get(address); ok {
+		info.Subscribers = clients.SubscriberCount()
+	}
+	return info, true
+}
+
+// Formats <address>;SPEED;<speed>;<age in ms>, or <address>;SPEED;no-data before the first position update
+func speedReport(address string) string {
+	sample, ok := server.LastSpeeds.Get(address)
+	if !ok {
+		return address + ";SPEED;no-data"
+	}
+	age := time.Since(sample.ReceivedAt).Milliseconds()
+	return address + ";SPEED;" + strconv.Itoa(int(sample.SpeedMmPerSec)) + ";" + strconv.FormatInt(age, 10)
+}
+
+// Formats <address>;OFFSET;<offset from the road center in mm>, or <address>;OFFSET;no-data before the first
+// position or transition update
+func offsetReport(address string) string {
+	offset, ok := server.LastOffsets.Get(address)
+	if !ok {
+		return address + ";OFFSET;no-data"
+	}
+	return address + ";OFFSET;" + strconv.FormatFloat(float64(offset), 'f', -1, 32)
+}
@@ -0,0 +1,91 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Best-effort UDP sink for position and transition telemetry, enabled with telemetryUDPAddr. Every decoded update is
+ * additionally sent as one datagram; the tcp connection stays authoritative and nothing is retransmitted. Datagrams
+ * are little-endian:
+ *		version (1) | message id (1) | unix nanos received (8) | address length n (1) | address (n) | fields
+ * with the fields of a position update (0x27) being location (1), road piece (1), offset mm float32 (4), speed (2)
+ * and of a transition update (0x29) road piece index (1), previous road piece index int8 (1), offset mm float32 (4).
+ * Clients that selected ENCODING;COMPACT receive the same datagrams over tcp, see CompactEncoding.go.
+ *
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const TELEMETRY_UDP_VERSION = 1
+
+var (
+	telemetryConn  net.Conn
+	telemetryMutex sync.Mutex
+)
+
+// Opens the UDP socket telemetry datagrams are sent to
+func startTelemetryUDP(address string) error {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return err
+	}
+	telemetryConn = conn
+	displayInfo("Sending telemetry to udp " + address)
+	return nil
+}
+
+// Common start of every telemetry datagram
+func telemetryHeader(msgId byte, address string, receivedAt time.Time) []byte {
+	datagram := make([]byte, 11, 11+len(address)+8)
+	datagram[0] = TELEMETRY_UDP_VERSION
+	datagram[1] = msgId
+	binary.LittleEndian.PutUint64(datagram[2:], uint64(receivedAt.UnixNano()))
+	datagram[10] = byte(len(address))
+	return append(datagram, address...)
+}
+
+func encodePositionDatagram(address string, position PositionUpdate, receivedAt time.Time) []byte {
+	datagram := telemetryHeader(ANKI_MSG_V2C_POSITION_UPDATE, address, receivedAt)
+	fields := make([]byte, 8)
+	fields[0] = position.LocationId
+	fields[1] = position.RoadPieceId
+	binary.LittleEndian.PutUint32(fields[2:], math.Float32bits(position.OffsetMm))
+	binary.LittleEndian.PutUint16(fields[6:], position.SpeedMmPerSec)
+	return append(datagram, fields...)
+}
+
+func encodeTransitionDatagram(address string, transition TransitionUpdate, receivedAt time.Time) []byte {
+	datagram := telemetryHeader(ANKI_MSG_V2C_TRANSITION_UPDATE, address, receivedAt)
+	fields := make([]byte, 6)
+	fields[0] = transition.RoadPieceIdx
+	fields[1] = byte(transition.RoadPieceIdxPrev)
+	binary.LittleEndian.PutUint32(fields[2:], math.Float32bits(transition.OffsetMm))
+	return append(datagram, fields...)
+}
+
+// Encodes a position or transition update as a telemetry datagram, nil for any other vehicle message
+func telemetryDatagram(address string, value []byte, receivedAt time.Time) []byte {
+	if position, ok := ParsePositionUpdate(value); ok {
+		return encodePositionDatagram(address, position, receivedAt)
+	}
+	if transition, ok := ParseTransition(value); ok {
+		return encodeTransitionDatagram(address, transition, receivedAt)
+	}
+	return nil
+}
+
+// Sends a datagram if telemetry is enabled. A lost or refused datagram is not worth reporting, the next update
+// replaces it anyway
+func sendTelemetry(datagram []byte) {
+	telemetryMutex.Lock()
+	defer telemetryMutex.Unlock()
+	if telemetryConn == nil {
+		return
+	}
+	telemetryConn.Write(datagram)
+}
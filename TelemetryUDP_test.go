@@ -0,0 +1,87 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the UDP telemetry datagrams.
+ *
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// Listens for telemetry datagrams and points the server's UDP sink at it until the test ends
+func listenTelemetry(t *testing.T) net.PacketConn {
+	t.Helper()
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := startTelemetryUDP(listener.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		telemetryMutex.Lock()
+		defer telemetryMutex.Unlock()
+		telemetryConn.Close()
+		telemetryConn = nil
+		listener.Close()
+	})
+	return listener
+}
+
+func readDatagram(t *testing.T, listener net.PacketConn) []byte {
+	t.Helper()
+	buf := make([]byte, 512)
+	listener.SetReadDeadline(time.Now().Add(TEST_TIMEOUT))
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no telemetry datagram: %v", err)
+	}
+	return buf[:n]
+}
+
+// Position and transition updates arrive as datagrams in the documented layout, other notifications are not sent
+func TestTelemetryDatagrams(t *testing.T) {
+	adapter := newTestServer(t)
+	listener := listenTelemetry(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	before := time.Now()
+	vehicle.Emit([]byte{0x03, ANKI_MSG_V2C_BATTERY_LEVEL, 0x10, 0x0e})
+	vehicle.Emit(positionUpdate(7, 17, -23.5, 550))
+	vehicle.Emit(transitionUpdate(18, 17, 12.25))
+
+	// the battery level is left out, the first datagram is the position update
+	position := readDatagram(t, listener)
+	header := len(TEST_VEHICLE) + 11
+	if len(position) != header+8 || position[0] != TELEMETRY_UDP_VERSION || position[1] != ANKI_MSG_V2C_POSITION_UPDATE {
+		t.Fatalf("position datagram %x", position)
+	}
+	receivedAt := time.Unix(0, int64(binary.LittleEndian.Uint64(position[2:])))
+	if receivedAt.Before(before) || receivedAt.After(time.Now()) {
+		t.Fatalf("position received at %v, it was emitted at %v", receivedAt, before)
+	}
+	if int(position[10]) != len(TEST_VEHICLE) || string(position[11:header]) != TEST_VEHICLE {
+		t.Fatalf("position datagram for %q", position[11:header])
+	}
+	fields := position[header:]
+	if fields[0] != 7 || fields[1] != 17 || math.Float32frombits(binary.LittleEndian.Uint32(fields[2:])) != -23.5 || binary.LittleEndian.Uint16(fields[6:]) != 550 {
+		t.Fatalf("position fields %x", fields)
+	}
+
+	transition := readDatagram(t, listener)
+	if len(transition) != header+6 || transition[1] != ANKI_MSG_V2C_TRANSITION_UPDATE {
+		t.Fatalf("transition datagram %x", transition)
+	}
+	if fields := transition[header:]; hex.EncodeToString(fields) != "1211"+"00004441" {
+		t.Fatalf("transition fields %x", fields)
+	}
+}
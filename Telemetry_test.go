@@ -0,0 +1,115 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the last known speed and offset of the vehicles, and of the VEHICLE report built on them.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// QUERY_SPEED answers the speed of the latest position update and how long ago it arrived
+func TestQuerySpeed(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Send("QUERY_SPEED;" + TEST_VEHICLE + ";1")
+	client.Expect(t, TEST_VEHICLE+";SPEED;no-data;1")
+
+	vehicle.Emit(positionUpdate(1, 17, 0, 300))
+	vehicle.Emit(positionUpdate(2, 17, 0, 550))
+	time.Sleep(30 * time.Millisecond)
+	client.Send("QUERY_SPEED;" + TEST_VEHICLE)
+	fields := strings.Split(client.Expect(t, TEST_VEHICLE+";SPEED;"), ";")
+	if len(fields) != 4 || fields[2] != "550" {
+		t.Fatalf("speed report %q, want the latest speed 550", fields)
+	}
+	if age, err := strconv.Atoi(fields[3]); err != nil || age < 30 || age > int(TEST_TIMEOUT.Milliseconds()) {
+		t.Fatalf("speed reported %sms old, it arrived about 30ms ago", fields[3])
+	}
+
+	// transition updates carry no speed
+	vehicle.Emit(transitionUpdate(18, 17, 0))
+	client.Send("QUERY_SPEED;" + TEST_VEHICLE)
+	if got := client.Expect(t, TEST_VEHICLE+";SPEED;"); !strings.HasPrefix(got, TEST_VEHICLE+";SPEED;550;") {
+		t.Fatalf("speed after a transition update %q", got)
+	}
+	client.Send("QUERY_SPEED;" + TEST_VEHICLE_2)
+	client.Expect(t, "ERROR;not-connected;"+TEST_VEHICLE_2)
+}
+
+// QUERY_OFFSET answers the offset of the latest position or transition update
+func TestQueryOffset(t *testing.T) {
+	adapter := newTestServer(t)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+
+	client.Send("QUERY_OFFSET;" + TEST_VEHICLE + ";1")
+	client.Expect(t, TEST_VEHICLE+";OFFSET;no-data;1")
+
+	vehicle.Emit(positionUpdate(1, 17, -23.5, 300))
+	client.Send("QUERY_OFFSET;" + TEST_VEHICLE)
+	client.Expect(t, TEST_VEHICLE+";OFFSET;-23.5")
+
+	// the offset drifts as the vehicle crosses transition points
+	vehicle.Emit(transitionUpdate(18, 17, 12.25))
+	client.Send("QUERY_OFFSET;" + TEST_VEHICLE + ";2")
+	client.Expect(t, TEST_VEHICLE+";OFFSET;12.25;2")
+
+	client.Send("QUERY_OFFSET;" + TEST_VEHICLE_2)
+	client.Expect(t, "ERROR;not-connected;"+TEST_VEHICLE_2)
+}
+
+// VEHICLE reports the state, alias, last sighting, latest telemetry, subscribers and notification switch of a vehicle
+func TestVehicleInfo(t *testing.T) {
+	adapter := newTestServer(t)
+	adapter.Advertise(TEST_VEHICLE_2, -50)
+	client := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+	subscriber := newTestClient(t, nil)
+	subscriber.Send("SUBSCRIBE;" + TEST_VEHICLE)
+	subscriber.Expect(t, "SUBSCRIBE;SUCCESS")
+	client.Send("ALIAS;" + TEST_VEHICLE + ";Skull")
+	client.Expect(t, "ALIAS;SUCCESS")
+	vehicle.Emit(positionUpdate(1, 17, -23.5, 550))
+	device, _ := server.DiscoveredDevices.Get(TEST_VEHICLE)
+	lastSeen := device.lastSeen.UTC().Format(time.RFC3339)
+
+	// the owner receives the notifications as well as the subscriber
+	client.Send("VEHICLE;Skull;4")
+	want := "VEHICLE;" + TEST_VEHICLE + ";state=CONNECTED;alias=Skull;lastSeen=" + lastSeen +
+		";speed=550;offset=-23.5;subscribers=2;notifications=on;4"
+	if got := client.Expect(t, "VEHICLE;"); got != want {
+		t.Fatalf("vehicle report %q, want %q", got, want)
+	}
+
+	client.Send("NOTIFY;" + TEST_VEHICLE + ";OFF")
+	client.Expect(t, "NOTIFY;SUCCESS")
+	client.Send("VEHICLE;" + TEST_VEHICLE)
+	if got := client.Expect(t, "VEHICLE;"); !strings.HasSuffix(got, ";notifications=off") {
+		t.Fatalf("vehicle report %q with notifications off", got)
+	}
+
+	// a vehicle that was only discovered has no telemetry yet
+	serverConf.WireFormat = WIRE_FORMAT_JSON
+	client.Send("VEHICLE;" + TEST_VEHICLE_2)
+	var info VehicleInfoMessage
+	if err := json.Unmarshal([]byte(client.Expect(t, `{"type":"vehicle"`)), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Address != TEST_VEHICLE_2 || info.State != "DISCOVERED" || info.SpeedMmPerSec != nil || info.OffsetMm != nil || info.Notifications {
+		t.Fatalf("discovered vehicle reported as %+v", info)
+	}
+
+	serverConf.WireFormat = WIRE_FORMAT_LEGACY
+	client.Send("VEHICLE;AA:00:00:00:00:09")
+	client.Expect(t, "VEHICLE;FAILED;unknown-address")
+}
@@ -0,0 +1,198 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * The BLE operations the server uses to find, connect and talk to vehicles. BluetoothAdapter drives the host's BLE
+ * stack through tinygo; SimAdapter fabricates vehicles so the tcp protocol can be exercised without hardware.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	ADAPTER_BLE = "ble"
+	ADAPTER_SIM = "sim"
+
+	// active scans request the scan response, which carries the local name, passive scans only listen
+	SCAN_MODE_ACTIVE  = "active"
+	SCAN_MODE_PASSIVE = "passive"
+)
+
+// Transmit power levels in dBm TXPOWER accepts, the steps most BLE controllers offer
+var TX_POWER_LEVELS = []int{-20, -16, -12, -8, -4, 0, 4}
+
+type VehicleAdapter interface {
+	Enable() error
+	// Reports every advertising ANKI vehicle to found until StopScan is called
+	Scan(found func(AnkiVehicle)) error
+	StopScan() error
+	// Selects active or passive scanning for the following scans
+	SetScanMode(mode string) error
+	// The transmit power of the adapter in dBm, an error if the platform can't report or change it
+	TxPower() (int, error)
+	SetTxPower(dBm int) error
+	Connect(vehicle AnkiVehicle, params bluetooth.ConnectionParams) (VehicleLink, error)
+	// Called with the address of a vehicle that dropped the link on its own
+	SetDisconnectHandler(handler func(address string))
+}
+
+// The BLE link to a connected vehicle
+type VehicleLink interface {
+	DiscoverCharacteristics() (VehicleCharacteristics, error)
+	Disconnect() error
+}
+
+// A characteristic of the ANKI service
+type Characteristic interface {
+	UUID() bluetooth.UUID
+	WriteWithoutResponse(p []byte) (int, error)
+	EnableNotifications(callback func(buf []byte)) error
+	Read(data []byte) (int, error)
+}
+
+// Implemented by characteristics that know their ATT handle, tinygo does not expose it
+type handledCharacteristic interface {
+	Handle() uint16
+}
+
+// Whether two discoveries found the same characteristic, the same UUID at the same handle. Without handles only the
+// very same characteristic counts, so it is subscribed to again rather than missing notifications
+func sameCharacteristic(a, b Characteristic) bool {
+	if a == nil || b == nil || a.UUID() != b.UUID() {
+		return false
+	}
+	handledA, okA := a.(handledCharacteristic)
+	handledB, okB := b.(handledCharacteristic)
+	if okA && okB {
+		return handledA.Handle() == handledB.Handle()
+	}
+	return a == b
+}
+
+type BluetoothAdapter struct {
+	adapter *bluetooth.Adapter
+}
+
+func (b *BluetoothAdapter) Enable() error {
+	return b.adapter.Enable()
+}
+
+func (b *BluetoothAdapter) Scan(found func(AnkiVehicle)) error {
+	return b.adapter.Scan(func(adapter *bluetooth.Adapter, device bluetooth.ScanResult) {
+		if vehicle, ok := scannedVehicle(device); ok {
+			found(vehicle)
+		}
+	})
+}
+
+// The ANKI vehicle a scan result advertises, false for any other device
+func scannedVehicle(device bluetooth.ScanResult) (AnkiVehicle, bool) {
+	// only scan for devices that contain "Drive" for anki drive
+	if !strings.Contains(device.LocalName(), "Drive") {
+		return AnkiVehicle{}, false
+	}
+	// the advertisement data is only valid during the callback, keep copies
+	records := make(map[uint16][]byte)
+	for companyId, data := range device.ManufacturerData() {
+		records[companyId] = append([]byte(nil), data...)
+	}
+	// ANKI device properties
+	return AnkiVehicle{
+		Address:             normalizeAddress(device.Address.String()),
+		ManufacturerData:    encodeManufacturerData(records),
+		LocalName:           device.LocalName(),
+		ManufacturerRecords: records,
+		Addresser:           device.Address,
+		RSSI:                device.RSSI,
+	}, true
+}
+
+func (b *BluetoothAdapter) StopScan() error {
+	return b.adapter.StopScan()
+}
+
+// BlueZ always scans actively and tinygo offers no way to change that
+func (b *BluetoothAdapter) SetScanMode(mode string) error {
+	if mode != SCAN_MODE_ACTIVE {
+		return errors.New("the BLE stack only supports active scanning")
+	}
+	return nil
+}
+
+// tinygo offers no access to the controller's transmit power on any platform
+func (b *BluetoothAdapter) TxPower() (int, error) {
+	return 0, errors.New("unsupported")
+}
+
+func (b *BluetoothAdapter) SetTxPower(dBm int) error {
+	return errors.New("unsupported")
+}
+
+func (b *BluetoothAdapter) Connect(vehicle AnkiVehicle, params bluetooth.ConnectionParams) (VehicleLink, error) {
+	// vehicles restored from the state file have no BLE address until a scan sees them again
+	if vehicle.Addresser == nil {
+		return nil, errors.New("not-scanned")
+	}
+	device, err := b.adapter.Connect(vehicle.Addresser, params)
+	if err != nil {
+		return nil, err
+	}
+	return bluetoothVehicle{device}, nil
+}
+
+func (b *BluetoothAdapter) SetDisconnectHandler(handler func(address string)) {
+	b.adapter.SetConnectHandler(func(device bluetooth.Addresser, connected bool) {
+		if !connected {
+			handler(normalizeAddress(device.String()))
+		}
+	})
+}
+
+type bluetoothVehicle struct {
+	*bluetooth.Device
+}
+
+// Finds the ANKI service of a connected vehicle and its write and read characteristics. The characteristics are
+// matched by UUID since the BLE stack does not guarantee they are returned in the order they were requested.
+func (v bluetoothVehicle) DiscoverCharacteristics() (VehicleCharacteristics, error) {
+	services, err := v.DiscoverServices([]bluetooth.UUID{ANKI_STR_SERVICE_UUID})
+	if err != nil {
+		return VehicleCharacteristics{}, err
+	}
+	if len(services) == 0 {
+		return VehicleCharacteristics{}, errors.New("ANKI service not found")
+	}
+
+	characteristics, err := services[0].DiscoverCharacteristics([]bluetooth.UUID{ANKI_STR_CHR_READ_UUID, ANKI_STR_CHR_WRITE_UUID})
+	if err != nil {
+		return VehicleCharacteristics{}, err
+	}
+
+	discovered := make([]Characteristic, len(characteristics))
+	for i := range characteristics {
+		discovered[i] = &characteristics[i]
+	}
+	return matchCharacteristics(discovered)
+}
+
+// Picks the write and read characteristics out of the discovered ones by their UUID, in whatever order they are
+func matchCharacteristics(characteristics []Characteristic) (VehicleCharacteristics, error) {
+	var found VehicleCharacteristics
+	for _, characteristic := range characteristics {
+		switch characteristic.UUID() {
+		case ANKI_STR_CHR_WRITE_UUID:
+			found.Writer = characteristic
+		case ANKI_STR_CHR_READ_UUID:
+			found.Reader = characteristic
+		}
+	}
+	if found.Writer == nil || found.Reader == nil {
+		return VehicleCharacteristics{}, errors.New("ANKI read or write characteristic not found")
+	}
+	return found, nil
+}
@@ -0,0 +1,90 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the scan results and the matching of the discovered ANKI characteristics.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"tinygo.org/x/bluetooth"
+)
+
+// The writer and the reader are told apart by UUID in either order, characteristics of other UUIDs are ignored
+func TestMatchCharacteristics(t *testing.T) {
+	writer := &fakeCharacteristic{uuid: ANKI_STR_CHR_WRITE_UUID}
+	reader := &fakeCharacteristic{uuid: ANKI_STR_CHR_READ_UUID}
+	other := &fakeCharacteristic{uuid: bluetooth.CharacteristicUUIDBatteryLevel}
+	orders := [][]Characteristic{
+		{writer, reader},
+		{reader, writer},
+		{other, reader, writer},
+	}
+	for _, order := range orders {
+		found, err := matchCharacteristics(order)
+		if err != nil {
+			t.Fatalf("%d characteristics: %v", len(order), err)
+		}
+		if found.Writer != writer || found.Reader != reader {
+			t.Errorf("writer and reader swapped or lost for %d characteristics", len(order))
+		}
+	}
+
+	for _, order := range [][]Characteristic{{writer}, {reader, other}, nil} {
+		if _, err := matchCharacteristics(order); err == nil {
+			t.Errorf("matched %d characteristics without both the writer and the reader", len(order))
+		}
+	}
+}
+
+// The advertisement of a scan result
+type fakeAdvertisement struct {
+	localName string
+	records   map[uint16][]byte
+}
+
+func (a fakeAdvertisement) LocalName() string                   { return a.localName }
+func (a fakeAdvertisement) HasServiceUUID(bluetooth.UUID) bool  { return false }
+func (a fakeAdvertisement) Bytes() []byte                       { return nil }
+func (a fakeAdvertisement) ManufacturerData() map[uint16][]byte { return a.records }
+
+// Every manufacturer data record of a vehicle is kept, each with its own company id, and only vehicles are reported
+func TestScannedVehicleRecords(t *testing.T) {
+	newTestServer(t)
+	mac, err := bluetooth.ParseMAC(TEST_VEHICLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := bluetooth.Address{MACAddress: bluetooth.MACAddress{MAC: mac}}
+	records := map[uint16][]byte{0xbeef: {0x00, 0x01, 0x12, 0x34}, 0x004c: {0x02, 0x15}, 0x0f00: {}}
+	vehicle, ok := scannedVehicle(bluetooth.ScanResult{Address: address, RSSI: -60, AdvertisementPayload: fakeAdvertisement{"Drive", records}})
+	if !ok {
+		t.Fatal("vehicle not recognized")
+	}
+	if vehicle.ManufacturerData != "004c02150f00beef00011234" {
+		t.Errorf("manufacturer data %q, want every record after its company id", vehicle.ManufacturerData)
+	}
+	if len(vehicle.ManufacturerRecords) != len(records) {
+		t.Fatalf("records %x, want %x", vehicle.ManufacturerRecords, records)
+	}
+	for companyId, data := range records {
+		if !bytes.Equal(vehicle.ManufacturerRecords[companyId], data) {
+			t.Errorf("record %04x is %x, want %x", companyId, vehicle.ManufacturerRecords[companyId], data)
+		}
+	}
+	// the advertisement may be reused once the callback returned
+	records[0xbeef][0] = 0xff
+	if vehicle.ManufacturerRecords[0xbeef][0] != 0x00 {
+		t.Error("record not copied out of the advertisement")
+	}
+	if vehicle.Address != TEST_VEHICLE || vehicle.RSSI != -60 {
+		t.Errorf("vehicle %s at %d dBm", vehicle.Address, vehicle.RSSI)
+	}
+
+	if _, ok := scannedVehicle(bluetooth.ScanResult{Address: address, AdvertisementPayload: fakeAdvertisement{"Headphones", records}}); ok {
+		t.Error("a device that is no vehicle was reported")
+	}
+}
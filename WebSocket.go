@@ -0,0 +1,212 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * WebSocket front-end for browser based dashboards, enabled with wsEnabled. Every text message a client sends is
+ * handled like a message on the tcp listener and every response and notification is sent back as a text message.
+ * The connection is wrapped as a net.Conn so it goes through the same handleRequest as tcp clients.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	WS_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// largest message accepted from a client
+	WS_MAX_MESSAGE_BYTES = 64 * 1024
+
+	WS_OP_CONTINUATION = 0x0
+	WS_OP_TEXT         = 0x1
+	WS_OP_BINARY       = 0x2
+	WS_OP_CLOSE        = 0x8
+	WS_OP_PING         = 0x9
+	WS_OP_PONG         = 0xa
+)
+
+// Accepts WebSocket clients on address until the server terminates
+func serveWebSocket(address string) error {
+	return http.ListenAndServe(address, webSocketHandler())
+}
+
+// Upgrades every request to a WebSocket and handles the client until it goes away
+func webSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err != nil || !accessList.PermitsIP(net.ParseIP(host)) {
+			displayInfo("Refusing WebSocket connection from " + r.RemoteAddr + ".")
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+			http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "websocket not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			return
+		}
+
+		accept := sha1.Sum([]byte(key + WS_GUID))
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+		if err := rw.Flush(); err != nil {
+			conn.Close()
+			return
+		}
+		displayInfo("WebSocket client connected from " + conn.RemoteAddr().String())
+		handleRequest(&WebSocketConn{Conn: conn, reader: rw.Reader}, nil)
+	})
+}
+
+// A WebSocket connection seen as a stream of messages. Read returns one message at a time, terminated by a newline
+// like a message on the tcp listener, and every Write is sent as a single text message.
+type WebSocketConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	pending []byte
+	writeMu sync.Mutex
+}
+
+func (c *WebSocketConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.HasSuffix(msg, []byte("\n")) {
+			msg = append(msg, '\n')
+		}
+		c.pending = msg
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *WebSocketConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(WS_OP_TEXT, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Reads frames until a complete text or binary message arrived, answering pings on the way
+func (c *WebSocketConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case WS_OP_PING:
+			if err := c.writeFrame(WS_OP_PONG, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case WS_OP_PONG:
+			continue
+		case WS_OP_CLOSE:
+			c.writeFrame(WS_OP_CLOSE, nil)
+			return nil, io.EOF
+		case WS_OP_TEXT, WS_OP_BINARY, WS_OP_CONTINUATION:
+		default:
+			return nil, errors.New("unknown websocket opcode")
+		}
+
+		if len(msg)+len(payload) > WS_MAX_MESSAGE_BYTES {
+			return nil, errors.New("websocket message too large")
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (c *WebSocketConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	// clients always mask their frames
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("unmasked websocket frame")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if length > WS_MAX_MESSAGE_BYTES {
+		return false, 0, nil, errors.New("websocket message too large")
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, mask); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// Writes a single unmasked frame, responses and notifications are written from different goroutines
+func (c *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode, 0}
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		header = append(header, 0, 0)
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.Conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
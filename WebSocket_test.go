@@ -0,0 +1,131 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the WebSocket front-end against a minimal WebSocket client.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A WebSocket client that sends masked frames as browsers do
+type wsTestClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Connects to the WebSocket front-end served by the test, the client is closed and its handler waited for when the
+// test ends
+func dialWebSocket(t *testing.T) *wsTestClient {
+	t.Helper()
+	clients := atomic.LoadInt32(&liveConnections)
+	ws := httptest.NewServer(webSocketHandler())
+	t.Cleanup(ws.Close)
+	conn, err := net.DialTimeout("tcp", ws.Listener.Addr().String(), TEST_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		waitUntil(t, "the WebSocket client to be let go", func() bool { return atomic.LoadInt32(&liveConnections) == clients })
+	})
+	conn.SetDeadline(time.Now().Add(TEST_TIMEOUT))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + ws.Listener.Addr().String() + "\r\nUpgrade: websocket\r\n" +
+		"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the accept key of the example handshake in RFC 6455
+	if response.StatusCode != http.StatusSwitchingProtocols || response.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("upgrade answered %v %v", response.Status, response.Header)
+	}
+	return &wsTestClient{conn: conn, reader: reader}
+}
+
+func (c *wsTestClient) Send(t *testing.T, opcode byte, payload string) {
+	t.Helper()
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reads the next frame the server sends
+func (c *wsTestClient) Receive(t *testing.T) (byte, string) {
+	t.Helper()
+	c.conn.SetDeadline(time.Now().Add(TEST_TIMEOUT))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		t.Fatal(err)
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		extended := make([]byte, 2)
+		io.ReadFull(c.reader, extended)
+		length = int(binary.BigEndian.Uint16(extended))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0f, string(payload)
+}
+
+// Reads text messages until one starts with prefix
+func (c *wsTestClient) Expect(t *testing.T, prefix string) string {
+	t.Helper()
+	for {
+		if opcode, msg := c.Receive(t); opcode == WS_OP_TEXT && strings.HasPrefix(msg, prefix) {
+			return msg
+		}
+	}
+}
+
+// A WebSocket client speaks the tcp protocol in text messages and receives the notifications of the vehicles it
+// subscribed to
+func TestWebSocketPingAndNotification(t *testing.T) {
+	adapter := newTestServer(t)
+	owner := newTestClient(t, nil)
+	vehicle := connectTestVehicle(t, adapter, owner, TEST_VEHICLE)
+	client := dialWebSocket(t)
+
+	client.Send(t, WS_OP_TEXT, "PING;1")
+	if got := client.Expect(t, "PONG"); got != "PONG;1\n" {
+		t.Fatalf("PING answered %q", got)
+	}
+	client.Send(t, WS_OP_PING, "hi")
+	if opcode, payload := client.Receive(t); opcode != WS_OP_PONG || payload != "hi" {
+		t.Fatalf("ping frame answered with opcode %x %q", opcode, payload)
+	}
+
+	client.Send(t, WS_OP_TEXT, "SUBSCRIBE;"+TEST_VEHICLE)
+	client.Expect(t, "SUBSCRIBE;SUCCESS")
+	vehicle.Emit(transitionUpdate(2, 1, 0))
+	if got, want := client.Expect(t, TEST_VEHICLE+";"), TEST_VEHICLE+";"+encodeHex(transitionUpdate(2, 1, 0))+"\n"; got != want {
+		t.Fatalf("notification %q, want %q", got, want)
+	}
+
+	client.Send(t, WS_OP_CLOSE, "")
+	if opcode, _ := client.Receive(t); opcode != WS_OP_CLOSE {
+		t.Fatalf("close answered with opcode %x", opcode)
+	}
+}
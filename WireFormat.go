@@ -0,0 +1,201 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Messages the server sends to its clients. By default they are written in the legacy ';'-delimited format the
+ * ANKI SDK for Java expects; with wireFormat: json they are written as newline-delimited JSON objects instead.
+ *
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+const (
+	WIRE_FORMAT_LEGACY = "legacy"
+	WIRE_FORMAT_JSON   = "json"
+
+	HEX_CASE_LOWER = "lower"
+	HEX_CASE_UPPER = "upper"
+)
+
+// A message that can be written in either wire format
+type WireMessage interface {
+	// the ';'-delimited form without the trailing newline
+	Legacy() string
+}
+
+type ScanResultMessage struct {
+	Type             string `json:"type"`
+	Address          string `json:"address"`
+	ManufacturerData string `json:"manufacturerData"`
+	LocalName        string `json:"localName"`
+}
+
+func (m ScanResultMessage) Legacy() string {
+	return "SCAN;" + m.Address + ";" + m.ManufacturerData + ";" + m.LocalName
+}
+
+type ScanCompletedMessage struct {
+	Type  string `json:"type"`
+	ReqId string `json:"reqId,omitempty"`
+}
+
+func (m ScanCompletedMessage) Legacy() string {
+	msg := "SCAN;COMPLETED"
+	if m.ReqId != "" {
+		msg += ";" + m.ReqId
+	}
+	return msg
+}
+
+type ScanFailedMessage struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+func (m ScanFailedMessage) Legacy() string {
+	return "SCAN;FAILED;" + m.Reason
+}
+
+type StatusMessage struct {
+	Type      string `json:"type"`
+	Adapter   string `json:"adapter"`
+	Connected int    `json:"connected"`
+	ReqId     string `json:"reqId,omitempty"`
+}
+
+func (m StatusMessage) Legacy() string {
+	msg := "STATUS;adapter=" + m.Adapter + ";connected=" + strconv.Itoa(m.Connected)
+	if m.ReqId != "" {
+		msg += ";" + m.ReqId
+	}
+	return msg
+}
+
+type StatsMessage struct {
+	Type               string `json:"type"`
+	UptimeSeconds      int64  `json:"uptimeSeconds"`
+	ConnectionsServed  uint64 `json:"connectionsServed"`
+	CurrentConnections int    `json:"currentConnections"`
+	CommandsForwarded  uint64 `json:"commandsForwarded"`
+	Notifications      uint64 `json:"notifications"`
+	Scans              uint64 `json:"scans"`
+	ConnectFailures    uint64 `json:"connectFailures"`
+	ReqId              string `json:"reqId,omitempty"`
+}
+
+func (m StatsMessage) Legacy() string {
+	msg := "STATS;uptime=" + strconv.FormatInt(m.UptimeSeconds, 10) +
+		";conns=" + strconv.FormatUint(m.ConnectionsServed, 10) +
+		";current=" + strconv.Itoa(m.CurrentConnections) +
+		";commands=" + strconv.FormatUint(m.CommandsForwarded, 10) +
+		";notifications=" + strconv.FormatUint(m.Notifications, 10) +
+		";scans=" + strconv.FormatUint(m.Scans, 10) +
+		";connectFailures=" + strconv.FormatUint(m.ConnectFailures, 10)
+	if m.ReqId != "" {
+		msg += ";" + m.ReqId
+	}
+	return msg
+}
+
+// The server's view of a single vehicle, Speed and Offset are nil until the vehicle reported them
+type VehicleInfoMessage struct {
+	Type          string   `json:"type"`
+	Address       string   `json:"address"`
+	State         string   `json:"state"`
+	Alias         string   `json:"alias,omitempty"`
+	LastSeen      string   `json:"lastSeen,omitempty"`
+	SpeedMmPerSec *uint16  `json:"speedMmPerSec,omitempty"`
+	OffsetMm      *float32 `json:"offsetMm,omitempty"`
+	Subscribers   int      `json:"subscribers"`
+	Notifications bool     `json:"notifications"`
+	ReqId         string   `json:"reqId,omitempty"`
+}
+
+func (m VehicleInfoMessage) Legacy() string {
+	speed, offset, notifications := "none", "none", "off"
+	if m.SpeedMmPerSec != nil {
+		speed = strconv.Itoa(int(*m.SpeedMmPerSec))
+	}
+	if m.OffsetMm != nil {
+		offset = strconv.FormatFloat(float64(*m.OffsetMm), 'f', -1, 32)
+	}
+	if m.Notifications {
+		notifications = "on"
+	}
+	msg := "VEHICLE;" + m.Address + ";state=" + m.State + ";alias=" + m.Alias + ";lastSeen=" + m.LastSeen +
+		";speed=" + speed + ";offset=" + offset + ";subscribers=" + strconv.Itoa(m.Subscribers) +
+		";notifications=" + notifications
+	if m.ReqId != "" {
+		msg += ";" + m.ReqId
+	}
+	return msg
+}
+
+// A vehicle notification forwarded as is
+type NotificationMessage struct {
+	Type      string `json:"type"`
+	Address   string `json:"address"`
+	Timestamp string `json:"timestamp,omitempty"`
+	Payload   string `json:"payload"`
+}
+
+func (m NotificationMessage) Legacy() string {
+	if m.Timestamp != "" {
+		return m.Address + ";" + m.Timestamp + ";" + m.Payload
+	}
+	return m.Address + ";" + m.Payload
+}
+
+// A vehicle notification the server decoded, e.g. POS;<location>;<piece>;<offset>;<speed>
+type DecodedNotificationMessage struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+	Message string `json:"message"`
+}
+
+func (m DecodedNotificationMessage) Legacy() string {
+	return m.Address + ";" + m.Message
+}
+
+// A vehicle notification the server understood, e.g. DELOCALIZED, or a disconnect with the reason the server
+// disconnected the vehicle, e.g. IDLE
+type VehicleEventMessage struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+	Event   string `json:"event"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func (m VehicleEventMessage) Legacy() string {
+	if m.Reason != "" {
+		return m.Address + ";" + m.Reason + ";" + m.Event
+	}
+	return m.Address + ";" + m.Event
+}
+
+// Serializes msg in the configured wire format, terminated by a newline
+func encodeMessage(msg WireMessage) []byte {
+	if serverConf.WireFormat == WIRE_FORMAT_JSON {
+		encoded, err := json.Marshal(msg)
+		if err == nil {
+			return append(encoded, '\n')
+		}
+		displayInfo("Could not encode message as json: " + err.Error())
+	}
+	return []byte(msg.Legacy() + "\n")
+}
+
+// Hex encodes bytes sent to clients in the configured hexCase
+func encodeHex(data []byte) string {
+	encoded := hex.EncodeToString(data)
+	if serverConf.HexCase == HEX_CASE_UPPER {
+		return strings.ToUpper(encoded)
+	}
+	return encoded
+}
@@ -0,0 +1,117 @@
+/*
+ * State University of New York, College at Oswego
+ *
+ * Tests of the messages the server sends in both wire formats.
+ *
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// The same message carries the same data in the legacy and the json format
+func TestEncodeMessage(t *testing.T) {
+	tests := []struct {
+		msg    WireMessage
+		legacy string
+		json   string
+	}{
+		{
+			ScanResultMessage{Type: "scan", Address: TEST_VEHICLE, ManufacturerData: "beef0001", LocalName: "Drive"},
+			"SCAN;" + TEST_VEHICLE + ";beef0001;Drive",
+			`{"type":"scan","address":"` + TEST_VEHICLE + `","manufacturerData":"beef0001","localName":"Drive"}`,
+		},
+		{
+			ScanCompletedMessage{Type: "scan-completed", ReqId: "7"},
+			"SCAN;COMPLETED;7",
+			`{"type":"scan-completed","reqId":"7"}`,
+		},
+		{
+			ScanCompletedMessage{Type: "scan-completed"},
+			"SCAN;COMPLETED",
+			`{"type":"scan-completed"}`,
+		},
+		{
+			StatusMessage{Type: "status", Adapter: "ready", Connected: 2},
+			"STATUS;adapter=ready;connected=2",
+			`{"type":"status","adapter":"ready","connected":2}`,
+		},
+		{
+			NotificationMessage{Type: "notification", Address: TEST_VEHICLE, Payload: "0117"},
+			TEST_VEHICLE + ";0117",
+			`{"type":"notification","address":"` + TEST_VEHICLE + `","payload":"0117"}`,
+		},
+		{
+			DecodedNotificationMessage{Type: "decoded", Address: TEST_VEHICLE, Message: "POS;1;2;0;300"},
+			TEST_VEHICLE + ";POS;1;2;0;300",
+			`{"type":"decoded","address":"` + TEST_VEHICLE + `","message":"POS;1;2;0;300"}`,
+		},
+		{
+			VehicleEventMessage{Type: "event", Address: TEST_VEHICLE, Event: "DELOCALIZED"},
+			TEST_VEHICLE + ";DELOCALIZED",
+			`{"type":"event","address":"` + TEST_VEHICLE + `","event":"DELOCALIZED"}`,
+		},
+	}
+	newTestServer(t)
+	for _, test := range tests {
+		serverConf.WireFormat = WIRE_FORMAT_LEGACY
+		if got := string(encodeMessage(test.msg)); got != test.legacy+"\n" {
+			t.Errorf("legacy %q, want %q", got, test.legacy)
+		}
+		serverConf.WireFormat = WIRE_FORMAT_JSON
+		if got := string(encodeMessage(test.msg)); got != test.json+"\n" {
+			t.Errorf("json %q, want %q", got, test.json)
+		}
+	}
+}
+
+// With wireFormat json the scan results and STATUS a client asks for are json objects
+func TestJsonResponses(t *testing.T) {
+	adapter := newTestServer(t)
+	serverConf.WireFormat = WIRE_FORMAT_JSON
+	client := newDispatchClient(t)
+	adapter.Advertise(TEST_VEHICLE, -50)
+
+	lines, _ := dispatchFrame(client, "SCAN;4")
+	want := []string{
+		`{"type":"scan","address":"` + TEST_VEHICLE + `","manufacturerData":"beef00011234","localName":"` + LEGACY_LOCAL_NAME + `"}`,
+		`{"type":"scan-completed","reqId":"4"}`,
+	}
+	if len(lines) != 2 || lines[0] != want[0] || lines[1] != want[1] {
+		t.Fatalf("json scan answered %q, want %q", lines, want)
+	}
+	lines, _ = dispatchFrame(client, "STATUS")
+	if len(lines) != 1 || lines[0] != `{"type":"status","adapter":"ready","connected":0}` {
+		t.Fatalf("json status answered %q", lines)
+	}
+}
+
+// hexCase applies to every hex encoding sent to clients, the scan results and the forwarded notifications
+func TestHexCase(t *testing.T) {
+	for _, hexCase := range []string{HEX_CASE_LOWER, HEX_CASE_UPPER} {
+		t.Run(hexCase, func(t *testing.T) {
+			adapter := newTestServer(t)
+			serverConf.HexCase = hexCase
+			encode := strings.ToLower
+			if hexCase == HEX_CASE_UPPER {
+				encode = strings.ToUpper
+			}
+			if got := encodeHex([]byte{0x01, 0xab, 0xcd, 0xef}); got != encode("01abcdef") {
+				t.Fatalf("encoded as %s", got)
+			}
+
+			client := newTestClient(t, nil)
+			vehicle := connectTestVehicle(t, adapter, client, TEST_VEHICLE)
+			client.Send("SCAN")
+			scanned := strings.Split(client.Expect(t, "SCAN;"+TEST_VEHICLE), ";")
+			if len(scanned) < 3 || !strings.HasPrefix(scanned[2], encode("beef")) || scanned[2] != encode(scanned[2]) {
+				t.Fatalf("scan result %q", scanned)
+			}
+			vehicle.Emit([]byte{0x03, 0xfe, 0xab, 0xcd})
+			client.Expect(t, TEST_VEHICLE+";"+encode("03feabcd"))
+		})
+	}
+}
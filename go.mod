@@ -4,6 +4,7 @@ go 1.18
 
 require (
 	github.com/orcaman/concurrent-map/v2 v2.0.1
+	gopkg.in/yaml.v3 v3.0.1
 	tinygo.org/x/bluetooth v0.6.0
 )
 
@@ -16,5 +17,4 @@ require (
 	github.com/sirupsen/logrus v1.9.0 // indirect
 	github.com/tinygo-org/cbgo v0.0.4 // indirect
 	golang.org/x/sys v0.0.0-20220829200755-d48e67d00261 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
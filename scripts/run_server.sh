@@ -7,4 +7,4 @@ then
 fi
 
 go mod download
-go run AutomotiveCpsServer.go
+go run .
@@ -0,0 +1,62 @@
+#! /bin/bash
+
+# Drives SCAN, CONNECT, a set-speed command and the following position update against the simulated adapter,
+# so the tcp protocol can be checked end to end without ANKI vehicles or a BLE adapter.
+
+if [ ! -d scripts/ ]
+then
+  printf "Please run script from project root directory."
+  exit
+fi
+
+PORT=${PORT:-5099}
+VEHICLE=5A:00:00:00:00:01
+WORKDIR=$(mktemp -d)
+trap 'kill $SERVER 2> /dev/null; rm -rf "$WORKDIR"' EXIT
+
+cat > "$WORKDIR/serverconf.yml" << EOF
+host: 127.0.0.1
+port: $PORT
+adapter: sim
+scanTimeoutSeconds: 1
+EOF
+
+go build -o "$WORKDIR/server" . || exit 1
+"$WORKDIR/server" -config "$WORKDIR/serverconf.yml" > "$WORKDIR/server.log" 2>&1 &
+SERVER=$!
+
+for i in $(seq 50)
+do
+  (exec 3<> /dev/tcp/127.0.0.1/$PORT) 2> /dev/null && break
+  sleep 0.1
+done
+exec 3<> /dev/tcp/127.0.0.1/$PORT || exit 1
+
+# Reads lines from the server until one matches $1, fails after 5 seconds
+expect() {
+  while IFS= read -r -t 5 line <&3
+  do
+    if [[ "$line" =~ $1 ]]
+    then
+      printf "ok   %s\n" "$line"
+      return 0
+    fi
+  done
+  printf "FAIL expected %s\n" "$1"
+  exit 1
+}
+
+printf "SCAN\n" >&3
+expect "^SCAN;$VEHICLE;"
+expect "^SCAN;COMPLETED"
+
+printf "CONNECT;%s\n" "$VEHICLE" >&3
+expect "^CONNECT;SUCCESS"
+
+# set speed 200 mm/s, the simulated vehicle then reports position updates
+printf "%s;0624c800e80300\n" "$VEHICLE" >&3
+expect "^$VEHICLE;0a27"
+
+printf "DISCONNECT;%s\n" "$VEHICLE" >&3
+expect "^DISCONNECT;SUCCESS"
+printf "All checks passed.\n"